@@ -0,0 +1,71 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// alphaCodecs maps the output formats that can carry alpha to the codec
+// arguments that keep it: VP9 with an alpha plane for WebM and Matroska and
+// ProRes 4444 for QuickTime.
+var alphaCodecs = map[string][]string{
+	"webm":     {"-c:v", "libvpx-vp9", "-pix_fmt", "yuva420p"},
+	"matroska": {"-c:v", "libvpx-vp9", "-pix_fmt", "yuva420p"},
+	"mov":      {"-c:v", "prores_ks", "-profile:v", "4", "-pix_fmt", "yuva444p10le"},
+}
+
+// alphaOutputArgs returns the arguments that encode out on its own with the
+// alpha channel kept.
+func alphaOutputArgs(opts Options, out OutputSpec) []string {
+	codec := alphaCodecs[out.Format]
+	args := append([]string(nil), codec...)
+
+	if opts.TargetQuality > 0 && codec[1] == "libvpx-vp9" {
+		args = append(args,
+			"-crf", strconv.Itoa(qualityToCRF(codec[1], opts.TargetQuality)),
+			"-b:v", "0",
+		)
+	}
+	// The origin bandwidth throttle only concerns the HLS stream
+	opts.throttle = throttleLevel{}
+	if filters := videoFilters(opts); len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	if opts.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(opts.Threads))
+	}
+
+	if opts.SilentAudio {
+		audio := "aac"
+		if out.Format == "webm" {
+			// WebM only takes Opus or Vorbis
+			audio = "libopus"
+		}
+		args = append(args, "-c:a", audio, "-b:a", "32k", "-shortest")
+	}
+	return append(args, out.args()...)
+}
+
+// validateAlpha checks that the input and outputs can carry alpha.
+func (opts Options) validateAlpha() error {
+	if !opts.PreserveAlpha {
+		return nil
+	}
+	if len(opts.Outputs) == 0 {
+		return fmt.Errorf("preserving alpha requires Outputs, HLS segments cannot carry alpha")
+	}
+	if opts.InputCodec != "" {
+		if opts.InputCodec != ImageCodecPNG {
+			return fmt.Errorf("preserving alpha requires an input with alpha, %s images have none", opts.InputCodec)
+		}
+	} else if opts.InputPixelFormat != PixelFormatRGBA && opts.InputPixelFormat != PixelFormatRGBA64 {
+		return fmt.Errorf("preserving alpha requires an RGBA input pixel format, got %s", opts.InputPixelFormat)
+	}
+	for _, out := range opts.Outputs {
+		if _, ok := alphaCodecs[out.Format]; !ok {
+			return fmt.Errorf("%s output cannot carry alpha, use webm, matroska or mov", out.Format)
+		}
+	}
+	return nil
+}
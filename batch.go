@@ -0,0 +1,106 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// EncodeFrames encodes frames to outPath and returns once the output is
+// finalized, for finite inputs such as rendering an animation to a file.
+// The output format follows the extension of outPath:
+//
+//   - .m3u8: a VOD playlist, written with its segments into the directory
+//     of outPath as with Options.RecordDir
+//   - .ts: an MPEG-TS file
+//   - .mp4: an MP4 file
+//
+// No HTTP server is started. It returns ctx.Err() if ctx is done before
+// every frame is encoded, and an error if not all frames were encoded.
+func EncodeFrames(ctx context.Context, opts Options, frames []image.Image, outPath string) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames to encode")
+	}
+
+	// Stopped below to get the error of finalizing the output
+	opts.KeepRunningAfterClose = true
+
+	var start func(e *Encoder, ch <-chan image.Image) error
+	switch ext := filepath.Ext(outPath); ext {
+	case ".m3u8":
+		opts.PlaylistType = PlaylistTypeVOD
+		opts.RecordDir = filepath.Dir(outPath)
+		start = func(e *Encoder, ch <-chan image.Image) error {
+			_, err := e.Start(ctx, ch)
+			return err
+		}
+	case ".ts":
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		start = func(e *Encoder, ch <-chan image.Image) error {
+			return e.StartToWriter(ctx, ch, f)
+		}
+	case ".mp4":
+		// Encoded once by the tee muxer; the MPEG-TS stream isn't needed
+		opts.Outputs = append(opts.Outputs, OutputSpec{
+			Format:  "mp4",
+			Path:    outPath,
+			Options: map[string]string{"movflags": "+faststart"},
+		})
+		start = func(e *Encoder, ch <-chan image.Image) error {
+			return e.StartToWriter(ctx, ch, io.Discard)
+		}
+	default:
+		return fmt.Errorf("unsupported output extension %q, want .m3u8, .ts or .mp4", ext)
+	}
+
+	e, err := New(opts)
+	if err != nil {
+		return err
+	}
+
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan image.Image)
+	go func() {
+		defer close(ch)
+		for _, frame := range frames {
+			select {
+			case ch <- frame:
+			case <-feedCtx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := start(e, ch); err != nil {
+		return err
+	}
+	<-e.Done()
+	if err := e.Stop(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := e.Stats()
+	if s.Failed {
+		return fmt.Errorf("frame processing failed")
+	}
+	// Frames dropped on purpose, e.g. by InputFrameRate, don't count
+	if encoded := s.FramesWritten + s.FramesDecimated + s.LatencyExceeded + s.OutOfOrderFrames; encoded < uint64(len(frames)) {
+		return fmt.Errorf("encoded %d of %d frames", s.FramesWritten, len(frames))
+	}
+
+	if name := filepath.Base(outPath); opts.RecordDir != "" && name != playlistName {
+		return os.Rename(filepath.Join(opts.RecordDir, playlistName), outPath)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeFrames(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	frames := make([]image.Image, 10)
+	for i := range frames {
+		frames[i] = image.NewRGBA(image.Rect(0, 0, 16, 16))
+	}
+
+	out := filepath.Join(t.TempDir(), "out.ts")
+	if err := EncodeFrames(context.Background(), opts, frames, out); err != nil {
+		t.Fatalf("EncodeFrames = %v", err)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("output not written: %v", err)
+	}
+
+	if err := EncodeFrames(context.Background(), opts, frames, "out.gif"); err == nil {
+		t.Error("EncodeFrames to .gif succeeded, want an unsupported extension error")
+	}
+	if err := EncodeFrames(context.Background(), opts, nil, out); err == nil {
+		t.Error("EncodeFrames without frames succeeded, want an error")
+	}
+}
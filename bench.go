@@ -0,0 +1,116 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"time"
+)
+
+// benchFrames is the number of distinct test pattern frames Benchmark
+// cycles through, drawn up front so drawing doesn't count.
+const benchFrames = 16
+
+// BenchResult is the encoding throughput measured by Benchmark.
+type BenchResult struct {
+	// Frames is the number of frames encoded.
+	Frames uint64
+
+	// Duration is the time from starting ffmpeg until it encoded the last
+	// frame and exited.
+	Duration time.Duration
+
+	// FPS is the achieved frame rate, Frames over Duration.
+	FPS float64
+
+	// RealtimeFactor is FPS relative to Options.FrameRate: above 1 the
+	// options can be encoded live, and e.g. 3 means about three such
+	// streams fit at once.
+	RealtimeFactor float64
+
+	// CPUTime is the user and system CPU time ffmpeg spent.
+	CPUTime time.Duration
+
+	// CPUUsage is CPUTime over Duration, in cores: 1.5 means ffmpeg kept
+	// one and a half cores busy.
+	CPUUsage float64
+}
+
+// Benchmark measures how fast the encoding pipeline runs with opts on this
+// host, for capacity planning. It feeds TestPattern frames of opts' size as
+// fast as ffmpeg accepts them for duration, discarding the encoded MPEG-TS
+// stream, then waits for ffmpeg to encode the rest. Frames are never paced
+// or dropped: PaceToRealtime, RealtimeInput and InputFrameRate are
+// ignored. No HTTP server is started. It returns ctx.Err() if ctx is done
+// first.
+func Benchmark(ctx context.Context, opts Options, duration time.Duration) (BenchResult, error) {
+	if duration <= 0 {
+		return BenchResult{}, fmt.Errorf("invalid benchmark duration %v", duration)
+	}
+	opts.PaceToRealtime = false
+	opts.RealtimeInput = false
+	opts.InputFrameRate = 0
+	// Stopped below to wait for ffmpeg to encode every frame
+	opts.KeepRunningAfterClose = true
+
+	e, err := New(opts)
+	if err != nil {
+		return BenchResult{}, err
+	}
+	opts = e.opts
+	pattern := &TestPattern{Width: opts.Width, Height: opts.Height}
+	frames := make([]image.Image, benchFrames)
+	for i := range frames {
+		frames[i] = pattern.Frame(i)
+	}
+
+	ch := make(chan image.Image)
+	start := time.Now()
+	if err := e.StartToWriter(ctx, ch, io.Discard); err != nil {
+		return BenchResult{}, err
+	}
+
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+feed:
+	for i := 0; ; i++ {
+		select {
+		case ch <- frames[i%len(frames)]:
+		case <-deadline.C:
+			break feed
+		case <-ctx.Done():
+			break feed
+		case <-e.Done():
+			break feed
+		}
+	}
+	close(ch)
+	<-e.Done()
+	if err := e.Stop(); err != nil {
+		return BenchResult{}, err
+	}
+	elapsed := time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return BenchResult{}, err
+	}
+
+	s := e.Stats()
+	if s.Failed {
+		return BenchResult{}, fmt.Errorf("frame processing failed")
+	}
+	usage, err := e.ProcessStats()
+	if err != nil {
+		return BenchResult{}, err
+	}
+
+	r := BenchResult{
+		Frames:   s.FramesWritten,
+		Duration: elapsed,
+		FPS:      float64(s.FramesWritten) / elapsed.Seconds(),
+		CPUTime:  usage.UserTime + usage.SystemTime,
+	}
+	r.RealtimeFactor = r.FPS / float64(opts.FrameRate)
+	r.CPUUsage = r.CPUTime.Seconds() / elapsed.Seconds()
+	return r, nil
+}
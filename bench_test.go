@@ -0,0 +1,32 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBenchmark(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.PaceToRealtime = true
+
+	r, err := Benchmark(context.Background(), opts, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Benchmark = %v", err)
+	}
+	if r.Frames == 0 || r.FPS <= 0 || r.Duration < 200*time.Millisecond {
+		t.Errorf("Benchmark = %+v, want frames encoded over at least the duration", r)
+	}
+	// Unpaced, the helper takes frames far faster than real time
+	if r.RealtimeFactor <= 1 {
+		t.Errorf("RealtimeFactor = %v, want above 1", r.RealtimeFactor)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Benchmark(ctx, opts, time.Second); err != context.Canceled {
+		t.Errorf("Benchmark with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
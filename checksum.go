@@ -0,0 +1,59 @@
+package nimsforestencoder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumsName is the name of the segment checksum manifest.
+const checksumsName = "checksums.txt"
+
+// addChecksum hashes the segment and adds it to the checksum manifest in
+// outputDir, in the format of sha256sum so it can be verified with
+// `sha256sum -c checksums.txt`. Entries of segments that have since been
+// deleted, by the live window or MaxDiskBytes, are dropped, so the check
+// keeps passing.
+func addChecksum(outputDir string, seg segmentInfo) error {
+	f, err := os.Open(filepath.Join(outputDir, filepath.FromSlash(seg.URI)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	path := filepath.Join(outputDir, checksumsName)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var manifest bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(old))
+	for scanner.Scan() {
+		line := scanner.Text()
+		_, name, ok := strings.Cut(line, "  ")
+		if !ok || name == seg.URI {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(name))); err != nil {
+			continue
+		}
+		manifest.WriteString(line)
+		manifest.WriteByte('\n')
+	}
+	fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), seg.URI)
+
+	// Readers never see a partly rewritten manifest
+	return replaceFile(path, manifest.Bytes())
+}
@@ -0,0 +1,54 @@
+package nimsforestencoder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddChecksum(t *testing.T) {
+	dir := t.TempDir()
+	// sum writes the segment name with data and returns its manifest line
+	sum := func(name, data string) string {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(h[:]) + "  " + name + "\n"
+	}
+	check := func(want string) {
+		t.Helper()
+		got, err := os.ReadFile(filepath.Join(dir, checksumsName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("manifest = %q, want %q", got, want)
+		}
+	}
+
+	seg0, seg1 := sum("segment0.ts", "zero"), sum("segment1.ts", "one")
+	for _, uri := range []string{"segment0.ts", "segment1.ts"} {
+		if err := addChecksum(dir, segmentInfo{URI: uri}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(seg0 + seg1)
+
+	// A rewritten segment replaces its entry, and deleted ones are dropped
+	seg1 = sum("segment1.ts", "one again")
+	if err := os.Remove(filepath.Join(dir, "segment0.ts")); err != nil {
+		t.Fatal(err)
+	}
+	if err := addChecksum(dir, segmentInfo{URI: "segment1.ts"}); err != nil {
+		t.Fatal(err)
+	}
+	check(seg1)
+
+	if err := addChecksum(dir, segmentInfo{URI: "segment9.ts"}); err == nil {
+		t.Error("checksum of a missing segment added")
+	}
+	check(seg1)
+}
@@ -0,0 +1,67 @@
+package nimsforestencoder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// tempDirPattern is the pattern of the output directories Start creates
+// without Options.RecordDir.
+const tempDirPattern = "nimsforestencoder-*"
+
+// tempDirName returns the MkdirTemp pattern of the output directory of the
+// stream streamID, which matches tempDirPattern.
+func tempDirName(streamID string) string {
+	if streamID == "" {
+		return tempDirPattern
+	}
+	return "nimsforestencoder-" + streamID + "-*"
+}
+
+// orphanMaxAge is the age beyond which New removes output directories left
+// behind in the temp directory.
+const orphanMaxAge = 7 * 24 * time.Hour
+
+// cleanupOnce makes New clean up orphans once per process.
+var cleanupOnce sync.Once
+
+// CleanupOrphans removes the output directories that encoders of crashed
+// processes, which never called Stop, left behind in the system temp
+// directory. Only directories not modified for maxAge are removed: running
+// encoders keep writing segments into theirs, so pick a maxAge well above
+// the longest segment duration. New already removes the ones older than a
+// week, in the background, once per process.
+func CleanupOrphans(maxAge time.Duration) error {
+	return cleanupOrphans(os.TempDir(), maxAge, time.Now())
+}
+
+// cleanupOrphans removes the output directories in root not modified since
+// maxAge before now, returning the errors of those that couldn't be.
+func cleanupOrphans(root string, maxAge time.Duration, now time.Time) error {
+	matches, err := filepath.Glob(filepath.Join(root, tempDirPattern))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, path := range matches {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		// Overlay text files share the prefix
+		if !info.IsDir() || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
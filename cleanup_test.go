@@ -0,0 +1,54 @@
+package nimsforestencoder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupOrphans(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	tests := []struct {
+		name    string
+		dir     bool
+		modTime time.Time
+		removed bool
+	}{
+		{"nimsforestencoder-old", true, old, true},
+		{"nimsforestencoder-running", true, now, false},
+		{"nimsforestencoder-overlay-1.txt", false, old, false},
+		{"other-old", true, old, false},
+	}
+	for _, tc := range tests {
+		path := filepath.Join(root, tc.name)
+		var err error
+		if tc.dir {
+			err = os.Mkdir(path, 0o755)
+			if err == nil {
+				err = os.WriteFile(filepath.Join(path, "segment0.ts"), nil, 0o644)
+			}
+		} else {
+			err = os.WriteFile(path, nil, 0o644)
+		}
+		if err == nil {
+			err = os.Chtimes(path, tc.modTime, tc.modTime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanupOrphans(root, time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		_, err := os.Stat(filepath.Join(root, tc.name))
+		if removed := os.IsNotExist(err); removed != tc.removed {
+			t.Errorf("%s removed: %v, want %v", tc.name, removed, tc.removed)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package nimsforestencoder
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the number of clients tracked at once, so a flood
+// of short-lived clients can't grow the tracker without limit.
+const maxTrackedClients = 4096
+
+// ClientInfo describes a client of the HLS server.
+type ClientInfo struct {
+	// Addr is the client's IP address. Clients behind the same NAT or
+	// proxy share an address and are reported as one.
+	Addr string
+
+	// UserAgent is the User-Agent of the client's latest request.
+	UserAgent string
+
+	// LastRequest is when the client's latest request completed.
+	LastRequest time.Time
+
+	// BytesServed is the number of response bytes sent to the client, after
+	// compression.
+	BytesServed int64
+}
+
+// clientState is the tracked state of a client.
+type clientState struct {
+	info        ClientInfo
+	lastSegment time.Time // zero if it never fetched a segment
+}
+
+// clientTracker tracks the clients of the HLS server. Clients are forgotten
+// once idle for window.
+type clientTracker struct {
+	window time.Duration
+	clock  clock
+
+	mu   sync.Mutex
+	seen map[string]*clientState
+}
+
+// newClientTracker creates a tracker that forgets clients window after
+// their last request according to c.
+func newClientTracker(window time.Duration, c clock) *clientTracker {
+	return &clientTracker{window: window, clock: c, seen: make(map[string]*clientState)}
+}
+
+// clientAddr returns the IP address of the client of r.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// E.g. a Unix socket peer
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// served records that n response bytes were sent for r.
+func (t *clientTracker) served(r *http.Request, n int64) {
+	host := clientAddr(r)
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.seen[host]
+	if !ok {
+		if len(t.seen) >= maxTrackedClients {
+			t.expire(now)
+		}
+		if len(t.seen) >= maxTrackedClients {
+			t.evictOldest()
+		}
+		c = &clientState{info: ClientInfo{Addr: host}}
+		t.seen[host] = c
+	}
+	c.info.UserAgent = r.UserAgent()
+	c.info.LastRequest = now
+	c.info.BytesServed += n
+	if isSegmentFile(r.URL.Path) {
+		c.lastSegment = now
+	}
+}
+
+// active returns the number of clients that fetched a segment within the
+// window, i.e. the viewers of the stream.
+func (t *clientTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	t.expire(now)
+
+	n := 0
+	for _, c := range t.seen {
+		if now.Sub(c.lastSegment) <= t.window {
+			n++
+		}
+	}
+	return n
+}
+
+// clients returns the tracked clients ordered by address.
+func (t *clientTracker) clients() []ClientInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(t.clock.Now())
+
+	clients := make([]ClientInfo, 0, len(t.seen))
+	for _, c := range t.seen {
+		clients = append(clients, c.info)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Addr < clients[j].Addr
+	})
+	return clients
+}
+
+// expire forgets the clients idle for longer than the window. Callers must
+// hold t.mu.
+func (t *clientTracker) expire(now time.Time) {
+	for host, c := range t.seen {
+		if now.Sub(c.info.LastRequest) > t.window {
+			delete(t.seen, host)
+		}
+	}
+}
+
+// evictOldest forgets the client with the oldest request. Callers must hold
+// t.mu.
+func (t *clientTracker) evictOldest() {
+	var oldest string
+	var last time.Time
+	for host, c := range t.seen {
+		if oldest == "" || c.info.LastRequest.Before(last) {
+			oldest, last = host, c.info.LastRequest
+		}
+	}
+	delete(t.seen, oldest)
+}
+
+// clientLimiter bounds the requests each client has in flight at once.
+type clientLimiter struct {
+	limit int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// newClientLimiter creates a limiter of limit requests per client.
+func newClientLimiter(limit int) *clientLimiter {
+	return &clientLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// acquire starts a request of the client at addr, reporting false if the
+// client already has the limit in flight.
+func (l *clientLimiter) acquire(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[addr] >= l.limit {
+		return false
+	}
+	l.active[addr]++
+	return true
+}
+
+// release ends a request started by acquire.
+func (l *clientLimiter) release(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Idle clients take no space
+	if l.active[addr]--; l.active[addr] == 0 {
+		delete(l.active, addr)
+	}
+}
+
+// countingResponseWriter counts the response body bytes written.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+// Write writes the body, counting it.
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the underlying writer's sendfile path for served files.
+func (w *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(r)
+		w.n += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// Clients returns the clients of the HLS server that made a request
+// recently, ordered by address. A client is listed until it has been idle
+// for three segment durations. Returns nil while the encoder isn't running
+// or has no HLS server.
+func (e *Encoder) Clients() []ClientInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running || e.hlsServer == nil {
+		return nil
+	}
+	return e.hlsServer.clients.clients()
+}
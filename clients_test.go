@@ -0,0 +1,86 @@
+package nimsforestencoder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fetch records a request for path from the client at addr.
+func fetch(tr *clientTracker, addr, path string, n int64) {
+	r := httptest.NewRequest("GET", path, nil)
+	r.RemoteAddr = addr + ":40000"
+	tr.served(r, n)
+}
+
+func TestClientTrackerExpire(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	tr := newClientTracker(10*time.Second, c)
+
+	fetch(tr, "192.0.2.1", "/segment0.ts", 1000)
+	fetch(tr, "192.0.2.2", "/stream.m3u8", 100)
+	c.Advance(5 * time.Second)
+	fetch(tr, "192.0.2.1", "/segment1.ts", 1000)
+
+	// Only clients fetching segments are viewers
+	if got := tr.active(); got != 1 {
+		t.Errorf("active() = %d, want 1", got)
+	}
+	clients := tr.clients()
+	if len(clients) != 2 || clients[0].BytesServed != 2000 || !clients[0].LastRequest.Equal(c.Now()) {
+		t.Fatalf("clients() = %+v", clients)
+	}
+
+	c.Advance(6 * time.Second)
+	clients = tr.clients()
+	if len(clients) != 1 || clients[0].Addr != "192.0.2.1" {
+		t.Fatalf("clients() after 11s = %+v, want only 192.0.2.1", clients)
+	}
+
+	c.Advance(5 * time.Second)
+	if got := tr.active(); got != 0 {
+		t.Errorf("active() after 16s = %d, want 0", got)
+	}
+	if got := tr.clients(); len(got) != 0 {
+		t.Errorf("clients() after 16s = %+v, want none", got)
+	}
+}
+
+func TestMaxConcurrentPerClient(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "segment0.ts"), []byte("segment"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, dir, nil)
+	h.limiter = newClientLimiter(1)
+
+	get := func(addr string) int {
+		r := httptest.NewRequest("GET", "/segment0.ts", nil)
+		r.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A download of 192.0.2.1 is in flight
+	if !h.limiter.acquire("192.0.2.1") {
+		t.Fatal("first download refused")
+	}
+	if code := get("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("second concurrent download: status %d, want 429", code)
+	}
+	if code := get("192.0.2.2"); code != http.StatusOK {
+		t.Errorf("download of another client: status %d, want 200", code)
+	}
+
+	h.limiter.release("192.0.2.1")
+	if code := get("192.0.2.1"); code != http.StatusOK {
+		t.Errorf("download after the first finished: status %d, want 200", code)
+	}
+	if len(h.limiter.active) != 0 {
+		t.Errorf("limiter still tracks %v after all downloads finished", h.limiter.active)
+	}
+}
@@ -0,0 +1,56 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the source of time for the encoder's timing logic: pacing,
+// tickers, latency bounds, readiness timeouts and statistics. Tests replace
+// Encoder.clock with a fakeClock before starting the encoder to drive that
+// logic deterministically.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker is the part of *time.Ticker the encoder uses.
+type ticker interface {
+	// Chan returns the channel the ticks are delivered on.
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// since returns the time elapsed since t according to c.
+func since(c clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// sleep waits for d according to c. It returns false if ctx is done first.
+func sleep(ctx context.Context, c clock, d time.Duration) bool {
+	t := c.NewTicker(d)
+	defer t.Stop()
+
+	select {
+	case <-t.Chan():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts *time.Ticker to ticker.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
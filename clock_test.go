@@ -0,0 +1,155 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for tests. Its tickers fire only
+// when Advance moves the time past their next tick, and like *time.Ticker
+// drop ticks the receiver isn't ready for.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// newFakeClock creates a fake clock set to now.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the tickers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+// waitTicker waits until a ticker of period d has been created, so that an
+// Advance reaches it.
+func (c *fakeClock) waitTicker(d time.Duration) {
+	for {
+		c.mu.Lock()
+		for _, t := range c.tickers {
+			if t.period == d {
+				c.mu.Unlock()
+				return
+			}
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeTicker is a ticker of a fakeClock.
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	tk := c.NewTicker(time.Second)
+	defer tk.Stop()
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-tk.Chan():
+		t.Fatal("ticker fired early")
+	default:
+	}
+
+	// Like *time.Ticker, the ticks the receiver misses are dropped
+	c.Advance(3 * time.Second)
+	if got, want := <-tk.Chan(), time.Unix(1, 0); !got.Equal(want) {
+		t.Errorf("tick = %v, want %v", got, want)
+	}
+	select {
+	case <-tk.Chan():
+		t.Fatal("missed ticks were queued")
+	default:
+	}
+}
+
+func TestSleep(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	done := make(chan bool)
+	go func() {
+		done <- sleep(context.Background(), c, time.Second)
+	}()
+
+	for {
+		c.Advance(100 * time.Millisecond)
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Fatal("sleep returned false without cancellation")
+			}
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if sleep(ctx, newFakeClock(time.Unix(0, 0)), time.Hour) {
+		t.Error("sleep returned true after cancellation")
+	}
+}
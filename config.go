@@ -0,0 +1,116 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix is the prefix of the environment variables read by
+// OptionsFromEnv.
+const envPrefix = "NIMSFORESTENCODER_"
+
+// OptionsFromEnv builds Options from the environment variables named
+// NIMSFORESTENCODER_ followed by an option name, e.g.
+// NIMSFORESTENCODER_SEGMENT_DURATION=4. Values are parsed as by
+// OptionsFromMap.
+func OptionsFromEnv() (Options, error) {
+	values := make(map[string]string)
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if name, ok := strings.CutPrefix(key, envPrefix); ok {
+			values[name] = value
+		}
+	}
+	return OptionsFromMap(values)
+}
+
+// OptionsFromMap builds Options from string values keyed by option name,
+// such as a parsed config file. Names match the Options fields ignoring case
+// and underscores, so "SegmentDuration", "segment_duration" and
+// "SEGMENT_DURATION" are the same option. Values are parsed according to
+// the field type: integers, booleans as accepted by strconv.ParseBool and
+// durations as accepted by time.ParseDuration, e.g. "500ms". Options that
+// aren't given keep their defaults.
+//
+// Fields holding functions, interfaces, pointers, slices or maps, such as
+// Logger or Outputs, can't be given as strings and are reported as errors.
+// The result is validated like the options passed to New.
+func OptionsFromMap(values map[string]string) (Options, error) {
+	opts := DefaultOptions()
+	target := reflect.ValueOf(&opts).Elem()
+
+	fields := make(map[string]int)
+	for i := 0; i < target.NumField(); i++ {
+		if f := target.Type().Field(i); f.IsExported() {
+			fields[normalizeOptionName(f.Name)] = i
+		}
+	}
+
+	// Sorted, so the first error reported doesn't depend on map order
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		i, ok := fields[normalizeOptionName(key)]
+		if !ok {
+			return Options{}, fmt.Errorf("unknown option %q", key)
+		}
+		name := target.Type().Field(i).Name
+		if err := setOption(target.Field(i), values[key]); err != nil {
+			return Options{}, fmt.Errorf("option %s: %w", name, err)
+		}
+	}
+
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return Options{}, fmt.Errorf("invalid options: %w", err)
+	}
+	return opts, nil
+}
+
+// normalizeOptionName folds an option name for matching.
+func normalizeOptionName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// setOption parses value into the option field v.
+func setOption(v reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("%s values can't be given as a string", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package nimsforestencoder
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromMap(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values map[string]string
+		err    string // "" if accepted
+	}{
+		{"valid", map[string]string{
+			"SegmentDuration": "4",
+			"port":            " 8081 ",
+			"PLAYLIST_TYPE":   "event",
+			"ShutdownTimeout": "500ms",
+			"ProgramDateTime": "true",
+		}, ""},
+		{"unknown key", map[string]string{"SegmentLength": "4"}, `unknown option "SegmentLength"`},
+		{"unsettable field", map[string]string{"Outputs": "out.mp4"}, "can't be given as a string"},
+		{"malformed duration", map[string]string{"ShutdownTimeout": "5"}, `option ShutdownTimeout: invalid duration "5"`},
+		{"malformed bool", map[string]string{"ProgramDateTime": "maybe"}, `option ProgramDateTime: invalid boolean "maybe"`},
+		{"malformed int", map[string]string{"SegmentDuration": "2.5"}, `option SegmentDuration: invalid integer "2.5"`},
+		{"int out of range", map[string]string{"SegmentDuration": "99999999999999999999"}, "invalid integer"},
+		{"unknown enum", map[string]string{"PlaylistType": "rolling"}, `unsupported playlist type "rolling"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := OptionsFromMap(tc.values)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("OptionsFromMap = %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.SegmentDuration != 4 || opts.Port != 8081 || opts.PlaylistType != PlaylistTypeEvent ||
+				opts.ShutdownTimeout != 500*time.Millisecond || !opts.ProgramDateTime {
+				t.Errorf("options not set from %v: %+v", tc.values, opts)
+			}
+			// Options not given keep their defaults
+			if opts.Width != DefaultOptions().Width {
+				t.Errorf("Width = %d, want the default %d", opts.Width, DefaultOptions().Width)
+			}
+		})
+	}
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv(envPrefix+"SEGMENT_DURATION", "6")
+	t.Setenv("PORT", "1")
+	opts, err := OptionsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only prefixed variables are read
+	if opts.SegmentDuration != 6 || opts.Port != DefaultOptions().Port {
+		t.Errorf("SegmentDuration, Port = %d, %d, want 6, %d", opts.SegmentDuration, opts.Port, DefaultOptions().Port)
+	}
+
+	t.Setenv(envPrefix+"SHUTDOWN_TIMEOUT", "soon")
+	if _, err := OptionsFromEnv(); err == nil || !strings.Contains(err.Error(), "invalid duration") {
+		t.Errorf("OptionsFromEnv = %v, want an invalid duration error", err)
+	}
+}
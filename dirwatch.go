@@ -0,0 +1,79 @@
+package nimsforestencoder
+
+import (
+	"sync"
+	"time"
+)
+
+// notifyBackstop is how often a directory watched for change notifications
+// is polled anyway, in case notifications are lost or never arrive, as on
+// some network file systems.
+const notifyBackstop = time.Second
+
+// dirWatcher reports that a directory may have changed.
+type dirWatcher interface {
+	// Changes delivers a value when the directory may have changed.
+	// Changes arriving while one is pending are coalesced.
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// newDirWatcher watches dir for change notifications backed up by polling,
+// falling back to polling every interval where notifications aren't
+// available.
+func newDirWatcher(dir string, c clock, interval time.Duration) dirWatcher {
+	if w, err := newNotifyWatcher(dir, c); err == nil {
+		return w
+	}
+	return newPollingWatcher(c, interval)
+}
+
+// pollingWatcher reports a possible change every interval.
+type pollingWatcher struct {
+	ticker ticker
+	done   chan struct{}
+	once   sync.Once
+
+	changes chan struct{}
+}
+
+// newPollingWatcher creates a watcher that polls every interval of c.
+func newPollingWatcher(c clock, interval time.Duration) *pollingWatcher {
+	w := &pollingWatcher{
+		ticker:  c.NewTicker(interval),
+		done:    make(chan struct{}),
+		changes: make(chan struct{}, 1),
+	}
+	go w.forward(w.ticker.Chan())
+	return w
+}
+
+// forward turns ticks into changes until the watcher is closed.
+func (w *pollingWatcher) forward(ticks <-chan time.Time) {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticks:
+			w.changed()
+		}
+	}
+}
+
+// changed reports a possible change without blocking.
+func (w *pollingWatcher) changed() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (w *pollingWatcher) Changes() <-chan struct{} { return w.changes }
+
+func (w *pollingWatcher) Close() error {
+	w.once.Do(func() {
+		w.ticker.Stop()
+		close(w.done)
+	})
+	return nil
+}
@@ -0,0 +1,54 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// notifyWatcher reports changes to a directory from inotify, with polling
+// as a backstop.
+type notifyWatcher struct {
+	*pollingWatcher
+	file *os.File
+}
+
+// newNotifyWatcher watches dir with inotify.
+func newNotifyWatcher(dir string, c clock) (dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// ffmpeg replaces the playlist by renaming a temporary file over it
+	mask := uint32(syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("inotify watch %s: %w", dir, err)
+	}
+
+	// A non-blocking descriptor is read through the runtime poller, so
+	// closing the file ends a pending read
+	w := &notifyWatcher{
+		pollingWatcher: newPollingWatcher(c, notifyBackstop),
+		file:           os.NewFile(uintptr(fd), "inotify"),
+	}
+	go w.read()
+	return w, nil
+}
+
+// read reports a change for every batch of inotify events until the file is
+// closed. The events themselves don't matter, as the directory is rescanned.
+func (w *notifyWatcher) read() {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		w.changed()
+	}
+}
+
+func (w *notifyWatcher) Close() error {
+	w.pollingWatcher.Close()
+	return w.file.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package nimsforestencoder
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// newNotifyWatcher is not supported, so directories are polled.
+func newNotifyWatcher(dir string, c clock) (dirWatcher, error) {
+	return nil, fmt.Errorf("directory notifications are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,32 @@
+package nimsforestencoder
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPollingWatcher(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	w := newPollingWatcher(c, time.Second)
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		c.Advance(time.Second)
+		select {
+		case <-w.Changes():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no change after tick %d", i)
+		}
+	}
+}
+
+func TestDirWatcherFallback(t *testing.T) {
+	// Nothing can watch a missing directory for notifications
+	w := newDirWatcher(filepath.Join(t.TempDir(), "missing"), newFakeClock(time.Unix(0, 0)), time.Second)
+	defer w.Close()
+
+	if _, ok := w.(*pollingWatcher); !ok {
+		t.Errorf("newDirWatcher = %T, want a polling fallback", w)
+	}
+}
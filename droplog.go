@@ -0,0 +1,104 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons for dropping a frame, as reported in drop summaries.
+const (
+	dropLatency    = "latency"      // Options.MaxLatency exceeded
+	dropOutOfOrder = "out_of_order" // Options.VerifyOrdering
+	dropTiming     = "timing"       // too early for the next slot of a TimestampSource
+	dropConvert    = "convert"      // the frame failed to convert
+	dropEmpty      = "empty"        // an empty encoded frame
+	dropSource     = "source"       // the FrameSource failed
+)
+
+// dropLogger logs dropped frames: each one as it happens, or with
+// Options.DropLogInterval as a summary once per interval, so sustained
+// drops don't flood the log. Decimated frames are dropped on purpose and
+// not logged.
+type dropLogger struct {
+	logger   *slog.Logger
+	interval time.Duration
+	clock    clock
+
+	mu      sync.Mutex
+	counts  map[string]uint64
+	lastErr error
+}
+
+// newDropLogger creates a logger of drops to logger, summarizing every
+// interval if it isn't 0.
+func newDropLogger(logger *slog.Logger, interval time.Duration, c clock) *dropLogger {
+	return &dropLogger{logger: logger, interval: interval, clock: c, counts: make(map[string]uint64)}
+}
+
+// drop records a frame dropped for reason, with the error that caused it if
+// any.
+func (d *dropLogger) drop(reason string, err error) {
+	if d.interval == 0 {
+		if err != nil {
+			d.logger.Warn("dropping frame", "reason", reason, "error", err)
+		}
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counts[reason]++
+	if err != nil {
+		d.lastErr = err
+	}
+}
+
+// run logs a summary every interval until ctx is done, then one of the
+// drops since the last summary.
+func (d *dropLogger) run(ctx context.Context) {
+	if d.interval == 0 {
+		return
+	}
+	t := d.clock.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.Chan():
+			d.flush()
+		case <-ctx.Done():
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush logs a summary of the drops since the last one, if there were any.
+func (d *dropLogger) flush() {
+	d.mu.Lock()
+	counts, lastErr := d.counts, d.lastErr
+	d.counts, d.lastErr = make(map[string]uint64), nil
+	d.mu.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(counts))
+	var total uint64
+	for reason, n := range counts {
+		reasons = append(reasons, reason)
+		total += n
+	}
+	sort.Strings(reasons)
+
+	attrs := []any{"count", total, "interval", d.interval}
+	for _, reason := range reasons {
+		attrs = append(attrs, reason, counts[reason])
+	}
+	if lastErr != nil {
+		attrs = append(attrs, "last_error", lastErr)
+	}
+	d.logger.Warn("frames dropped", attrs...)
+}
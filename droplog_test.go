@@ -0,0 +1,50 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDropLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	// Each drop with an error is logged as it happens
+	d := newDropLogger(logger, 0, newFakeClock(time.Unix(0, 0)))
+	d.drop(dropLatency, nil)
+	d.drop(dropConvert, errors.New("bad frame"))
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 || !strings.Contains(buf.String(), "reason=convert") {
+		t.Errorf("log without interval:\n%s\nwant one line for the convert drop", buf.String())
+	}
+
+	buf.Reset()
+	d = newDropLogger(logger, time.Second, newFakeClock(time.Unix(0, 0)))
+	for i := 0; i < 3; i++ {
+		d.drop(dropLatency, nil)
+	}
+	d.drop(dropConvert, errors.New("bad frame"))
+	if buf.Len() != 0 {
+		t.Errorf("drops logged before the interval passed:\n%s", buf.String())
+	}
+	d.flush()
+	want := `count=4 interval=1s convert=1 latency=3 last_error="bad frame"`
+	if got := buf.String(); strings.Count(got, "\n") != 1 || !strings.Contains(got, want) {
+		t.Errorf("summary:\n%s\nwant one line with %s", got, want)
+	}
+
+	// The window starts over, and its drops are summarized when the run ends
+	buf.Reset()
+	d.flush()
+	d.drop(dropTiming, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.run(ctx)
+	if got := buf.String(); strings.Count(got, "\n") != 1 || !strings.Contains(got, "count=1 interval=1s timing=1\n") {
+		t.Errorf("summary at the end:\n%s\nwant one line with count=1 interval=1s timing=1", got)
+	}
+}
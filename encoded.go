@@ -0,0 +1,106 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// StartEncoded is like Start, but takes compressed images in the format of
+// Options.InputCodec, such as JPEG frames from an MJPEG camera, one image
+// per []byte. ffmpeg decodes them itself, so they aren't decoded and
+// converted in Go. The frames must not be modified after they are sent.
+func (e *Encoder) StartEncoded(ctx context.Context, frames <-chan []byte) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return e.url(), ErrAlreadyRunning
+	}
+	if e.opts.InputCodec == "" {
+		return "", fmt.Errorf("encoded frames require an input codec")
+	}
+
+	return e.start(ctx, func(ctx context.Context) {
+		e.processEncodedFrames(ctx, frames)
+	})
+}
+
+// processEncodedFrames reads compressed frames from the channel and writes
+// them to ffmpeg as they are.
+func (e *Encoder) processEncodedFrames(ctx context.Context, frames <-chan []byte) {
+	defer e.wg.Done()
+	defer e.recoverFrames()
+
+	stats := e.stats.Load()
+
+	// Pace writes to the frame rate so bursts don't collapse stream timing
+	var pace <-chan time.Time
+	if e.opts.PaceToRealtime {
+		ticker := e.clock.NewTicker(e.opts.captureInterval())
+		defer ticker.Stop()
+		pace = ticker.Chan()
+	}
+
+	// Buffered writes are flushed at least once per frame interval
+	var flush <-chan time.Time
+	if e.opts.WriteBufferSize > 0 {
+		ticker := e.clock.NewTicker(e.opts.captureInterval())
+		defer ticker.Stop()
+		flush = ticker.Chan()
+	}
+
+	// Periodically finalize the current output and start a fresh one
+	var rotate <-chan time.Time
+	if e.opts.RotateInterval > 0 {
+		ticker := e.clock.NewTicker(e.opts.RotateInterval)
+		defer ticker.Stop()
+		rotate = ticker.Chan()
+	}
+
+	// A faster input is thinned out before it reaches ffmpeg
+	decimator := newFrameDecimator(e.opts)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush:
+			if err := e.ffmpeg.Load().FlushWrites(); err != nil {
+				// ffmpeg may have exited
+				return
+			}
+		case level := <-e.throttle:
+			if err := e.setThrottle(level); err != nil {
+				// Without a running ffmpeg there is nothing to write to
+				e.emitError(err)
+				return
+			}
+		case <-rotate:
+			if err := e.rotateOutput(); err != nil {
+				// Without a running ffmpeg there is nothing to write to
+				e.emitError(err)
+				return
+			}
+		case frame, ok := <-frames:
+			if !ok {
+				// Channel closed, stop processing
+				return
+			}
+			if decimator != nil && !decimator.keep() {
+				stats.framesDecimated.Add(1)
+				stats.framesDropped.Add(1)
+				continue
+			}
+			if len(frame) == 0 {
+				e.drops.drop(dropEmpty, errors.New("empty frame"))
+				stats.framesDropped.Add(1)
+				continue
+			}
+			if !e.writeFrame(ctx, frame, pace, stats) {
+				return
+			}
+		}
+	}
+}
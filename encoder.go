@@ -4,150 +4,1094 @@ import (
 	"context"
 	"fmt"
 	"image"
-	"image/draw"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Encoder encodes image frames to HLS stream.
 type Encoder struct {
 	opts      Options
-	ffmpeg    *ffmpegProcess
+	ffmpeg    atomic.Pointer[ffmpegProcess]
 	hlsServer *hlsServer
+	watcher   *segmentWatcher
+	tags      *playlistTags
+	pruner    *segmentPruner
+	thumbs    *thumbnailer     // owned by the frame processing goroutine
+	dumper    *frameDumper     // owned by the frame processing goroutine
+	keys      *keyRotator      // nil without Options.KeyProvider
+	uploads   *segmentUploader // nil without Options.Uploader
+	verifier  *segmentVerifier // nil without Options.VerifySegments
+	drops     *dropLogger
+	stats     atomic.Pointer[encoderStats]
 	outputDir string
 
 	mu      sync.Mutex
 	running bool
+	warming bool
+	// finalized is set once the current run's stream is finalized and only
+	// served until Stop
+	finalized bool
+	attach    chan (<-chan image.Image)
+	// throttle hands new throttle levels to the frame processing goroutine
+	throttle chan throttleLevel
+	// stalled tells the frame processing goroutine to restart ffmpeg
+	stalled chan struct{}
 	cancel  context.CancelFunc
 	wg      sync.WaitGroup
+
+	// runCtx is done when the current run stops
+	runCtx context.Context
+	// startCtx is the context the current run was started with; the HTTP
+	// server shutdown keeps its values
+	startCtx context.Context
+
+	// done is closed when frame processing of the current run has ended
+	done chan struct{}
+
+	// stopped is closed once the current run's output is finalized, with
+	// stopErr the error of finalizing or stopping it
+	stopped chan struct{}
+	stopErr error
+
+	// overlayText is the text drawn with Options.TextOverlay
+	overlayText string
+
+	// events delivers lifecycle events; see Events
+	events chan Event
+
+	// periodStart is when the current rotation period began; owned by the
+	// frame processing goroutine while running
+	periodStart time.Time
+
+	// clock drives pacing, tickers, timeouts and statistics; tests swap in
+	// a fakeClock before starting the encoder
+	clock clock
+
+	// probeCommand runs ffprobe for Options.VerifySegments; tests swap in
+	// a helper process
+	probeCommand func(ctx context.Context, path string) *exec.Cmd
 }
 
-// New creates a new Encoder with the given options.
+// New creates a new Encoder with the given options. The first call in a
+// process also removes, in the background, output directories older than a
+// week that crashed processes left behind; see CleanupOrphans.
 func New(opts Options) (*Encoder, error) {
 	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %w", err)
+	}
+
+	e := &Encoder{
+		opts:         opts,
+		clock:        realClock{},
+		events:       make(chan Event, eventBuffer),
+		probeCommand: probeCommand,
+	}
+	e.stats.Store(&encoderStats{})
+
+	cleanupOnce.Do(func() {
+		go cleanupOrphans(os.TempDir(), orphanMaxAge, time.Now())
+	})
 
-	return &Encoder{
-		opts: opts,
-	}, nil
+	return e, nil
+}
+
+// NewWithContext is like New, but also checks that the installed ffmpeg
+// runs and has the encoder of Options.Codec and, with Options.Clock, the
+// drawtext filter, so a missing or incomplete ffmpeg surfaces here rather
+// than at Start. Probing runs ffmpeg, which can take a while on a loaded
+// host; ctx bounds it. New itself does no I/O. Nothing is probed with a
+// CommandFactory, which runs its own command.
+func NewWithContext(ctx context.Context, opts Options) (*Encoder, error) {
+	e, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if e.opts.CommandFactory == nil {
+		if err := probeFFmpeg(ctx, e.opts); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
 // Start begins encoding frames from the channel and returns the HLS URL.
-// It starts the ffmpeg process and HTTP server.
+// It starts the ffmpeg process and HTTP server. Once ctx is done or frames
+// is closed, the encoder finalizes the stream, unless
+// Options.KeepRunningAfterClose is set: ffmpeg writes the last segment and
+// #EXT-X-ENDLIST rather than being killed. The finished stream is served
+// until Stop. Once ctx is done, ffmpeg is killed and the encoder stopped
+// instead, unless Options.FinalizeOnCancel is set.
+//
+// If the encoder is already running, Start leaves it untouched and returns
+// the URL of the running stream together with ErrAlreadyRunning, so callers
+// racing to start the same encoder can all obtain the URL.
+//
+// After Warmup, Start switches the running pipeline from filler frames to
+// frames from the channel; the encoder then also stops when ctx is done.
 func (e *Encoder) Start(ctx context.Context, frames <-chan image.Image) (string, error) {
+	first, err := e.peekFirst(ctx, func() (image.Image, error) {
+		return receiveFirst(ctx, frames)
+	})
+	if err != nil {
+		return "", err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	return e.startFrames(ctx, frames, first)
+}
+
+// peekFirst obtains the first frame from next if AutoPixFmt or
+// StrictFirstFrame is set and the encoder is not running yet, selecting the
+// input pixel format for it or checking it. Otherwise it returns a nil frame.
+func (e *Encoder) peekFirst(ctx context.Context, next func() (image.Image, error)) (image.Image, error) {
+	e.mu.Lock()
+	running := e.running
+	e.mu.Unlock()
+
+	if (!e.opts.AutoPixFmt && !e.opts.StrictFirstFrame) || running {
+		return nil, nil
+	}
+
+	// Wait without holding e.mu, which would block Stop and URL
+	first, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running {
+		if format, ok := detectPixelFormat(first); ok && e.opts.AutoPixFmt {
+			e.opts.InputPixelFormat = format
+		}
+		if e.opts.StrictFirstFrame {
+			if err := e.ValidateFrame(first); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidFirstFrame, err)
+			}
+		}
+	}
+	return first, nil
+}
+
+// receiveFirst receives the first frame from frames.
+func receiveFirst(ctx context.Context, frames <-chan image.Image) (image.Image, error) {
+	select {
+	case frame, ok := <-frames:
+		if !ok {
+			return nil, fmt.Errorf("frame channel closed before the first frame")
+		}
+		return frame, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startFrames implements Start, with first as the frame peeked by
+// AutoPixFmt if any. Callers must hold e.mu.
+func (e *Encoder) startFrames(ctx context.Context, frames <-chan image.Image, first image.Image) (string, error) {
+	if err := e.checkImageInput(); err != nil {
+		return "", err
+	}
 	if e.running {
-		return "", fmt.Errorf("encoder already running")
+		if !e.warming {
+			return e.url(), ErrAlreadyRunning
+		}
+
+		// Hand the channel to the warmed-up frame loop
+		e.attach <- frames
+		e.warming = false
+		context.AfterFunc(ctx, e.cancel)
+		return e.url(), nil
 	}
 
-	// Create temp directory for HLS output
-	outputDir, err := os.MkdirTemp("", "nimsforestencoder-*")
+	return e.start(ctx, func(ctx context.Context) {
+		e.processFrames(ctx, frames, first)
+	})
+}
+
+// Warmup starts ffmpeg and the HTTP server before any frames are available
+// and feeds black frames at the frame rate, so the pipeline is producing
+// segments by the time Start is called with the real frames. It returns the
+// HLS URL. The encoder runs until ctx is done or Stop is called.
+func (e *Encoder) Warmup(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return e.url(), ErrAlreadyRunning
+	}
+	if e.opts.AutoPixFmt || e.opts.StrictFirstFrame {
+		return "", fmt.Errorf("warm-up is not supported with AutoPixFmt or StrictFirstFrame")
+	}
+	if err := e.checkImageInput(); err != nil {
+		return "", err
+	}
+
+	url, err := e.start(ctx, func(ctx context.Context) {
+		e.processFrames(ctx, nil, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	e.warming = true
+	return url, nil
+}
+
+// SwapSource switches frame processing to read from frames instead of the
+// channel passed to Start, e.g. after the frame source reconnected. ffmpeg
+// keeps running and the stream URL stays the same. Frames still pending on
+// the old channel are not encoded. The old channel may be closed once
+// SwapSource returns; closing it before then ends frame processing as usual.
+// Returns ErrNotRunning if the encoder isn't running or its stream was
+// finalized.
+func (e *Encoder) SwapSource(ctx context.Context, frames <-chan image.Image) error {
+	if err := e.checkImageInput(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	if !e.running || e.finalized {
+		e.mu.Unlock()
+		return ErrNotRunning
+	}
+	if e.warming {
+		e.mu.Unlock()
+		return fmt.Errorf("encoder is warming up, pass the frames to Start")
+	}
+	attach, runCtx := e.attach, e.runCtx
+	e.mu.Unlock()
+
+	// Not holding e.mu, so Stop isn't held up by a pending swap
+	select {
+	case attach <- frames:
+		return nil
+	case <-runCtx.Done():
+		return ErrNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start launches the HLS server, ffmpeg and process as the frame processing
+// goroutine, which must call e.wg.Done when it returns. Callers must hold
+// e.mu.
+func (e *Encoder) start(ctx context.Context, process func(ctx context.Context)) (string, error) {
+	// Create temp directory for HLS output, or record into RecordDir
+	outputDir := e.opts.RecordDir
+	var err error
+	if outputDir != "" {
+		err = os.MkdirAll(outputDir, 0o755)
+	} else {
+		outputDir, err = os.MkdirTemp("", tempDirName(e.opts.StreamID))
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return "", fmt.Errorf("failed to create output directory: %w", err)
 	}
 	e.outputDir = outputDir
 
 	// Start HLS server first so we know the port
-	hlsServer, err := newHLSServer(outputDir, e.opts.Port)
-	if err != nil {
-		os.RemoveAll(outputDir)
-		return "", fmt.Errorf("failed to create HLS server: %w", err)
+	e.tags = newPlaylistTags()
+	e.pruner = nil
+	if e.opts.MaxDiskBytes > 0 {
+		e.pruner = newSegmentPruner(outputDir, e.opts.MaxDiskBytes)
+	}
+	e.thumbs = nil
+	if e.opts.ThumbnailInterval > 0 {
+		e.thumbs = newThumbnailer(outputDir, e.opts)
+	}
+	e.uploads = nil
+	if e.opts.Uploader != nil {
+		e.uploads = newSegmentUploader(e.opts.Uploader, outputDir, e.tags, e.pruner, e.opts.HLSVersion, e.clock, func(err error) {
+			e.opts.logger().Warn("upload failed", "error", err)
+			e.emitError(err)
+		})
+	}
+	e.verifier = nil
+	if e.opts.VerifySegments {
+		e.verifier = newSegmentVerifier(outputDir, e.probeCommand, e.clock, func(uri string, err error) {
+			e.opts.logger().Warn("corrupt segment", "segment", uri, "error", err)
+			e.stats.Load().corruptSegments.Add(1)
+			e.emit(Event{Type: EventCorruptSegment, Segment: uri, Err: err})
+		})
+	}
+	e.hlsServer = nil
+	if e.opts.RecordDir == "" {
+		hlsServer, err := newHLSServer(ctx, outputDir, e.opts, e.clock, e.Stats, e.tags, e.pruner, e.thumbs)
+		if err != nil {
+			os.RemoveAll(outputDir)
+			return "", fmt.Errorf("failed to create HLS server: %w", err)
+		}
+		e.hlsServer = hlsServer
+		hlsServer.Start(ctx)
+	}
+
+	// abort undoes the above when starting fails
+	abort := func() {
+		if e.hlsServer != nil {
+			e.hlsServer.Stop(context.Background())
+			e.hlsServer = nil
+		}
+		e.removeOutput()
+	}
+
+	// Write the first encryption key before ffmpeg reads the key info file
+	var keys *keyRotator
+	if e.opts.KeyProvider != nil {
+		keys, err = newKeyRotator(outputDir, e.opts.KeyProvider, e.opts.KeyRotationInterval)
+		if err != nil {
+			abort()
+			return "", err
+		}
+	}
+	e.keys = keys
+
+	e.dumper = nil
+	if e.opts.DumpFramesDir != "" {
+		if e.dumper, err = newFrameDumper(e.opts); err != nil {
+			abort()
+			return "", err
+		}
+	}
+
+	if err := e.startOverlay(); err != nil {
+		abort()
+		return "", err
 	}
-	e.hlsServer = hlsServer
-	hlsServer.Start()
 
 	// Start ffmpeg process
-	ffmpeg, err := newFFmpegProcess(outputDir, e.opts)
+	ffmpeg, err := newFFmpegProcess(outputDir, e.opts, e.clock, nil)
 	if err != nil {
-		hlsServer.Stop(context.Background())
-		os.RemoveAll(outputDir)
+		abort()
+		e.stopOverlay()
 		return "", fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
-	e.ffmpeg = ffmpeg
+	if e.opts.WaitForFFmpegStart {
+		if err := ffmpeg.waitStarted(); err != nil {
+			abort()
+			e.stopOverlay()
+			return "", err
+		}
+	}
+	e.ffmpeg.Store(ffmpeg)
+
+	e.periodStart = e.clock.Now()
 
 	// Create cancellable context for frame processing
+	e.startCtx = ctx
 	ctx, cancel := context.WithCancel(ctx)
+	e.runCtx = ctx
 	e.cancel = cancel
 	e.running = true
 
-	// Start frame processing goroutine
+	// Watch the playlist for completed segments
+	stats := newEncoderStats(e.clock)
+	e.stats.Store(stats)
+	slowAfter := e.opts.segmentDuration() + e.opts.SlowOutputThreshold
+	e.watcher = newSegmentWatcher(outputDir, stats, e.clock, slowAfter, e.handleSegment, e.opts.OnSlowOutput)
+	stalled := make(chan struct{}, 1)
+	e.stalled = stalled
+	e.watcher.stallAfter = e.opts.StallTimeout
+	e.watcher.onStall = func(sinceLastSegment time.Duration) {
+		e.opts.logger().Warn("ffmpeg stalled, restarting", "since_last_segment", sinceLastSegment)
+		e.emit(Event{Type: EventFFmpegStalled})
+		select {
+		case stalled <- struct{}{}:
+		default:
+		}
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.watcher.run(ctx)
+	}()
+
+	e.throttle = make(chan throttleLevel)
+	if e.opts.MaxOriginBandwidth > 0 {
+		governor := &bandwidthGovernor{
+			opts:    e.opts,
+			clients: e.hlsServer.clients,
+			stats:   stats,
+			clock:   e.clock,
+			apply: func(level throttleLevel) {
+				select {
+				case e.throttle <- level:
+				case <-ctx.Done():
+				}
+			},
+		}
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			governor.run(ctx)
+		}()
+	}
+
+	if keys != nil && keys.interval > 0 {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			keys.run(ctx, e.clock)
+		}()
+	}
+
+	if e.opts.WriteManifestJSON {
+		if err := e.writeManifest(); err != nil {
+			e.opts.logger().Warn("stream manifest failed", "error", err)
+		}
+	}
+
+	e.drops = newDropLogger(e.opts.logger(), e.opts.DropLogInterval, e.clock)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.drops.run(ctx)
+	}()
+
+	e.goProcess(ctx, process)
+
+	e.emit(Event{Type: EventStarted})
+	return e.url(), nil
+}
+
+// removeOutput removes the temporary output directory. A RecordDir is kept.
+// Callers must hold e.mu.
+func (e *Encoder) removeOutput() error {
+	if e.outputDir == "" || e.opts.RecordDir != "" {
+		return nil
+	}
+	return os.RemoveAll(e.outputDir)
+}
+
+// goProcess starts process as the frame processing goroutine of the run.
+// Once it returns the stream is finalized, unless
+// Options.KeepRunningAfterClose is set. Callers must hold e.mu.
+func (e *Encoder) goProcess(ctx context.Context, process func(ctx context.Context)) {
+	e.attach = make(chan (<-chan image.Image), 1)
+	done := make(chan struct{})
+	e.done = done
+	e.stopped = make(chan struct{})
+	e.stopErr = nil
+	e.finalized = false
 	e.wg.Add(1)
-	go e.processFrames(ctx, frames)
+	go func() {
+		process(ctx)
+		close(done)
+		if !e.opts.KeepRunningAfterClose {
+			// Not stopped by Stop, which holds e.mu until the run is gone
+			e.endRun(done, ctx.Err() != nil && !e.opts.FinalizeOnCancel)
+		}
+	}()
+}
+
+// endRun finalizes the stream of the run whose frame processing closed
+// done, unless it has been stopped already. The output stays served until
+// Stop; without an HTTP server there is nothing to serve, and the run is
+// stopped. With abort, ffmpeg is killed and the run stopped instead.
+func (e *Encoder) endRun(done chan struct{}, abort bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running || e.done != done || e.finalized {
+		return
+	}
+	e.finalize(abort)
+	if abort || e.hlsServer == nil {
+		_ = e.stop()
+	}
+}
+
+// checkImageInput returns an error if frames must be passed to
+// StartEncoded rather than as images.
+func (e *Encoder) checkImageInput() error {
+	if e.opts.InputCodec != "" {
+		return fmt.Errorf("frames must be passed to StartEncoded with input codec %q", e.opts.InputCodec)
+	}
+	if e.opts.InputPattern != "" {
+		return fmt.Errorf("frames are read from the input pattern by StartFromPattern")
+	}
+	return nil
+}
+
+// handleSegment is called by the segment watcher for each completed segment.
+func (e *Encoder) handleSegment(seg segmentInfo) {
+	// The watcher counts a segment before reporting it
+	if e.stats.Load().segments.Load() == 1 {
+		e.emit(Event{Type: EventFirstSegment, Segment: seg.URI})
+	}
+	e.emit(Event{Type: EventSegmentWritten, Segment: seg.URI})
+	e.tags.segmentDone(seg)
+	if e.pruner != nil {
+		e.pruner.segmentDone(seg)
+	}
+	if e.keys != nil && e.opts.KeyRotationInterval > 0 {
+		e.keys.prune()
+	}
+	if e.opts.SegmentChecksums {
+		// The segment may already have been deleted by a slow scan
+		_ = addChecksum(e.outputDir, seg)
+	}
+	if e.opts.SyncSegments {
+		if err := syncSegment(e.outputDir, seg, e.opts.SegmentChecksums); err != nil {
+			e.opts.logger().Warn("segment sync failed", "segment", seg.URI, "error", err)
+		}
+	}
+	if e.opts.WriteManifestJSON {
+		// Updating the measured bitrate
+		if err := e.writeManifest(); err != nil {
+			e.opts.logger().Warn("stream manifest failed", "error", err)
+		}
+	}
+	if e.uploads != nil {
+		e.uploads.segmentDone(seg)
+	}
+	if e.verifier != nil {
+		e.verifier.segmentDone(seg)
+	}
+}
 
-	return hlsServer.URL(), nil
+// recoverFrames, deferred by the frame processing goroutine, turns a panic
+// in it into a failed encoder rather than a crash of the host program.
+func (e *Encoder) recoverFrames() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e.stats.Load().failed.Store(true)
+	e.opts.logger().Error("frame processing panicked", "panic", r, "stack", string(debug.Stack()))
+	e.emitError(fmt.Errorf("frame processing panicked: %v", r))
 }
 
 // processFrames reads frames from the channel and writes them to ffmpeg.
-func (e *Encoder) processFrames(ctx context.Context, frames <-chan image.Image) {
+// A nil channel starts in warm-up mode. A non-nil first frame, peeked by
+// AutoPixFmt, is encoded before them.
+func (e *Encoder) processFrames(ctx context.Context, frames <-chan image.Image, first image.Image) {
 	defer e.wg.Done()
+	defer e.recoverFrames()
+
+	stats := e.stats.Load()
 
-	// Buffer for RGBA data
-	bufSize := e.opts.Width * e.opts.Height * 4
-	buf := make([]byte, bufSize)
+	// Buffer for raw frame data
+	buf := make([]byte, e.opts.frameSize())
+
+	// Pace writes to the frame rate so bursts don't collapse stream timing
+	var pace <-chan time.Time
+	if e.opts.PaceToRealtime {
+		ticker := e.clock.NewTicker(e.opts.captureInterval())
+		defer ticker.Stop()
+		pace = ticker.Chan()
+	}
+
+	// With a latency bound, frames are timestamped on arrival and queued so
+	// the age of each frame is known when it is encoded. Each source has
+	// its own queue, stopped when the source is swapped.
+	var queue <-chan queuedFrame
+	stopQueue := func() {}
+	defer func() { stopQueue() }()
+	setSource := func(src <-chan image.Image) {
+		frames = src
+		if e.opts.MaxLatency > 0 {
+			stopQueue()
+			var queueCtx context.Context
+			queueCtx, stopQueue = context.WithCancel(ctx)
+			queue = e.queueFrames(queueCtx, src, stats)
+			frames = nil
+		}
+	}
+
+	// New sources are attached after warm-up and by SwapSource
+	attach := e.attach
+
+	if frames != nil && e.opts.BufferStartupFrames > 0 {
+		frames = e.bufferStartup(ctx, frames, e.ffmpeg.Load().ready)
+	}
+
+	// During warm-up, feed black frames until the first real frame arrives
+	var peeked chan image.Image
+	var source <-chan image.Image
+	var filler <-chan time.Time
+	var black []byte
+	if frames == nil {
+		black = blackFrame(e.opts)
+		ticker := e.clock.NewTicker(e.opts.captureInterval())
+		defer ticker.Stop()
+		filler = ticker.Chan()
+	} else if first != nil {
+		// The peeked frame goes first, so the channel is only read after it
+		peeked = make(chan image.Image, 1)
+		peeked <- first
+		source, frames = frames, nil
+	} else {
+		setSource(frames)
+	}
+
+	// Buffered writes are flushed at least once per frame interval
+	var flush <-chan time.Time
+	if e.opts.WriteBufferSize > 0 {
+		ticker := e.clock.NewTicker(e.opts.captureInterval())
+		defer ticker.Stop()
+		flush = ticker.Chan()
+	}
+
+	// Periodically finalize the current output and start a fresh one
+	var rotate <-chan time.Time
+	if e.opts.RotateInterval > 0 {
+		ticker := e.clock.NewTicker(e.opts.RotateInterval)
+		defer ticker.Stop()
+		rotate = ticker.Chan()
+	}
+
+	// With a timestamp source, frames are placed on the frame rate grid by
+	// their timestamps. written counts the slots written so far.
+	clock := newFrameClock(e.opts, e.clock)
+	var written int64
+	var converted bool
+
+	// A faster input is thinned out before any conversion work
+	decimator := newFrameDecimator(e.opts)
+
+	var order *orderChecker
+	if e.opts.VerifyOrdering {
+		order = &orderChecker{}
+	}
+
+	// Once live frames stop arriving, the fallback source stands in for
+	// them until they resume
+	var idle <-chan time.Time
+	var fallback *fallbackSource
+	var fallbackFrames <-chan []byte
+	var fallbackFailed bool
+	var lastFrame time.Time
+	if e.opts.FallbackSource != "" {
+		defer func() {
+			if fallback != nil {
+				fallback.stop()
+			}
+		}()
+	}
+	// sourceStalled is set once FrameTimeout passed without live frames
+	var sourceStalled bool
+	if interval := idleCheckInterval(e.opts); interval > 0 {
+		ticker := e.clock.NewTicker(interval)
+		defer ticker.Stop()
+		idle = ticker.Chan()
+	}
 
 	for {
+		var frame image.Image
+		var arrived time.Time
+		ok := true
+
 		select {
 		case <-ctx.Done():
 			return
-		case frame, ok := <-frames:
-			if !ok {
-				// Channel closed, stop processing
+		case <-flush:
+			if err := e.ffmpeg.Load().FlushWrites(); err != nil {
+				// ffmpeg may have exited
 				return
 			}
+			continue
+		case level := <-e.throttle:
+			if err := e.setThrottle(level); err != nil {
+				// Without a running ffmpeg there is nothing to write to
+				e.emitError(err)
+				return
+			}
+			continue
+		case <-e.stalled:
+			if err := e.restartStalled(); err != nil {
+				// Without a running ffmpeg there is nothing to write to
+				e.emitError(err)
+				return
+			}
+			continue
+		case <-rotate:
+			if err := e.rotateOutput(); err != nil {
+				// Without a running ffmpeg there is nothing to write to
+				e.emitError(err)
+				return
+			}
+			continue
+		case src := <-attach:
+			if peeked != nil {
+				// Read once the peeked frame is encoded
+				source = src
+			} else {
+				setSource(src)
+			}
+			continue
+		case <-filler:
+			if err := e.ffmpeg.Load().WriteFrame(black); err != nil {
+				e.emitError(err)
+				return
+			}
+			written++
+			if n := stats.framesWritten.Add(1); e.maxFramesReached(n) {
+				return
+			}
+			continue
+		case <-idle:
+			if e.opts.FrameTimeout > 0 && !sourceStalled && !lastFrame.IsZero() && since(e.clock, lastFrame) > e.opts.FrameTimeout {
+				sourceStalled = true
+				e.opts.logger().Warn("frame source stalled", "since_last_frame", since(e.clock, lastFrame))
+				e.emit(Event{Type: EventSourceStalled})
+				if e.opts.StopOnFrameTimeout {
+					// Finalized like a closed channel
+					return
+				}
+			}
+			if e.opts.FallbackSource == "" || fallback != nil || fallbackFailed || lastFrame.IsZero() || since(e.clock, lastFrame) <= e.opts.FallbackTimeout {
+				continue
+			}
+			var err error
+			if fallback, err = e.startFallback(ctx); err != nil {
+				e.opts.logger().Warn("fallback source failed", "error", err)
+				fallbackFailed = true
+				continue
+			}
+			fallbackFrames = fallback.frames
+			e.opts.logger().Info("live frames idle, streaming fallback source", "source", e.opts.FallbackSource)
+			continue
+		case raw, fallbackOK := <-fallbackFrames:
+			if !fallbackOK {
+				// Don't restart a broken source until live frames resume
+				e.opts.logger().Warn("fallback source ended", "source", e.opts.FallbackSource)
+				fallback.stop()
+				fallback, fallbackFrames = nil, nil
+				fallbackFailed = true
+				continue
+			}
+			if !e.writeFrame(ctx, raw, pace, stats) {
+				return
+			}
+			written++
+			continue
+		case frame = <-peeked:
+			arrived = e.clock.Now()
+			peeked = nil
+			setSource(source)
+		case frame, ok = <-frames:
+			arrived = e.clock.Now()
+		case queued, queueOK := <-queue:
+			if queueOK && since(e.clock, queued.arrived) > e.opts.MaxLatency {
+				stats.latencyExceeded.Add(1)
+				stats.framesDropped.Add(1)
+				e.drops.drop(dropLatency, nil)
+				continue
+			}
+			frame, ok, arrived = queued.frame, queueOK, queued.arrived
+		}
+		if !ok {
+			// A source swapped in before the old channel closed takes over
+			select {
+			case src := <-attach:
+				setSource(src)
+				continue
+			default:
+			}
+			// Channel closed, stop processing
+			return
+		}
+		filler = nil
 
-			// Convert frame to RGBA bytes
-			if err := e.frameToRGBA(frame, buf); err != nil {
-				// Log error but continue processing
+		lastFrame = arrived
+		sourceStalled = false
+		fallbackFailed = false
+		if fallback != nil {
+			fallback.stop()
+			fallback, fallbackFrames = nil, nil
+			e.opts.logger().Info("live frames resumed")
+		}
+
+		if e.dumper != nil {
+			if err := e.dumper.add(frame); err != nil {
+				e.opts.logger().Warn("frame dump failed", "error", err)
+			}
+		}
+
+		if order != nil {
+			if err := order.check(frame); err != nil {
+				stats.outOfOrder.Add(1)
+				stats.framesDropped.Add(1)
+				e.drops.drop(dropOutOfOrder, err)
+				e.emit(Event{Type: EventFrameOrder, Err: err})
 				continue
 			}
+		}
 
-			// Write to ffmpeg
-			if err := e.ffmpeg.WriteFrame(buf); err != nil {
-				// ffmpeg may have exited
-				return
+		if decimator != nil && !decimator.keep() {
+			stats.framesDecimated.Add(1)
+			stats.framesDropped.Add(1)
+			continue
+		}
+
+		if clock != nil {
+			target := clock.place(frame, arrived, written)
+			if target < written {
+				// Too early for the next slot
+				stats.framesDropped.Add(1)
+				e.drops.drop(dropTiming, nil)
+				continue
+			}
+			// Hold the previous frame until this one is due
+			for converted && written < target {
+				if !e.writeFrame(ctx, buf, pace, stats) {
+					return
+				}
+				written++
+			}
+		}
+
+		// Convert frame to raw bytes in the input pixel format
+		start := time.Now()
+		err := e.convertFrame(frame, buf)
+		stats.convertLatency.observe(time.Since(start))
+		if err != nil {
+			// Log error but continue processing
+			e.drops.drop(dropConvert, err)
+			stats.framesDropped.Add(1)
+			converted = false
+			continue
+		}
+		converted = true
+
+		if e.thumbs != nil {
+			if err := e.thumbs.add(frame, written); err != nil {
+				e.opts.logger().Warn("thumbnail failed", "error", err)
 			}
 		}
+
+		if !e.writeFrame(ctx, buf, pace, stats) {
+			return
+		}
+		written++
 	}
 }
 
-// frameToRGBA converts an image.Image to raw RGBA bytes.
-func (e *Encoder) frameToRGBA(img image.Image, buf []byte) error {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
+// Delays between retries of a failed frame write, doubling from the first.
+const (
+	writeRetryDelay    = 10 * time.Millisecond
+	maxWriteRetryDelay = time.Second
+)
 
-	// Validate dimensions
-	if width != e.opts.Width || height != e.opts.Height {
-		return fmt.Errorf("frame size mismatch: got %dx%d, expected %dx%d",
-			width, height, e.opts.Width, e.opts.Height)
+// writeFrame waits for the next pace tick if pacing, then writes a converted
+// frame to ffmpeg. It returns false if frame processing should stop.
+func (e *Encoder) writeFrame(ctx context.Context, buf []byte, pace <-chan time.Time, stats *encoderStats) bool {
+	if pace != nil {
+		select {
+		case <-pace:
+		case <-ctx.Done():
+			return false
+		}
 	}
 
-	// Try to use existing RGBA data if available
-	if rgba, ok := img.(*image.RGBA); ok && rgba.Stride == width*4 {
-		copy(buf, rgba.Pix)
-		return nil
+	// Write to ffmpeg
+	start := time.Now()
+	err := e.writeRetrying(ctx, buf, stats)
+	stats.writeLatency.observe(time.Since(start))
+	if err != nil {
+		// ffmpeg may have exited
+		e.emitError(err)
+		return false
+	}
+	if n := stats.framesWritten.Add(1); e.maxFramesReached(n) {
+		// Finalized like a closed channel
+		return false
 	}
+	return true
+}
 
-	// Convert to RGBA
-	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
-	copy(buf, rgba.Pix)
+// maxFramesReached reports whether n frames written reach
+// Options.MaxFrames.
+func (e *Encoder) maxFramesReached(n uint64) bool {
+	return e.opts.MaxFrames > 0 && n >= uint64(e.opts.MaxFrames)
+}
 
-	return nil
+// writeRetrying writes a frame to ffmpeg, retrying failed writes up to
+// Options.MaxWriteErrors times in a row with growing delays. A retry
+// continues where the failed write stopped, so the frame stays whole.
+func (e *Encoder) writeRetrying(ctx context.Context, frame []byte, stats *encoderStats) error {
+	ffmpeg := e.ffmpeg.Load()
+	n, err := ffmpeg.writeFrame(frame)
+
+	delay := writeRetryDelay
+	for failures := 1; err != nil && failures <= e.opts.MaxWriteErrors; failures++ {
+		select {
+		case <-ffmpeg.Exited():
+			// Nothing reads the frames anymore
+			return err
+		default:
+		}
+		stats.writeErrors.Add(1)
+		e.opts.logger().Warn("frame write failed, retrying", "error", err, "failures", failures)
+
+		if !sleep(ctx, e.clock, delay) {
+			return err
+		}
+		delay = min(2*delay, maxWriteRetryDelay)
+
+		frame = frame[n:]
+		n, err = ffmpeg.resumeFrame(frame)
+	}
+	return err
+}
+
+// queuedFrame is a frame with its arrival time.
+type queuedFrame struct {
+	frame   image.Image
+	arrived time.Time
+}
+
+// queueFrames receives frames as soon as they arrive, timestamps them and
+// queues them for encoding. The queue holds what can be encoded within
+// MaxLatency at the configured frame rate; frames arriving while it is full
+// would exceed the latency bound and are dropped. The returned channel is
+// closed when frames is closed.
+func (e *Encoder) queueFrames(ctx context.Context, frames <-chan image.Image, stats *encoderStats) <-chan queuedFrame {
+	size := int(e.opts.MaxLatency.Seconds()*float64(e.opts.captureRate())) + 1
+	queue := make(chan queuedFrame, size)
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(queue)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					return
+				}
+				select {
+				case queue <- queuedFrame{frame: frame, arrived: e.clock.Now()}:
+				default:
+					stats.latencyExceeded.Add(1)
+					stats.framesDropped.Add(1)
+					e.drops.drop(dropLatency, nil)
+				}
+			}
+		}
+	}()
+
+	return queue
+}
+
+// bufferStartup receives up to Options.BufferStartupFrames frames without
+// waiting for them to be encoded until ffmpeg is ready, so producers that
+// don't block on the channel keep the opening frames. Afterwards frames are
+// passed on one at a time. The returned channel is closed once frames is
+// closed and the buffered frames were handed on.
+func (e *Encoder) bufferStartup(ctx context.Context, frames <-chan image.Image, ready <-chan struct{}) <-chan image.Image {
+	out := make(chan image.Image)
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(out)
+
+		var pending []image.Image
+		for frames != nil || len(pending) > 0 {
+			in := frames
+			if len(pending) >= e.opts.BufferStartupFrames || (len(pending) > 0 && isClosed(ready)) {
+				in = nil
+			}
+			var send chan<- image.Image
+			var next image.Image
+			if len(pending) > 0 {
+				send, next = out, pending[0]
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-in:
+				if !ok {
+					frames = nil
+					continue
+				}
+				pending = append(pending, frame)
+			case send <- next:
+				pending = pending[1:]
+			}
+		}
+	}()
+
+	return out
 }
 
 // Stop stops the encoder, closes ffmpeg, and shuts down the HTTP server.
+// It returns once the output is finalized, like Wait.
 func (e *Encoder) Stop() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	return e.stop()
+}
+
+// stop implements Stop. Callers must hold e.mu.
+func (e *Encoder) stop() error {
 	if !e.running {
 		return nil
 	}
+	if !e.finalized {
+		e.finalize(false)
+	}
+
+	var errs []error
+
+	// Archive the final rotation period before the output is removed
+	if e.opts.RotateInterval > 0 {
+		if err := archiveOutput(e.outputDir, e.opts.ArchiveDir, e.periodStart, e.opts.SyncSegments); err != nil {
+			errs = append(errs, fmt.Errorf("archive: %w", err))
+		}
+	}
+
+	// Stop HTTP server, giving in-flight requests ShutdownTimeout even if
+	// the context the run was started with is done
+	if e.hlsServer != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(e.startCtx), e.opts.ShutdownTimeout)
+		err := e.hlsServer.Stop(ctx)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("HLS server stop: %w", err))
+		}
+	}
+
+	// Clean up temp directory
+	if err := e.removeOutput(); err != nil {
+		errs = append(errs, fmt.Errorf("cleanup: %w", err))
+	}
+
+	e.running = false
+	e.warming = false
+
+	for _, err := range errs {
+		e.emitError(err)
+	}
+	e.emit(Event{Type: EventStopped})
+
+	if e.stopErr == nil && len(errs) > 0 {
+		e.stopErr = errs[0]
+	}
+	return e.stopErr
+}
 
+// finalize ends encoding for the current run: frame processing stops,
+// ffmpeg writes the final segment and #EXT-X-ENDLIST and the playlist is
+// completed, or with abort ffmpeg is killed, leaving the playlist as it is.
+// The output stays on disk and served until stop. Callers must hold e.mu.
+func (e *Encoder) finalize(abort bool) {
 	// Signal frame processing to stop
 	if e.cancel != nil {
 		e.cancel()
@@ -158,33 +1102,44 @@ func (e *Encoder) Stop() error {
 
 	var errs []error
 
-	// Close ffmpeg (this will finalize the stream)
-	if e.ffmpeg != nil {
-		if err := e.ffmpeg.Close(); err != nil {
+	// Close ffmpeg (this will finalize the stream). A restart that failed
+	// has ended the previous process already and reported why.
+	if ffmpeg := e.ffmpeg.Load(); ffmpeg != nil && !ffmpeg.ended.Load() {
+		if abort {
+			ffmpeg.kill()
+		} else if err := ffmpeg.Close(); err != nil {
 			errs = append(errs, fmt.Errorf("ffmpeg close: %w", err))
 		}
 	}
 
-	// Stop HTTP server
-	if e.hlsServer != nil {
-		if err := e.hlsServer.Stop(context.Background()); err != nil {
-			errs = append(errs, fmt.Errorf("HLS server stop: %w", err))
-		}
+	// Account for the segments written while ffmpeg finalized
+	if e.watcher != nil {
+		e.watcher.scan()
 	}
-
-	// Clean up temp directory
-	if e.outputDir != "" {
-		if err := os.RemoveAll(e.outputDir); err != nil {
-			errs = append(errs, fmt.Errorf("cleanup: %w", err))
+	if !abort && e.opts.PlaylistType == PlaylistTypeVOD && e.outputDir != "" {
+		if err := finalizeVOD(e.outputDir); err != nil {
+			errs = append(errs, fmt.Errorf("finalize playlist: %w", err))
 		}
 	}
+	if e.uploads != nil {
+		e.uploads.close(e.opts.ShutdownTimeout)
+	}
+	if e.verifier != nil {
+		e.verifier.close(e.opts.ShutdownTimeout)
+	}
+	e.stopOverlay()
 
-	e.running = false
+	e.stats.Load().stop()
+	e.warming = false
+	e.finalized = true
 
+	for _, err := range errs {
+		e.emitError(err)
+	}
 	if len(errs) > 0 {
-		return errs[0]
+		e.stopErr = errs[0]
 	}
-	return nil
+	close(e.stopped)
 }
 
 // URL returns the HLS stream URL. Only valid after Start() is called.
@@ -192,43 +1147,258 @@ func (e *Encoder) URL() string {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	return e.url()
+}
+
+// Done returns a channel that is closed once frame processing of the current
+// or most recent run has ended: after the frame channel was closed and its
+// frames written to ffmpeg, or when the run was stopped. Waiting for it
+// before Stop ensures every frame sent is encoded. Unless
+// Options.KeepRunningAfterClose is set, the encoder then finalizes the
+// stream by itself, and serves it until Stop; a concurrent Stop waits for
+// that to finish. Returns nil if the encoder was never started.
+func (e *Encoder) Done() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.done
+}
+
+// Wait blocks until the output of the current or most recent run is
+// finalized, by Stop or by itself once frame processing ended: ffmpeg has
+// exited, the playlist is complete, RecordPath is written and pending
+// uploads are done. The finished stream may still be served until Stop. It
+// returns the error finalizing the run returned, ctx.Err() if ctx is done
+// first, or ErrNotRunning if the encoder was never started.
+func (e *Encoder) Wait(ctx context.Context) error {
+	e.mu.Lock()
+	stopped := e.stopped
+	e.mu.Unlock()
+
+	if stopped == nil {
+		return ErrNotRunning
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stopErr
+}
+
+// URLs returns the HLS stream URL of every listener: URL() followed by one
+// URL per Options.ExtraListeners address. Returns nil without an HLS server.
+func (e *Encoder) URLs() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.hlsServer == nil {
+		return nil
+	}
+	return e.hlsServer.URLs()
+}
+
+// url returns the HLS stream URL, or "" without an HLS server. Callers must
+// hold e.mu.
+func (e *Encoder) url() string {
 	if e.hlsServer != nil {
 		return e.hlsServer.URL()
 	}
 	return ""
 }
 
-// WaitReady waits for the HLS stream to be ready (first segment created).
-// Returns an error if the timeout is exceeded or context is cancelled.
-func (e *Encoder) WaitReady(ctx context.Context, timeout time.Duration) error {
+// SocketPath returns the Unix domain socket the HLS server listens on, or ""
+// when it listens on TCP.
+func (e *Encoder) SocketPath() string {
+	return e.opts.UnixSocket
+}
+
+// FS returns the HLS output directory (playlist, segments and keys) as a
+// read-only file system, or nil if the encoder was never started. The
+// contents change live: segments leaving the playlist window are deleted and
+// reads of them fail with fs.ErrNotExist, and Stop removes everything.
+func (e *Encoder) FS() fs.FS {
 	e.mu.Lock()
-	outputDir := e.outputDir
+	defer e.mu.Unlock()
+
+	if e.outputDir == "" {
+		return nil
+	}
+	return os.DirFS(e.outputDir)
+}
+
+// Playlist returns the current HLS playlist as served, with custom tags
+// inserted and pruned segments dropped but relative segment URLs. Returns
+// ErrNotRunning while the encoder isn't running or has no HLS server, and an
+// error wrapping fs.ErrNotExist before ffmpeg wrote the playlist.
+func (e *Encoder) Playlist() (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running || e.hlsServer == nil {
+		return "", ErrNotRunning
+	}
+	data, err := e.hlsServer.playlist()
+	if err != nil {
+		return "", fmt.Errorf("failed to read playlist: %w", err)
+	}
+	return string(data), nil
+}
+
+// Stats returns a snapshot of the encoder statistics for the current or most
+// recent run.
+func (e *Encoder) Stats() Stats {
+	s := e.stats.Load().snapshot()
+	s.StreamID = e.opts.StreamID
+	return s
+}
+
+// Options returns the options the encoder runs with: those passed to New
+// with the defaults applied, and the InputPixelFormat detected from the
+// first frame with AutoPixFmt.
+func (e *Encoder) Options() Options {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	opts := e.opts
+	// Runtime state, not configuration
+	opts.throttle = throttleLevel{}
+	opts.overlayFile = ""
+	return opts
+}
+
+// EncoderInfo returns the video encoder ffmpeg is running with for the
+// current or most recent run, as resolved from its arguments, or the zero
+// value if the encoder was never started. Check it to confirm that encoding
+// runs on hardware rather than the CPU.
+func (e *Encoder) EncoderInfo() EncoderInfo {
+	if ffmpeg := e.ffmpeg.Load(); ffmpeg != nil {
+		return ffmpeg.info
+	}
+	return EncoderInfo{}
+}
+
+// ProcessStats returns the CPU time and memory usage of the ffmpeg process of
+// the current or most recent run, e.g. to find how many encoders fit on a
+// host. With a CommandFactory it is the usage of the command started, which
+// may be a wrapper around ffmpeg. Usage of a running process is only
+// available on Linux. Returns ErrNotRunning if the encoder was never
+// started.
+func (e *Encoder) ProcessStats() (ProcUsage, error) {
+	ffmpeg := e.ffmpeg.Load()
+	if ffmpeg == nil {
+		return ProcUsage{}, ErrNotRunning
+	}
+	return ffmpeg.Usage()
+}
+
+// InsertPlaylistTag inserts tag, such as an #EXT-X-DATERANGE or a comment
+// line, into the playlist at the next segment boundary: after the segment
+// that is being encoded when it is called.
+//
+// The tag is added when the playlist is served over HTTP rather than
+// written into the file ffmpeg maintains, since ffmpeg rewrites the whole
+// playlist after every segment. The playlist in FS() does not contain it.
+// The tag disappears together with its segment once that leaves the live
+// window.
+func (e *Encoder) InsertPlaylistTag(tag string) error {
+	if err := validatePlaylistTag(tag); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.running {
+		return ErrNotRunning
+	}
+	e.tags.add(tag)
+	return nil
+}
+
+// Flush blocks until ffmpeg has encoded every frame written so far, or ctx
+// is done. Encoded frames reach the playlist once the segment containing
+// them completes. ffmpeg reports progress about twice a second, so Flush
+// returns with up to that delay.
+func (e *Encoder) Flush(ctx context.Context) error {
+	e.mu.Lock()
+	running := e.running
 	e.mu.Unlock()
 
-	if outputDir == "" {
-		return fmt.Errorf("encoder not started")
+	if !running {
+		return ErrNotRunning
 	}
 
-	m3u8Path := filepath.Join(outputDir, "stream.m3u8")
-	deadline := time.Now().Add(timeout)
+	target := int64(e.stats.Load().framesWritten.Load())
+
+	ticker := e.clock.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
 
+	// Rotation and throttling replace ffmpeg, which waits for the old
+	// process to encode its frames, so only the current one is checked
 	for {
+		ffmpeg := e.ffmpeg.Load()
+		if ffmpeg.FramesEncoded() >= target-ffmpeg.frameBase {
+			return nil
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		default:
+		case <-ffmpeg.Exited():
+			if e.ffmpeg.Load() != ffmpeg || ffmpeg.FramesEncoded() >= target-ffmpeg.frameBase {
+				continue
+			}
+			return fmt.Errorf("ffmpeg exited before encoding all frames")
+		case <-ticker.Chan():
 		}
+	}
+}
+
+// WaitReady waits for the HLS stream to be ready (first segment created),
+// or until MinSegmentsBeforeReady segments are listed if set.
+// Returns an error wrapping ErrWaitTimeout if the timeout is exceeded, or the
+// context's error if it is cancelled.
+func (e *Encoder) WaitReady(ctx context.Context, timeout time.Duration) error {
+	e.mu.Lock()
+	outputDir := e.outputDir
+	e.mu.Unlock()
+
+	if outputDir == "" {
+		return fmt.Errorf("encoder not started")
+	}
+
+	m3u8Path := filepath.Join(outputDir, playlistName)
+	deadline := e.clock.Now().Add(timeout)
 
-		if time.Now().After(deadline) {
-			return fmt.Errorf("timeout waiting for HLS stream to be ready")
+	ticker := e.clock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if e.clock.Now().After(deadline) {
+			return fmt.Errorf("%w after %v", ErrWaitTimeout, timeout)
 		}
 
-		// Check if m3u8 file exists and has content
-		info, err := os.Stat(m3u8Path)
-		if err == nil && info.Size() > 0 {
-			return nil
+		if e.opts.MinSegmentsBeforeReady > 0 {
+			entries, err := readPlaylistEntries(m3u8Path)
+			if err == nil && len(entries) >= e.opts.MinSegmentsBeforeReady {
+				return nil
+			}
+		} else {
+			// Check if m3u8 file exists and has content
+			info, err := os.Stat(m3u8Path)
+			if err == nil && info.Size() > 0 {
+				return nil
+			}
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.Chan():
+		}
 	}
 }
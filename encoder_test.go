@@ -0,0 +1,1224 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// TestHelperProcess stands in for ffmpeg when run by helperCommand: it
+// consumes the frames and exits once stdin is closed, or in "hang" mode
+// keeps running until it is signalled. In "progress" mode it reports every
+// frame of NIMSFOREST_HELPER_FRAME_BYTES read as encoded.
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("NIMSFOREST_HELPER_PROCESS")
+	if mode == "" {
+		return
+	}
+	switch mode {
+	case "probe":
+		// ffprobe counting the frames of a segment
+		fmt.Println(60)
+		os.Exit(0)
+	case "probe-corrupt":
+		fmt.Fprintln(os.Stderr, "Invalid NAL unit size")
+		os.Exit(0)
+	case "bad-args":
+		// ffmpeg rejecting its arguments
+		fmt.Fprintln(os.Stderr, "Unrecognized option 'bogus'.")
+		os.Exit(1)
+	case "progress":
+		// ffmpeg reporting every frame it encodes
+		size, _ := strconv.Atoi(os.Getenv("NIMSFOREST_HELPER_FRAME_BYTES"))
+		frame := make([]byte, size)
+		for n := 1; ; n++ {
+			if _, err := io.ReadFull(os.Stdin, frame); err != nil {
+				os.Exit(0)
+			}
+			fmt.Printf("frame=%d\nprogress=continue\n", n)
+		}
+	}
+	io.Copy(io.Discard, os.Stdin)
+	if mode == "hang" {
+		select {}
+	}
+	os.Exit(0)
+}
+
+// helperCommand is a CommandFactory running TestHelperProcess, so the
+// encoder can run without ffmpeg.
+func helperCommand(outputDir string, opts Options) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "NIMSFOREST_HELPER_PROCESS=1")
+	return cmd
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(chan image.Image)
+	url, err := e.Start(context.Background(), frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if url == "" || url != e.URL() {
+		t.Fatalf("Start = %q, URL() = %q", url, e.URL())
+	}
+
+	// A racing Start gets the running stream
+	again, err := e.Start(context.Background(), make(chan image.Image))
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("second Start error = %v, want ErrAlreadyRunning", err)
+	}
+	if again != url {
+		t.Errorf("second Start = %q, want %q", again, url)
+	}
+
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatalf("Start after Stop = %v", err)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	e, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+	e.outputDir = t.TempDir()
+
+	done := make(chan error)
+	go func() {
+		done <- e.WaitReady(context.Background(), time.Second)
+	}()
+
+	// No playlist is ever written, so only the clock ends the wait
+	for {
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrWaitTimeout) {
+				t.Fatalf("WaitReady = %v, want ErrWaitTimeout", err)
+			}
+			if elapsed := since(c, time.Unix(0, 0)); elapsed <= time.Second {
+				t.Errorf("WaitReady returned after %v, before the timeout", elapsed)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			c.Advance(100 * time.Millisecond)
+		}
+	}
+}
+
+func TestWaitReadyMinSegments(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MinSegmentsBeforeReady = 2
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+	e.outputDir = t.TempDir()
+	write := func(segments ...string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(e.outputDir, playlistName), []byte(testPlaylist(segments...)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("segment0.ts")
+	done := make(chan error)
+	go func() {
+		done <- e.WaitReady(context.Background(), time.Minute)
+	}()
+	c.waitTicker(100 * time.Millisecond)
+	c.Advance(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("WaitReady with one segment listed = %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	write("segment0.ts", "segment1.ts")
+	c.Advance(100 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("WaitReady with two segments listed = %v", err)
+	}
+
+	opts.MinSegmentsBeforeReady = opts.PlaylistSize + 1
+	if _, err := New(opts); err == nil {
+		t.Error("minimum segments beyond the playlist size accepted")
+	}
+}
+
+func TestInvalidFramesDropped(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan image.Image, 4)
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	// None of these panic the frame loop
+	frames <- nil
+	frames <- (*image.RGBA)(nil)
+	frames <- image.NewRGBA(image.Rectangle{})
+	frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for deadline := time.Now().Add(10 * time.Second); e.Stats().FramesWritten < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("valid frame after the invalid ones not written")
+		}
+	}
+	if stats := e.Stats(); stats.FramesDropped != 3 || stats.FramesWritten != 1 {
+		t.Errorf("%d frames dropped and %d written, want 3 and 1", stats.FramesDropped, stats.FramesWritten)
+	}
+}
+
+func TestOddDimensions(t *testing.T) {
+	for _, tc := range []struct {
+		width, height int
+		padded        string
+	}{
+		{641, 480, "642x480"},
+		{640, 481, "640x482"},
+		{1, 1, "2x2"},
+	} {
+		opts := DefaultOptions()
+		opts.Width, opts.Height = tc.width, tc.height
+		_, err := New(opts)
+		if !errors.Is(err, ErrOddDimensions) || !strings.Contains(err.Error(), tc.padded) {
+			t.Errorf("New with %dx%d frames = %v, want ErrOddDimensions suggesting %s", tc.width, tc.height, err, tc.padded)
+		}
+	}
+}
+
+func TestProcessStats(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ProcessStats(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("ProcessStats before Start = %v, want ErrNotRunning", err)
+	}
+
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" {
+		usage, err := e.ProcessStats()
+		if err != nil || usage.Exited || usage.RSS <= 0 {
+			t.Errorf("ProcessStats while running = %+v, %v", usage, err)
+		}
+	}
+
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// The operating system reports the peak usage of the exited process
+	usage, err := e.ProcessStats()
+	if err != nil || !usage.Exited || (runtime.GOOS == "linux" && usage.RSS <= 0) {
+		t.Errorf("ProcessStats after Stop = %+v, %v", usage, err)
+	}
+}
+
+func TestRecoverFrames(t *testing.T) {
+	opts := DefaultOptions()
+	var logs bytes.Buffer
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer e.recoverFrames()
+		panic("boom")
+	}()
+	<-done
+
+	if !e.Stats().Failed {
+		t.Error("encoder not failed after a panic")
+	}
+	select {
+	case ev := <-e.Events():
+		if ev.Type != EventError || ev.Err == nil || !strings.Contains(ev.Err.Error(), "boom") {
+			t.Errorf("event = %+v, want an error with the panic", ev)
+		}
+	default:
+		t.Error("no event for the panic")
+	}
+	if !strings.Contains(logs.String(), "frame processing panicked") {
+		t.Errorf("logs %q don't report the panic", logs.String())
+	}
+}
+
+// failingWriter fails its first failures writes after writing part of the
+// data, like a pipe interrupted mid-frame.
+type failingWriter struct {
+	bytes.Buffer
+	failures int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.failures > 0 {
+		w.failures--
+		n, _ := w.Buffer.Write(p[:min(len(p), 3)])
+		return n, errors.New("resource temporarily unavailable")
+	}
+	return w.Buffer.Write(p)
+}
+
+func (w *failingWriter) Close() error { return nil }
+
+func TestWriteRetrying(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		maxErrors, failures int
+		exited              bool
+		ok                  bool
+		writeErrors         uint64
+	}{
+		{"retried", 3, 2, false, true, 2},
+		{"too many failures", 1, 2, false, false, 1},
+		{"exited", 3, 1, true, false, 0},
+	} {
+		opts := DefaultOptions()
+		opts.Width, opts.Height = 4, 2
+		opts.MaxWriteErrors = tc.maxErrors
+		c := newFakeClock(time.Unix(0, 0))
+		e := &Encoder{opts: opts, clock: c}
+		w := &failingWriter{failures: tc.failures}
+		f := &ffmpegProcess{stdin: w, opts: opts, stdoutDone: make(chan struct{})}
+		if tc.exited {
+			close(f.stdoutDone)
+		}
+		e.ffmpeg.Store(f)
+
+		frame := make([]byte, opts.frameSize())
+		for i := range frame {
+			frame[i] = byte(i)
+		}
+		stats := &encoderStats{}
+		done := make(chan error)
+		go func() {
+			done <- e.writeRetrying(context.Background(), frame, stats)
+		}()
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-done:
+				break wait
+			case <-time.After(time.Millisecond):
+				c.Advance(writeRetryDelay)
+			}
+		}
+
+		if (err == nil) != tc.ok || stats.writeErrors.Load() != tc.writeErrors {
+			t.Errorf("%s: writeRetrying = %v with %d write errors, want ok %v and %d", tc.name, err, stats.writeErrors.Load(), tc.ok, tc.writeErrors)
+		}
+		// Retries go on where the failed write stopped
+		if tc.ok && !bytes.Equal(w.Bytes(), frame) {
+			t.Errorf("%s: wrote %v, want the frame %v", tc.name, w.Bytes(), frame)
+		}
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Playlist(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Playlist before Start = %v, want ErrNotRunning", err)
+	}
+
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if _, err := e.Playlist(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Playlist before ffmpeg wrote it = %v, want fs.ErrNotExist", err)
+	}
+
+	// The helper doesn't write one, so stand in for ffmpeg
+	want := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nsegment0.ts\n"
+	if err := os.WriteFile(filepath.Join(e.outputDir, playlistName), []byte(want), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.Playlist(); err != nil || got != want {
+		t.Errorf("Playlist = %q, %v, want %q", got, err, want)
+	}
+
+	e.Stop()
+	if _, err := e.Playlist(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Playlist after Stop = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.FS() != nil {
+		t.Error("FS before Start isn't nil")
+	}
+
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	for name, data := range map[string]string{playlistName: "#EXTM3U\n", "segment0.ts": "segment"} {
+		if err := os.WriteFile(filepath.Join(e.outputDir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := e.FS()
+	if err := fstest.TestFS(fsys, playlistName, "segment0.ts"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "segment0.ts"); err != nil || string(data) != "segment" {
+		t.Errorf("ReadFile = %q, %v, want the segment", data, err)
+	}
+
+	// Deleted segments are gone from the live view
+	if err := os.Remove(filepath.Join(e.outputDir, "segment0.ts")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, "segment0.ts"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile of a deleted segment = %v, want fs.ErrNotExist", err)
+	}
+	e.Stop()
+	if _, err := fs.ReadFile(fsys, playlistName); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile after Stop = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestStopOnChannelClose(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Port = 0
+		opts.CommandFactory = helperCommand
+		opts.PlaylistType = PlaylistTypeVOD
+		opts.KeepRunningAfterClose = keep
+		e, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frames := make(chan image.Image)
+		url, err := e.Start(context.Background(), frames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		playlist := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXTINF:2.000000,\nsegment0.ts\n"
+		if err := os.WriteFile(filepath.Join(e.outputDir, playlistName), []byte(playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		close(frames)
+		<-e.Done()
+
+		if keep {
+			if err := e.SwapSource(context.Background(), make(chan image.Image)); err != nil {
+				t.Errorf("KeepRunningAfterClose: SwapSource after the channel closed = %v", err)
+			}
+		} else {
+			if err := e.Wait(context.Background()); err != nil {
+				t.Fatalf("Wait after the channel closed = %v", err)
+			}
+			// The finished stream is served until Stop
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || !strings.HasSuffix(string(body), "#EXT-X-ENDLIST\n") {
+				t.Errorf("playlist after the channel closed: %d %q, want it finalized", resp.StatusCode, body)
+			}
+			if err := e.SwapSource(context.Background(), make(chan image.Image)); !errors.Is(err, ErrNotRunning) {
+				t.Errorf("SwapSource after finalizing = %v, want ErrNotRunning", err)
+			}
+		}
+
+		dir := e.outputDir
+		if err := e.Stop(); err != nil {
+			t.Errorf("KeepRunningAfterClose %v: Stop = %v", keep, err)
+		}
+		if _, err := e.Playlist(); !errors.Is(err, ErrNotRunning) {
+			t.Errorf("KeepRunningAfterClose %v: still running after Stop", keep)
+		}
+		if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("KeepRunningAfterClose %v: output kept after Stop", keep)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Wait(context.Background()); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Wait before Start = %v, want ErrNotRunning", err)
+	}
+
+	frames := make(chan image.Image)
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := e.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait while running = %v, want context.DeadlineExceeded", err)
+	}
+
+	close(frames)
+	if err := e.Wait(context.Background()); err != nil {
+		t.Errorf("Wait after closing the channel = %v", err)
+	}
+	if !isClosed(e.ffmpeg.Load().Exited()) {
+		t.Error("ffmpeg still running once Wait returned")
+	}
+	if _, err := e.Playlist(); errors.Is(err, ErrNotRunning) {
+		t.Error("finished stream no longer served once Wait returned")
+	}
+	e.Stop()
+}
+
+func TestPaceToRealtime(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.PaceToRealtime = true
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+
+	// A burst of frames is written one per frame interval
+	frames := make(chan image.Image, 3)
+	for i := 0; i < cap(frames); i++ {
+		frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	}
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	interval := opts.captureInterval()
+	c.waitTicker(interval)
+	for want := uint64(0); want <= 2; want++ {
+		time.Sleep(20 * time.Millisecond)
+		if n := e.Stats().FramesWritten; n != want {
+			t.Fatalf("%d frames written after %d intervals, want %d", n, want, want)
+		}
+		c.Advance(interval)
+		for deadline := time.Now().Add(10 * time.Second); e.Stats().FramesWritten <= want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("frame %d not written after its interval", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	for _, encodes := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.Width, opts.Height = 16, 16
+		// The hanging helper is terminated at Stop
+		opts.ShutdownTimeout = 100 * time.Millisecond
+		opts.CommandFactory = func(outputDir string, opts Options) *exec.Cmd {
+			cmd := helperCommand(outputDir, opts)
+			if encodes {
+				cmd.Env = append(cmd.Env, "NIMSFOREST_HELPER_PROCESS=progress", fmt.Sprintf("NIMSFOREST_HELPER_FRAME_BYTES=%d", opts.frameSize()))
+			} else {
+				cmd.Env = append(cmd.Env, "NIMSFOREST_HELPER_PROCESS=hang")
+			}
+			return cmd
+		}
+		e, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Flush(context.Background()); !errors.Is(err, ErrNotRunning) {
+			t.Fatalf("Flush before Start = %v, want ErrNotRunning", err)
+		}
+
+		frames := make(chan image.Image, 3)
+		for i := 0; i < cap(frames); i++ {
+			frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+		}
+		if _, err := e.Start(context.Background(), frames); err != nil {
+			t.Fatal(err)
+		}
+		for e.Stats().FramesWritten < 3 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = e.Flush(ctx)
+		cancel()
+		if encodes {
+			if err != nil {
+				t.Errorf("Flush = %v", err)
+			} else if n := e.ffmpeg.Load().FramesEncoded(); n < 3 {
+				t.Errorf("Flush returned with %d of 3 frames encoded", n)
+			}
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Flush with no frame encoded = %v, want context.DeadlineExceeded", err)
+		}
+		e.Stop()
+	}
+}
+
+func TestQueueFramesMaxLatency(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxLatency = 100 * time.Millisecond
+	c := newFakeClock(time.Unix(0, 0))
+	e := &Encoder{opts: opts, clock: c, drops: newDropLogger(opts.logger(), 0, c)}
+	stats := newEncoderStats(c)
+
+	// What can be encoded within 100ms at 30 fps is queued, later frames
+	// are dropped on arrival
+	frames := make(chan image.Image)
+	queue := e.queueFrames(context.Background(), frames, stats)
+	c.Advance(time.Second)
+	for i := 0; i < 6; i++ {
+		frames <- image.NewRGBA(image.Rect(0, 0, i+1, 1))
+	}
+	close(frames)
+	e.wg.Wait()
+
+	var got []string
+	for queued := range queue {
+		got = append(got, fmt.Sprintf("%d@%v", queued.frame.Bounds().Dx(), queued.arrived.Sub(time.Unix(0, 0))))
+	}
+	want := []string{"1@1s", "2@1s", "3@1s", "4@1s"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("queued frames %q, want %q", got, want)
+	}
+	if s := stats.snapshot(); s.LatencyExceeded != 2 || s.FramesDropped != 2 {
+		t.Errorf("LatencyExceeded, FramesDropped = %d, %d, want 2, 2", s.LatencyExceeded, s.FramesDropped)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+	url, err := e.Warmup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	// waitWritten waits for n frames to be written
+	interval := opts.captureInterval()
+	waitWritten := func(n uint64) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); e.Stats().FramesWritten < n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d frames written, want %d", e.Stats().FramesWritten, n)
+			}
+		}
+	}
+	// Black frames are fed at the frame rate
+	c.waitTicker(interval)
+	c.Advance(interval)
+	waitWritten(1)
+	c.Advance(interval)
+	waitWritten(2)
+
+	if again, err := e.Warmup(context.Background()); !errors.Is(err, ErrAlreadyRunning) || again != url {
+		t.Errorf("second Warmup = %q, %v, want %q, ErrAlreadyRunning", again, err, url)
+	}
+	if err := e.SwapSource(context.Background(), make(chan image.Image)); err == nil {
+		t.Error("SwapSource while warming up succeeded")
+	}
+
+	frames := make(chan image.Image, 1)
+	frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	if got, err := e.Start(context.Background(), frames); err != nil || got != url {
+		t.Fatalf("Start after Warmup = %q, %v, want %q", got, err, url)
+	}
+	// The real frame is written as it arrives
+	waitWritten(3)
+
+	// The filler stops at the first real frame
+	for i := 0; i < 5; i++ {
+		c.Advance(interval)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := e.Stats().FramesWritten; n != 3 {
+		t.Errorf("%d frames written once real frames arrived, want 3", n)
+	}
+
+	opts.AutoPixFmt = true
+	if e, err := New(opts); err != nil {
+		t.Fatal(err)
+	} else if _, err := e.Warmup(context.Background()); err == nil {
+		e.Stop()
+		t.Error("Warmup with AutoPixFmt succeeded")
+	}
+}
+
+func TestFrameTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.FrameTimeout = time.Second
+	opts.StopOnFrameTimeout = true
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+
+	frames := make(chan image.Image, 1)
+	frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	// The source never sends again nor closes its channel
+	timeout := time.After(10 * time.Second)
+	for stalled := false; !stalled; {
+		select {
+		case ev := <-e.Events():
+			stalled = ev.Type == EventSourceStalled
+		case <-time.After(time.Millisecond):
+			c.Advance(100 * time.Millisecond)
+		case <-timeout:
+			t.Fatal("no EventSourceStalled")
+		}
+	}
+	if elapsed := since(c, time.Unix(0, 0)); elapsed <= time.Second {
+		t.Errorf("source stalled after %v, before the timeout", elapsed)
+	}
+	select {
+	case <-e.Done():
+	case <-timeout:
+		t.Fatal("StopOnFrameTimeout didn't end frame processing")
+	}
+}
+
+func TestMaxFrames(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.MaxFrames = 4
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More frames than the limit, and the channel never closes
+	frames := make(chan image.Image, 10)
+	for i := 0; i < cap(frames); i++ {
+		frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	}
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Done():
+	case <-time.After(10 * time.Second):
+		e.Stop()
+		t.Fatal("MaxFrames didn't end frame processing")
+	}
+	if n := e.Stats().FramesWritten; n != 4 {
+		t.Errorf("wrote %d frames, want MaxFrames 4", n)
+	}
+	if len(frames) != 6 {
+		t.Errorf("%d frames left in the channel, want 6", len(frames))
+	}
+}
+
+func TestWaitForFFmpegStart(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CommandFactory = func(string, Options) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), "NIMSFOREST_HELPER_PROCESS=bad-args")
+		return cmd
+	}
+	opts.WaitForFFmpegStart = true
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Start(context.Background(), make(chan image.Image))
+	if err == nil {
+		e.Stop()
+		t.Fatal("Start succeeded with ffmpeg exiting")
+	}
+	if !strings.Contains(err.Error(), "Unrecognized option 'bogus'.") {
+		t.Errorf("Start = %v, want ffmpeg's error output", err)
+	}
+	if e.outputDir != "" {
+		if _, err := os.Stat(e.outputDir); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("output directory %s left behind", e.outputDir)
+		}
+	}
+
+	// A running ffmpeg starts as usual
+	opts.CommandFactory = helperCommand
+	if e, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatalf("Start = %v", err)
+	}
+	e.Stop()
+}
+
+func TestOptions(t *testing.T) {
+	e, err := New(Options{Width: 640, Height: 360})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := e.Options()
+	if opts.Width != 640 || opts.Height != 360 {
+		t.Errorf("Options() frame size %dx%d, want the 640x360 passed to New", opts.Width, opts.Height)
+	}
+	defaults := DefaultOptions()
+	if opts.FrameRate != defaults.FrameRate || opts.SegmentDuration != defaults.SegmentDuration || opts.Codec != defaults.Codec {
+		t.Errorf("Options() = frame rate %d, segment duration %v, codec %q, want the defaults", opts.FrameRate, opts.SegmentDuration, opts.Codec)
+	}
+}
+
+func TestStreamID(t *testing.T) {
+	var logs bytes.Buffer
+	opts := DefaultOptions()
+	opts.CommandFactory = helperCommand
+	opts.StreamID = "cam-1"
+	opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	if ev := <-e.Events(); ev.StreamID != "cam-1" {
+		t.Errorf("event StreamID = %q, want cam-1", ev.StreamID)
+	}
+	if id := e.Stats().StreamID; id != "cam-1" {
+		t.Errorf("Stats().StreamID = %q, want cam-1", id)
+	}
+	if dir := filepath.Base(e.outputDir); !strings.HasPrefix(dir, "nimsforestencoder-cam-1-") {
+		t.Errorf("output directory %s isn't named after the stream", dir)
+	}
+	e.opts.logger().Info("hello")
+	if !strings.Contains(logs.String(), "stream=cam-1") {
+		t.Errorf("log %q lacks stream=cam-1", logs.String())
+	}
+
+	opts.StreamID = "../cam"
+	if _, err := New(opts); err == nil {
+		t.Error("stream ID with a path accepted")
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	opts.RotateInterval = time.Minute
+	opts.ArchiveDir = t.TempDir()
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	// ffmpeg completes two segments
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nsegment0.ts\n#EXTINF:2.000000,\nsegment1.ts\n"
+	for name, data := range map[string]string{playlistName: playlist, "segment0.ts": "0", "segment1.ts": "1"} {
+		if err := os.WriteFile(filepath.Join(e.outputDir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.watcher.scan()
+
+	// Rotating once restarts ffmpeg
+	c.waitTicker(opts.RotateInterval)
+	c.Advance(opts.RotateInterval)
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for restarted := false; !restarted; {
+		select {
+		case ev := <-e.Events():
+			got = append(got, string(ev.Type)+" "+ev.Segment)
+			restarted = ev.Type == EventFFmpegRestarted
+		case <-timeout:
+			t.Fatalf("no EventFFmpegRestarted, got %q", got)
+		}
+	}
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for stopped := false; !stopped; {
+		select {
+		case ev := <-e.Events():
+			got = append(got, string(ev.Type)+" "+ev.Segment)
+			stopped = ev.Type == EventStopped
+		case <-timeout:
+			t.Fatalf("no EventStopped, got %q", got)
+		}
+	}
+
+	want := []string{
+		"started ",
+		"first_segment segment0.ts",
+		"segment_written segment0.ts",
+		"segment_written segment1.ts",
+		"ffmpeg_restarted ",
+		"stopped ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestFinalizeOnCancel(t *testing.T) {
+	for _, finalize := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Port = 0
+		opts.CommandFactory = helperCommand
+		opts.PlaylistType = PlaylistTypeVOD
+		opts.FinalizeOnCancel = finalize
+		e, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		url, err := e.Start(ctx, make(chan image.Image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := e.outputDir
+		playlist := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXTINF:2.000000,\nsegment0.ts\n"
+		if err := os.WriteFile(filepath.Join(dir, playlistName), []byte(playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if err := e.Wait(context.Background()); err != nil {
+			t.Fatalf("FinalizeOnCancel %v: Wait after cancelling = %v", finalize, err)
+		}
+
+		if !finalize {
+			// Aborted: stopped with the output removed
+			if _, err := e.Playlist(); !errors.Is(err, ErrNotRunning) {
+				t.Error("still running after cancelling")
+			}
+			if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+				t.Error("output kept after aborting")
+			}
+			continue
+		}
+
+		// Finalized and served until Stop, after the shutdown of Start's ctx
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.HasSuffix(string(body), "#EXT-X-ENDLIST\n") {
+			t.Errorf("playlist after cancelling = %q, want it finalized", body)
+		}
+		if err := e.Stop(); err != nil {
+			t.Errorf("Stop = %v", err)
+		}
+	}
+}
+
+func TestRecordDirServeDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recording")
+	opts := DefaultOptions()
+	opts.CommandFactory = helperCommand
+	opts.PlaylistType = PlaylistTypeVOD
+	opts.RecordDir = dir
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := e.Start(context.Background(), make(chan image.Image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "" {
+		t.Errorf("Start = %q, want no URL without a server", url)
+	}
+	// Stand in for ffmpeg writing the event playlist
+	playlist := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXTINF:2.000000,\nsegment0.ts\n"
+	if err := os.WriteFile(filepath.Join(dir, playlistName), []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A free port for ServeDir
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- ServeDir(ctx, dir, port) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("ServeDir = %v", err)
+		}
+	}()
+
+	var resp *http.Response
+	for i := 0; ; i++ {
+		resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/%s", port, playlistName))
+		if err == nil || i == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	want := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:2.000000,\nsegment0.ts\n#EXT-X-ENDLIST\n"
+	if string(body) != want {
+		t.Errorf("served recording = %q, want %q", body, want)
+	}
+}
+
+func TestStrictFirstFrame(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.StrictFirstFrame = true
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := make(chan image.Image, 1)
+	frames <- image.NewRGBA(image.Rect(0, 0, 32, 16))
+	_, err = e.Start(context.Background(), frames)
+	var sizeErr *FrameSizeError
+	if !errors.Is(err, ErrInvalidFirstFrame) || !errors.As(err, &sizeErr) {
+		t.Fatalf("Start with a wrong-sized first frame = %v, want ErrInvalidFirstFrame and a *FrameSizeError", err)
+	}
+
+	frames <- image.NewRGBA(image.Rect(0, 0, 16, 16))
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatalf("Start with a valid first frame = %v", err)
+	}
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteManifestJSON(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Width, opts.Height = 640, 360
+	opts.CommandFactory = helperCommand
+	opts.WriteManifestJSON = true
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	data, err := fs.ReadFile(e.FS(), manifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest streamManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Width != 640 || manifest.Height != 360 || manifest.FrameRate != 30 ||
+		manifest.SegmentDuration != 2 || manifest.Playlist != playlistName || manifest.StartTime.IsZero() {
+		t.Errorf("manifest = %+v", manifest)
+	}
+}
+
+func TestBufferStartup(t *testing.T) {
+	e := &Encoder{opts: Options{BufferStartupFrames: 3}}
+	frames := make(chan image.Image)
+	ready := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := e.bufferStartup(ctx, frames, ready)
+
+	sent := make([]image.Image, 4)
+	for i := range sent {
+		sent[i] = image.NewGray(image.Rect(0, 0, i+1, 1))
+	}
+	for _, frame := range sent[:3] {
+		select {
+		case frames <- frame:
+		case <-time.After(time.Second):
+			t.Fatal("startup frame not accepted before ffmpeg is ready")
+		}
+	}
+	select {
+	case frames <- sent[3]:
+		t.Fatal("frame beyond BufferStartupFrames accepted")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(ready)
+	go func() {
+		frames <- sent[3]
+		close(frames)
+	}()
+	var got []image.Image
+	for frame := range out {
+		got = append(got, frame)
+	}
+	if len(got) != len(sent) {
+		t.Fatalf("received %d frames, want %d", len(got), len(sent))
+	}
+	for i := range sent {
+		if got[i] != sent[i] {
+			t.Errorf("frame %d out of order", i)
+		}
+	}
+	e.wg.Wait()
+}
+
+func TestStartFromPattern(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.CommandFactory = helperCommand
+	opts.InputPattern = filepath.Join(dir, "%05d.png")
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.StartFromPattern(context.Background()); err == nil {
+		t.Fatal("StartFromPattern without files succeeded")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00001.png"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err == nil {
+		t.Error("Start with an input pattern succeeded")
+	}
+	if _, err := e.StartFromPattern(context.Background()); err != nil {
+		t.Fatalf("StartFromPattern = %v", err)
+	}
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*Options)
+		ok     bool
+	}{
+		{"within", func(o *Options) {}, true},
+		{"pixels", func(o *Options) { o.Width, o.Height = 3840, 2160 }, false},
+		{"frame rate", func(o *Options) { o.FrameRate = 60 }, false},
+		{"input frame rate", func(o *Options) { o.InputFrameRate = 120 }, false},
+	} {
+		opts := DefaultOptions()
+		tc.modify(&opts)
+		opts.MaxPixels = 1920 * 1080
+		opts.MaxFrameRate = 30
+		_, err := New(opts)
+		if tc.ok && err != nil {
+			t.Errorf("%s: New = %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: New = %v, want ErrLimitExceeded", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package nimsforestencoder
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrAlreadyRunning is returned by Start when the encoder is already running.
+// Start also returns the URL of the running stream alongside this error.
+var ErrAlreadyRunning = errors.New("encoder already running")
+
+// ErrNotRunning is returned by operations that need a running encoder.
+var ErrNotRunning = errors.New("encoder not running")
+
+// ErrPortInUse is returned, wrapped, by Start when the TCP port of the HLS
+// server or of one of Options.ExtraListeners is taken, e.g. by another
+// encoder with the same Options.Port, and stays taken for the bind retries.
+var ErrPortInUse = errors.New("port already in use")
+
+// ErrWaitTimeout is returned, wrapped, by WaitReady when the stream does not
+// become ready within the timeout. Cancellation of the context is reported
+// as the context's error instead.
+var ErrWaitTimeout = errors.New("timeout waiting for HLS stream to be ready")
+
+// ErrOddDimensions is returned, wrapped, by New when Width or Height is odd.
+// The encoded video is always 4:2:0, which subsamples chroma by two in both
+// directions, so ffmpeg would fail to start.
+var ErrOddDimensions = errors.New("frame dimensions must be even for 4:2:0 output")
+
+// ErrLimitExceeded is returned, wrapped, by New when the options exceed
+// Options.MaxPixels or Options.MaxFrameRate.
+var ErrLimitExceeded = errors.New("encoding limit exceeded")
+
+// ErrInvalidFirstFrame is returned, wrapped together with the cause, by Start
+// when Options.StrictFirstFrame is set and the first frame can't be encoded.
+var ErrInvalidFirstFrame = errors.New("invalid first frame")
+
+// FrameSizeError reports a frame whose dimensions don't match the configured
+// Width and Height.
+type FrameSizeError struct {
+	Width, Height                 int
+	ExpectedWidth, ExpectedHeight int
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("frame size mismatch: got %dx%d, expected %dx%d",
+		e.Width, e.Height, e.ExpectedWidth, e.ExpectedHeight)
+}
+
+// FrameOrderError reports a TimedFrame whose PTS doesn't follow the previous
+// frame's, found with Options.VerifyOrdering.
+type FrameOrderError struct {
+	PTS, PreviousPTS time.Duration
+}
+
+func (e *FrameOrderError) Error() string {
+	if e.PTS == e.PreviousPTS {
+		return fmt.Sprintf("duplicate frame PTS %v", e.PTS)
+	}
+	return fmt.Sprintf("out of order frame PTS %v after %v", e.PTS, e.PreviousPTS)
+}
@@ -0,0 +1,91 @@
+package nimsforestencoder
+
+import "time"
+
+// eventBuffer is the number of events buffered for a slow Events consumer.
+const eventBuffer = 64
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventStarted is emitted when the encoder has started.
+	EventStarted EventType = "started"
+
+	// EventFirstSegment is emitted when the first segment of a run has
+	// completed, before its EventSegmentWritten.
+	EventFirstSegment EventType = "first_segment"
+
+	// EventSegmentWritten is emitted for every completed segment.
+	EventSegmentWritten EventType = "segment_written"
+
+	// EventFFmpegRestarted is emitted when ffmpeg was restarted at runtime,
+	// by output rotation, the bandwidth governor or after a stall.
+	EventFFmpegRestarted EventType = "ffmpeg_restarted"
+
+	// EventFFmpegStalled is emitted when ffmpeg produced no segment for
+	// Options.StallTimeout while frames were written, before it is killed
+	// and restarted.
+	EventFFmpegStalled EventType = "ffmpeg_stalled"
+
+	// EventSourceStalled is emitted when no frame arrived for
+	// Options.FrameTimeout.
+	EventSourceStalled EventType = "source_stalled"
+
+	// EventCorruptSegment is emitted for each segment that ffprobe failed
+	// to decode with Options.VerifySegments, with the error.
+	EventCorruptSegment EventType = "corrupt_segment"
+
+	// EventFrameOrder is emitted for each TimedFrame dropped by
+	// Options.VerifyOrdering, with a *FrameOrderError.
+	EventFrameOrder EventType = "frame_order"
+
+	// EventStopped is emitted when Stop has stopped the encoder.
+	EventStopped EventType = "stopped"
+
+	// EventError is emitted for an error that ends frame processing, such
+	// as ffmpeg exiting, and for errors returned by Stop.
+	EventError EventType = "error"
+)
+
+// Event describes a change in the encoder's lifecycle.
+type Event struct {
+	Type EventType
+
+	// Time is when the event happened.
+	Time time.Time
+
+	// StreamID is Options.StreamID.
+	StreamID string
+
+	// Segment is the segment URI for EventFirstSegment,
+	// EventSegmentWritten and EventCorruptSegment.
+	Segment string
+
+	// Err is the error for EventError, EventCorruptSegment and
+	// EventFrameOrder.
+	Err error
+}
+
+// Events returns the channel lifecycle events are delivered on, the same
+// for every run. The encoder never waits for the consumer: once 64 events
+// are pending, further events are dropped until the consumer catches up.
+// The channel is never closed.
+func (e *Encoder) Events() <-chan Event {
+	return e.events
+}
+
+// emit delivers ev without blocking, dropping it if the buffer is full.
+func (e *Encoder) emit(ev Event) {
+	ev.Time = e.clock.Now()
+	ev.StreamID = e.opts.StreamID
+	select {
+	case e.events <- ev:
+	default:
+	}
+}
+
+// emitError emits an EventError for err.
+func (e *Encoder) emitError(err error) {
+	e.emit(Event{Type: EventError, Err: err})
+}
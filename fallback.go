@@ -0,0 +1,106 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fallbackSource decodes Options.FallbackSource in a helper ffmpeg process
+// into raw frames in the input pixel format, looping it endlessly at its
+// native rate. The encoding ffmpeg keeps running while it stands in for the
+// live frames, so the stream stays continuous.
+type fallbackSource struct {
+	cancel context.CancelFunc
+	// frames delivers the decoded frames and is closed when the helper
+	// exits. A received frame is valid until the next one is received.
+	frames <-chan []byte
+}
+
+// startFallback starts decoding the fallback source. The helper stops when
+// ctx is done or stop is called.
+func (e *Encoder) startFallback(ctx context.Context) (*fallbackSource, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", fallbackArgs(e.opts)...)
+	if len(e.opts.Env) > 0 {
+		cmd.Env = buildEnv(os.Environ(), e.opts.Env)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create fallback stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start fallback ffmpeg: %w", err)
+	}
+
+	frames := make(chan []byte)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(frames)
+		defer cmd.Wait()
+
+		// The receiver is done with a frame once it receives the next, so
+		// two buffers can alternate
+		bufs := [2][]byte{make([]byte, e.opts.frameSize()), make([]byte, e.opts.frameSize())}
+		for i := 0; ; i ^= 1 {
+			if _, err := io.ReadFull(stdout, bufs[i]); err != nil {
+				return
+			}
+			select {
+			case frames <- bufs[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return &fallbackSource{cancel: cancel, frames: frames}, nil
+}
+
+// stop stops the helper process.
+func (f *fallbackSource) stop() {
+	f.cancel()
+}
+
+// fallbackArgs returns the helper ffmpeg arguments that decode the fallback
+// source into raw frames of the configured size, rate and pixel format on
+// stdout.
+func fallbackArgs(opts Options) []string {
+	// Images are repeated as a stream, videos restarted at their end
+	loop := []string{"-stream_loop", "-1"}
+	if isImageFile(opts.FallbackSource) {
+		loop = []string{"-loop", "1"}
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-re", // Produce frames in real time, as a live source would
+	}
+	args = append(args, loop...)
+	return append(args,
+		"-i", opts.FallbackSource,
+		"-an",
+		"-vf", fmt.Sprintf("scale=%d:%d,fps=%d", opts.Width, opts.Height, opts.FrameRate),
+		"-pix_fmt", string(opts.InputPixelFormat),
+		"-f", "rawvideo",
+		"pipe:1",
+	)
+}
+
+// isImageFile reports whether path names a still image by its extension.
+func isImageFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".bmp", ".webp", ".tif", ".tiff":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+)
+
+// FanOut feeds every frame received from frames to n channels, e.g. one for
+// each of several encoders started with different options. Each channel
+// buffers up to buffer frames; while a channel's buffer is full, frames for
+// it are dropped, so a slow encoder doesn't stall the others or the source.
+// The same frames are sent to every channel and must not be modified by any
+// consumer. The channels are closed once frames is closed or ctx is done.
+func FanOut(ctx context.Context, frames <-chan image.Image, n, buffer int) []<-chan image.Image {
+	outs := make([]chan image.Image, n)
+	result := make([]<-chan image.Image, n)
+	for i := range outs {
+		outs[i] = make(chan image.Image, max(buffer, 1))
+		result[i] = outs[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					return
+				}
+				for _, out := range outs {
+					select {
+					case out <- frame:
+					default:
+						// This consumer is behind
+					}
+				}
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,36 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+func TestFanOut(t *testing.T) {
+	frames := make(chan image.Image)
+	outs := FanOut(context.Background(), frames, 2, 2)
+
+	sent := make([]image.Image, 4)
+	for i := range sent {
+		sent[i] = image.NewGray(image.Rect(0, 0, i+1, 1))
+	}
+	// The first consumer keeps up, the second isn't reading
+	for _, frame := range sent {
+		frames <- frame
+		if got := <-outs[0]; got != frame {
+			t.Errorf("first consumer received %v, want %v", got.Bounds(), frame.Bounds())
+		}
+	}
+	close(frames)
+
+	var slow []image.Image
+	for frame := range outs[1] {
+		slow = append(slow, frame)
+	}
+	if len(slow) != 2 || slow[0] != sent[0] || slow[1] != sent[1] {
+		t.Errorf("slow consumer received %d frames, want the first 2 with the rest dropped", len(slow))
+	}
+	if _, ok := <-outs[0]; ok {
+		t.Error("first consumer's channel not closed")
+	}
+}
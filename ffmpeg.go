@@ -1,10 +1,18 @@
 package nimsforestencoder
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ffmpegProcess manages an ffmpeg subprocess for encoding raw RGBA frames to HLS.
@@ -13,43 +21,62 @@ type ffmpegProcess struct {
 	stdin     io.WriteCloser
 	outputDir string
 	opts      Options
-}
+	clock     clock
 
-// newFFmpegProcess creates and starts a new ffmpeg process.
-// It accepts raw RGBA frames on stdin and outputs HLS segments to outputDir.
-func newFFmpegProcess(outputDir string, opts Options) (*ffmpegProcess, error) {
-	// Build ffmpeg command
-	// ffmpeg -f rawvideo -pix_fmt rgba -s WxH -r FPS -i pipe:0 \
-	//   -c:v libx264 -preset ultrafast -tune zerolatency \
-	//   -f hls -hls_time SEGMENT_DURATION -hls_list_size 5 -hls_flags delete_segments \
-	//   OUTPUT_DIR/stream.m3u8
+	// buffered wraps stdin when Options.WriteBufferSize is set
+	buffered *bufio.Writer
 
-	resolution := fmt.Sprintf("%dx%d", opts.Width, opts.Height)
-	frameRate := strconv.Itoa(opts.FrameRate)
-	segmentDuration := strconv.Itoa(opts.SegmentDuration)
-	outputPath := outputDir + "/stream.m3u8"
+	// info describes the video encoder the process was started with
+	info EncoderInfo
 
-	args := []string{
-		"-y",             // Overwrite output files
-		"-loglevel", "warning", // Reduce log noise
-		"-f", "rawvideo",
-		"-pix_fmt", "rgba",
-		"-s", resolution,
-		"-r", frameRate,
-		"-i", "pipe:0",
-		"-c:v", "libx264",
-		"-preset", "ultrafast",
-		"-tune", "zerolatency",
-		"-pix_fmt", "yuv420p", // Required for compatibility
-		"-f", "hls",
-		"-hls_time", segmentDuration,
-		"-hls_list_size", "5",
-		"-hls_flags", "delete_segments",
-		"-hls_segment_type", "mpegts",
-		outputPath,
-	}
+	// exitState is the process state once Close has waited for ffmpeg
+	exitState atomic.Pointer[os.ProcessState]
+	// ended is set once Close or kill has begun ending the process, which
+	// mustn't be closed again
+	ended atomic.Bool
+
+	// framesEncoded is the frame count from ffmpeg's latest progress report
+	framesEncoded atomic.Int64
+	// frameBase is the run's frames written count when the process was
+	// started, as ffmpeg counts the frames of its own process only. Set
+	// before the process is stored in Encoder.ffmpeg.
+	frameBase  int64
+	stdoutDone chan struct{}
+
+	// stderr holds the end of ffmpeg's stderr, complete once stderrDone
+	// is closed
+	stderr     *stderrTail
+	stderrDone chan struct{}
+
+	// ready is closed at ffmpeg's first progress report, once it is
+	// reading and encoding input, or when it exits
+	ready     chan struct{}
+	readyOnce sync.Once
+}
 
-	cmd := exec.Command("ffmpeg", args...)
+// newFFmpegProcess creates and starts a new ffmpeg process.
+// It accepts raw RGBA frames on stdin and outputs HLS segments to outputDir,
+// or an MPEG-TS stream to w if w is not nil. c times the shutdown.
+func newFFmpegProcess(outputDir string, opts Options, c clock, w io.Writer) (*ffmpegProcess, error) {
+	var cmd *exec.Cmd
+	if opts.CommandFactory != nil {
+		cmd = opts.CommandFactory(outputDir, opts)
+		if cmd == nil {
+			return nil, fmt.Errorf("command factory returned nil")
+		}
+		if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+			return nil, fmt.Errorf("command factory must not set Stdin, Stdout or Stderr")
+		}
+	} else {
+		args := buildFFmpegArgs(outputDir, opts, w != nil)
+		if opts.ModifyArgs != nil {
+			args = opts.ModifyArgs(args)
+		}
+		cmd = exec.Command("ffmpeg", args...)
+		if len(opts.Env) > 0 {
+			cmd.Env = buildEnv(os.Environ(), opts.Env)
+		}
+	}
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -63,82 +90,320 @@ func newFFmpegProcess(outputDir string, opts Options) (*ffmpegProcess, error) {
 		return nil, fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
 
-	// Capture stdout (must be before Start)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		stdin.Close()
-		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	// Capture progress (must be before Start)
+	var progress io.ReadCloser
+	if w == nil {
+		progress, err = cmd.StdoutPipe()
+		if err != nil {
+			stdin.Close()
+			return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+		}
+	} else {
+		// The stream takes stdout, so progress goes to file descriptor 3
+		cmd.Stdout = w
+		r, pw, err := os.Pipe()
+		if err != nil {
+			stdin.Close()
+			return nil, fmt.Errorf("failed to create progress pipe: %w", err)
+		}
+		// Only the child keeps the write end open
+		defer pw.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, pw)
+		progress = r
 	}
 
 	// Start the process
 	if err := cmd.Start(); err != nil {
 		stdin.Close()
+		if w != nil {
+			progress.Close()
+		}
 		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
-	// Drain stderr in background to prevent blocking
+	f := &ffmpegProcess{
+		cmd:        cmd,
+		stdin:      stdin,
+		outputDir:  outputDir,
+		opts:       opts,
+		clock:      c,
+		info:       encoderInfo(cmd.Args),
+		stderr:     &stderrTail{},
+		stdoutDone: make(chan struct{}),
+		stderrDone: make(chan struct{}),
+		ready:      make(chan struct{}),
+	}
+
+	// Drain stderr in background to prevent blocking, keeping its end to
+	// explain a failed start
 	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := stderr.Read(buf)
-			if err != nil {
-				return
-			}
-			// Optionally log ffmpeg errors
-			if n > 0 {
-				// fmt.Printf("[ffmpeg] %s", buf[:n])
-			}
-		}
+		defer close(f.stderrDone)
+		io.Copy(f.stderr, stderr)
 	}()
+	if opts.WriteBufferSize > 0 {
+		f.buffered = bufio.NewWriterSize(stdin, opts.WriteBufferSize)
+	}
 
-	// Drain stdout in background
+	// Read progress reports in background
 	go func() {
-		buf := make([]byte, 4096)
-		for {
-			_, err := stdout.Read(buf)
-			if err != nil {
-				return
-			}
+		f.readProgress(progress)
+		if w != nil {
+			// Unlike the stdout pipe, Wait doesn't close this one
+			progress.Close()
 		}
 	}()
 
-	return &ffmpegProcess{
-		cmd:       cmd,
-		stdin:     stdin,
-		outputDir: outputDir,
-		opts:      opts,
-	}, nil
+	return f, nil
+}
+
+// readProgress parses the key=value progress reports ffmpeg writes to r
+// (-progress) until r is closed, which happens when ffmpeg exits.
+func (f *ffmpegProcess) readProgress(r io.Reader) {
+	defer close(f.stdoutDone)
+	defer f.readyOnce.Do(func() { close(f.ready) })
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "progress":
+			// The last key of every report
+			f.readyOnce.Do(func() { close(f.ready) })
+		case "frame":
+			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+				f.framesEncoded.Store(n)
+			}
+		}
+	}
+
+	// Keep draining so ffmpeg never blocks on a full pipe
+	io.Copy(io.Discard, r)
+}
+
+// FramesEncoded returns the number of frames ffmpeg has reported as encoded.
+func (f *ffmpegProcess) FramesEncoded() int64 {
+	return f.framesEncoded.Load()
+}
+
+// Exited returns a channel that is closed once the ffmpeg process has exited.
+func (f *ffmpegProcess) Exited() <-chan struct{} {
+	return f.stdoutDone
+}
+
+// waitStarted waits up to ffmpegStartGrace for ffmpeg to exit right after
+// starting, as it does on invalid arguments or a missing encoder, and then
+// returns an error with the end of its stderr. It returns nil if ffmpeg is
+// still running.
+func (f *ffmpegProcess) waitStarted() error {
+	t := f.clock.NewTicker(ffmpegStartGrace)
+	defer t.Stop()
+	select {
+	case <-f.stdoutDone:
+	case <-t.Chan():
+		return nil
+	}
+
+	<-f.stderrDone
+	_ = f.stdin.Close()
+	err := f.cmd.Wait()
+	f.exitState.Store(f.cmd.ProcessState)
+	if err == nil {
+		err = fmt.Errorf("exit status 0")
+	}
+	if msg := f.stderr.String(); msg != "" {
+		return fmt.Errorf("ffmpeg exited at startup: %w: %s", err, msg)
+	}
+	return fmt.Errorf("ffmpeg exited at startup: %w", err)
+}
+
+// stderrTail keeps the last stderrTailSize bytes written to it.
+type stderrTail struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+const (
+	// ffmpegStartGrace is how long Options.WaitForFFmpegStart gives ffmpeg
+	// to fail at startup.
+	ffmpegStartGrace = 500 * time.Millisecond
+
+	// stderrTailSize bounds the stderr output kept by stderrTail.
+	stderrTailSize = 1024
+)
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > stderrTailSize {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-stderrTailSize:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the kept output.
+func (t *stderrTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(string(t.buf))
 }
 
-// WriteFrame writes raw RGBA frame data to ffmpeg.
-// The data must be exactly Width * Height * 4 bytes (RGBA).
+// WriteFrame writes raw frame data to ffmpeg.
+// The data must be exactly one frame in the input pixel format, e.g.
+// Width * Height * 4 bytes for RGBA, or one compressed image with
+// Options.InputCodec.
 func (f *ffmpegProcess) WriteFrame(data []byte) error {
-	expectedSize := f.opts.Width * f.opts.Height * 4
-	if len(data) != expectedSize {
-		return fmt.Errorf("invalid frame size: got %d, expected %d", len(data), expectedSize)
+	_, err := f.writeFrame(data)
+	return err
+}
+
+// writeFrame is WriteFrame, also returning the number of bytes of data
+// written, from which a failed write is resumed with resumeFrame.
+func (f *ffmpegProcess) writeFrame(data []byte) (int, error) {
+	if f.opts.InputCodec != "" {
+		if len(data) == 0 {
+			return 0, fmt.Errorf("empty %s frame", f.opts.InputCodec)
+		}
+	} else if expectedSize := f.opts.frameSize(); len(data) != expectedSize {
+		return 0, fmt.Errorf("invalid frame size: got %d, expected %d", len(data), expectedSize)
 	}
+	return f.resumeFrame(data)
+}
 
-	_, err := f.stdin.Write(data)
-	if err != nil {
-		return fmt.Errorf("failed to write frame: %w", err)
+// resumeFrame writes the rest of a frame, whose start has been written.
+func (f *ffmpegProcess) resumeFrame(rest []byte) (int, error) {
+	var w io.Writer = f.stdin
+	if f.buffered != nil {
+		w = f.buffered
+	}
+
+	// Writers that break the io.Writer contract may write less without an
+	// error, and a missing byte would shift every following frame
+	var written int
+	for written < len(rest) {
+		n, err := w.Write(rest[written:])
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("failed to write frame: %w", err)
+		}
+		if n == 0 {
+			return written, fmt.Errorf("failed to write frame: %w", io.ErrShortWrite)
+		}
 	}
 
+	return written, nil
+}
+
+// FlushWrites writes any buffered frame data through to ffmpeg.
+func (f *ffmpegProcess) FlushWrites() error {
+	if f.buffered == nil {
+		return nil
+	}
+	if err := f.buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
 	return nil
 }
 
-// Close closes the stdin pipe and waits for ffmpeg to finish.
+// Close closes the stdin pipe and waits for ffmpeg to finish. ffmpeg
+// writes the final segment and exits once stdin is closed; if it hasn't
+// after Options.ShutdownTimeout it is sent SIGTERM, where supported, and
+// after another ShutdownTimeout it is killed.
 func (f *ffmpegProcess) Close() error {
+	f.ended.Store(true)
+
+	// Don't lose buffered frames; ffmpeg may already have exited, in which
+	// case they can't be delivered anyway
+	_ = f.FlushWrites()
+
 	if err := f.stdin.Close(); err != nil {
 		return fmt.Errorf("failed to close stdin: %w", err)
 	}
 
-	if err := f.cmd.Wait(); err != nil {
+	// Wait must not be called before all reads from stdout are done
+	stopped := ""
+	if !f.waitExit() {
+		stopped = "terminated"
+		if f.cmd.Process.Signal(syscall.SIGTERM) != nil || !f.waitExit() {
+			stopped = "killed"
+			_ = f.Kill()
+			<-f.stdoutDone
+		}
+	}
+
+	err := f.cmd.Wait()
+	f.exitState.Store(f.cmd.ProcessState)
+	if stopped != "" {
+		return fmt.Errorf("ffmpeg didn't exit within %v of closing stdin and was %s", f.opts.ShutdownTimeout, stopped)
+	}
+	if err != nil {
 		return fmt.Errorf("ffmpeg exited with error: %w", err)
 	}
 
 	return nil
 }
 
+// waitExit waits up to Options.ShutdownTimeout for ffmpeg to exit. It
+// reports whether it did.
+func (f *ffmpegProcess) waitExit() bool {
+	t := f.clock.NewTicker(f.opts.ShutdownTimeout)
+	defer t.Stop()
+
+	select {
+	case <-f.stdoutDone:
+		return true
+	case <-t.Chan():
+		return false
+	}
+}
+
+// ProcUsage is the resource usage of the ffmpeg process.
+type ProcUsage struct {
+	// UserTime and SystemTime are the CPU time spent in user and kernel
+	// mode so far.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// RSS is the resident memory in bytes: the current size while running,
+	// the peak size once exited, or 0 where unknown.
+	RSS int64
+
+	// Exited reports that the process has exited and been waited for.
+	Exited bool
+}
+
+// Usage returns the resource usage of the process. While it runs this
+// needs /proc and is only supported on Linux; once exited the usage
+// reported by the operating system is used everywhere.
+func (f *ffmpegProcess) Usage() (ProcUsage, error) {
+	if state := f.exitState.Load(); state != nil {
+		return ProcUsage{
+			UserTime:   state.UserTime(),
+			SystemTime: state.SystemTime(),
+			RSS:        peakRSS(state),
+			Exited:     true,
+		}, nil
+	}
+	if f.cmd.Process == nil {
+		return ProcUsage{}, fmt.Errorf("ffmpeg not started")
+	}
+	return processUsage(f.cmd.Process.Pid)
+}
+
+// kill kills ffmpeg without letting it finish the stream and waits for it
+// to exit, for a process that stopped making progress.
+func (f *ffmpegProcess) kill() {
+	f.ended.Store(true)
+	_ = f.Kill()
+	_ = f.stdin.Close()
+	<-f.stdoutDone
+	_ = f.cmd.Wait()
+	f.exitState.Store(f.cmd.ProcessState)
+}
+
 // Kill forcefully terminates the ffmpeg process.
 func (f *ffmpegProcess) Kill() error {
 	if f.cmd.Process != nil {
@@ -146,3 +411,517 @@ func (f *ffmpegProcess) Kill() error {
 	}
 	return nil
 }
+
+// buildFFmpegArgs returns the ffmpeg command line arguments for encoding raw
+// RGBA frames from stdin into an HLS stream in outputDir, or into an MPEG-TS
+// stream on stdout if toStdout is set.
+func buildFFmpegArgs(outputDir string, opts Options, toStdout bool) []string {
+	// ffmpeg -f rawvideo -pix_fmt rgba -s WxH -r FPS -i pipe:0 \
+	//   -c:v libx264 -preset ultrafast -tune zerolatency \
+	//   -f hls -hls_time SEGMENT_DURATION -hls_list_size 5 -hls_flags delete_segments \
+	//   OUTPUT_DIR/stream.m3u8
+
+	resolution := fmt.Sprintf("%dx%d", opts.Width, opts.Height)
+	frameRate := strconv.Itoa(opts.FrameRate)
+
+	args := []string{
+		"-y",                   // Overwrite output files
+		"-loglevel", "warning", // Reduce log noise
+		"-nostats",
+	}
+	if toStdout {
+		args = append(args, "-progress", "pipe:3") // Stdout carries the stream
+	} else {
+		args = append(args, "-progress", "pipe:1") // Machine-readable progress on stdout
+	}
+	if opts.LowDelayInput {
+		// Hand each frame to the encoder as soon as it is read
+		args = append(args,
+			"-fflags", "nobuffer",
+			"-flags", "low_delay",
+			"-probesize", "32",
+			"-analyzeduration", "0",
+		)
+	}
+	if opts.RealtimeInput {
+		// Read the frame input no faster than its frame rate
+		args = append(args, "-re")
+	}
+	if opts.ThreadQueueSize > 0 {
+		// Applies to the frame input below
+		args = append(args, "-thread_queue_size", strconv.Itoa(opts.ThreadQueueSize))
+	}
+	if opts.InputPattern != "" {
+		// Numbered image files read by ffmpeg, decimated by videoFilters
+		inputRate := frameRate
+		if opts.InputFrameRate > 0 {
+			inputRate = strconv.Itoa(opts.InputFrameRate)
+		}
+		args = append(args,
+			"-f", "image2",
+			"-framerate", inputRate,
+			"-i", opts.InputPattern,
+		)
+	} else if opts.InputCodec != "" {
+		// A stream of concatenated images
+		args = append(args,
+			"-f", "image2pipe",
+			"-c:v", string(opts.InputCodec),
+			"-framerate", frameRate,
+			"-i", "pipe:0",
+		)
+	} else {
+		args = append(args,
+			"-f", "rawvideo",
+			"-pix_fmt", string(opts.InputPixelFormat),
+			"-s", resolution,
+			"-r", frameRate,
+			"-i", "pipe:0",
+		)
+	}
+	if opts.SilentAudio {
+		// Endless silence, cut to the video length by -shortest
+		args = append(args,
+			"-f", "lavfi",
+			"-i", "anullsrc=channel_layout=stereo:sample_rate=48000",
+		)
+	}
+
+	outputs := [][]string{hlsOutputArgs(outputDir, opts)}
+	if toStdout {
+		outputs[0] = []string{"-f", "mpegts", "pipe:1"}
+	}
+	if opts.RecordPath != "" {
+		outputs = append(outputs, []string{
+			"-f", "mp4",
+			"-movflags", "+faststart", // Playable before fully downloaded
+			opts.RecordPath,
+		})
+	}
+	if opts.RTSPURL != "" {
+		outputs = append(outputs, []string{
+			"-f", "rtsp",
+			"-rtsp_transport", "tcp", // Avoid UDP packet loss
+			opts.RTSPURL,
+		})
+	}
+	if opts.WHIPEndpoint != "" {
+		outputs = append(outputs, []string{"-f", "whip", opts.WHIPEndpoint})
+	}
+
+	if len(opts.Outputs) > 0 && !opts.PreserveAlpha {
+		// Encode once and have the tee muxer write every output
+		for _, out := range opts.Outputs {
+			outputs = append(outputs, out.args())
+		}
+		args = append(args, videoCodecArgs(opts)...)
+		args = append(args, audioCodecArgs(opts)...)
+		// Containers such as MP4 need the codec headers out of band
+		args = append(args, "-flags", "+global_header", "-map", "0:v")
+		if opts.SilentAudio {
+			args = append(args, "-map", "1:a")
+		}
+		args = append(args, "-f", "tee", teeOutput(outputs))
+		if opts.PreviewInterval > 0 && !toStdout {
+			args = append(args, previewOutputArgs(outputDir, opts)...)
+		}
+		return args
+	}
+
+	// Each output encodes the input again with the same settings
+	for _, out := range outputs {
+		args = append(args, videoCodecArgs(opts)...)
+		args = append(args, audioCodecArgs(opts)...)
+		args = append(args, out...)
+	}
+	if opts.PreserveAlpha {
+		// The other outputs can't carry alpha, so these are encoded apart
+		for _, out := range opts.Outputs {
+			args = append(args, alphaOutputArgs(opts, out)...)
+		}
+	}
+	if opts.PreviewInterval > 0 && !toStdout {
+		args = append(args, previewOutputArgs(outputDir, opts)...)
+	}
+
+	return args
+}
+
+// previewOutputArgs returns the output overwriting a single JPEG of the
+// current frame every Options.PreviewInterval.
+func previewOutputArgs(outputDir string, opts Options) []string {
+	filters := append(videoFilters(opts), "fps=1/"+formatSeconds(opts.PreviewInterval))
+	return []string{
+		"-map", "0:v",
+		"-vf", strings.Join(filters, ","),
+		"-q:v", "5",
+		"-update", "1", // Overwrite one file rather than numbering them
+		"-f", "image2",
+		outputDir + "/" + opts.PreviewName,
+	}
+}
+
+// videoCodecArgs returns the encoding arguments for an output.
+func videoCodecArgs(opts Options) []string {
+	args := []string{"-c:v", opts.Codec}
+
+	// Preset and tune names are specific to the x264 family
+	if isX26x(opts.Codec) {
+		preset, tune := "ultrafast", "zerolatency"
+		if p, ok := profiles[opts.Profile]; ok {
+			preset, tune = p.preset, p.tune
+		}
+		args = append(args, "-preset", preset)
+		if tune != "" {
+			args = append(args, "-tune", tune)
+		}
+	}
+	if opts.Profile != "" {
+		args = append(args, "-g", strconv.Itoa(keyframeInterval(opts)))
+	}
+
+	args = append(args, "-pix_fmt", outputPixelFormat(opts))
+
+	maxBitrate := opts.MaxBitrate
+	if opts.throttle.maxBitrate > 0 && (maxBitrate == 0 || opts.throttle.maxBitrate < maxBitrate) {
+		maxBitrate = opts.throttle.maxBitrate
+	}
+	if opts.TargetQuality > 0 {
+		args = append(args, "-crf", strconv.Itoa(qualityToCRF(opts.Codec, opts.TargetQuality)))
+		if opts.Codec == "libvpx-vp9" {
+			// libvpx treats CRF with a bitrate as constrained quality capped
+			// at it, and needs a zero bitrate for constant quality
+			args = append(args, "-b:v", strconv.FormatInt(maxBitrate, 10))
+		}
+	}
+	args = append(args, maxBitrateArgs(maxBitrate)...)
+	if opts.ScaleAlgorithm != "" {
+		args = append(args, "-sws_flags", opts.ScaleAlgorithm)
+	}
+	if filters := videoFilters(opts); len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	if opts.BitDepth == 10 {
+		switch opts.Codec {
+		case "libx264":
+			args = append(args, "-profile:v", "high10")
+		case "libx265":
+			args = append(args, "-profile:v", "main10")
+		}
+	}
+	if opts.ColorRange != "" {
+		args = append(args, "-color_range", colorRangeTag(opts.ColorRange))
+	}
+	if opts.ColorPrimaries != "" {
+		args = append(args, "-color_primaries", opts.ColorPrimaries)
+	}
+	if opts.ColorTransfer != "" {
+		args = append(args, "-color_trc", opts.ColorTransfer)
+	}
+	if opts.ColorSpace != "" {
+		args = append(args, "-colorspace", opts.ColorSpace)
+	}
+
+	if opts.ForceKeyFrames != "" {
+		args = append(args, "-force_key_frames", opts.ForceKeyFrames)
+	}
+
+	if opts.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(opts.Threads))
+	}
+
+	return args
+}
+
+// isX26x reports whether codec is libx264 or libx265.
+func isX26x(codec string) bool {
+	return codec == "libx264" || codec == "libx265"
+}
+
+// EncoderInfo describes the video encoder ffmpeg was started with.
+type EncoderInfo struct {
+	// Codec is the ffmpeg video encoder, e.g. "libx264" or "h264_nvenc".
+	Codec string
+
+	// HardwareAccelerated reports whether Codec encodes on a GPU or other
+	// dedicated hardware rather than the CPU.
+	HardwareAccelerated bool
+}
+
+// encoderInfo resolves the video encoder from the arguments ffmpeg was
+// started with, after ModifyArgs or from the CommandFactory command. Codec
+// options before the last -i apply to an input; the first one after it is
+// that of the HLS stream, which comes before the other outputs, such as
+// those encoded apart with PreserveAlpha.
+func encoderInfo(args []string) EncoderInfo {
+	var info EncoderInfo
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-i":
+			info = EncoderInfo{}
+		case "-c:v", "-codec:v", "-vcodec":
+			if info.Codec == "" {
+				info.Codec = args[i+1]
+			}
+		}
+	}
+	info.HardwareAccelerated = isHardwareCodec(info.Codec)
+	return info
+}
+
+// hardwareCodecSuffixes are the suffixes of ffmpeg's hardware encoder names,
+// e.g. h264_nvenc or hevc_vaapi.
+var hardwareCodecSuffixes = []string{
+	"_nvenc", "_qsv", "_vaapi", "_videotoolbox", "_amf", "_v4l2m2m",
+	"_mf", "_omx", "_rkmpp", "_mediacodec", "_vulkan", "_d3d12va",
+}
+
+// isHardwareCodec reports whether codec is a hardware encoder.
+func isHardwareCodec(codec string) bool {
+	for _, suffix := range hardwareCodecSuffixes {
+		if strings.HasSuffix(codec, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// audioCodecArgs returns the per-output audio encoding arguments.
+func audioCodecArgs(opts Options) []string {
+	if !opts.SilentAudio {
+		return nil
+	}
+	return []string{
+		"-c:a", "aac",
+		"-b:a", "32k", // Silence needs next to nothing
+		"-shortest",
+	}
+}
+
+// maxCRF returns the largest (lowest quality) CRF value of codec, or 0 if
+// the codec has no CRF mode.
+func maxCRF(codec string) int {
+	switch codec {
+	case "libx264", "libx265":
+		return 51
+	case "libvpx-vp9", "libaom-av1", "libsvtav1":
+		return 63
+	}
+	return 0
+}
+
+// qualityToCRF maps a 1-100 quality onto the CRF range of codec.
+func qualityToCRF(codec string, quality int) int {
+	limit := maxCRF(codec)
+	return (limit*(100-quality) + 50) / 100
+}
+
+// videoFilters returns the filter chain applied to the video of an output.
+func videoFilters(opts Options) []string {
+	var filters []string
+	if opts.InputCodec != "" || opts.InputPattern != "" {
+		// Decoded images come in whatever size the source produced
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", opts.Width, opts.Height))
+	}
+	if opts.SampleAspectRatio != "" {
+		// Before any later scaling, which keeps the display aspect ratio
+		filters = append(filters, "setsar="+strings.Replace(opts.SampleAspectRatio, ":", "/", 1))
+	}
+	if opts.InputPattern != "" && opts.InputFrameRate > 0 {
+		// The image files aren't written by the frame loop, which would
+		// otherwise drop the extra frames
+		filters = append(filters, fmt.Sprintf("fps=%d", opts.FrameRate))
+	}
+	if opts.ColorRange != "" {
+		// Convert without squeezing or stretching the sample range
+		filters = append(filters, fmt.Sprintf("scale=in_range=%s:out_range=%s", opts.ColorRange, opts.ColorRange))
+	}
+	if opts.overlayFile != "" {
+		filters = append(filters, overlayFilter(opts))
+	}
+	if opts.Clock {
+		filters = append(filters, clockFilter(opts))
+	}
+	if opts.throttle.width > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:%d", opts.throttle.width, opts.throttle.height))
+	}
+	return filters
+}
+
+// colorRangeTag returns ffmpeg's -color_range value for r.
+func colorRangeTag(r ColorRange) string {
+	if r == ColorRangeFull {
+		return "pc"
+	}
+	return "tv"
+}
+
+// codecPixelFormats holds the output pixel format of each bit depth that
+// the encoders with known support can encode. Other encoders are passed
+// yuv420p or yuv420p10le unchecked.
+var codecPixelFormats = map[string]map[int]string{
+	"libx264":           {8: "yuv420p", 10: "yuv420p10le"},
+	"libx265":           {8: "yuv420p", 10: "yuv420p10le"},
+	"libvpx-vp9":        {8: "yuv420p", 10: "yuv420p10le"},
+	"libaom-av1":        {8: "yuv420p", 10: "yuv420p10le"},
+	"libsvtav1":         {8: "yuv420p", 10: "yuv420p10le"},
+	"h264_nvenc":        {8: "yuv420p"},
+	"hevc_nvenc":        {8: "yuv420p", 10: "p010le"},
+	"av1_nvenc":         {8: "yuv420p", 10: "p010le"},
+	"h264_qsv":          {8: "yuv420p"},
+	"hevc_qsv":          {8: "yuv420p", 10: "p010le"},
+	"h264_amf":          {8: "yuv420p"},
+	"hevc_amf":          {8: "yuv420p", 10: "p010le"},
+	"h264_videotoolbox": {8: "yuv420p"},
+	"hevc_videotoolbox": {8: "yuv420p", 10: "p010le"},
+}
+
+// outputPixelFormat returns the pixel format of the encoded video.
+func outputPixelFormat(opts Options) string {
+	if format, ok := codecPixelFormats[opts.Codec][opts.BitDepth]; ok {
+		// Hardware encoders take 10-bit video as P010
+		return format
+	}
+	if opts.BitDepth == 10 {
+		return "yuv420p10le"
+	}
+	// Required for compatibility
+	return "yuv420p"
+}
+
+// supportedBitDepths lists the bit depths codec supports with their output
+// pixel formats, e.g. "8 (yuv420p), 10 (p010le)", or "" if its support
+// isn't known.
+func supportedBitDepths(codec string) string {
+	formats := codecPixelFormats[codec]
+	var list []string
+	for _, depth := range []int{8, 10} {
+		if format, ok := formats[depth]; ok {
+			list = append(list, fmt.Sprintf("%d (%s)", depth, format))
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// hlsOutputArgs returns the muxer arguments and path for the HLS output.
+func hlsOutputArgs(outputDir string, opts Options) []string {
+	args := []string{
+		"-f", "hls",
+		"-hls_time", formatSeconds(opts.segmentDuration()),
+		"-hls_list_size", strconv.Itoa(playlistSize(opts)),
+		"-hls_segment_type", "mpegts",
+	}
+	if opts.PlaylistType == PlaylistTypeEvent || opts.PlaylistType == PlaylistTypeVOD {
+		// ffmpeg writes a vod playlist only when it finishes, see finalizeVOD
+		args = append(args, "-hls_playlist_type", string(PlaylistTypeEvent))
+	}
+
+	if flags := hlsFlags(opts); len(flags) > 0 {
+		args = append(args, "-hls_flags", strings.Join(flags, "+"))
+	}
+	if opts.DeleteThreshold > 0 && deletesSegments(opts) {
+		args = append(args, "-hls_delete_threshold", strconv.Itoa(opts.DeleteThreshold))
+	}
+
+	if opts.SegmentOptions != "" {
+		args = append(args, "-hls_segment_options", opts.SegmentOptions)
+	}
+	if opts.MaxSegmentSize > 0 {
+		args = append(args, "-hls_segment_size", strconv.FormatInt(opts.MaxSegmentSize, 10))
+	}
+	if opts.StrftimeSegments {
+		args = append(args, "-strftime", "1")
+	}
+	if opts.SegmentFilename != "" {
+		args = append(args, "-hls_segment_filename", outputDir+"/"+opts.SegmentFilename)
+	}
+	if opts.KeyProvider != nil {
+		args = append(args, "-hls_key_info_file", outputDir+"/"+keyInfoName)
+	}
+
+	return append(args, outputDir+"/"+playlistName)
+}
+
+// hlsFlags returns the values for ffmpeg's -hls_flags option.
+func hlsFlags(opts Options) []string {
+	var flags []string
+	if opts.SingleFile {
+		flags = append(flags, "single_file")
+	}
+	if deletesSegments(opts) {
+		flags = append(flags, "delete_segments")
+	}
+	if opts.KeyRotationInterval > 0 {
+		// Re-read the key info file at every segment to pick up new keys
+		flags = append(flags, "periodic_rekey")
+	}
+	if opts.MaxOriginBandwidth > 0 {
+		// Throttling restarts ffmpeg, which must continue the playlist
+		flags = append(flags, "append_list", "omit_endlist")
+	} else if opts.StallTimeout > 0 {
+		// A stalled ffmpeg is replaced by one continuing the playlist
+		flags = append(flags, "append_list")
+	}
+	if opts.ProgramDateTime {
+		flags = append(flags, "program_date_time")
+	}
+	if opts.IndependentSegments {
+		flags = append(flags, "independent_segments")
+	}
+	if opts.TempFileSegments {
+		// Written as .tmp and renamed once complete
+		flags = append(flags, "temp_file")
+	}
+	return flags
+}
+
+// playlistSize returns the number of segments listed in the playlist, where
+// 0 means all of them.
+func playlistSize(opts Options) int {
+	if keepsAllSegments(opts) {
+		return 0
+	}
+	return opts.PlaylistSize
+}
+
+// deletesSegments reports whether ffmpeg deletes segments that have left
+// the playlist. The single file can't be pruned, so this only applies to a
+// file per segment.
+func deletesSegments(opts Options) bool {
+	return !opts.SingleFile && !keepsAllSegments(opts)
+}
+
+// keepsAllSegments reports whether every segment stays on disk and in the
+// playlist instead of a sliding live window.
+func keepsAllSegments(opts Options) bool {
+	return opts.RotateInterval > 0 || opts.PlaylistType == PlaylistTypeEvent || opts.PlaylistType == PlaylistTypeVOD
+}
+
+// formatSeconds formats d as a decimal number of seconds for ffmpeg.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// buildEnv returns base with the variables in extra added, replacing any
+// existing entries with the same name.
+func buildEnv(base []string, extra map[string]string) []string {
+	env := make([]string, 0, len(base)+len(extra))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := extra[name]; !ok {
+			env = append(env, kv)
+		}
+	}
+
+	// Sort for a deterministic environment
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+extra[key])
+	}
+
+	return env
+}
@@ -0,0 +1,660 @@
+package nimsforestencoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingPipe counts the writes to a pipe, each of which is a syscall.
+type countingPipe struct {
+	*os.File
+	writes int
+}
+
+func (p *countingPipe) Write(b []byte) (int, error) {
+	p.writes++
+	return p.File.Write(b)
+}
+
+// shortWriter writes at most max bytes per call without an error, like a
+// writer breaking the io.Writer contract.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p[:min(len(p), w.max)])
+}
+
+func (w *shortWriter) Close() error { return nil }
+
+func TestWriteFrameShortWrites(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 4, 2
+	w := &shortWriter{max: 5}
+	f := &ffmpegProcess{stdin: w, opts: opts}
+
+	frame := make([]byte, opts.frameSize())
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.WriteFrame(frame); err != nil {
+			t.Fatalf("WriteFrame = %v", err)
+		}
+	}
+	if want := append(append([]byte{}, frame...), frame...); !bytes.Equal(w.Bytes(), want) {
+		t.Errorf("wrote %v, want both frames %v", w.Bytes(), want)
+	}
+
+	w.max = 0
+	if err := f.WriteFrame(frame); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("WriteFrame to a writer accepting nothing = %v, want io.ErrShortWrite", err)
+	}
+}
+
+// BenchmarkWriteFrame writes small frames to a pipe drained like ffmpeg's
+// stdin, with and without WriteBufferSize. writes/frame is the number of
+// write syscalls per frame.
+func BenchmarkWriteFrame(b *testing.B) {
+	for _, size := range []struct{ width, height int }{{64, 36}, {320, 180}} {
+		for _, bufSize := range []int{0, 64 << 10, 1 << 20} {
+			name := fmt.Sprintf("%dx%d/buffer=%d", size.width, size.height, bufSize)
+			b.Run(name, func(b *testing.B) {
+				r, w, err := os.Pipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer r.Close()
+				drained := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, r)
+					close(drained)
+				}()
+
+				pipe := &countingPipe{File: w}
+				opts := DefaultOptions()
+				opts.Width, opts.Height, opts.WriteBufferSize = size.width, size.height, bufSize
+				f := &ffmpegProcess{stdin: pipe, opts: opts}
+				if bufSize > 0 {
+					f.buffered = bufio.NewWriterSize(pipe, bufSize)
+				}
+				frame := make([]byte, opts.frameSize())
+
+				b.SetBytes(int64(len(frame)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := f.WriteFrame(frame); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := f.FlushWrites(); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+
+				b.ReportMetric(float64(pipe.writes)/float64(b.N), "writes/frame")
+				w.Close()
+				<-drained
+			})
+		}
+	}
+}
+
+func TestCloseTerminatesHungFFmpeg(t *testing.T) {
+	opts := DefaultOptions().withDefaults()
+	opts.CommandFactory = func(string, Options) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+		cmd.Env = append(os.Environ(), "NIMSFOREST_HELPER_PROCESS=hang")
+		return cmd
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	f, err := newFFmpegProcess(t.TempDir(), opts, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- f.Close() }()
+
+	// Ignoring the closed stdin, it only exits once the timeout passed
+	for {
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "terminated") {
+				t.Fatalf("Close = %v, want the process terminated", err)
+			}
+			if elapsed := since(c, time.Unix(0, 0)); elapsed < opts.ShutdownTimeout {
+				t.Errorf("terminated after %v, before the shutdown timeout", elapsed)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			c.Advance(time.Second)
+		}
+	}
+}
+
+func TestThreadQueueSizeArgs(t *testing.T) {
+	args := strings.Join(buildFFmpegArgs(t.TempDir(), DefaultOptions(), false), " ")
+	queue := strings.Index(args, "-thread_queue_size 512 ")
+	if queue < 0 || queue > strings.Index(args, "-i pipe:0") {
+		t.Errorf("args %q don't set -thread_queue_size 512 on the frame input", args)
+	}
+}
+
+func TestCappedCRFArgs(t *testing.T) {
+	for _, tc := range []struct {
+		codec string
+		want  string
+	}{
+		{"libx264", "-crf 23 -maxrate 3000000 -bufsize 6000000"},
+		// Constrained quality
+		{"libvpx-vp9", "-crf 28 -b:v 3000000 -maxrate 3000000 -bufsize 6000000"},
+	} {
+		opts := DefaultOptions()
+		opts.Codec = tc.codec
+		opts.TargetQuality = 55
+		opts.MaxBitrate = 3_000_000
+		if args := strings.Join(videoCodecArgs(opts), " "); !strings.Contains(args, tc.want) {
+			t.Errorf("%s args %q don't contain %q", tc.codec, args, tc.want)
+		}
+
+		// The bandwidth governor only lowers the cap
+		opts.throttle = throttleLevel{maxBitrate: 4_000_000}
+		if args := strings.Join(videoCodecArgs(opts), " "); !strings.Contains(args, "-maxrate 3000000 ") {
+			t.Errorf("%s args %q with a higher throttle cap don't keep -maxrate 3000000", tc.codec, args)
+		}
+	}
+}
+
+func TestInputPatternArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.InputPattern = "frames/%05d.png"
+	opts.InputFrameRate = 10
+	args := strings.Join(buildFFmpegArgs(t.TempDir(), opts, false), " ")
+	for _, want := range []string{"-f image2 -framerate 10 -i frames/%05d.png", "scale=1920:1080,fps=30"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q don't contain %q", args, want)
+		}
+	}
+}
+
+func TestSegmentFlagArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.IndependentSegments = true
+	opts.TempFileSegments = true
+	args := buildFFmpegArgs(t.TempDir(), opts, false)
+	for i, arg := range args {
+		if arg == "-hls_flags" && i+1 < len(args) {
+			if flags := args[i+1]; !strings.Contains(flags, "independent_segments") || !strings.Contains(flags, "temp_file") {
+				t.Errorf("-hls_flags %s lacks independent_segments or temp_file", flags)
+			}
+			return
+		}
+	}
+	t.Errorf("args %q have no -hls_flags", args)
+}
+
+func TestScaleAlgorithmArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ScaleAlgorithm = "lanczos"
+	if args := strings.Join(videoCodecArgs(opts), " "); !strings.Contains(args, "-sws_flags lanczos") {
+		t.Errorf("args %q don't contain -sws_flags lanczos", args)
+	}
+
+	opts.ScaleAlgorithm = "nearest"
+	if _, err := New(opts); err == nil {
+		t.Error("unknown scale algorithm accepted")
+	}
+}
+
+func TestPreviewArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.PreviewInterval = 5 * time.Second
+	dir := t.TempDir()
+	want := "-map 0:v -vf fps=1/5 -q:v 5 -update 1 -f image2 " + dir + "/preview.jpg"
+	if args := strings.Join(buildFFmpegArgs(dir, opts, false), " "); !strings.HasSuffix(args, want) {
+		t.Errorf("args %q don't end with %q", args, want)
+	}
+	if args := strings.Join(buildFFmpegArgs(dir, opts, true), " "); strings.Contains(args, "preview.jpg") {
+		t.Errorf("args %q to a writer write a preview", args)
+	}
+
+	opts.PreviewName = "../preview.jpg"
+	if _, err := New(opts); err == nil {
+		t.Error("preview name outside the output directory accepted")
+	}
+}
+
+func TestSampleAspectRatioArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SampleAspectRatio = "16:15"
+	if filters := strings.Join(videoFilters(opts), ","); filters != "setsar=16/15" {
+		t.Errorf("filters = %q, want setsar=16/15", filters)
+	}
+
+	for _, ratio := range []string{"16/15", "16:0", "-1:1", "wide"} {
+		opts.SampleAspectRatio = ratio
+		if _, err := New(opts); err == nil {
+			t.Errorf("sample aspect ratio %q accepted", ratio)
+		}
+	}
+}
+
+func TestWHIPArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WHIPEndpoint = "https://sfu.example.com/whip/live"
+	if args := strings.Join(buildFFmpegArgs(t.TempDir(), opts, false), " "); !strings.HasSuffix(args, "-f whip https://sfu.example.com/whip/live") {
+		t.Errorf("args %q don't end with the WHIP output", args)
+	}
+
+	for i, bad := range []func(*Options){
+		func(o *Options) { o.WHIPEndpoint = "rtp://sfu.example.com" },
+		func(o *Options) { o.Codec = "libx265" },
+		func(o *Options) { o.SilentAudio = true },
+	} {
+		o := opts
+		bad(&o)
+		if _, err := New(o); err == nil {
+			t.Errorf("invalid WHIP options %d accepted", i)
+		}
+	}
+}
+
+func TestBitDepthCodecs(t *testing.T) {
+	for _, tt := range []struct {
+		codec  string
+		depth  int
+		format string // "" if rejected
+	}{
+		{"libx264", 8, "yuv420p"},
+		{"libx264", 10, "yuv420p10le"},
+		{"hevc_nvenc", 10, "p010le"},
+		{"h264_nvenc", 8, "yuv420p"},
+		{"h264_nvenc", 10, ""},
+		{"h264_videotoolbox", 10, ""},
+		{"custom_encoder", 10, "yuv420p10le"},
+	} {
+		opts := DefaultOptions()
+		opts.Codec, opts.BitDepth = tt.codec, tt.depth
+		_, err := New(opts)
+		if tt.format == "" {
+			if err == nil || !strings.Contains(err.Error(), "supported: 8 (yuv420p)") {
+				t.Errorf("%s at %d bits: New = %v, want an error listing the supported bit depths", tt.codec, tt.depth, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s at %d bits: New = %v", tt.codec, tt.depth, err)
+		}
+		if format := outputPixelFormat(opts); format != tt.format {
+			t.Errorf("%s at %d bits: output pixel format = %s, want %s", tt.codec, tt.depth, format, tt.format)
+		}
+	}
+}
+
+func TestEncoderInfo(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want EncoderInfo
+	}{
+		{[]string{"-f", "rawvideo", "-i", "pipe:0", "-c:v", "libx264", "out.m3u8"}, EncoderInfo{Codec: "libx264"}},
+		{[]string{"-i", "pipe:0", "-vcodec", "h264_nvenc", "out.m3u8"}, EncoderInfo{Codec: "h264_nvenc", HardwareAccelerated: true}},
+		// A decoder of an input isn't the encoder
+		{[]string{"-c:v", "h264_qsv", "-i", "in.mp4", "-codec:v", "hevc_vaapi", "out.m3u8"}, EncoderInfo{Codec: "hevc_vaapi", HardwareAccelerated: true}},
+		{[]string{"-c:v", "h264_cuvid", "-i", "in.mp4", "out.m3u8"}, EncoderInfo{}},
+		{[]string{"-c:v"}, EncoderInfo{}},
+	} {
+		if got := encoderInfo(tc.args); got != tc.want {
+			t.Errorf("encoderInfo(%q) = %+v, want %+v", tc.args, got, tc.want)
+		}
+	}
+
+	e, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := e.EncoderInfo(); info != (EncoderInfo{}) {
+		t.Errorf("EncoderInfo before Start = %+v", info)
+	}
+}
+
+func TestEncoderInfoPreserveAlpha(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.InputPixelFormat = PixelFormatRGBA
+	opts.PreserveAlpha = true
+	opts.Outputs = []OutputSpec{
+		{Format: "webm", Path: filepath.Join(t.TempDir(), "alpha.webm")},
+		{Format: "mov", Path: filepath.Join(t.TempDir(), "alpha.mov")},
+	}
+	// The helper is passed the arguments ffmpeg would be started with
+	opts.CommandFactory = func(outputDir string, opts Options) *exec.Cmd {
+		cmd := helperCommand(outputDir, opts)
+		cmd.Args = append(append(cmd.Args, "--"), buildFFmpegArgs(outputDir, opts, false)...)
+		return cmd
+	}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	// The alpha outputs come after the HLS stream with codecs of their own
+	if info := e.EncoderInfo(); info.Codec != "libx264" || info.HardwareAccelerated {
+		t.Errorf("EncoderInfo = %+v, want the HLS stream's libx264", info)
+	}
+}
+
+func TestSegmentArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		apply func(*Options)
+		want  []string
+	}{
+		{"whole seconds", func(o *Options) { o.SegmentDuration = 4 }, []string{"-hls_time 4 "}},
+		{"sub-second time", func(o *Options) { o.SegmentDuration, o.SegmentTime = 4, 1500*time.Millisecond }, []string{"-hls_time 1.5 "}},
+		{"muxer options and size cap", func(o *Options) {
+			o.SegmentOptions = "mpegts_flags=+initial_discontinuity"
+			o.MaxSegmentSize = 1 << 20
+		}, []string{"-hls_segment_options mpegts_flags=+initial_discontinuity ", "-hls_segment_size 1048576 "}},
+	} {
+		opts := DefaultOptions()
+		tc.apply(&opts)
+		args := strings.Join(buildFFmpegArgs(t.TempDir(), opts, false), " ")
+		for _, want := range tc.want {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s: args %q don't contain %q", tc.name, args, want)
+			}
+		}
+	}
+
+	for i, bad := range []func(*Options){
+		func(o *Options) { o.SegmentDuration = -1 },
+		func(o *Options) { o.SegmentTime = -time.Second },
+		func(o *Options) { o.MaxSegmentSize = -1 },
+	} {
+		opts := DefaultOptions()
+		bad(&opts)
+		if _, err := New(opts); err == nil {
+			t.Errorf("invalid segment options %d accepted", i)
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	base := []string{"PATH=/usr/bin", "LD_LIBRARY_PATH=/opt/old", "HOME=/root"}
+	extra := map[string]string{"LD_LIBRARY_PATH": "/opt/cuda/lib64", "CUDA_VISIBLE_DEVICES": "1"}
+	want := "PATH=/usr/bin HOME=/root CUDA_VISIBLE_DEVICES=1 LD_LIBRARY_PATH=/opt/cuda/lib64"
+	if env := strings.Join(buildEnv(base, extra), " "); env != want {
+		t.Errorf("buildEnv = %q, want %q", env, want)
+	}
+	if env := buildEnv(base, nil); strings.Join(env, " ") != strings.Join(base, " ") {
+		t.Errorf("buildEnv without extra = %q, want %q", env, base)
+	}
+}
+
+func TestStrftimeSegmentArgs(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.StrftimeSegments = true
+	opts = opts.withDefaults()
+	want := "-strftime 1 -hls_segment_filename " + dir + "/" + defaultStrftimeSegmentFilename + " "
+	if args := strings.Join(buildFFmpegArgs(dir, opts, false), " "); !strings.Contains(args, want) {
+		t.Errorf("args %q don't contain %q", args, want)
+	}
+
+	opts.SegmentFilename = "cam-%Y%m%d-%H%M%S.ts"
+	if args := strings.Join(buildFFmpegArgs(dir, opts, false), " "); !strings.Contains(args, dir+"/cam-%Y%m%d-%H%M%S.ts ") {
+		t.Errorf("args %q don't use the segment filename", args)
+	}
+
+	for _, name := range []string{"../cam-%s.ts", `sub\cam.ts`, ".."} {
+		opts.SegmentFilename = name
+		if _, err := New(opts); err == nil {
+			t.Errorf("segment filename %q outside the output directory accepted", name)
+		}
+	}
+}
+
+func TestThreadsArgs(t *testing.T) {
+	opts := DefaultOptions()
+	if args := strings.Join(videoCodecArgs(opts), " "); strings.Contains(args, "-threads") {
+		t.Errorf("args %q limit threads by default", args)
+	}
+	opts.Threads = 2
+	if args := strings.Join(videoCodecArgs(opts), " "); !strings.HasSuffix(args, "-threads 2") {
+		t.Errorf("args %q don't end with -threads 2", args)
+	}
+
+	opts.Threads = -1
+	if _, err := New(opts); err == nil {
+		t.Error("negative thread count accepted")
+	}
+}
+
+func TestRecordPathArgs(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.RecordPath = filepath.Join(dir, "record.mp4")
+	args := buildFFmpegArgs(dir, opts, false)
+	joined := strings.Join(args, " ")
+	if want := "-f mp4 -movflags +faststart " + opts.RecordPath; !strings.HasSuffix(joined, want) {
+		t.Errorf("args %q don't end with %q", joined, want)
+	}
+	// The recording is encoded apart from the HLS stream
+	if n := strings.Count(joined, "-c:v "+opts.Codec); n != 2 {
+		t.Errorf("args %q encode %d times, want 2", joined, n)
+	}
+
+	// With other outputs the tee muxer writes it from a single encode
+	opts.Outputs = []OutputSpec{{Format: "flv", Path: "rtmp://host/app/key"}}
+	args = buildFFmpegArgs(dir, opts, false)
+	joined = strings.Join(args, " ")
+	if n := strings.Count(joined, "-c:v "); n != 1 || !strings.Contains(args[len(args)-1], "[f=mp4:movflags=+faststart]"+opts.RecordPath) {
+		t.Errorf("args %q don't tee the recording from one encode", joined)
+	}
+}
+
+func TestColorRangeArgs(t *testing.T) {
+	opts := DefaultOptions()
+	if args := strings.Join(videoCodecArgs(opts), " "); strings.Contains(args, "range") {
+		t.Errorf("args %q set a color range by default", args)
+	}
+
+	for _, tc := range []struct {
+		colorRange ColorRange
+		tag        string
+	}{
+		{ColorRangeFull, "pc"},
+		{ColorRangeLimited, "tv"},
+	} {
+		opts.ColorRange = tc.colorRange
+		args := strings.Join(videoCodecArgs(opts), " ")
+		for _, want := range []string{
+			fmt.Sprintf("scale=in_range=%s:out_range=%s", tc.colorRange, tc.colorRange),
+			"-color_range " + tc.tag,
+		} {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s args %q don't contain %q", tc.colorRange, args, want)
+			}
+		}
+	}
+
+	opts.ColorRange = "jpeg"
+	if _, err := New(opts); err == nil {
+		t.Error("unknown color range accepted")
+	}
+}
+
+func TestModifyArgs(t *testing.T) {
+	// ffmpeg on the PATH is the test binary, run as the helper
+	bin := t.TempDir()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(exe, filepath.Join(bin, "ffmpeg")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Env = map[string]string{"NIMSFOREST_HELPER_PROCESS": "1"}
+	var built []string
+	opts.ModifyArgs = func(args []string) []string {
+		built = args
+		modified := []string{"-test.run=^TestHelperProcess$", "--"}
+		for _, arg := range args {
+			if arg == "libx264" {
+				arg = "libx265"
+			}
+			modified = append(modified, arg)
+		}
+		return modified
+	}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	if !strings.Contains(strings.Join(built, " "), "-c:v libx264") {
+		t.Errorf("ModifyArgs got %q, not the built arguments", built)
+	}
+	// ffmpeg is started with the modified arguments
+	if info := e.EncoderInfo(); info.Codec != "libx265" {
+		t.Errorf("EncoderInfo = %+v, want libx265 from the modified arguments", info)
+	}
+}
+
+func TestTargetQuality(t *testing.T) {
+	for _, tc := range []struct {
+		codec   string
+		quality int
+		crf     int
+	}{
+		{"libx264", 55, 23},
+		{"libx264", 100, 0},
+		{"libx265", 1, 50},
+		{"libvpx-vp9", 55, 28},
+		{"libsvtav1", 100, 0},
+	} {
+		opts := DefaultOptions()
+		opts.Codec = tc.codec
+		opts.TargetQuality = tc.quality
+		want := fmt.Sprintf("-crf %d", tc.crf)
+		if args := strings.Join(videoCodecArgs(opts), " "); !strings.Contains(args, want) {
+			t.Errorf("%s at quality %d: args %q don't contain %q", tc.codec, tc.quality, args, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		codec   string
+		quality int
+	}{
+		{"libx264", -1},
+		{"libx264", 101},
+		{"h264_nvenc", 50},
+	} {
+		opts := DefaultOptions()
+		opts.Codec = tc.codec
+		opts.TargetQuality = tc.quality
+		if _, err := New(opts); err == nil {
+			t.Errorf("%s at quality %d accepted", tc.codec, tc.quality)
+		}
+	}
+}
+
+func TestDeleteThresholdArgs(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DeleteThreshold = 3
+	if args := strings.Join(buildFFmpegArgs(t.TempDir(), opts, false), " "); !strings.Contains(args, "-hls_delete_threshold 3 ") {
+		t.Errorf("args %q don't contain -hls_delete_threshold 3", args)
+	}
+
+	// Nothing is deleted from an event playlist or a single file
+	opts.PlaylistType = PlaylistTypeEvent
+	if _, err := New(opts); err == nil {
+		t.Error("delete threshold with an event playlist accepted")
+	}
+	opts.PlaylistType = PlaylistTypeLive
+	opts.SingleFile = true
+	if _, err := New(opts); err == nil {
+		t.Error("delete threshold with a single file accepted")
+	}
+
+	opts.SingleFile = false
+	opts.DeleteThreshold = -1
+	if _, err := New(opts); err == nil {
+		t.Error("negative delete threshold accepted")
+	}
+}
+
+func TestForceKeyFramesArgs(t *testing.T) {
+	opts := DefaultOptions()
+	if args := strings.Join(videoCodecArgs(opts), " "); strings.Contains(args, "-force_key_frames") {
+		t.Errorf("args %q force keyframes by default", args)
+	}
+	opts.ForceKeyFrames = "expr:gte(t,n_forced*1)"
+	if args := strings.Join(videoCodecArgs(opts), " "); !strings.Contains(args, "-force_key_frames expr:gte(t,n_forced*1)") {
+		t.Errorf("args %q don't force the keyframes", args)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	// Without ffmpeg the plan is still returned
+	t.Setenv("PATH", t.TempDir())
+
+	opts := DefaultOptions()
+	opts.Port = 8080
+	opts.ModifyArgs = func(args []string) []string {
+		return append(args, "-loglevel", "debug")
+	}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := e.DryRun()
+	if err == nil {
+		t.Error("DryRun without ffmpeg succeeded")
+	}
+	if plan.Listen != ":8080" || plan.Options.Codec != "libx264" {
+		t.Errorf("plan = %+v", plan)
+	}
+	args := strings.Join(plan.Args, " ")
+	if !strings.HasPrefix(args, "ffmpeg ") || !strings.HasSuffix(args, " -loglevel debug") || !strings.Contains(args, plan.OutputDir) {
+		t.Errorf("plan args %q aren't the modified ffmpeg command writing to %s", args, plan.OutputDir)
+	}
+	if e.URL() != "" {
+		t.Errorf("DryRun started the encoder at %s", e.URL())
+	}
+
+	opts.Port = 0
+	opts.UnixSocket = "/run/hls.sock"
+	if e, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	if plan, _ := e.DryRun(); plan.Listen != opts.UnixSocket {
+		t.Errorf("plan listens on %q, want %q", plan.Listen, opts.UnixSocket)
+	}
+}
@@ -0,0 +1,343 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// convertFrame applies the configured transforms to img and converts it to
+// raw bytes in the input pixel format. A frame that can't be converted,
+// including a nil image or one whose methods panic, is reported as an error
+// rather than taking down the frame goroutine.
+func (e *Encoder) convertFrame(img image.Image, buf []byte) (err error) {
+	defer recoverFrame(img, &err)
+
+	img, err = e.prepareFrame(img)
+	if err != nil {
+		return err
+	}
+
+	switch e.opts.InputPixelFormat {
+	case PixelFormatNV12:
+		return e.frameToNV12(img, buf)
+	case PixelFormatRGBA64:
+		return e.frameToRGBA64(img, buf)
+	case PixelFormatGray:
+		return e.frameToGray(img, buf)
+	case PixelFormatYUV422P:
+		return e.frameToYUVPlanar(img, buf, image.YCbCrSubsampleRatio422)
+	case PixelFormatYUV444P:
+		return e.frameToYUVPlanar(img, buf, image.YCbCrSubsampleRatio444)
+	default:
+		return e.frameToRGBA(img, buf)
+	}
+}
+
+// ValidateFrame checks that img would be accepted for encoding, after
+// applying the configured transforms, so producers can check a sample frame
+// before streaming. A size mismatch is reported as a *FrameSizeError.
+func (e *Encoder) ValidateFrame(img image.Image) (err error) {
+	defer recoverFrame(img, &err)
+
+	_, err = e.prepareFrame(img)
+	return err
+}
+
+// prepareFrame unwraps a TimedFrame, applies the configured transforms and
+// validates the size of the result.
+func (e *Encoder) prepareFrame(img image.Image) (image.Image, error) {
+	if tf, ok := img.(TimedFrame); ok {
+		img = tf.Image
+	}
+	if img == nil {
+		return nil, fmt.Errorf("nil frame")
+	}
+
+	for _, t := range e.opts.Transforms {
+		img = t.Apply(img)
+	}
+
+	if err := e.validateFrameSize(img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// recoverFrame turns a panic while handling img into an error in *err.
+// It must be deferred directly.
+func recoverFrame(img image.Image, err *error) {
+	if r := recover(); r != nil {
+		// E.g. a typed nil *image.RGBA
+		*err = fmt.Errorf("invalid frame %T: %v", img, r)
+	}
+}
+
+// blackFrame returns a black frame in the input pixel format.
+func blackFrame(opts Options) []byte {
+	buf := make([]byte, opts.frameSize())
+	switch opts.InputPixelFormat {
+	case PixelFormatNV12:
+		// Y is already 0, chroma is neutral at 128
+		for i := opts.Width * opts.Height; i < len(buf); i++ {
+			buf[i] = 128
+		}
+	case PixelFormatRGBA64:
+		// Opaque black, big-endian 16-bit alpha
+		for i := 6; i < len(buf); i += 8 {
+			buf[i], buf[i+1] = 255, 255
+		}
+	case PixelFormatGray:
+		// Already black
+	case PixelFormatYUV422P, PixelFormatYUV444P:
+		// Y is already 0, the chroma planes are neutral at 128
+		for i := opts.Width * opts.Height; i < len(buf); i++ {
+			buf[i] = 128
+		}
+	default:
+		// Opaque black
+		for i := 3; i < len(buf); i += 4 {
+			buf[i] = 255
+		}
+	}
+	return buf
+}
+
+// validateFrameSize checks that img has the configured dimensions.
+func (e *Encoder) validateFrameSize(img image.Image) error {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	if bounds.Empty() {
+		return fmt.Errorf("empty frame with bounds %v", bounds)
+	}
+	if width != e.opts.Width || height != e.opts.Height {
+		return &FrameSizeError{
+			Width:          width,
+			Height:         height,
+			ExpectedWidth:  e.opts.Width,
+			ExpectedHeight: e.opts.Height,
+		}
+	}
+	return nil
+}
+
+// frameToRGBA converts an image.Image to raw RGBA bytes.
+func (e *Encoder) frameToRGBA(img image.Image, buf []byte) error {
+	// Validate dimensions
+	if err := e.validateFrameSize(img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// Convert straight into buf
+	dst := &image.RGBA{Pix: buf, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+
+	switch src := img.(type) {
+	case *image.RGBA:
+		// Copy rows to drop any stride padding
+		for y := 0; y < height; y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], src.Pix[i:i+width*4])
+		}
+		return nil
+	}
+
+	draw.Draw(dst, dst.Rect, img, bounds.Min, draw.Src)
+	return nil
+}
+
+// frameToRGBA64 converts an image.Image to raw 16-bit big-endian RGBA bytes.
+func (e *Encoder) frameToRGBA64(img image.Image, buf []byte) error {
+	// Validate dimensions
+	if err := e.validateFrameSize(img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	// *image.RGBA64 already stores big-endian samples
+	if rgba, ok := img.(*image.RGBA64); ok && rgba.Stride == width*8 {
+		copy(buf, rgba.Pix)
+		return nil
+	}
+
+	// Convert to RGBA64
+	rgba := image.NewRGBA64(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	copy(buf, rgba.Pix)
+
+	return nil
+}
+
+// frameToNV12 converts an image.Image to raw NV12 bytes: the Y plane followed
+// by the interleaved CbCr plane.
+func (e *Encoder) frameToNV12(img image.Image, buf []byte) error {
+	// Validate dimensions
+	if err := e.validateFrameSize(img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	yPlane := buf[:width*height]
+	uvPlane := buf[width*height:]
+
+	switch src := img.(type) {
+	case *NV12:
+		// Copy planes row by row to drop any stride padding
+		for y := 0; y < height; y++ {
+			i := src.YOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(yPlane[y*width:(y+1)*width], src.Y[i:i+width])
+		}
+		for y := 0; y < height/2; y++ {
+			i := src.UVOffset(bounds.Min.X, bounds.Min.Y+2*y)
+			copy(uvPlane[y*width:(y+1)*width], src.UV[i:i+width])
+		}
+		return nil
+
+	case *image.YCbCr:
+		if src.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+			// Same samples, only the chroma planes need interleaving
+			for y := 0; y < height; y++ {
+				i := src.YOffset(bounds.Min.X, bounds.Min.Y+y)
+				copy(yPlane[y*width:(y+1)*width], src.Y[i:i+width])
+			}
+			for y := 0; y < height/2; y++ {
+				row := uvPlane[y*width : (y+1)*width]
+				for x := 0; x < width/2; x++ {
+					ci := src.COffset(bounds.Min.X+2*x, bounds.Min.Y+2*y)
+					row[2*x] = src.Cb[ci]
+					row[2*x+1] = src.Cr[ci]
+				}
+			}
+			return nil
+		}
+	}
+
+	// Convert pixel by pixel, taking chroma from the top-left pixel of
+	// each 2x2 block
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.YCbCrModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.YCbCr)
+			yPlane[y*width+x] = c.Y
+			if x%2 == 0 && y%2 == 0 {
+				i := (y/2)*width + x
+				uvPlane[i] = c.Cb
+				uvPlane[i+1] = c.Cr
+			}
+		}
+	}
+
+	return nil
+}
+
+// frameToGray converts an image.Image to raw 8-bit gray bytes.
+func (e *Encoder) frameToGray(img image.Image, buf []byte) error {
+	// Validate dimensions
+	if err := e.validateFrameSize(img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	if gray, ok := img.(*image.Gray); ok && gray.Stride == width {
+		copy(buf, gray.Pix)
+		return nil
+	}
+
+	// Convert to Gray
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	copy(buf, gray.Pix)
+
+	return nil
+}
+
+// frameToYUVPlanar converts an image.Image to raw planar YUV bytes with the
+// given chroma subsampling, 4:2:2 or 4:4:4: the Y plane followed by the Cb
+// and Cr planes.
+func (e *Encoder) frameToYUVPlanar(img image.Image, buf []byte, ratio image.YCbCrSubsampleRatio) error {
+	// Validate dimensions
+	if err := e.validateFrameSize(img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+	chromaWidth := width
+	if ratio == image.YCbCrSubsampleRatio422 {
+		chromaWidth = width / 2
+	}
+	yPlane := buf[:width*height]
+	cbPlane := buf[width*height : width*height+chromaWidth*height]
+	crPlane := buf[width*height+chromaWidth*height:]
+
+	if src, ok := img.(*image.YCbCr); ok && src.SubsampleRatio == ratio {
+		// Copy planes row by row to drop any stride padding
+		for y := 0; y < height; y++ {
+			i := src.YOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(yPlane[y*width:(y+1)*width], src.Y[i:i+width])
+			ci := src.COffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(cbPlane[y*chromaWidth:(y+1)*chromaWidth], src.Cb[ci:ci+chromaWidth])
+			copy(crPlane[y*chromaWidth:(y+1)*chromaWidth], src.Cr[ci:ci+chromaWidth])
+		}
+		return nil
+	}
+
+	// Convert pixel by pixel, taking 4:2:2 chroma from the left pixel of
+	// each pair
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.YCbCrModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.YCbCr)
+			yPlane[y*width+x] = c.Y
+			if chromaWidth == width || x%2 == 0 {
+				i := y*chromaWidth + x*chromaWidth/width
+				cbPlane[i] = c.Cb
+				crPlane[i] = c.Cr
+			}
+		}
+	}
+
+	return nil
+}
+
+// detectPixelFormat returns the input pixel format that img can be passed
+// to ffmpeg in without conversion, if any.
+func detectPixelFormat(img image.Image) (PixelFormat, bool) {
+	if tf, ok := img.(TimedFrame); ok {
+		img = tf.Image
+	}
+
+	switch src := img.(type) {
+	case *image.RGBA, *image.NRGBA:
+		return PixelFormatRGBA, true
+	case *image.RGBA64:
+		return PixelFormatRGBA64, true
+	case *NV12:
+		return PixelFormatNV12, true
+	case *image.Gray:
+		return PixelFormatGray, true
+	case *image.YCbCr:
+		switch src.SubsampleRatio {
+		case image.YCbCrSubsampleRatio420:
+			return PixelFormatNV12, true
+		case image.YCbCrSubsampleRatio422:
+			return PixelFormatYUV422P, true
+		case image.YCbCrSubsampleRatio444:
+			return PixelFormatYUV444P, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,301 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"math/rand"
+	"testing"
+)
+
+// randomImage returns an image of kind filled with random pixels, with
+// bounds at a random origin and, if sub is set, cut out of a larger image
+// so its stride exceeds its width.
+func randomImage(rng *rand.Rand, kind, width, height int, sub bool) image.Image {
+	origin := image.Pt(rng.Intn(64)-32, rng.Intn(64)-32)
+	if kind == kindYCbCr {
+		// image.YCbCr doesn't support negative coordinates
+		origin = image.Pt(rng.Intn(32)+4, rng.Intn(32)+4)
+	}
+	r := image.Rect(0, 0, width, height).Add(origin)
+	outer := r
+	if sub {
+		outer = image.Rect(r.Min.X-rng.Intn(5), r.Min.Y-rng.Intn(5), r.Max.X+rng.Intn(5), r.Max.Y+rng.Intn(5))
+	}
+
+	var img interface {
+		image.Image
+		SubImage(image.Rectangle) image.Image
+	}
+	var fill func(x, y int)
+	switch kind {
+	case 0:
+		m := image.NewRGBA(outer)
+		rng.Read(m.Pix)
+		img = m
+	case 1:
+		m := image.NewNRGBA(outer)
+		rng.Read(m.Pix)
+		img = m
+	case 2:
+		m := image.NewRGBA64(outer)
+		rng.Read(m.Pix)
+		img = m
+	case 3:
+		m := image.NewNRGBA64(outer)
+		rng.Read(m.Pix)
+		img = m
+	case 4:
+		m := image.NewGray(outer)
+		rng.Read(m.Pix)
+		img = m
+	case 5:
+		m := image.NewGray16(outer)
+		rng.Read(m.Pix)
+		img = m
+	case kindYCbCr:
+		ratios := []image.YCbCrSubsampleRatio{
+			image.YCbCrSubsampleRatio420,
+			image.YCbCrSubsampleRatio422,
+			image.YCbCrSubsampleRatio444,
+		}
+		m := image.NewYCbCr(outer, ratios[rng.Intn(len(ratios))])
+		rng.Read(m.Y)
+		rng.Read(m.Cb)
+		rng.Read(m.Cr)
+		img = m
+	case 7:
+		m := image.NewPaletted(outer, palette.Plan9)
+		fill = func(x, y int) { m.SetColorIndex(x, y, uint8(rng.Intn(len(m.Palette)))) }
+		img = m
+	case 8:
+		m := image.NewAlpha(outer)
+		rng.Read(m.Pix)
+		img = m
+	default:
+		m := image.NewCMYK(outer)
+		rng.Read(m.Pix)
+		img = m
+	}
+	if fill != nil {
+		for y := outer.Min.Y; y < outer.Max.Y; y++ {
+			for x := outer.Min.X; x < outer.Max.X; x++ {
+				fill(x, y)
+			}
+		}
+	}
+	if !sub {
+		return img
+	}
+	return img.SubImage(r)
+}
+
+const (
+	// imageKinds is the number of kinds randomImage draws
+	imageKinds = 10
+
+	// kindYCbCr is the kind of *image.YCbCr
+	kindYCbCr = 6
+)
+
+// referenceRGBA converts img to RGBA bytes pixel by pixel.
+func referenceRGBA(img image.Image) []byte {
+	b := img.Bounds()
+	out := make([]byte, 0, b.Dx()*b.Dy()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			out = append(out, c.R, c.G, c.B, c.A)
+		}
+	}
+	return out
+}
+
+// checkFrameToRGBA converts img and compares the result with referenceRGBA.
+func checkFrameToRGBA(t *testing.T, img image.Image) {
+	t.Helper()
+
+	b := img.Bounds()
+	e := &Encoder{opts: Options{Width: b.Dx(), Height: b.Dy()}}
+	buf := make([]byte, b.Dx()*b.Dy()*4)
+	// Stale data from the previous frame must be overwritten
+	for i := range buf {
+		buf[i] = 0xaa
+	}
+	if err := e.frameToRGBA(img, buf); err != nil {
+		t.Fatalf("%T %v: %v", img, b, err)
+	}
+
+	want := referenceRGBA(img)
+	if !bytes.Equal(buf, want) {
+		for i := range buf {
+			if buf[i] != want[i] {
+				p := i / 4
+				t.Fatalf("%T %v: pixel (%d, %d) is %v, want %v", img, b,
+					p%b.Dx(), p/b.Dx(), buf[p*4:p*4+4], want[p*4:p*4+4])
+			}
+		}
+	}
+}
+
+func TestFrameToRGBA(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		kind := i % imageKinds
+		width, height := 1+rng.Intn(33), 1+rng.Intn(33)
+		sub := rng.Intn(2) == 0
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			checkFrameToRGBA(t, randomImage(rng, kind, width, height, sub))
+		})
+	}
+}
+
+func FuzzFrameToRGBA(f *testing.F) {
+	f.Add(int64(0), uint8(0), uint8(16), uint8(9), false)
+	f.Add(int64(1), uint8(6), uint8(3), uint8(5), true)
+	f.Add(int64(2), uint8(7), uint8(1), uint8(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, kind, width, height uint8, sub bool) {
+		if width == 0 || height == 0 {
+			t.Skip()
+		}
+		rng := rand.New(rand.NewSource(seed))
+		img := randomImage(rng, int(kind)%imageKinds, int(width%64)+1, int(height%64)+1, sub)
+		checkFrameToRGBA(t, img)
+	})
+}
+
+// referenceNV12 converts img to NV12 bytes pixel by pixel, with the chroma
+// of the top-left pixel of each 2x2 block.
+func referenceNV12(img image.Image) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]byte, w*h*3/2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.YCbCrModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.YCbCr)
+			out[y*w+x] = c.Y
+			if x%2 == 0 && y%2 == 0 {
+				out[w*h+(y/2)*w+x] = c.Cb
+				out[w*h+(y/2)*w+x+1] = c.Cr
+			}
+		}
+	}
+	return out
+}
+
+func TestFrameToNV12(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 60; i++ {
+		width, height := 2*(1+rng.Intn(16)), 2*(1+rng.Intn(16))
+		origin := image.Pt(2*rng.Intn(8), 2*rng.Intn(8))
+		r := image.Rect(0, 0, width, height).Add(origin)
+		// Padded rows, as capture buffers often have
+		outer := image.Rect(0, 0, width+2*rng.Intn(3), height+2*rng.Intn(3)).Add(origin)
+
+		var img image.Image
+		switch i % 3 {
+		case 0:
+			m := NewNV12(outer)
+			rng.Read(m.Y)
+			rng.Read(m.UV)
+			m.Rect = r
+			img = m
+		case 1:
+			m := image.NewYCbCr(outer, image.YCbCrSubsampleRatio420)
+			rng.Read(m.Y)
+			rng.Read(m.Cb)
+			rng.Read(m.Cr)
+			img = m.SubImage(r)
+		default:
+			img = randomImage(rng, 0, width, height, true)
+		}
+
+		e := &Encoder{opts: Options{Width: width, Height: height, InputPixelFormat: PixelFormatNV12}}
+		buf := make([]byte, width*height*3/2)
+		for j := range buf {
+			buf[j] = 0xaa
+		}
+		if err := e.frameToNV12(img, buf); err != nil {
+			t.Fatalf("%T %v: %v", img, r, err)
+		}
+		if want := referenceNV12(img); !bytes.Equal(buf, want) {
+			t.Errorf("%T %v: NV12 bytes differ from the pixel by pixel conversion", img, r)
+		}
+	}
+}
+
+func TestValidateFrame(t *testing.T) {
+	e := &Encoder{opts: Options{Width: 4, Height: 2}}
+	valid := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for _, img := range []image.Image{valid, TimedFrame{Image: valid}, image.NewGray(image.Rect(10, 10, 14, 12))} {
+		if err := e.ValidateFrame(img); err != nil {
+			t.Errorf("ValidateFrame(%T) = %v", img, err)
+		}
+	}
+
+	var sizeErr *FrameSizeError
+	err := e.ValidateFrame(image.NewRGBA(image.Rect(0, 0, 2, 4)))
+	if !errors.As(err, &sizeErr) || *sizeErr != (FrameSizeError{Width: 2, Height: 4, ExpectedWidth: 4, ExpectedHeight: 2}) {
+		t.Errorf("ValidateFrame of a 2x4 frame = %v, want a *FrameSizeError", err)
+	}
+
+	for _, img := range []image.Image{nil, TimedFrame{}, (*image.RGBA)(nil), image.NewRGBA(image.Rectangle{})} {
+		if err := e.ValidateFrame(img); err == nil {
+			t.Errorf("ValidateFrame(%T) accepted", img)
+		}
+	}
+}
+
+func TestDetectPixelFormat(t *testing.T) {
+	r := image.Rect(0, 0, 4, 2)
+	for _, tc := range []struct {
+		img    image.Image
+		format PixelFormat
+	}{
+		{image.NewRGBA(r), PixelFormatRGBA},
+		{image.NewNRGBA(r), PixelFormatRGBA},
+		{image.NewRGBA64(r), PixelFormatRGBA64},
+		{NewNV12(r), PixelFormatNV12},
+		{image.NewGray(r), PixelFormatGray},
+		{image.NewYCbCr(r, image.YCbCrSubsampleRatio420), PixelFormatNV12},
+		{image.NewYCbCr(r, image.YCbCrSubsampleRatio422), PixelFormatYUV422P},
+		{image.NewYCbCr(r, image.YCbCrSubsampleRatio444), PixelFormatYUV444P},
+		{TimedFrame{Image: image.NewGray(r)}, PixelFormatGray},
+		// Converted to the configured format instead
+		{image.NewYCbCr(r, image.YCbCrSubsampleRatio410), ""},
+		{image.NewCMYK(r), ""},
+		{image.NewPaletted(r, palette.Plan9), ""},
+	} {
+		format, ok := detectPixelFormat(tc.img)
+		if format != tc.format || ok != (tc.format != "") {
+			t.Errorf("detectPixelFormat(%T) = %q, %v, want %q", tc.img, format, ok, tc.format)
+		}
+	}
+
+	// Start picks the format of the first frame
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.Width, opts.Height = 4, 2
+	opts.AutoPixFmt = true
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan image.Image, 1)
+	frames <- image.NewGray(r)
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	e.mu.Lock()
+	format := e.opts.InputPixelFormat
+	e.mu.Unlock()
+	if format != PixelFormatGray {
+		t.Errorf("input pixel format of a gray first frame = %q, want %q", format, PixelFormatGray)
+	}
+}
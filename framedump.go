@@ -0,0 +1,62 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// frameDumper saves frames as received, before any Transforms or
+// conversion, as PNG files for Options.DumpFramesDir. It is owned by the
+// frame processing goroutine.
+type frameDumper struct {
+	dir   string
+	every int64
+
+	// received counts the frames received so far
+	received int64
+}
+
+// newFrameDumper creates a dumper of every opts.DumpFramesEvery-th frame
+// into opts.DumpFramesDir, creating the directory.
+func newFrameDumper(opts Options) (*frameDumper, error) {
+	if err := os.MkdirAll(opts.DumpFramesDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create frame dump directory: %w", err)
+	}
+	return &frameDumper{dir: opts.DumpFramesDir, every: int64(opts.DumpFramesEvery)}, nil
+}
+
+// add saves frame, the next frame received, if it is due.
+func (d *frameDumper) add(frame image.Image) (err error) {
+	n := d.received
+	d.received++
+	if n%d.every != 0 {
+		return nil
+	}
+
+	defer recoverFrame(frame, &err)
+	if tf, ok := frame.(TimedFrame); ok {
+		frame = tf.Image
+	}
+	if frame == nil {
+		// Dropped as it fails to convert
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, frame); err != nil {
+		return fmt.Errorf("failed to encode frame %d: %w", n, err)
+	}
+	if err := replaceFile(filepath.Join(d.dir, dumpFrameName(n)), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write frame %d: %w", n, err)
+	}
+	return nil
+}
+
+// dumpFrameName returns the file name of received frame n.
+func dumpFrameName(n int64) string {
+	return fmt.Sprintf("frame-%08d.png", n)
+}
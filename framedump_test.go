@@ -0,0 +1,67 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDumpFrames(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "frames")
+	opts := DefaultOptions()
+	opts.Width, opts.Height = 16, 16
+	opts.CommandFactory = helperCommand
+	opts.DumpFramesDir = dir
+	opts.DumpFramesEvery = 2
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pattern := &TestPattern{Width: 16, Height: 16, Kind: PatternCounter}
+	frames := make(chan image.Image, 5)
+	for i := 0; i < 5; i++ {
+		frames <- pattern.Frame(i)
+	}
+	close(frames)
+	if _, err := e.Start(context.Background(), frames); err != nil {
+		t.Fatal(err)
+	}
+	<-e.Done()
+	e.Stop()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"frame-00000000.png", "frame-00000002.png", "frame-00000004.png"}; !slices.Equal(names, want) {
+		t.Fatalf("dumped %v, want %v", names, want)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "frame-00000002.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pattern.Frame(2)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if got := color.RGBAModel.Convert(img.At(x, y)); got != want.RGBAAt(x, y) {
+				t.Fatalf("dumped frame pixel (%d, %d) = %v, want %v", x, y, got, want.RGBAAt(x, y))
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package nimsforestencoder
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyPercentiles summarizes a latency distribution. Values are the upper
+// bounds of histogram buckets that double in size, so they overestimate by
+// up to a factor of two. Encoded in JSON as nanoseconds.
+type LatencyPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+}
+
+// Latency histogram buckets: the first covers up to histogramBase, each
+// following one twice as much as the previous, and the last everything
+// above.
+const (
+	histogramBase    = 16 * time.Microsecond
+	histogramBuckets = 24
+)
+
+// latencyHistogram is a lock-free histogram of durations with
+// exponentially sized buckets, cheap enough to update for every frame.
+type latencyHistogram struct {
+	buckets [histogramBuckets]atomic.Uint64
+}
+
+// observe records d.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for bound := histogramBase; d > bound && i < histogramBuckets-1; bound *= 2 {
+		i++
+	}
+	h.buckets[i].Add(1)
+}
+
+// percentiles returns the 50th, 95th and 99th percentiles of the recorded
+// durations, or zero values if there are none.
+func (h *latencyHistogram) percentiles() LatencyPercentiles {
+	var counts [histogramBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return LatencyPercentiles{}
+	}
+
+	quantile := func(q float64) time.Duration {
+		rank := uint64(q * float64(total))
+		var seen uint64
+		bound := histogramBase
+		for i, n := range counts {
+			seen += n
+			if seen > rank || i == histogramBuckets-1 {
+				break
+			}
+			bound *= 2
+		}
+		return bound
+	}
+
+	return LatencyPercentiles{
+		P50: quantile(0.50),
+		P95: quantile(0.95),
+		P99: quantile(0.99),
+	}
+}
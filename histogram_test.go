@@ -0,0 +1,37 @@
+package nimsforestencoder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	if p := h.percentiles(); p != (LatencyPercentiles{}) {
+		t.Errorf("percentiles of an empty histogram = %+v", p)
+	}
+
+	for _, tc := range []struct {
+		d time.Duration
+		n int
+	}{
+		// Bounds belong to the bucket below them
+		{histogramBase, 50},
+		{100 * time.Microsecond, 45},
+		{time.Millisecond, 4},
+		{time.Hour, 1},
+	} {
+		for i := 0; i < tc.n; i++ {
+			h.observe(tc.d)
+		}
+	}
+	want := LatencyPercentiles{
+		P50: 128 * time.Microsecond,
+		P95: 1024 * time.Microsecond,
+		// The last bucket holds everything above
+		P99: histogramBase << (histogramBuckets - 1),
+	}
+	if p := h.percentiles(); p != want {
+		t.Errorf("percentiles = %+v, want %+v", p, want)
+	}
+}
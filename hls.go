@@ -1,84 +1,543 @@
 package nimsforestencoder
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// playlistName is the name of the HLS playlist ffmpeg writes.
+const playlistName = "stream.m3u8"
+
+// masterPlaylistName is the name of the master playlist served alongside
+// the thumbnails, which HLS image streams are listed in.
+const masterPlaylistName = "master.m3u8"
+
 // hlsServer serves HLS segments over HTTP.
 type hlsServer struct {
 	server     *http.Server
 	listener   net.Listener
+	extra      []net.Listener // Options.ExtraListeners
 	outputDir  string
 	actualPort int
+	fileServer http.Handler
+	opts       Options
+	stats      func() Stats
+	tags       *playlistTags
+	pruner     *segmentPruner // nil without Options.MaxDiskBytes
+	thumbs     *thumbnailer   // nil without Options.ThumbnailInterval
+	iframes    *iframeIndex   // nil without Options.IFramePlaylist
+
+	// clients tracks the clients, counting viewers for
+	// Options.MaxOriginBandwidth
+	clients *clientTracker
+
+	// limiter bounds the segment downloads of each client; nil without
+	// Options.MaxConcurrentPerClient
+	limiter *clientLimiter
+
+	// tls reports whether the server serves HTTPS. Serve modifies the
+	// server's TLS settings, so they aren't read once it runs.
+	tls bool
+
+	// ip is the outbound address advertised in URLs, looked up once as it
+	// takes a UDP dial and URLs are built for every absolute playlist
+	ipOnce sync.Once
+	ip     string
 }
 
-// newHLSServer creates a new HLS HTTP server.
-func newHLSServer(outputDir string, port int) (*hlsServer, error) {
+// newHLSServer creates a new HLS HTTP server. stats provides the encoder
+// statistics for the optional /stats.json endpoint, tags the custom tags
+// inserted into the served playlist and pruner, if not nil, the segments
+// dropped from it. thumbs, if not nil, adds the thumbnails to the master
+// playlist. c times bind retries, which end early once ctx is done.
+func newHLSServer(ctx context.Context, outputDir string, opts Options, c clock, stats func() Stats, tags *playlistTags, pruner *segmentPruner, thumbs *thumbnailer) (*hlsServer, error) {
 	// Create listener first to get actual port if port is 0
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := listen(ctx, opts, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create listener: %w", err)
 	}
 
 	// Get the actual port assigned
-	actualPort := listener.Addr().(*net.TCPAddr).Port
+	var actualPort int
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		actualPort = addr.Port
+	}
+
+	var extra []net.Listener
+	for _, addr := range opts.ExtraListeners {
+		l, err := listenRetrying(ctx, "tcp", addr, opts, c)
+		if err != nil {
+			listener.Close()
+			for _, l := range extra {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to create listener on %s: %w", addr, err)
+		}
+		extra = append(extra, l)
+	}
+
+	h := &hlsServer{
+		listener:   listener,
+		extra:      extra,
+		outputDir:  outputDir,
+		actualPort: actualPort,
+		fileServer: http.FileServer(http.Dir(outputDir)),
+		opts:       opts,
+		stats:      stats,
+		tags:       tags,
+		pruner:     pruner,
+		thumbs:     thumbs,
+		// Viewers fetch a segment at least once per segment duration
+		clients: newClientTracker(3*opts.segmentDuration(), c),
+	}
+	if opts.IFramePlaylist {
+		h.iframes = newIFrameIndex(outputDir)
+	}
+	if opts.MaxConcurrentPerClient > 0 {
+		h.limiter = newClientLimiter(opts.MaxConcurrentPerClient)
+	}
 
-	// Create file server for the output directory
 	mux := http.NewServeMux()
+	mux.HandleFunc("/segments.json", h.serveSegmentList)
+	if opts.EnableStatsEndpoint {
+		mux.HandleFunc("/stats.json", h.serveStats)
+	}
+	mux.HandleFunc("/", h.serveFile)
 
-	// Serve HLS files with proper MIME types
-	fileServer := http.FileServer(http.Dir(outputDir))
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Set appropriate headers for HLS
-		ext := filepath.Ext(r.URL.Path)
-		switch ext {
-		case ".m3u8":
-			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-		case ".ts":
-			w.Header().Set("Content-Type", "video/mp2t")
+	h.server = newHTTPServer(opts.HTTPServer, mux)
+	h.tls = h.server.TLSConfig != nil
+
+	return h, nil
+}
+
+// ServeDir serves the HLS recording in dir, e.g. one made with
+// Options.RecordDir, at http://<host>:<port>/stream.m3u8 until ctx is done,
+// with the headers and endpoints of a live stream. Returns an error if it
+// can't listen on port.
+func ServeDir(ctx context.Context, dir string, port int) error {
+	if port <= 0 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	opts := DefaultOptions()
+	opts.Port = port
+	h, err := newHLSServer(ctx, dir, opts, realClock{}, func() Stats { return Stats{} }, newPlaylistTags(), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HLS server: %w", err)
+	}
+	h.Start(ctx)
+
+	<-ctx.Done()
+	stopCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	return h.Stop(stopCtx)
+}
+
+// newHTTPServer returns a server for handler, configured like tmpl if it is
+// not nil. A server can't serve again once shut down, and an encoder can be
+// started again, so every run gets a fresh copy of the settings. Every
+// exported field is copied, only Handler is replaced; the unexported state
+// holds locks and must not be copied.
+func newHTTPServer(tmpl *http.Server, handler http.Handler) *http.Server {
+	server := &http.Server{}
+	if tmpl != nil {
+		src, dst := reflect.ValueOf(tmpl).Elem(), reflect.ValueOf(server).Elem()
+		for i := 0; i < src.NumField(); i++ {
+			if src.Type().Field(i).IsExported() {
+				dst.Field(i).Set(src.Field(i))
+			}
 		}
+	}
+	server.Handler = handler
+	return server
+}
 
-		// Allow CORS for browser playback
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// listen opens the server's listener: a Unix domain socket if configured,
+// otherwise TCP. An address that is still in use, e.g. a fixed port in
+// TIME_WAIT after a restart, is retried up to BindRetries times, doubling the
+// delay between attempts according to c, until ctx is done.
+func listen(ctx context.Context, opts Options, c clock) (net.Listener, error) {
+	if opts.UnixSocket != "" {
+		return listenRetrying(ctx, "unix", opts.UnixSocket, opts, c)
+	}
+
+	listener, err := listenRetrying(ctx, "tcp", fmt.Sprintf(":%d", opts.Port), opts, c)
+	if errors.Is(err, ErrPortInUse) && opts.PortFallback {
+		return net.Listen("tcp", ":0")
+	}
+	return listener, err
+}
+
+// listenRetrying listens on addr, retrying as configured for listen. A TCP
+// address still in use after the retries is reported as ErrPortInUse. Once
+// ctx is done it stops retrying and returns ctx.Err().
+func listenRetrying(ctx context.Context, network, addr string, opts Options, c clock) (net.Listener, error) {
+	delay := opts.BindRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		listener, err := net.Listen(network, addr)
+		if err == nil || !isAddrInUse(err) {
+			// Other errors, such as a bad address, won't go away
+			return listener, err
+		}
+		if attempt >= opts.BindRetries {
+			if network == "tcp" {
+				return nil, fmt.Errorf("%w: %w", ErrPortInUse, err)
+			}
+			return nil, err
+		}
+
+		if !sleep(ctx, c, delay) {
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// wsaeaddrinuse is the error Windows reports for an address in use, which
+// syscall.EADDRINUSE doesn't match there.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// isAddrInUse reports whether err is from binding an address in use.
+func isAddrInUse(err error) bool {
+	var errno syscall.Errno
+	return errors.Is(err, syscall.EADDRINUSE) ||
+		(runtime.GOOS == "windows" && errors.As(err, &errno) && errno == wsaeaddrinuse)
+}
+
+// defaultMIMETypes are the content types of the files the encoder writes
+// and formats it may serve, by extension. Options.MIMETypes overrides them.
+var defaultMIMETypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".mpd":  "application/dash+xml",
+	".vtt":  "text/vtt",
+	".jpg":  "image/jpeg",
+	".key":  "application/octet-stream",
+	".json": "application/json",
+}
+
+// contentType returns the content type served for files with extension
+// ext, or "" to leave it to the file server.
+func (h *hlsServer) contentType(ext string) string {
+	if typ, ok := h.opts.MIMETypes[ext]; ok {
+		return typ
+	}
+	return defaultMIMETypes[ext]
+}
+
+// serveFile serves HLS files from the output directory with proper MIME types.
+func (h *hlsServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	// Set appropriate headers for HLS
+	ext := filepath.Ext(r.URL.Path)
+	if ext == ".keyinfo" || strings.HasPrefix(filepath.Base(r.URL.Path), keyInfoName) {
+		// Internal to ffmpeg, contains local paths, as does its temporary
+		// copy while the key rotates
+		http.NotFound(w, r)
+		return
+	}
+	if h.limiter != nil && isSegmentFile(r.URL.Path) {
+		addr := clientAddr(r)
+		if !h.limiter.acquire(addr) {
+			h.setStreamHeaders(w)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent segment downloads", http.StatusTooManyRequests)
+			return
+		}
+		defer h.limiter.release(addr)
+	}
+	if typ := h.contentType(ext); typ != "" {
+		w.Header().Set("Content-Type", typ)
+	}
+
+	h.setStreamHeaders(w)
+	for name, value := range h.opts.ResponseHeaders[ext] {
+		w.Header().Set(name, value)
+	}
 
-		// Disable caching for live stream
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		w.Header().Set("Pragma", "no-cache")
-		w.Header().Set("Expires", "0")
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() { h.clients.served(r, cw.n) }()
+	w = cw
 
-		fileServer.ServeHTTP(w, r)
+	// Compress text playlists for clients that accept it
+	if isCompressibleExt(ext) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			// Byte ranges would refer to the uncompressed file
+			r.Header.Del("Range")
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+			w = gw
+		}
+	}
+
+	if r.URL.Path == "/"+playlistName {
+		h.servePlaylist(w, r)
+		return
+	}
+	if r.URL.Path == "/"+masterPlaylistName && (h.thumbs != nil || h.iframes != nil) {
+		h.serveMasterPlaylist(w, r)
+		return
+	}
+	if r.URL.Path == "/"+iframesPlaylistName && h.iframes != nil {
+		h.serveIFramePlaylist(w, r)
+		return
+	}
+	h.fileServer.ServeHTTP(w, r)
+}
+
+// servePlaylist serves the playlist with the custom tags inserted, pruned
+// segments dropped and, if configured, absolute segment URLs.
+func (h *hlsServer) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	data, err := h.playlist()
+	if errors.Is(err, fs.ErrNotExist) && h.opts.RetryBeforeReady {
+		// ffmpeg writes the playlist with the first segment
+		retry := int(math.Ceil(h.opts.segmentDuration().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		http.Error(w, "stream starting", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if h.opts.AbsoluteSegmentURLs {
+		data = absoluteSegmentURLs(data, h.baseURL(r))
+	}
+
+	// No modification time, as tags can change without the file changing
+	http.ServeContent(w, r, playlistName, time.Time{}, bytes.NewReader(data))
+}
+
+// playlist returns the playlist ffmpeg wrote with the custom tags inserted
+// and pruned segments dropped.
+func (h *hlsServer) playlist() ([]byte, error) {
+	return readPlaylist(h.outputDir, h.tags, h.pruner, h.opts.HLSVersion)
+}
+
+// readPlaylist reads the playlist in outputDir with the custom tags inserted,
+// the pruned segments, if pruner is not nil, dropped and, unless version is
+// 0, the #EXT-X-VERSION set to it.
+func readPlaylist(outputDir string, tags *playlistTags, pruner *segmentPruner, version int) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, playlistName))
+	if err != nil {
+		return nil, err
+	}
+	data = tags.rewrite(data)
+	if pruner != nil {
+		data = pruner.rewrite(data)
+	}
+	if version > 0 {
+		data = setPlaylistVersion(data, version)
+	}
+	return data, nil
+}
+
+// setPlaylistVersion replaces the #EXT-X-VERSION of playlist with version,
+// adding the tag after #EXTM3U if ffmpeg wrote none.
+func setPlaylistVersion(playlist []byte, version int) []byte {
+	tag := "#EXT-X-VERSION:" + strconv.Itoa(version)
+
+	var out bytes.Buffer
+	out.Grow(len(playlist) + len(tag) + 1)
+	found := false
+	for _, line := range strings.SplitAfter(string(playlist), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+			out.WriteString(tag + "\n")
+			found = true
+			continue
+		}
+		out.WriteString(line)
+	}
+	if found {
+		return out.Bytes()
+	}
+
+	header, rest, _ := strings.Cut(string(playlist), "\n")
+	return []byte(header + "\n" + tag + "\n" + rest)
+}
+
+// serveMasterPlaylist serves a master playlist listing the stream, the
+// I-frame playlist as an #EXT-X-I-FRAME-STREAM-INF and, as an
+// #EXT-X-IMAGE-STREAM-INF, the thumbnails image playlist.
+func (h *hlsServer) serveMasterPlaylist(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	// BANDWIDTH is required; it is only known once segments were measured
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n",
+		max(int64(h.stats().OutputBitrate), 1), h.opts.Width, h.opts.Height)
+	b.WriteString(playlistName + "\n")
+	if h.iframes != nil {
+		var bitrate float64
+		if playlist, err := h.playlist(); err == nil {
+			_, bitrate = h.iframes.rewrite(playlist)
+		}
+		fmt.Fprintf(&b, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,URI=\"%s\"\n",
+			max(int64(bitrate), 1), h.opts.Width, h.opts.Height, iframesPlaylistName)
+	}
+	if h.thumbs != nil {
+		width, height := thumbnailSize(h.opts)
+		fmt.Fprintf(&b, "#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS=\"jpeg\",URI=\"%s\"\n",
+			max(h.thumbs.bitrate.Load(), 1), width*thumbnailColumns, height*thumbnailRows, thumbnailsPlaylistName)
+	}
+
+	http.ServeContent(w, r, masterPlaylistName, time.Time{}, bytes.NewReader(b.Bytes()))
+}
+
+// baseURL returns the advertised URL of the directory the playlist is
+// served from, ending in a slash. Without an advertised URL, as on a Unix
+// socket, it is derived from the Host r was sent to.
+func (h *hlsServer) baseURL(r *http.Request) string {
+	if u := h.URL(); u != "" {
+		return strings.TrimSuffix(u, playlistName)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/"
+}
+
+// absoluteSegmentURLs returns playlist with the relative segment URIs
+// prefixed with base.
+func absoluteSegmentURLs(playlist []byte, base string) []byte {
+	var out bytes.Buffer
+	out.Grow(len(playlist))
+
+	scanPlaylist(bytes.NewReader(playlist), func(line string, seg *segmentInfo) {
+		if seg != nil && !strings.Contains(seg.URI, "://") {
+			out.WriteString(base)
+			line = strings.TrimPrefix(seg.URI, "/")
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
 	})
 
-	server := &http.Server{
-		Handler: mux,
+	return out.Bytes()
+}
+
+// segmentListEntry describes a segment file in the /segments.json listing.
+type segmentListEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// serveSegmentList serves a JSON listing of the segment files currently in
+// the output directory, oldest first.
+func (h *hlsServer) serveSegmentList(w http.ResponseWriter, r *http.Request) {
+	dirEntries, err := os.ReadDir(h.outputDir)
+	if err != nil {
+		http.Error(w, "failed to read output directory", http.StatusInternalServerError)
+		return
 	}
 
-	return &hlsServer{
-		server:     server,
-		listener:   listener,
-		outputDir:  outputDir,
-		actualPort: actualPort,
-	}, nil
+	segments := []segmentListEntry{}
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !isSegmentFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Deleted since the directory was read
+			continue
+		}
+		segments = append(segments, segmentListEntry{
+			Name:     entry.Name(),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if !segments[i].Modified.Equal(segments[j].Modified) {
+			return segments[i].Modified.Before(segments[j].Modified)
+		}
+		return segments[i].Name < segments[j].Name
+	})
+
+	h.setStreamHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Segments []segmentListEntry `json:"segments"`
+	}{segments})
 }
 
-// Start starts the HTTP server in a goroutine.
-func (h *hlsServer) Start() {
-	go func() {
-		// Serve will return when the listener is closed
-		_ = h.server.Serve(h.listener)
-	}()
+// serveStats serves the encoder statistics as JSON.
+func (h *hlsServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	h.setStreamHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.stats())
 }
 
-// Stop gracefully shuts down the HTTP server.
+// setStreamHeaders sets the CORS and caching headers for live stream responses.
+func (h *hlsServer) setStreamHeaders(w http.ResponseWriter) {
+	// Allow CORS for browser playback
+	if !h.opts.DisableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+
+	// Disable caching for live stream
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// isSegmentFile reports whether name is an HLS media segment file.
+func isSegmentFile(name string) bool {
+	return filepath.Ext(name) == ".ts"
+}
+
+// Start starts the HTTP server on each listener in a goroutine. Requests
+// are served with contexts derived from ctx, so handlers see it being done,
+// unless Options.HTTPServer sets its own BaseContext.
+func (h *hlsServer) Start(ctx context.Context) {
+	if h.server.BaseContext == nil {
+		h.server.BaseContext = func(net.Listener) context.Context { return ctx }
+	}
+	for _, l := range append([]net.Listener{h.listener}, h.extra...) {
+		go func(l net.Listener) {
+			// Serve will return when the listener is closed
+			if h.tls {
+				// The certificates come from the TLS config
+				_ = h.server.ServeTLS(l, "", "")
+				return
+			}
+			_ = h.server.Serve(l)
+		}(l)
+	}
+}
+
+// Stop gracefully shuts down the HTTP server, waiting for in-flight
+// requests until ctx is done and then closing the remaining connections.
 func (h *hlsServer) Stop(ctx context.Context) error {
-	return h.server.Shutdown(ctx)
+	err := h.server.Shutdown(ctx)
+	if ctx.Err() != nil {
+		// Slow clients are cut off rather than holding up the shutdown
+		return h.server.Close()
+	}
+	return err
 }
 
 // Port returns the actual port the server is listening on.
@@ -86,16 +545,75 @@ func (h *hlsServer) Port() int {
 	return h.actualPort
 }
 
-// URL returns the full URL to the HLS playlist.
+// URL returns the full URL to the HLS playlist. With a public base URL
+// configured it is used instead of the server's own address. A server on a
+// Unix socket has no URL of its own and returns "".
 func (h *hlsServer) URL() string {
-	ip := getOutboundIP()
-	return fmt.Sprintf("http://%s:%d/stream.m3u8", ip, h.actualPort)
+	if h.opts.PublicBaseURL != "" {
+		return strings.TrimSuffix(h.opts.PublicBaseURL, "/") + "/" + playlistName
+	}
+	if h.opts.UnixSocket != "" {
+		return ""
+	}
+
+	return h.playlistURL(h.outboundIP(), h.actualPort)
+}
+
+// URLs returns the URL of the playlist on every listener: URL() followed
+// by one per Options.ExtraListeners entry. A listener on all interfaces is
+// given the outbound address, like URL().
+func (h *hlsServer) URLs() []string {
+	var urls []string
+	if u := h.URL(); u != "" {
+		urls = append(urls, u)
+	}
+	for _, l := range h.extra {
+		addr := l.Addr().(*net.TCPAddr)
+		ip := addr.IP.String()
+		if addr.IP.IsUnspecified() {
+			ip = h.outboundIP()
+		}
+		urls = append(urls, h.playlistURL(ip, addr.Port))
+	}
+	return urls
+}
+
+// playlistURL returns the URL of the playlist served at ip and port.
+func (h *hlsServer) playlistURL(ip string, port int) string {
+	scheme := "http"
+	if h.tls {
+		scheme = "https"
+	}
+	host := net.JoinHostPort(ip, strconv.Itoa(port))
+	return fmt.Sprintf("%s://%s/%s", scheme, host, playlistName)
 }
 
-// getOutboundIP gets the preferred outbound IP address
-func getOutboundIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// outboundIP returns the outbound address of the configured family, looked
+// up on first use.
+func (h *hlsServer) outboundIP() string {
+	h.ipOnce.Do(func() {
+		h.ip = getOutboundIP(h.opts.IPVersion)
+	})
+	return h.ip
+}
+
+// getOutboundIP gets the preferred outbound IP address of the given family
+func getOutboundIP(version IPVersion) string {
+	// Dialing UDP sends nothing but picks the source address of the route
+	network, target := "udp", "8.8.8.8:80"
+	switch version {
+	case IPVersion4:
+		network = "udp4"
+	case IPVersion6:
+		network, target = "udp6", "[2001:4860:4860::8888]:80"
+	}
+
+	conn, err := net.Dial(network, target)
 	if err != nil {
+		// No route to the internet, use any interface address
+		if ip := interfaceIP(version); ip != "" {
+			return ip
+		}
 		return "localhost"
 	}
 	defer conn.Close()
@@ -103,3 +621,25 @@ func getOutboundIP() string {
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	return localAddr.IP.String()
 }
+
+// interfaceIP returns the first non-loopback unicast address of the given
+// family, or "" if there is none.
+func interfaceIP(version IPVersion) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isV4 := ipNet.IP.To4() != nil
+		if (version == IPVersion4 && !isV4) || (version == IPVersion6 && isV4) {
+			continue
+		}
+		return ipNet.IP.String()
+	}
+	return ""
+}
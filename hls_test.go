@@ -0,0 +1,680 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer creates an HLS server for dir on a free port, with the
+// thumbnails of thumbs if not nil.
+func newTestServer(t *testing.T, dir string, thumbs *thumbnailer) *hlsServer {
+	t.Helper()
+
+	opts := DefaultOptions()
+	opts.Port = 0
+	if thumbs != nil {
+		opts.ThumbnailInterval = thumbs.interval
+	}
+	opts = opts.withDefaults()
+	h, err := newHLSServer(context.Background(), dir, opts, newFakeClock(time.Unix(0, 0)), func() Stats { return Stats{OutputBitrate: 2e6} }, newPlaylistTags(), nil, thumbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.listener.Close() })
+	return h
+}
+
+func TestServeFileGzip(t *testing.T) {
+	dir := t.TempDir()
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nsegment0.ts\n"
+	segment := string(make([]byte, 4096))
+	for name, data := range map[string]string{playlistName: playlist, "segment0.ts": segment} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestServer(t, dir, nil)
+
+	tests := []struct {
+		path, acceptEncoding string
+		gzipped              bool
+		body                 string
+	}{
+		{"/" + playlistName, "gzip, deflate", true, playlist},
+		{"/" + playlistName, "gzip;q=0", false, playlist},
+		{"/" + playlistName, "", false, playlist},
+		// Segments are already compressed
+		{"/segment0.ts", "gzip", false, segment},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(w, r)
+
+		resp := w.Result()
+		body := io.Reader(resp.Body)
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+			t.Errorf("GET %s (Accept-Encoding %q): gzipped = %v, want %v", tt.path, tt.acceptEncoding, got, tt.gzipped)
+			continue
+		}
+		if tt.gzipped {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("GET %s: %v", tt.path, err)
+			}
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		if string(data) != tt.body {
+			t.Errorf("GET %s (Accept-Encoding %q): body = %q, want %q", tt.path, tt.acceptEncoding, data, tt.body)
+		}
+	}
+}
+
+func TestServeMasterPlaylist(t *testing.T) {
+	dir := t.TempDir()
+
+	// Without thumbnails there is no master playlist
+	r := httptest.NewRequest("GET", "/"+masterPlaylistName, nil)
+	w := httptest.NewRecorder()
+	newTestServer(t, dir, nil).server.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET %s without thumbnails: status %d, want 404", r.URL.Path, w.Code)
+	}
+
+	opts := DefaultOptions().withDefaults()
+	opts.ThumbnailInterval = time.Second
+	h := newTestServer(t, dir, newThumbnailer(dir, opts))
+	w = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+masterPlaylistName, nil))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1920x1080\n" + playlistName + "\n",
+		`#EXT-X-IMAGE-STREAM-INF:BANDWIDTH=1,RESOLUTION=800x450,CODECS="jpeg",URI="` + thumbnailsPlaylistName + `"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("master playlist lacks %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	h := newTestServer(t, t.TempDir(), nil)
+
+	for _, disabled := range []bool{false, true} {
+		h.opts.DisableCORS = disabled
+		for _, path := range []string{"/" + playlistName, "/segments.json"} {
+			w := httptest.NewRecorder()
+			h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+			want := "*"
+			if disabled {
+				want = ""
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+				t.Errorf("GET %s with DisableCORS %v: Access-Control-Allow-Origin = %q, want %q", path, disabled, got, want)
+			}
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{playlistName, "segment0.ts", "init.mp4", "segment1.m4s", "subs.srt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestServer(t, dir, nil)
+	h.opts.MIMETypes = map[string]string{".srt": "application/x-subrip", ".ts": "video/MP2T"}
+
+	for path, want := range map[string]string{
+		"/" + playlistName: "application/vnd.apple.mpegurl",
+		"/segment0.ts":     "video/MP2T",
+		"/init.mp4":        "video/mp4",
+		"/segment1.m4s":    "video/iso.segment",
+		"/subs.srt":        "application/x-subrip",
+	} {
+		w := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("GET %s: Content-Type = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{playlistName, "segment0.ts"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestServer(t, dir, nil)
+	h.opts.ResponseHeaders = map[string]map[string]string{
+		".ts": {"Surrogate-Control": "max-age=60", "Cache-Control": "public, max-age=60"},
+	}
+
+	w := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/segment0.ts", nil))
+	if got := w.Header().Get("Surrogate-Control"); got != "max-age=60" {
+		t.Errorf("segment Surrogate-Control = %q, want max-age=60", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("segment Cache-Control = %q, want the configured one", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+playlistName, nil))
+	if got := w.Header().Get("Surrogate-Control"); got != "" {
+		t.Errorf("playlist Surrogate-Control = %q, want none", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-cache, no-store, must-revalidate" {
+		t.Errorf("playlist Cache-Control = %q, want the live default", got)
+	}
+
+	for _, headers := range []map[string]map[string]string{
+		{"ts": {"X-Cache-Key": "a"}},
+		{".ts": {"X Cache": "a"}},
+		{".ts": {"X-Cache-Key": "a\r\nSet-Cookie: b"}},
+	} {
+		opts := DefaultOptions()
+		opts.ResponseHeaders = headers
+		if _, err := New(opts); err == nil {
+			t.Errorf("response headers %q accepted", headers)
+		}
+	}
+}
+
+func TestRetryBeforeReady(t *testing.T) {
+	h := newTestServer(t, t.TempDir(), nil)
+
+	w := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+playlistName, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("playlist before the first segment: status %d, want 404", w.Code)
+	}
+
+	h.opts.RetryBeforeReady = true
+	w = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+playlistName, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("playlist before the first segment with RetryBeforeReady: status %d, Retry-After %q, want 503 and 2",
+			w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestSetPlaylistVersion(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"#EXTM3U\n#EXT-X-VERSION:6\n#EXTINF:2.0,\nsegment0.ts\n", "#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:2.0,\nsegment0.ts\n"},
+		{"#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n", "#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:2.0,\nsegment0.ts\n"},
+	} {
+		if got := string(setPlaylistVersion([]byte(tc.in), 3)); got != tc.want {
+			t.Errorf("setPlaylistVersion(%q, 3) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.SingleFile = true
+	opts.HLSVersion = 3
+	if _, err := New(opts); err == nil {
+		t.Error("HLSVersion 3 with SingleFile's byte ranges accepted")
+	}
+}
+
+func TestServeSingleFileByteRange(t *testing.T) {
+	dir := t.TempDir()
+	media := make([]byte, 3000)
+	for i := range media {
+		media[i] = byte(i)
+	}
+	// The second range follows the first without an offset
+	playlist := "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:2\n" +
+		"#EXTINF:2.000000,\n#EXT-X-BYTERANGE:1200@0\nstream.ts\n" +
+		"#EXTINF:2.000000,\n#EXT-X-BYTERANGE:1800\nstream.ts\n"
+	for name, data := range map[string][]byte{playlistName: []byte(playlist), "stream.ts": media} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := readPlaylistEntries(filepath.Join(dir, playlistName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Offset != 1200 || entries[1].Size != 1800 {
+		t.Fatalf("entries = %+v, want the second at 1800@1200", entries)
+	}
+
+	h := newTestServer(t, dir, nil)
+	seg := entries[1]
+	req := httptest.NewRequest(http.MethodGet, "/stream.ts", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.Offset, seg.Offset+seg.Size-1))
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got, want := rec.Header().Get("Content-Range"), "bytes 1200-2999/3000"; got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if body := rec.Body.Bytes(); !bytes.Equal(body, media[1200:]) {
+		t.Errorf("body is %d bytes, want the %d of the range", len(body), seg.Size)
+	}
+}
+
+func TestServeSegmentList(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{
+		"segment1.ts":  0,
+		"segment10.ts": 0,
+		"segment0.ts":  -2 * time.Second,
+		playlistName:   0,
+		"key0.key":     0,
+		"preview.jpg":  0,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, len(name)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, base.Add(age), base.Add(age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := newTestServer(t, dir, nil)
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/segments.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, Content-Type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var list struct {
+		Segments []segmentListEntry `json:"segments"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	// Oldest first, ties by name
+	var got []string
+	for _, seg := range list.Segments {
+		got = append(got, fmt.Sprintf("%s %d %s", seg.Name, seg.Size, seg.Modified.Format(time.TimeOnly)))
+	}
+	want := []string{"segment0.ts 11 11:59:58", "segment1.ts 11 12:00:00", "segment10.ts 12 12:00:00"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("segments = %q, want %q", got, want)
+	}
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	for _, base := range []string{"https://stream.example.com/live", "https://stream.example.com/live/"} {
+		opts := DefaultOptions()
+		opts.Port = 0
+		opts.PublicBaseURL = base
+		h, err := newHLSServer(context.Background(), t.TempDir(), opts.withDefaults(), newFakeClock(time.Unix(0, 0)), func() Stats { return Stats{} }, newPlaylistTags(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.listener.Close()
+		if got, want := h.URL(), "https://stream.example.com/live/"+playlistName; got != want {
+			t.Errorf("URL with base %q = %q, want %q", base, got, want)
+		}
+	}
+
+	for _, base := range []string{"stream.example.com/live", "/live", "https://"} {
+		opts := DefaultOptions()
+		opts.PublicBaseURL = base
+		if _, err := New(opts); err == nil {
+			t.Errorf("public base URL %q accepted", base)
+		}
+	}
+}
+
+func TestAbsoluteSegmentURLs(t *testing.T) {
+	dir := t.TempDir()
+	playlist := testPlaylist("segment0.ts", "/segment1.ts", "https://origin.example.com/segment2.ts")
+	if err := os.WriteFile(filepath.Join(dir, playlistName), []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.PublicBaseURL = "https://cdn.example.com/live"
+	opts.AbsoluteSegmentURLs = true
+	h, err := newHLSServer(context.Background(), dir, opts.withDefaults(), newFakeClock(time.Unix(0, 0)), func() Stats { return Stats{} }, newPlaylistTags(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.listener.Close()
+
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+playlistName, nil))
+	want := testPlaylist("https://cdn.example.com/live/segment0.ts", "https://cdn.example.com/live/segment1.ts", "https://origin.example.com/segment2.ts")
+	if rec.Body.String() != want {
+		t.Errorf("playlist = %q, want %q", rec.Body.String(), want)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, playlistName)); err != nil || string(data) != playlist {
+		t.Errorf("playlist on disk = %q, %v, want it unchanged", data, err)
+	}
+
+	// Without a URL of its own the request's host is used
+	h.opts.PublicBaseURL = ""
+	h.opts.UnixSocket = filepath.Join(dir, "hls.sock")
+	r := httptest.NewRequest(http.MethodGet, "/"+playlistName, nil)
+	r.Host = "proxy.internal:8080"
+	if got := h.baseURL(r); got != "http://proxy.internal:8080/" {
+		t.Errorf("base URL on a Unix socket = %q, want http://proxy.internal:8080/", got)
+	}
+}
+
+func TestOutboundIPVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version IPVersion
+		v4      bool
+	}{
+		{IPVersion4, true},
+		{IPVersion6, false},
+	} {
+		// Hosts without an address of the family fall back to localhost
+		ip := getOutboundIP(tc.version)
+		if ip == "localhost" {
+			continue
+		}
+		if parsed := net.ParseIP(ip); parsed == nil || (parsed.To4() != nil) != tc.v4 {
+			t.Errorf("%s outbound IP = %q", tc.version, ip)
+		}
+	}
+
+	h := newTestServer(t, t.TempDir(), nil)
+	want := "http://[2001:db8::1]:8080/" + playlistName
+	if got := h.playlistURL("2001:db8::1", 8080); got != want {
+		t.Errorf("IPv6 playlist URL = %q, want %q", got, want)
+	}
+
+	opts := DefaultOptions()
+	opts.IPVersion = "ipv5"
+	if _, err := New(opts); err == nil {
+		t.Error("unknown IP version accepted")
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.Port = 0
+		opts.EnableStatsEndpoint = enabled
+		stats := func() Stats { return Stats{FramesWritten: 42, OutputBitrate: 2e6} }
+		h, err := newHLSServer(context.Background(), t.TempDir(), opts.withDefaults(), newFakeClock(time.Unix(0, 0)), stats, newPlaylistTags(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.listener.Close()
+
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats.json", nil))
+		if !enabled {
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("disabled /stats.json status = %d, want %d", rec.Code, http.StatusNotFound)
+			}
+			continue
+		}
+		var got Stats
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" || got != stats() {
+			t.Errorf("/stats.json = %d %q %+v, want %+v", rec.Code, rec.Header().Get("Content-Type"), got, stats())
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.UnixSocket = filepath.Join(t.TempDir(), "hls.sock")
+	opts.EnableStatsEndpoint = true
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := e.Start(context.Background(), make(chan image.Image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	if url != "" || e.SocketPath() != opts.UnixSocket {
+		t.Errorf("Start = %q, SocketPath() = %q, want no URL and %q", url, e.SocketPath(), opts.UnixSocket)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", opts.UnixSocket)
+		},
+	}}
+	resp, err := client.Get("http://unix/stats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/stats.json over the socket status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	opts.Port = 8080
+	if _, err := New(opts); err == nil {
+		t.Error("port and unix socket both accepted")
+	}
+}
+
+func TestExtraListeners(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.ExtraListeners = []string{"127.0.0.1:0", ":0"}
+	opts.CommandFactory = helperCommand
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	urls := e.URLs()
+	if len(urls) != 3 || urls[0] != e.URL() {
+		t.Fatalf("URLs = %q, want URL() and one per extra listener", urls)
+	}
+	primary, err := url.Parse(urls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"127.0.0.1", primary.Hostname()} {
+		u, err := url.Parse(urls[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A listener on all interfaces is given the outbound address
+		if u.Hostname() != want || u.Port() == primary.Port() {
+			t.Errorf("URL of %s = %q, want host %s on a port of its own", opts.ExtraListeners[i], urls[i+1], want)
+		}
+		resp, err := http.Get("http://127.0.0.1:" + u.Port() + "/segments.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s serves /segments.json with status %d", opts.ExtraListeners[i], resp.StatusCode)
+		}
+	}
+
+	opts.ExtraListeners = []string{"9090"}
+	if _, err := New(opts); err == nil {
+		t.Error("extra listener address without a port accepted")
+	}
+}
+
+func TestListenPortInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	opts := DefaultOptions()
+	opts.Port = taken.Addr().(*net.TCPAddr).Port
+	c := newFakeClock(time.Unix(0, 0))
+	if _, err := listen(context.Background(), opts, c); !errors.Is(err, ErrPortInUse) {
+		t.Errorf("listen on a taken port = %v, want ErrPortInUse", err)
+	}
+
+	opts.PortFallback = true
+	l, err := listen(context.Background(), opts, c)
+	if err != nil {
+		t.Fatalf("listen with PortFallback = %v", err)
+	}
+	defer l.Close()
+	if port := l.Addr().(*net.TCPAddr).Port; port == opts.Port {
+		t.Errorf("PortFallback listened on the taken port %d", port)
+	}
+}
+
+func TestListenRetryCancelled(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	opts := DefaultOptions()
+	opts.Port = taken.Addr().(*net.TCPAddr).Port
+	opts.BindRetries = 3
+	opts.BindRetryDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		// The fake clock never reaches the retry
+		_, err := listen(ctx, opts, newFakeClock(time.Unix(0, 0)))
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("listen = %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("listen kept retrying after the context was cancelled")
+	}
+}
+
+func TestHTTPServerTemplate(t *testing.T) {
+	var states atomic.Int32
+	original := http.NewServeMux()
+	tmpl := &http.Server{
+		Handler:           original,
+		ReadHeaderTimeout: 7 * time.Second,
+		MaxHeaderBytes:    4096,
+		ConnState:         func(net.Conn, http.ConnState) { states.Add(1) },
+	}
+	handler := http.NewServeMux()
+	server := newHTTPServer(tmpl, handler)
+	if server == tmpl || server.ReadHeaderTimeout != 7*time.Second || server.MaxHeaderBytes != 4096 || server.ConnState == nil {
+		t.Error("server isn't a copy of the template")
+	}
+	if server.Handler != handler || tmpl.Handler != original {
+		t.Error("Handler not replaced in the copy only")
+	}
+
+	// The hooks of the template see the connections of the stream
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.HTTPServer = tmpl
+	h, err := newHLSServer(context.Background(), t.TempDir(), opts.withDefaults(), newFakeClock(time.Unix(0, 0)), func() Stats { return Stats{} }, newPlaylistTags(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start(context.Background())
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/segments.json", h.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := h.Stop(context.Background()); err != nil {
+		t.Errorf("Stop = %v", err)
+	}
+	if states.Load() == 0 {
+		t.Error("ConnState of the template not called")
+	}
+
+	// With a TLS config the stream is served over HTTPS
+	opts.HTTPServer = &http.Server{TLSConfig: &tls.Config{}}
+	h, err = newHLSServer(context.Background(), t.TempDir(), opts.withDefaults(), newFakeClock(time.Unix(0, 0)), func() Stats { return Stats{} }, newPlaylistTags(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.listener.Close()
+	if !strings.HasPrefix(h.URL(), "https://") {
+		t.Errorf("URL with a TLS config = %q, want https", h.URL())
+	}
+}
+
+func TestServerBaseContext(t *testing.T) {
+	h := newTestServer(t, t.TempDir(), nil)
+	entered := make(chan struct{})
+	h.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.Start(ctx)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", h.Port()))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	<-entered
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("request after cancelling: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't see the server context being cancelled")
+	}
+
+	if err := h.Stop(ctx); err != nil {
+		t.Errorf("Stop = %v", err)
+	}
+}
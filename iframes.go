@@ -0,0 +1,167 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// iframesPlaylistName is the I-frame playlist served with
+// Options.IFramePlaylist.
+const iframesPlaylistName = "iframes.m3u8"
+
+// tsPacketSize is the size of an MPEG-TS packet.
+const tsPacketSize = 188
+
+// iframeIndex derives an I-frame only playlist for trick play from the
+// media playlist. ffmpeg starts every segment with a keyframe, so each
+// segment's first video frame, together with the PAT and PMT before it, is
+// listed as a byte range of the segment.
+type iframeIndex struct {
+	outputDir string
+
+	mu sync.Mutex
+	// lengths holds the byte length of the first frame of the segments in
+	// the current playlist, by URI, measured on first use
+	lengths map[string]int64
+}
+
+// newIFrameIndex creates an index of the segments in outputDir.
+func newIFrameIndex(outputDir string) *iframeIndex {
+	return &iframeIndex{outputDir: outputDir, lengths: make(map[string]int64)}
+}
+
+// rewrite turns the media playlist into the I-frame playlist. Segments
+// whose first frame can't be found are left out. It also returns the
+// bitrate of the listed I-frames in bits per second.
+func (x *iframeIndex) rewrite(playlist []byte) ([]byte, float64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var out bytes.Buffer
+	out.Grow(len(playlist) * 2)
+	lengths := make(map[string]int64, len(x.lengths))
+	var total int64
+	var duration time.Duration
+	var extinf string
+
+	scanPlaylist(strings.NewReader(string(playlist)), func(line string, seg *segmentInfo) {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case seg != nil:
+			length, ok := x.lengths[seg.URI]
+			if !ok {
+				length, ok = x.measure(seg.URI)
+			}
+			if !ok {
+				return
+			}
+			lengths[seg.URI] = length
+			total += length
+			duration += seg.Duration
+			// Each I-frame lasts until the next listed one
+			out.WriteString(extinf + "\n")
+			out.WriteString("#EXT-X-BYTERANGE:" + strconv.FormatInt(length, 10) + "@0\n")
+			out.WriteString(line + "\n")
+		case strings.HasPrefix(trimmed, "#EXTINF:"):
+			// Written with its segment, if it is listed
+			extinf = line
+		case strings.HasPrefix(trimmed, "#EXT-X-VERSION:"):
+			// Raised below for byte ranges
+		case trimmed == "#EXTM3U":
+			out.WriteString(line + "\n")
+			out.WriteString("#EXT-X-VERSION:4\n")
+			out.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+		default:
+			out.WriteString(line + "\n")
+		}
+	})
+
+	// Segments that left the playlist never come back
+	x.lengths = lengths
+
+	if duration <= 0 {
+		return out.Bytes(), 0
+	}
+	return out.Bytes(), float64(total*8) / duration.Seconds()
+}
+
+// measure returns the length of the first video frame of the segment uri.
+// Callers must hold x.mu.
+func (x *iframeIndex) measure(uri string) (int64, bool) {
+	data, err := os.ReadFile(filepath.Join(x.outputDir, filepath.FromSlash(uri)))
+	if err != nil {
+		return 0, false
+	}
+	return firstFrameLength(data)
+}
+
+// firstFrameLength returns the length of the start of an MPEG-TS stream up
+// to where its second video PES packet, and so its second frame, begins.
+// It reports false if data has no video.
+func firstFrameLength(data []byte) (int64, bool) {
+	videoPID := -1
+	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
+		p := data[off : off+tsPacketSize]
+		if p[0] != 0x47 {
+			// Lost sync, not a TS segment
+			return 0, false
+		}
+		if p[1]&0x40 == 0 {
+			// Doesn't start a PES packet
+			continue
+		}
+		pid := int(p[1]&0x1f)<<8 | int(p[2])
+
+		payload := 4
+		control := p[3] >> 4 & 3
+		if control&1 == 0 {
+			// No payload
+			continue
+		}
+		if control&2 != 0 {
+			// Skip the adaptation field
+			payload += 1 + int(p[4])
+		}
+		if payload+4 > tsPacketSize {
+			continue
+		}
+
+		// A PES start code with a video stream ID
+		pes := p[payload:]
+		if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[3]&0xf0 != 0xe0 {
+			continue
+		}
+		if videoPID < 0 {
+			videoPID = pid
+		} else if pid == videoPID {
+			return int64(off), true
+		}
+	}
+
+	if videoPID < 0 {
+		return 0, false
+	}
+	// A single frame
+	return int64(len(data) / tsPacketSize * tsPacketSize), true
+}
+
+// serveIFramePlaylist serves the I-frame playlist of the current playlist.
+func (h *hlsServer) serveIFramePlaylist(w http.ResponseWriter, r *http.Request) {
+	data, err := h.playlist()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	data, _ = h.iframes.rewrite(data)
+	if h.opts.AbsoluteSegmentURLs {
+		data = absoluteSegmentURLs(data, h.baseURL(r))
+	}
+
+	http.ServeContent(w, r, iframesPlaylistName, time.Time{}, bytes.NewReader(data))
+}
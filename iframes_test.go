@@ -0,0 +1,111 @@
+package nimsforestencoder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tsPacket returns an MPEG-TS packet on pid, starting a PES packet with
+// streamID if it isn't 0.
+func tsPacket(pid int, streamID byte) []byte {
+	p := make([]byte, tsPacketSize)
+	p[0] = 0x47
+	p[1] = byte(pid >> 8 & 0x1f)
+	p[2] = byte(pid)
+	p[3] = 0x10
+	if streamID != 0 {
+		p[1] |= 0x40
+		copy(p[4:], []byte{0, 0, 1, streamID})
+	}
+	return p
+}
+
+// testSegment returns a segment with the PAT, then a keyframe over two
+// packets, then a second frame.
+func testSegment() []byte {
+	var data []byte
+	for _, p := range [][]byte{
+		tsPacket(0, 0),
+		tsPacket(0x100, 0xe0),
+		tsPacket(0x101, 0xc0), // audio
+		tsPacket(0x100, 0),
+		tsPacket(0x100, 0xe0),
+		tsPacket(0x100, 0),
+	} {
+		data = append(data, p...)
+	}
+	return data
+}
+
+func TestFirstFrameLength(t *testing.T) {
+	if n, ok := firstFrameLength(testSegment()); !ok || n != 4*tsPacketSize {
+		t.Errorf("firstFrameLength = %d, %v, want %d, true", n, ok, 4*tsPacketSize)
+	}
+
+	single := append(tsPacket(0x100, 0xe0), tsPacket(0x100, 0)...)
+	if n, ok := firstFrameLength(single); !ok || n != 2*tsPacketSize {
+		t.Errorf("firstFrameLength of a single frame = %d, %v, want %d, true", n, ok, 2*tsPacketSize)
+	}
+
+	for name, data := range map[string][]byte{
+		"audio only": tsPacket(0x101, 0xc0),
+		"not TS":     make([]byte, tsPacketSize),
+	} {
+		if _, ok := firstFrameLength(data); ok {
+			t.Errorf("firstFrameLength of %s reported a frame", name)
+		}
+	}
+}
+
+func TestServeIFramePlaylist(t *testing.T) {
+	dir := t.TempDir()
+	playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000000,\nsegment0.ts\n#EXTINF:2.000000,\nbroken.ts\n"
+	for name, data := range map[string][]byte{
+		playlistName:  []byte(playlist),
+		"segment0.ts": testSegment(),
+		"broken.ts":   []byte("not a segment"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestServer(t, dir, nil)
+
+	// Not served unless enabled
+	w := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+iframesPlaylistName, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET %s without IFramePlaylist: status %d, want 404", iframesPlaylistName, w.Code)
+	}
+
+	h.iframes = newIFrameIndex(dir)
+	w = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+iframesPlaylistName, nil))
+	want := "#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-I-FRAMES-ONLY\n#EXT-X-TARGETDURATION:2\n" +
+		"#EXTINF:2.000000,\n#EXT-X-BYTERANGE:752@0\nsegment0.ts\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("GET %s: status %d, body\n%s\nwant 200 and\n%s", iframesPlaylistName, w.Code, w.Body, want)
+	}
+
+	w = httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+masterPlaylistName, nil))
+	body := w.Body.String()
+	// 752 bytes every 2s
+	if want := `#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=3008,RESOLUTION=1920x1080,URI="` + iframesPlaylistName + `"`; !strings.Contains(body, want) {
+		t.Errorf("master playlist lacks %q:\n%s", want, body)
+	}
+	if strings.Contains(body, "#EXT-X-IMAGE-STREAM-INF") {
+		t.Errorf("master playlist without thumbnails lists them:\n%s", body)
+	}
+
+	opts := DefaultOptions()
+	opts.IFramePlaylist = true
+	opts.SingleFile = true
+	if _, err := New(opts); err == nil {
+		t.Error("IFramePlaylist with SingleFile accepted")
+	}
+}
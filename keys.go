@@ -0,0 +1,146 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyInfoName is the name of the ffmpeg key info file in the output directory.
+const keyInfoName = "stream.keyinfo"
+
+// KeyProvider supplies AES-128 keys for HLS segment encryption. Each call
+// must return a new 16-byte key.
+type KeyProvider func() ([]byte, error)
+
+// RandomKeys returns a KeyProvider that generates random keys.
+func RandomKeys() KeyProvider {
+	return func() ([]byte, error) {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+}
+
+// keyRotator writes encryption keys and the key info file ffmpeg reads them
+// from. With -hls_flags periodic_rekey ffmpeg re-reads the key info file at
+// every segment, so rewriting it switches new segments to the new key and
+// the playlist gets a new #EXT-X-KEY tag.
+type keyRotator struct {
+	outputDir string
+	provider  KeyProvider
+	interval  time.Duration
+
+	mu sync.Mutex
+	// seq is the number of the next key; oldest that of the oldest key
+	// that may still be on disk
+	seq    int
+	oldest int
+}
+
+// newKeyRotator creates a key rotator and writes the initial key.
+func newKeyRotator(outputDir string, provider KeyProvider, interval time.Duration) (*keyRotator, error) {
+	k := &keyRotator{
+		outputDir: outputDir,
+		provider:  provider,
+		interval:  interval,
+	}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// run rotates the key every interval of c until ctx is cancelled.
+func (k *keyRotator) run(ctx context.Context, c clock) {
+	ticker := c.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+			// On failure keep the current key; the next tick retries
+			_ = k.rotate()
+		}
+	}
+}
+
+// rotate fetches a new key and points the key info file at it.
+func (k *keyRotator) rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, err := k.provider()
+	if err != nil {
+		return fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	if len(key) != 16 {
+		return fmt.Errorf("invalid encryption key length %d, expected 16", len(key))
+	}
+
+	// Keys stay on disk for segments still in the playlist and are served
+	// to players next to the segments
+	keyName := fmt.Sprintf("key%d.key", k.seq)
+	keyPath := filepath.Join(k.outputDir, keyName)
+	if err := os.WriteFile(keyPath, key, 0o644); err != nil {
+		return fmt.Errorf("failed to write encryption key: %w", err)
+	}
+
+	// Key info file format: key URI, key file path (IV derives from the
+	// segment sequence number when omitted)
+	info := keyName + "\n" + keyPath + "\n"
+	infoPath := filepath.Join(k.outputDir, keyInfoName)
+	tmpPath := infoPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(info), 0o644); err != nil {
+		return fmt.Errorf("failed to write key info: %w", err)
+	}
+	// Rename so ffmpeg never reads a partially written file
+	if err := os.Rename(tmpPath, infoPath); err != nil {
+		return fmt.Errorf("failed to write key info: %w", err)
+	}
+
+	k.seq++
+	return nil
+}
+
+// prune deletes the keys the playlist no longer references, as their
+// segments have left the live window. The current key is always kept, as
+// it may not be referenced yet.
+func (k *keyRotator) prune() {
+	playlist, err := os.ReadFile(filepath.Join(k.outputDir, playlistName))
+	if err != nil {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, line := range strings.Split(string(playlist), "\n") {
+		if _, attrs, ok := strings.Cut(line, "#EXT-X-KEY:"); ok {
+			if _, uri, ok := strings.Cut(attrs, `URI="`); ok {
+				uri, _, _ = strings.Cut(uri, `"`)
+				referenced[uri] = true
+			}
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Keys leave the playlist oldest first
+	for ; k.oldest < k.seq-1; k.oldest++ {
+		name := fmt.Sprintf("key%d.key", k.oldest)
+		if referenced[name] {
+			return
+		}
+		if err := os.Remove(filepath.Join(k.outputDir, name)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	k, err := newKeyRotator(dir, RandomKeys(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := k.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.ReadFile(filepath.Join(dir, keyInfoName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "key2.key\n" + filepath.Join(dir, "key2.key") + "\n"; string(info) != want {
+		t.Errorf("key info = %q, want %q", info, want)
+	}
+
+	// Only the newest key is left in the playlist
+	playlist := "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key2.key\"\n#EXTINF:2.000000,\nsegment5.ts\n"
+	if err := os.WriteFile(filepath.Join(dir, playlistName), []byte(playlist), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	k.prune()
+	for i := 0; i < 3; i++ {
+		_, err := os.Stat(filepath.Join(dir, fmt.Sprintf("key%d.key", i)))
+		if removed := os.IsNotExist(err); removed != (i < 2) {
+			t.Errorf("key%d.key removed = %v, want %v", i, removed, i < 2)
+		}
+	}
+
+	// The key info file and its copy mid-rotation hold local paths
+	if err := os.WriteFile(filepath.Join(dir, keyInfoName+".tmp"), info, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, dir, nil)
+	for name, want := range map[string]int{
+		"key2.key":           http.StatusOK,
+		keyInfoName:          http.StatusNotFound,
+		keyInfoName + ".tmp": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if rec.Code != want {
+			t.Errorf("GET /%s = %d, want %d", name, rec.Code, want)
+		}
+	}
+}
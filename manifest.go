@@ -0,0 +1,57 @@
+package nimsforestencoder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestName is the JSON description of the stream written with
+// Options.WriteManifestJSON.
+const manifestName = "stream.json"
+
+// streamManifest describes the stream for downstream tooling.
+type streamManifest struct {
+	StreamID  string `json:"stream_id,omitempty"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	FrameRate int    `json:"frame_rate"`
+	Codec     string `json:"codec"`
+
+	// Bitrate is the measured Stats().OutputBitrate, 0 before the first
+	// segment
+	Bitrate float64 `json:"bitrate"`
+
+	// SegmentDuration is the target segment duration in seconds
+	SegmentDuration float64   `json:"segment_duration"`
+	StartTime       time.Time `json:"start_time"`
+	Playlist        string    `json:"playlist"`
+}
+
+// writeManifest writes the stream manifest into the output directory,
+// replacing the previous one atomically as it may be served concurrently.
+func (e *Encoder) writeManifest() error {
+	stats := e.stats.Load()
+	manifest := streamManifest{
+		StreamID:        e.opts.StreamID,
+		Width:           e.opts.Width,
+		Height:          e.opts.Height,
+		FrameRate:       e.opts.FrameRate,
+		Codec:           e.EncoderInfo().Codec,
+		Bitrate:         stats.snapshot().OutputBitrate,
+		SegmentDuration: e.opts.segmentDuration().Seconds(),
+		StartTime:       stats.started,
+		Playlist:        playlistName,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(e.outputDir, manifestName+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(e.outputDir, manifestName))
+}
@@ -0,0 +1,74 @@
+package nimsforestencoder
+
+import (
+	"image"
+	"image/color"
+)
+
+// NV12 is an in-memory image in NV12 format: a full resolution Y plane
+// followed by a half resolution plane of interleaved Cb and Cr samples, as
+// produced by many capture devices and GPUs. Use it with
+// Options.InputPixelFormat set to PixelFormatNV12 to pass such buffers to
+// ffmpeg without conversion.
+type NV12 struct {
+	// Y holds the luma samples, YStride bytes per row.
+	Y []uint8
+
+	// UV holds the interleaved Cb, Cr samples for each 2x2 block of pixels,
+	// UVStride bytes per row.
+	UV []uint8
+
+	YStride  int
+	UVStride int
+	Rect     image.Rectangle
+}
+
+// NewNV12 returns a new NV12 image with the given bounds. The width and
+// height should be even.
+func NewNV12(r image.Rectangle) *NV12 {
+	w, h := r.Dx(), r.Dy()
+	cw, ch := (w+1)/2, (h+1)/2
+	return &NV12{
+		Y:        make([]uint8, w*h),
+		UV:       make([]uint8, 2*cw*ch),
+		YStride:  w,
+		UVStride: 2 * cw,
+		Rect:     r,
+	}
+}
+
+// ColorModel returns the YCbCr color model.
+func (p *NV12) ColorModel() color.Model {
+	return color.YCbCrModel
+}
+
+// Bounds returns the image bounds.
+func (p *NV12) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// At returns the color of the pixel at (x, y).
+func (p *NV12) At(x, y int) color.Color {
+	return p.YCbCrAt(x, y)
+}
+
+// YCbCrAt returns the YCbCr color of the pixel at (x, y).
+func (p *NV12) YCbCrAt(x, y int) color.YCbCr {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.YCbCr{}
+	}
+	yi := p.YOffset(x, y)
+	ci := p.UVOffset(x, y)
+	return color.YCbCr{Y: p.Y[yi], Cb: p.UV[ci], Cr: p.UV[ci+1]}
+}
+
+// YOffset returns the index of the Y sample for the pixel at (x, y).
+func (p *NV12) YOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.YStride + (x - p.Rect.Min.X)
+}
+
+// UVOffset returns the index of the Cb sample for the pixel at (x, y). The
+// Cr sample follows it.
+func (p *NV12) UVOffset(x, y int) int {
+	return (y/2-p.Rect.Min.Y/2)*p.UVStride + 2*(x/2-p.Rect.Min.X/2)
+}
@@ -1,5 +1,141 @@
 package nimsforestencoder
 
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PixelFormat is the layout of the raw frame data written to ffmpeg.
+type PixelFormat string
+
+const (
+	// PixelFormatRGBA is 8-bit RGBA, 4 bytes per pixel.
+	PixelFormatRGBA PixelFormat = "rgba"
+
+	// PixelFormatNV12 is 8-bit YUV 4:2:0 with a Y plane followed by an
+	// interleaved CbCr plane, 1.5 bytes per pixel. Frames of type *NV12 or
+	// 4:2:0 *image.YCbCr are passed through without color conversion.
+	PixelFormatNV12 PixelFormat = "nv12"
+
+	// PixelFormatRGBA64 is 16-bit big-endian RGBA, 8 bytes per pixel, for
+	// high bit depth sources. Frames of type *image.RGBA64 are passed
+	// through without conversion.
+	PixelFormatRGBA64 PixelFormat = "rgba64be"
+
+	// PixelFormatGray is 8-bit luma only, 1 byte per pixel. Frames of type
+	// *image.Gray are passed through without conversion.
+	PixelFormatGray PixelFormat = "gray"
+
+	// PixelFormatYUV422P is 8-bit planar YUV 4:2:2, 2 bytes per pixel.
+	// Frames of type 4:2:2 *image.YCbCr are passed through without color
+	// conversion.
+	PixelFormatYUV422P PixelFormat = "yuv422p"
+
+	// PixelFormatYUV444P is 8-bit planar YUV 4:4:4, 3 bytes per pixel.
+	// Frames of type 4:4:4 *image.YCbCr are passed through without color
+	// conversion.
+	PixelFormatYUV444P PixelFormat = "yuv444p"
+)
+
+// ImageCodec is the codec of compressed frames passed to StartEncoded.
+type ImageCodec string
+
+const (
+	// ImageCodecJPEG is JPEG, e.g. frames from an MJPEG camera.
+	ImageCodecJPEG ImageCodec = "mjpeg"
+
+	// ImageCodecPNG is PNG.
+	ImageCodecPNG ImageCodec = "png"
+)
+
+// ColorRange is the range of sample values used by frames.
+type ColorRange string
+
+const (
+	// ColorRangeLimited uses the broadcast range 16-235 for luma.
+	ColorRangeLimited ColorRange = "limited"
+
+	// ColorRangeFull uses the full range 0-255.
+	ColorRangeFull ColorRange = "full"
+)
+
+// PlaylistType selects the semantics of the HLS playlist.
+type PlaylistType string
+
+const (
+	// PlaylistTypeLive is a sliding window over the most recent segments;
+	// older segments are deleted.
+	PlaylistTypeLive PlaylistType = "live"
+
+	// PlaylistTypeEvent keeps every segment and only appends to the
+	// playlist, so viewers can seek back to the start.
+	PlaylistTypeEvent PlaylistType = "event"
+
+	// PlaylistTypeVOD keeps every segment and marks the playlist as VOD
+	// once it is complete: when the encoder stops or the output rotates.
+	// Until then it is served as an event playlist, as a VOD playlist must
+	// not change.
+	PlaylistTypeVOD PlaylistType = "vod"
+)
+
+// TimestampSource selects how frame timestamps are derived.
+type TimestampSource string
+
+const (
+	// TimestampSourceWallClock timestamps frames with the wall-clock time
+	// they arrive, so clock adjustments such as NTP steps affect timing.
+	TimestampSourceWallClock TimestampSource = "wallclock"
+
+	// TimestampSourceMonotonic timestamps frames with the monotonic time
+	// they arrive, unaffected by clock adjustments.
+	TimestampSourceMonotonic TimestampSource = "monotonic"
+
+	// TimestampSourceProvided uses the PTS of TimedFrame frames. Other
+	// frames follow the previous frame.
+	TimestampSourceProvided TimestampSource = "provided"
+)
+
+// IPVersion selects the address family advertised in stream URLs.
+type IPVersion string
+
+const (
+	// IPVersionAuto uses the address of the default route.
+	IPVersionAuto IPVersion = "auto"
+
+	// IPVersion4 advertises an IPv4 address.
+	IPVersion4 IPVersion = "ipv4"
+
+	// IPVersion6 advertises an IPv6 address.
+	IPVersion6 IPVersion = "ipv6"
+)
+
+// Profile selects a coherent bundle of encoder settings for a goal. The
+// settings of each profile are listed with its constant.
+type Profile string
+
+const (
+	// ProfileLowLatency minimizes the delay behind the live edge: x264
+	// preset ultrafast with tune zerolatency, 1 second segments and the
+	// encoder's default rate control.
+	ProfileLowLatency Profile = "low_latency"
+
+	// ProfileBalanced trades a little encoding speed for quality: x264
+	// preset veryfast, 2 second segments and TargetQuality 55 (CRF 23).
+	ProfileBalanced Profile = "balanced"
+
+	// ProfileHighQuality favors quality over latency and CPU: x264 preset
+	// medium, 6 second segments and TargetQuality 65 (CRF 18).
+	ProfileHighQuality Profile = "high_quality"
+)
+
 // Options configures the encoder.
 type Options struct {
 	// Width is the frame width in pixels. Default: 1920
@@ -16,16 +152,759 @@ type Options struct {
 
 	// Port is the HTTP server port. 0 means auto-assign. Default: 0
 	Port int
+
+	// SegmentTime is the target HLS segment duration with sub-second
+	// precision. When set it takes precedence over SegmentDuration. ffmpeg
+	// rounds #EXT-X-TARGETDURATION up to whole seconds, so 1500ms produces
+	// 1.5s segments advertised with a target duration of 2. Default: 0 (use
+	// SegmentDuration)
+	SegmentTime time.Duration
+
+	// SegmentOptions is passed to ffmpeg as -hls_segment_options and
+	// configures the segment muxer, e.g. "mpegts_flags=+initial_discontinuity".
+	// Default: "" (none)
+	SegmentOptions string
+
+	// MaxSegmentSize caps the size of each segment in bytes (-hls_segment_size).
+	// Segments are split on the next keyframe once the cap is reached.
+	// Default: 0 (unlimited)
+	MaxSegmentSize int64
+
+	// Env holds extra environment variables for the ffmpeg process, e.g.
+	// CUDA_VISIBLE_DEVICES or LIBVA_DRIVER_NAME. They are added to the
+	// environment of the current process and override existing values.
+	// Default: nil
+	Env map[string]string
+
+	// PaceToRealtime limits writes to ffmpeg to FrameRate frames per second,
+	// so frames sent in a burst are spread out instead of collapsing the
+	// stream's timing. Default: false
+	PaceToRealtime bool
+
+	// SegmentFilename is the segment file name template passed to ffmpeg as
+	// -hls_segment_filename, relative to the output directory. Without
+	// StrftimeSegments it may contain %d for the sequence number.
+	// Default: "" (ffmpeg names segments stream0.ts, stream1.ts, ...)
+	SegmentFilename string
+
+	// StrftimeSegments expands strftime patterns such as %Y%m%d-%H%M%S in
+	// SegmentFilename with the wall-clock time the segment starts, which is
+	// useful for DVR and archive indexing. Names must be unique per segment,
+	// so include seconds in the pattern. Default: false
+	StrftimeSegments bool
+
+	// KeyProvider enables AES-128 segment encryption when set. Keys are
+	// served to players alongside the segments. Default: nil (unencrypted)
+	KeyProvider KeyProvider
+
+	// KeyRotationInterval is how often a new key is requested from
+	// KeyProvider. Segments started after a rotation use the new key.
+	// Default: 0 (one key for the whole stream)
+	KeyRotationInterval time.Duration
+
+	// Threads limits the number of encoder threads (-threads), capping CPU
+	// usage on shared hosts. Default: 0 (auto)
+	Threads int
+
+	// MaxLatency bounds how long a frame may wait between arriving on the
+	// channel and being encoded. Frames that would exceed it are dropped and
+	// counted in Stats.LatencyExceeded. Default: 0 (unbounded)
+	MaxLatency time.Duration
+
+	// RecordPath additionally records the stream to an MP4 file at this path.
+	// The file is finalized when the encoder stops. Recording encodes the
+	// frames a second time. Default: "" (no recording)
+	RecordPath string
+
+	// InputPixelFormat is the pixel format frames are converted to before
+	// being written to ffmpeg. Choosing the format of the frame source
+	// avoids a conversion round-trip. Default: PixelFormatRGBA
+	InputPixelFormat PixelFormat
+
+	// PublicBaseURL is the externally reachable base URL of the stream, e.g.
+	// "https://stream.example.com/live" behind a reverse proxy. URL() returns
+	// it with the playlist name appended, while the server still listens on
+	// Port. Default: "" (advertise the server's own address)
+	PublicBaseURL string
+
+	// EnableStatsEndpoint serves Stats as JSON at /stats.json on the HLS
+	// server. Default: false
+	EnableStatsEndpoint bool
+
+	// BitDepth is the bit depth of the encoded video, 8 or 10. 10-bit output
+	// uses the High 10 profile and needs an ffmpeg built with 10-bit x264;
+	// combine with PixelFormatRGBA64 input to keep the extra precision.
+	// New rejects bit depths that Codec is known not to support, such as
+	// 10-bit h264_nvenc. Default: 8
+	BitDepth int
+
+	// ColorPrimaries, ColorTransfer and ColorSpace tag the output with color
+	// metadata for HDR, e.g. "bt2020", "smpte2084" (PQ) or "arib-std-b67"
+	// (HLG), and "bt2020nc". Values are passed to ffmpeg's -color_primaries,
+	// -color_trc and -colorspace. Default: "" (untagged)
+	ColorPrimaries string
+	ColorTransfer  string
+	ColorSpace     string
+
+	// CommandFactory replaces the built-in ffmpeg invocation. It is called
+	// with the output directory and the resolved options and must return an
+	// unstarted command that reads raw frames in InputPixelFormat from stdin
+	// and writes the HLS playlist (stream.m3u8) into outputDir. The encoder
+	// connects stdin, stdout and stderr and manages the process lifecycle,
+	// so the command must leave them unset. Flush requires the command to
+	// report progress on stdout (-progress pipe:1). Env is not applied.
+	// Default: nil (built-in command)
+	CommandFactory func(outputDir string, opts Options) *exec.Cmd
+
+	// BindRetries is how many times to retry binding Port if it is in use,
+	// so restarts on a fixed port succeed once it is released. Retrying ends
+	// once the context passed to Start is done. Default: 0
+	BindRetries int
+
+	// BindRetryDelay is the delay before the first bind retry; it doubles
+	// with every further retry. Default: 100ms
+	BindRetryDelay time.Duration
+
+	// RotateInterval periodically finalizes the stream as a complete VOD
+	// playlist (with #EXT-X-ENDLIST), moves it to a new subdirectory of
+	// ArchiveDir named after the period's start time, and starts a fresh
+	// playlist. Segments are kept for the whole period rather than deleted.
+	// Live viewers see the stream end and must reload at each rotation.
+	// Default: 0 (no rotation)
+	RotateInterval time.Duration
+
+	// ArchiveDir receives the finalized output of each rotation period,
+	// including the last one when the encoder stops. Required with
+	// RotateInterval. Default: ""
+	ArchiveDir string
+
+	// ColorRange is the range of the input frames. When set, the output keeps
+	// the same range and is tagged with it, so players neither compress nor
+	// expand it, which otherwise makes full-range sources look washed out.
+	// Default: "" (ffmpeg's default: limited-range output)
+	ColorRange ColorRange
+
+	// Codec is the ffmpeg video encoder, e.g. "libx264", "h264_nvenc" or
+	// "h264_vaapi". AvailableEncoders lists the encoders the installed
+	// ffmpeg supports. The ultrafast/zerolatency tuning applies to libx264
+	// and libx265 only. Default: "libx264"
+	Codec string
+
+	// WriteBufferSize buffers frame data written to ffmpeg's stdin in a
+	// buffer of this many bytes, reducing write calls when frames are small
+	// relative to the pipe buffer. Buffered data is flushed at least once per
+	// frame interval and when ffmpeg is closed. Default: 0 (unbuffered)
+	WriteBufferSize int
+
+	// ModifyArgs is called with the ffmpeg arguments built from the options
+	// and returns the arguments to launch ffmpeg with, for tuning that the
+	// typed options don't cover. Changes to the input, the playlist path or
+	// -progress break the encoder, and invalid arguments only surface when
+	// ffmpeg fails. Not used with CommandFactory. Default: nil
+	ModifyArgs func(args []string) []string
+
+	// UnixSocket makes the HLS server listen on a Unix domain socket at this
+	// path instead of TCP, for local consumers and sidecars. URL() is then
+	// empty unless PublicBaseURL is set. Default: "" (TCP on Port)
+	UnixSocket string
+
+	// SegmentChecksums records the SHA-256 of each completed segment in
+	// checksums.txt in the output directory, served next to the segments,
+	// in sha256sum format. Segments deleted from disk are dropped from it.
+	// Default: false
+	SegmentChecksums bool
+
+	// IPVersion selects the address family of the host in URL(), e.g. to
+	// force IPv4 URLs for legacy players on dual-stack hosts. Default:
+	// IPVersionAuto
+	IPVersion IPVersion
+
+	// TargetQuality selects constant-quality encoding on a scale from 1
+	// (smallest) to 100 (best) instead of the encoder's default rate control.
+	// It maps linearly onto the codec's CRF range: 0-51 for libx264 and
+	// libx265 (e.g. 55 -> CRF 23), 0-63 for libvpx-vp9, libaom-av1 and
+	// libsvtav1. Other codecs are not supported. Default: 0 (unset)
+	TargetQuality int
+
+	// SingleFile writes all segments into one media file and lists them in
+	// the playlist as #EXT-X-BYTERANGE ranges of it, instead of writing a
+	// file per segment. The file only grows, so it suits bounded sessions or
+	// RotateInterval. Default: false
+	SingleFile bool
+
+	// MinSegmentsBeforeReady makes WaitReady wait until at least this many
+	// segments are listed in the playlist, trading startup latency for a
+	// buffer players can start from. It cannot exceed the live window of 5
+	// segments unless all segments are kept. Default: 0 (the playlist exists)
+	MinSegmentsBeforeReady int
+
+	// Logger receives diagnostics such as dropped frames. Default: nil
+	// (discard)
+	Logger *slog.Logger
+
+	// RTSPURL additionally publishes the stream to an RTSP server at this
+	// rtsp:// or rtsps:// URL, e.g. a MediaMTX instance that NVRs and other
+	// RTSP clients pull from. ffmpeg can only push RTSP, not serve it. The
+	// server must accept the stream when the encoder starts, as ffmpeg fails
+	// if any output can't be opened. Publishing encodes the frames a second
+	// time. Default: "" (no RTSP output)
+	RTSPURL string
+
+	// TimestampSource makes frames keep their timing: each frame is placed
+	// at the position its timestamp falls on in the FrameRate grid,
+	// repeating the previous frame to fill gaps and dropping frames that
+	// arrive too early. Jumps of more than a second restart the timeline.
+	// Default: "" (every frame is encoded as the next one, regardless of
+	// timing)
+	TimestampSource TimestampSource
+
+	// SlowOutputThreshold is how much later than the segment duration a new
+	// segment may appear, while frames are being written, before the output
+	// is reported as slow via Stats().SlowOutput and OnSlowOutput.
+	// Default: 2 segment durations
+	SlowOutputThreshold time.Duration
+
+	// OnSlowOutput is called once each time slow output is detected, with
+	// how long ago the last segment appeared. It is called from the segment
+	// watcher and must not block or call Stop. Default: nil
+	OnSlowOutput func(sinceLastSegment time.Duration)
+
+	// Transforms are applied in order to every frame before it is
+	// converted, e.g. FlipVertical for bottom-up sources or Crop. The
+	// transformed frame must match Width and Height. Default: nil
+	Transforms []FrameTransform
+
+	// LowDelayInput disables ffmpeg's input buffering and probing
+	// (-fflags nobuffer -flags low_delay) so frames reach the encoder as
+	// soon as they are written. Default: false
+	LowDelayInput bool
+
+	// Outputs are additional outputs such as DASH or an MP4 recording. With
+	// Outputs set, the video is encoded once and ffmpeg's tee muxer writes
+	// it to the HLS stream, RecordPath, RTSPURL and every output, instead of
+	// encoding it again for each of them. Default: nil
+	Outputs []OutputSpec
+
+	// SilentAudio adds a silent stereo AAC audio track, for players that
+	// misbehave with video-only streams. Default: false
+	SilentAudio bool
+
+	// DeleteThreshold keeps this many segments on disk after they leave the
+	// playlist before ffmpeg deletes them, so clients that are slightly
+	// behind can still fetch them. A live stream keeps PlaylistSize plus
+	// DeleteThreshold segments on disk, e.g. a small advertised window with
+	// a large buffer for lagging clients when acting as a CDN origin.
+	// Default: 0 (ffmpeg's default of 1)
+	DeleteThreshold int
+
+	// SkipSourceErrors keeps pulling frames after a FrameSource passed to
+	// StartFromSource returns an error other than io.EOF, counting the frame
+	// as dropped, instead of ending the stream. Default: false
+	SkipSourceErrors bool
+
+	// PlaylistType selects a live sliding window or an event or VOD playlist
+	// that keeps every segment. Default: PlaylistTypeLive
+	PlaylistType PlaylistType
+
+	// MaxOriginBandwidth is the bandwidth budget in bits per second for
+	// serving all viewers. When the output bitrate times the number of
+	// clients that recently fetched segments exceeds it, ffmpeg is
+	// restarted with a lower resolution and a bitrate cap, continuing the
+	// playlist after an #EXT-X-DISCONTINUITY, and back at full quality once
+	// the viewers drop. Changes are at least 30 seconds apart. The playlist
+	// is not ended with #EXT-X-ENDLIST when the encoder stops. Default: 0
+	// (no limit)
+	MaxOriginBandwidth int64
+
+	// AutoPixFmt picks InputPixelFormat from the type of the first frame,
+	// so frames are passed to ffmpeg without conversion where possible:
+	// *image.RGBA and *image.NRGBA as rgba, *image.RGBA64 as rgba64be, *NV12
+	// and 4:2:0 *image.YCbCr as nv12, 4:2:2 and 4:4:4 *image.YCbCr as
+	// yuv422p and yuv444p, and *image.Gray as gray. Other types keep the
+	// configured format. Start waits for the first frame before starting
+	// ffmpeg, so AutoPixFmt can't be used with Warmup. Default: false
+	AutoPixFmt bool
+
+	// ShutdownTimeout bounds how long Stop waits for in-flight HTTP requests,
+	// such as slow segment downloads, before closing their connections. It
+	// also bounds each stage of stopping ffmpeg: after stdin is closed
+	// ffmpeg gets this long to write the final segment and exit before it
+	// is sent SIGTERM, and as long again before it is killed. Once the
+	// context the encoder was started with is done, Stop no longer waits
+	// for HTTP requests, which also see that context being done.
+	// Default: 5s
+	ShutdownTimeout time.Duration
+
+	// AbsoluteSegmentURLs serves the playlist with absolute segment URLs
+	// based on the advertised base URL: PublicBaseURL if set, otherwise the
+	// server's own address, or the request's Host on a Unix socket. Some
+	// CDNs and proxies resolve relative URIs incorrectly. The playlist on
+	// disk and in FS() keeps relative URIs. Default: false
+	AbsoluteSegmentURLs bool
+
+	// InputCodec makes the encoder take compressed images, which ffmpeg
+	// decodes itself, instead of raw frames. Frames are then passed to
+	// StartEncoded as one image per []byte and scaled to Width x Height;
+	// InputPixelFormat doesn't apply. Default: "" (raw frames)
+	InputCodec ImageCodec
+
+	// MaxDiskBytes caps the disk space of the kept segments with
+	// PlaylistTypeEvent, PlaylistTypeVOD or a RotateInterval: once their
+	// total size exceeds it, the oldest segments are deleted and dropped
+	// from the served playlist, giving a DVR window of bounded size. The
+	// served playlist then has no #EXT-X-PLAYLIST-TYPE, and the playlist in
+	// FS() still lists the deleted segments. Default: 0 (no limit)
+	MaxDiskBytes int64
+
+	// TextOverlay draws text in the top-left corner of the video that can
+	// be changed at runtime with SetOverlayText, e.g. a live scoreboard,
+	// without restarting ffmpeg. Default: false
+	TextOverlay bool
+
+	// OverlayFontFile is the font file the overlay text and Clock are
+	// drawn with. Default: "" (ffmpeg's default font, which needs
+	// fontconfig)
+	OverlayFontFile string
+
+	// OverlayFontSize is the size of the overlay text and Clock in pixels.
+	// Default: 24
+	OverlayFontSize int
+
+	// ForceKeyFrames forces keyframes at the times given by an ffmpeg
+	// -force_key_frames value: a comma-separated list of times in seconds
+	// such as "0,5.5,10", or an expression such as
+	// "expr:gte(t,n_forced*1)" for one every second, giving players more
+	// switch and seek points than the segment boundaries. ffmpeg can't take
+	// keyframe requests while running, so the times are fixed when the
+	// encoder starts. Default: "" (keyframes chosen by the encoder)
+	ForceKeyFrames string
+
+	// InputFrameRate is the frame rate of the frame source when it runs
+	// faster than FrameRate, e.g. 120 for a camera streamed at 30. Frames
+	// are then dropped evenly before conversion, 3 of every 4 in that
+	// example. An fps filter added with ModifyArgs can't do this, as ffmpeg
+	// reads the raw input at FrameRate and would see every frame as the
+	// next one; such filters see the already decimated frames. It can't be
+	// combined with TimestampSource, which places frames by their
+	// timestamps instead. Default: 0 (every frame is encoded)
+	InputFrameRate int
+
+	// RealtimeInput makes ffmpeg read the frame input at its native frame
+	// rate (-re) instead of as fast as frames arrive. Frames sent faster
+	// block in the pipe to ffmpeg, so a producer that just writes as fast
+	// as it can, such as one looping a decoded video file, plays as a live
+	// channel. Unlike PaceToRealtime the pacing happens in ffmpeg, keeping
+	// its timing exact while frame writes stall. Default: false
+	RealtimeInput bool
+
+	// FallbackSource is an image or video file streamed in place of the
+	// live frames, e.g. an "offline" placeholder, once no frame has arrived
+	// for FallbackTimeout. Images are shown continuously and videos looped;
+	// a helper ffmpeg process decodes it to raw frames, so the stream
+	// continues without restarting the encoder. Live frames take over again
+	// as soon as they arrive. Default: "" (no fallback)
+	FallbackSource string
+
+	// FallbackTimeout is how long live frames may be idle before
+	// FallbackSource is streamed. Default: 3s
+	FallbackTimeout time.Duration
+
+	// SyncSegments flushes every completed segment and the playlist to
+	// stable storage with fsync, and archived periods once moved, so they
+	// survive a crash or power loss. ffmpeg leaves flushing to the
+	// operating system. This costs some write throughput. Default: false
+	SyncSegments bool
+
+	// ThumbnailInterval enables trick-play thumbnails for scrubbing
+	// previews: a frame is taken every interval of stream time and scaled
+	// into JPEG sprite sheets of 5x5 thumbnails, listed with their regions
+	// in a WebVTT track served at /thumbnails.vtt and in an image playlist,
+	// which /master.m3u8 lists as an #EXT-X-IMAGE-STREAM-INF next to the
+	// stream. Cue times are relative to the start of the playlist, so they
+	// suit event and VOD playlists best; in a live window thumbnails older
+	// than the window are deleted. Thumbnails show frames as passed in,
+	// before Transforms. Not supported with InputCodec. Default: 0
+	// (disabled)
+	ThumbnailInterval time.Duration
+
+	// ThumbnailWidth is the width of a thumbnail in pixels. The height
+	// follows the frame's aspect ratio. Default: 160
+	ThumbnailWidth int
+
+	// Profile applies a bundle of encoder settings for a goal; see the
+	// Profile constants. Explicitly set SegmentDuration, SegmentTime and
+	// TargetQuality take precedence over the profile's values. With a
+	// profile a keyframe starts every segment, so segments are cut at exact
+	// durations. Preset and tune apply to libx264 and libx265, and
+	// TargetQuality only to codecs that support it. Default: "" (preset
+	// ultrafast, tune zerolatency)
+	Profile Profile
+
+	// PreserveAlpha keeps the alpha channel of the frames in Outputs, e.g.
+	// for compositing. The Outputs are then encoded apart from the HLS
+	// stream, with a codec chosen by their format: VP9 with yuva420p for
+	// webm and matroska, ProRes 4444 for mov; other formats are rejected.
+	// The HLS stream, RecordPath and RTSPURL can't carry alpha and are
+	// encoded with Codec as usual. Requires an RGBA or RGBA64 input pixel
+	// format or PNG input. Default: false
+	PreserveAlpha bool
+
+	// ProgramDateTime tags every segment in the playlist with
+	// #EXT-X-PROGRAM-DATE-TIME, the wall-clock time of its first frame, so
+	// players and tools can map media time to absolute time. Default: false
+	ProgramDateTime bool
+
+	// MaxWriteErrors is how many failed writes of a frame to ffmpeg are
+	// tolerated in a row, retried with delays doubling from 10ms up to 1s,
+	// before frame processing stops. Writes aren't retried once ffmpeg has
+	// exited. Not supported with WriteBufferSize, as the buffer keeps
+	// failing after an error. Default: 0 (stop at the first failure)
+	MaxWriteErrors int
+
+	// HTTPServer configures the HLS server, e.g. with timeouts, a ConnState
+	// hook or TLS. All its exported fields are copied to the server of every
+	// run; the encoder still supplies the Handler and listener, so Addr and
+	// Handler are ignored. With a TLSConfig, which must provide the certificates,
+	// the stream is served over HTTPS and URL() uses https. Default: nil
+	HTTPServer *http.Server
+
+	// VerifyOrdering checks that the PTS of every TimedFrame is after the
+	// previous one's. Out of order and duplicate frames are dropped rather
+	// than encoded, counted in Stats().OutOfOrderFrames and reported as an
+	// EventFrameOrder. Requires TimestampSourceProvided. Default: false
+	VerifyOrdering bool
+
+	// ExtraListeners are additional TCP addresses, such as
+	// "10.0.0.5:8080" or ":9090", the HLS server listens on next to Port
+	// or UnixSocket, e.g. to serve an internal and an external interface.
+	// All serve the same stream; URLs() lists their URLs. Default: nil
+	ExtraListeners []string
+
+	// DisableCORS omits the CORS headers, which otherwise allow any origin,
+	// so browsers refuse cross-origin playback, e.g. of internal-only
+	// streams. Default: false
+	DisableCORS bool
+
+	// PlaylistSize is the number of segments a live playlist lists. Disk
+	// retention beyond the window is set by DeleteThreshold. Not used by
+	// playlists that keep every segment. Default: 5
+	PlaylistSize int
+
+	// CaptureFrameRate is the rate frames are captured at when it differs
+	// from the FrameRate they are played back at, for timelapse or slow
+	// motion: frames captured at 1 fps and played at 30 give a stream 30
+	// times faster than real time. ffmpeg reads the frames at FrameRate, so
+	// each frame lasts one output frame; the real-time timing of
+	// PaceToRealtime, MaxLatency, TimestampSource and the black frames of
+	// Warmup follows the capture rate instead. Can't be combined with
+	// InputFrameRate, which drops frames to keep real time. Default: 0
+	// (frames are captured at FrameRate)
+	CaptureFrameRate int
+
+	// Clock burns the local wall-clock time of encoding into the top-right
+	// corner of the video, e.g. for screen recordings, drawn like the
+	// overlay text. Start fails if ffmpeg lacks the drawtext filter, which
+	// needs libfreetype. Default: false
+	Clock bool
+
+	// PortFallback makes the HLS server listen on an ephemeral port when
+	// Port is in use, e.g. by another encoder, instead of Start failing with
+	// ErrPortInUse. URL() reports the port actually used. ExtraListeners
+	// don't fall back. Default: false
+	PortFallback bool
+
+	// KeepRunningAfterClose keeps the encoder running once frame
+	// processing has ended, because the frame channel or source was closed,
+	// ctx was done or writing to ffmpeg failed, until Stop is called.
+	// Otherwise the encoder then finalizes the stream: ffmpeg writes the
+	// final segment and #EXT-X-ENDLIST, and the finished stream stays
+	// served until Stop shuts down the HTTP server and removes the output.
+	// Default: false (finalize)
+	KeepRunningAfterClose bool
+
+	// RecordDir records the stream as a complete VOD playlist with its
+	// segments into this directory, which is kept after Stop, instead of
+	// serving it live: no HTTP server runs and Start returns an empty URL.
+	// Serve the finished recording with ServeDir. Requires
+	// PlaylistTypeVOD; can't be combined with RotateInterval or
+	// MaxOriginBandwidth. Default: "" (serve live from a temporary
+	// directory)
+	RecordDir string
+
+	// MIMETypes maps file extensions, with the leading dot such as ".m4s",
+	// to the Content-Type the HLS server sends for them, adding to or
+	// overriding the defaults for the playlists, segments, subtitles and
+	// thumbnails the encoder writes. Default: nil (the defaults)
+	MIMETypes map[string]string
+
+	// StrictFirstFrame makes Start wait for the first frame and check it,
+	// after the Transforms and AutoPixFmt, before starting ffmpeg. A frame
+	// that couldn't be encoded, such as one of the wrong size, fails Start
+	// with an error wrapping ErrInvalidFirstFrame and the cause, e.g. a
+	// *FrameSizeError, instead of every frame of the session being dropped.
+	// Can't be used with Warmup or an InputCodec. Default: false
+	StrictFirstFrame bool
+
+	// Uploader uploads every completed segment, and then the playlist
+	// listing it, to object storage such as an S3 or MinIO bucket, under
+	// the same relative names as in the output directory. A few uploads
+	// run concurrently and failed ones are retried before being reported
+	// as an EventError. Stop waits up to ShutdownTimeout for pending
+	// uploads and uploads the final playlist. Uploaded segments aren't
+	// deleted; expire them with a bucket lifecycle rule. PublicBaseURL
+	// must be the public URL of the uploaded playlist's directory, so URL()
+	// points at the bucket or a CDN in front of it. Can't be combined with
+	// RotateInterval, SingleFile or KeyProvider. Default: nil
+	Uploader Uploader
+
+	// StallTimeout restarts ffmpeg when it keeps running but no new segment
+	// appears for this long while frames are written, e.g. when it is stuck
+	// in a filter. The hung process is killed and a new one continues the
+	// playlist, emitting EventFFmpegStalled and EventFFmpegRestarted. Must
+	// be longer than SegmentDuration. Not used by StartToWriter.
+	// Default: 0 (no watchdog)
+	StallTimeout time.Duration
+
+	// ThreadQueueSize is the number of packets ffmpeg queues from the frame
+	// input (-thread_queue_size), so high resolution or frame rate feeds
+	// don't block on "Thread message queue blocking" under load.
+	// Default: 512
+	ThreadQueueSize int
+
+	// WriteManifestJSON writes stream.json into the output directory,
+	// served next to the playlist, describing the stream for downstream
+	// tooling: dimensions, frame rate, codec, measured bitrate, segment
+	// duration, start time and playlist name. It is rewritten as segments
+	// complete to update the bitrate. Not used by StartToWriter.
+	// Default: false
+	WriteManifestJSON bool
+
+	// BufferStartupFrames is how many frames Start accepts from the channel
+	// without waiting while ffmpeg starts up, until its first progress
+	// report, so producers sending without blocking don't lose the opening
+	// frames of the stream. Buffered frames are held as sent and must not
+	// be modified. Default: 0 (frames are received as they are encoded)
+	BufferStartupFrames int
+
+	// MaxBitrate caps the video bitrate in bits per second (-maxrate, with
+	// a buffer of two seconds at this rate). Together with TargetQuality it
+	// gives capped CRF: constant quality without the bitrate spikes of
+	// complex scenes that break constrained links. Without it the cap
+	// applies to the encoder's default rate control. Default: 0 (no cap)
+	MaxBitrate int64
+
+	// RetryBeforeReady answers playlist requests before the first segment,
+	// when ffmpeg hasn't written the playlist yet, with 503 Service
+	// Unavailable and a Retry-After of one segment duration instead of 404,
+	// so players connecting during startup retry rather than give up.
+	// Default: false
+	RetryBeforeReady bool
+
+	// InputPattern is a numbered image sequence ffmpeg reads the frames
+	// from with StartFromPattern, e.g. "frames/%05d.png", instead of them
+	// being sent to the encoder. The frames are played at InputFrameRate,
+	// if set, and scaled to Width and Height; ffmpeg drops or repeats them
+	// to produce FrameRate. Options that work on the sent frames, such as
+	// Transforms, don't apply. Can't be combined with InputCodec,
+	// RotateInterval or MaxOriginBandwidth. Default: "" (frames are sent)
+	InputPattern string
+
+	// HLSVersion sets the #EXT-X-VERSION of the served and uploaded
+	// playlist instead of the one ffmpeg picks, for older players that
+	// reject newer versions. ffmpeg doesn't change what it writes, so the
+	// version must support the enabled features: at least 3 for the
+	// decimal segment durations ffmpeg writes and 4 for SingleFile's byte
+	// ranges. Default: 0 (ffmpeg's version)
+	HLSVersion int
+
+	// IndependentSegments tags the playlist with
+	// #EXT-X-INDEPENDENT-SEGMENTS (-hls_flags independent_segments), telling
+	// players every segment starts with a keyframe and decodes on its own.
+	// Default: false
+	IndependentSegments bool
+
+	// TempFileSegments makes ffmpeg write each segment to a temporary file
+	// and rename it once complete (-hls_flags temp_file), so a segment file
+	// requested before the playlist lists it is never served half-written.
+	// Default: false
+	TempFileSegments bool
+
+	// MaxPixels and MaxFrameRate cap Width times Height and the frame rates
+	// (FrameRate, InputFrameRate, CaptureFrameRate), e.g. when a
+	// multi-tenant service passes on untrusted configuration: New fails
+	// with an error wrapping ErrLimitExceeded if they are exceeded. Set them
+	// after loading the untrusted options. Default: 0 (no limit)
+	MaxPixels    int
+	MaxFrameRate int
+
+	// IFramePlaylist serves an I-frame only playlist for trick play, fast
+	// forward and rewind scrubbing, at /iframes.m3u8 and lists it in
+	// /master.m3u8 with #EXT-X-I-FRAME-STREAM-INF. It lists the keyframe
+	// each segment starts with as a byte range of the segment, so no extra
+	// files are written. Can't be combined with SingleFile or KeyProvider.
+	// Default: false
+	IFramePlaylist bool
+
+	// ScaleAlgorithm is the scaler ffmpeg uses (-sws_flags) to resize
+	// frames, e.g. decoded InputCodec images, image files of InputPattern
+	// or frames downscaled by MaxOriginBandwidth, and to convert them to
+	// the output pixel format: "fast_bilinear", "bilinear", "bicubic",
+	// "experimental", "neighbor", "area", "bicublin", "gauss", "sinc",
+	// "lanczos" or "spline". "lanczos" looks clearly better when
+	// downscaling but costs more CPU. Default: "bilinear"
+	ScaleAlgorithm string
+
+	// PreviewInterval has ffmpeg write a single JPEG of the current frame
+	// into the output directory every interval, overwriting the previous
+	// one, e.g. for a live preview grid of many streams. It is served at
+	// /PreviewName. Unlike ThumbnailInterval's sprite sheets it keeps no
+	// history. Not written by StartToWriter, which has no output directory.
+	// Default: 0 (disabled)
+	PreviewInterval time.Duration
+
+	// PreviewName is the file name of the PreviewInterval JPEG.
+	// Default: "preview.jpg"
+	PreviewName string
+
+	// VerifySegments decodes every completed segment with ffprobe, which
+	// must be installed, to catch segments that encoder or disk problems
+	// left unplayable. Failing segments are logged, counted in
+	// Stats.CorruptSegments and reported as an EventCorruptSegment; they
+	// stay in the playlist. Verification runs in the background and costs
+	// about as much CPU as decoding the stream. Default: false
+	VerifySegments bool
+
+	// DropLogInterval replaces the log line for each dropped frame with a
+	// summary every interval: the number of frames dropped and the count
+	// for each reason, such as "latency" or "convert", with the last error.
+	// Drops that are otherwise not logged, like MaxLatency ones, are
+	// counted too; frames decimated by InputFrameRate are not. Default: 0
+	// (log each drop that has an error)
+	DropLogInterval time.Duration
+
+	// FrameTimeout detects a dead frame source, one that stopped sending
+	// without closing its channel: once no frame arrived for this long, an
+	// EventSourceStalled is emitted, again after frames resumed and
+	// stopped anew. The stream goes on without new frames, or with
+	// FallbackSource's after FallbackTimeout, unless StopOnFrameTimeout is
+	// set. Not checked before the first frame. Default: 0 (disabled)
+	FrameTimeout time.Duration
+
+	// StopOnFrameTimeout finalizes the stream once FrameTimeout passed, as
+	// if the frame channel had been closed. Default: false
+	StopOnFrameTimeout bool
+
+	// SampleAspectRatio is the shape of the input pixels as width:height,
+	// e.g. "16:15" for some capture devices, so players don't show the
+	// video stretched. Default: "" (square pixels)
+	SampleAspectRatio string
+
+	// WHIPEndpoint additionally publishes the stream over WebRTC to this
+	// WHIP ingest URL, e.g. of an SFU, for sub-second browser latency. It
+	// needs ffmpeg 8.0 or later, built with its WHIP muxer and OpenSSL,
+	// and an H.264 Codec; WebRTC carries no AAC, so it can't be combined
+	// with SilentAudio. As with RTSPURL, the endpoint must accept the
+	// stream when the encoder starts and publishing encodes the frames a
+	// second time unless Outputs share one encode. Default: "" (no WebRTC
+	// output)
+	WHIPEndpoint string
+
+	// MaxConcurrentPerClient bounds the segment downloads each client, by
+	// IP address, has in flight at once, protecting the origin from
+	// aggressive players. Further requests get 429 Too Many Requests with
+	// Retry-After. Clients behind the same NAT or proxy share the limit.
+	// Default: 0 (unlimited)
+	MaxConcurrentPerClient int
+
+	// StreamID names the stream when running many encoders. It is added
+	// to every log line as "stream", to Stats, /stats.json, every Event and
+	// the stream manifest, and to the name of the temporary output
+	// directory. Letters, digits, '-', '_' and '.' only. Default: ""
+	StreamID string
+
+	// DumpFramesDir saves received frames as PNG files in this directory,
+	// e.g. to diff a frame generator's output against golden images.
+	// Frames are saved as passed to the encoder, before Transforms and
+	// pixel format conversion, named after their number since Start, e.g.
+	// frame-00000042.png, and overwritten by the next run. Frames passed to
+	// StartEncoded are not saved. For diagnostics only: PNG encoding runs
+	// in the frame loop and takes far longer than a frame interval at
+	// common sizes, so use DumpFramesEvery to sample. Default: "" (disabled)
+	DumpFramesDir string
+
+	// DumpFramesEvery saves only every n-th received frame to
+	// DumpFramesDir, starting with the first. Default: 1
+	DumpFramesEvery int
+
+	// WaitForFFmpegStart has Start and StartToWriter wait briefly after
+	// launching ffmpeg and fail with ffmpeg's error output if it exited,
+	// as it does right away on invalid arguments, ModifyArgs mistakes or a
+	// missing encoder, rather than the failure only surfacing once frames
+	// can't be written. It delays every start by half a second. Default:
+	// false
+	WaitForFFmpegStart bool
+
+	// ResponseHeaders sets extra HTTP headers on the HLS server's responses
+	// for files by extension, with the leading dot, e.g. {".ts":
+	// {"Surrogate-Control": "max-age=60"}, ".m3u8": {"Cache-Control":
+	// "max-age=1"}} for a CDN in front of it. They replace the default
+	// headers with the same name, such as the live Cache-Control, so
+	// setting caching headers for playlists risks serving stale ones.
+	// Default: nil (no extra headers)
+	ResponseHeaders map[string]map[string]string
+
+	// MaxFrames ends the stream once this many frames are written, as if
+	// the frame channel was closed: the stream is finalized and, with
+	// PlaylistTypeVOD, gets its #EXT-X-ENDLIST, for clips of an exact
+	// length whatever the timing of the channel. Every frame written
+	// counts, including frames repeated for a TimestampSource and the
+	// black frames of Warmup. Default: 0 (unlimited)
+	MaxFrames int
+
+	// FinalizeOnCancel finalizes the stream when the ctx passed to Start is
+	// done, as when the frame channel is closed: ffmpeg writes the final
+	// segment and #EXT-X-ENDLIST, and the finished stream is served until
+	// Stop. Otherwise a done ctx aborts the run: ffmpeg is killed, leaving
+	// the playlist unfinished, and the encoder stops as with Stop. Set it
+	// when ctx is the main lifecycle control, e.g. of an HTTP request,
+	// and the stream must end valid. Default: false (abort)
+	FinalizeOnCancel bool
+
+	// throttle is the output reduction the bandwidth governor applied to
+	// the current ffmpeg process
+	throttle throttleLevel
+
+	// overlayFile is the file the overlay text is read from while running
+	overlayFile string
 }
 
+// defaultStrftimeSegmentFilename is the segment name template used when
+// StrftimeSegments is set without a SegmentFilename.
+const defaultStrftimeSegmentFilename = "stream-%Y%m%d-%H%M%S.ts"
+
 // DefaultOptions returns Options with default values.
 func DefaultOptions() Options {
 	return Options{
-		Width:           1920,
-		Height:          1080,
-		FrameRate:       30,
-		SegmentDuration: 2,
-		Port:            0,
+		Width:            1920,
+		Height:           1080,
+		FrameRate:        30,
+		SegmentDuration:  2,
+		Port:             0,
+		InputPixelFormat: PixelFormatRGBA,
+		BitDepth:         8,
+		BindRetryDelay:   100 * time.Millisecond,
+		Codec:            "libx264",
+		IPVersion:        IPVersionAuto,
+		PlaylistType:     PlaylistTypeLive,
+		ShutdownTimeout:  5 * time.Second,
+		OverlayFontSize:  24,
+		FallbackTimeout:  3 * time.Second,
+		ThumbnailWidth:   160,
+		PlaylistSize:     5,
+		ThreadQueueSize:  512,
+		ScaleAlgorithm:   "bilinear",
+		PreviewName:      "preview.jpg",
+		DumpFramesEvery:  1,
 	}
 }
 
@@ -42,10 +921,532 @@ func (opts Options) withDefaults() Options {
 	if opts.FrameRate == 0 {
 		opts.FrameRate = defaults.FrameRate
 	}
+	if opts.Codec == "" {
+		opts.Codec = defaults.Codec
+	}
+	opts = opts.withProfile()
 	if opts.SegmentDuration == 0 {
 		opts.SegmentDuration = defaults.SegmentDuration
 	}
+	if opts.IPVersion == "" {
+		opts.IPVersion = defaults.IPVersion
+	}
+	if opts.FallbackTimeout == 0 {
+		opts.FallbackTimeout = defaults.FallbackTimeout
+	}
+	if opts.OverlayFontSize == 0 {
+		opts.OverlayFontSize = defaults.OverlayFontSize
+	}
+	if opts.ThumbnailWidth == 0 {
+		opts.ThumbnailWidth = defaults.ThumbnailWidth
+	}
+	if opts.PlaylistSize == 0 {
+		opts.PlaylistSize = defaults.PlaylistSize
+	}
+	if opts.ThreadQueueSize == 0 {
+		opts.ThreadQueueSize = defaults.ThreadQueueSize
+	}
+	if opts.ScaleAlgorithm == "" {
+		opts.ScaleAlgorithm = defaults.ScaleAlgorithm
+	}
+	if opts.PreviewName == "" {
+		opts.PreviewName = defaults.PreviewName
+	}
+	if opts.DumpFramesEvery == 0 {
+		opts.DumpFramesEvery = defaults.DumpFramesEvery
+	}
+	if opts.PlaylistType == "" {
+		opts.PlaylistType = defaults.PlaylistType
+	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaults.ShutdownTimeout
+	}
+	if opts.BindRetryDelay == 0 {
+		opts.BindRetryDelay = defaults.BindRetryDelay
+	}
+	if opts.BitDepth == 0 {
+		opts.BitDepth = defaults.BitDepth
+	}
+	if opts.InputPixelFormat == "" {
+		opts.InputPixelFormat = defaults.InputPixelFormat
+	}
+	if opts.SlowOutputThreshold == 0 {
+		opts.SlowOutputThreshold = 2 * opts.segmentDuration()
+	}
+	if opts.StrftimeSegments && opts.SegmentFilename == "" {
+		opts.SegmentFilename = defaultStrftimeSegmentFilename
+	}
 	// Port 0 is valid (auto-assign), so we don't apply default
 
 	return opts
 }
+
+// logger returns the configured logger, or one that discards everything.
+func (opts Options) logger() *slog.Logger {
+	if opts.Logger == nil {
+		return discardLogger
+	}
+	if opts.StreamID != "" {
+		return opts.Logger.With("stream", opts.StreamID)
+	}
+	return opts.Logger
+}
+
+// discardLogger is used when no Logger is configured.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// segmentDuration returns the effective HLS segment duration.
+func (opts Options) segmentDuration() time.Duration {
+	if opts.SegmentTime > 0 {
+		return opts.SegmentTime
+	}
+	return time.Duration(opts.SegmentDuration) * time.Second
+}
+
+// captureRate returns the rate frames arrive at in real time.
+func (opts Options) captureRate() int {
+	if opts.CaptureFrameRate > 0 {
+		return opts.CaptureFrameRate
+	}
+	return opts.FrameRate
+}
+
+// captureInterval returns the real time between two frames.
+func (opts Options) captureInterval() time.Duration {
+	return time.Second / time.Duration(opts.captureRate())
+}
+
+// isH264Codec reports whether codec is an H.264 encoder, such as libx264
+// or h264_nvenc.
+func isH264Codec(codec string) bool {
+	return codec == "libx264" || strings.HasPrefix(codec, "h264_")
+}
+
+// validHeaderName reports whether name is a valid HTTP header name: a
+// non-empty token of printable ASCII without separators.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validStreamID reports whether id is empty or made of letters, digits,
+// '-', '_' and '.' only, so it is safe in a file name.
+func validStreamID(id string) bool {
+	for _, r := range id {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-_.", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validRatio reports whether s is a ratio of two positive integers such as
+// "16:15".
+func validRatio(s string) bool {
+	num, den, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	for _, part := range []string{num, den} {
+		n, err := strconv.Atoi(part)
+		if err != nil || n <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// idleCheckInterval returns how often the frame loop checks for idle live
+// frames, for FallbackSource and FrameTimeout, or 0 if it needn't.
+func idleCheckInterval(opts Options) time.Duration {
+	var interval time.Duration
+	if opts.FallbackSource != "" {
+		interval = opts.FallbackTimeout / 4
+	}
+	if opts.FrameTimeout > 0 && (interval == 0 || opts.FrameTimeout/4 < interval) {
+		interval = max(opts.FrameTimeout/4, 1)
+	}
+	return interval
+}
+
+// frameSize returns the size in bytes of one raw frame in the input pixel
+// format.
+func (opts Options) frameSize() int {
+	switch opts.InputPixelFormat {
+	case PixelFormatNV12:
+		return opts.Width*opts.Height + opts.Width*opts.Height/2
+	case PixelFormatRGBA64:
+		return opts.Width * opts.Height * 8
+	case PixelFormatGray:
+		return opts.Width * opts.Height
+	case PixelFormatYUV422P:
+		return opts.Width * opts.Height * 2
+	case PixelFormatYUV444P:
+		return opts.Width * opts.Height * 3
+	default:
+		return opts.Width * opts.Height * 4
+	}
+}
+
+// validate reports whether the options (with defaults applied) are usable.
+func (opts Options) validate() error {
+	if opts.Width < 0 || opts.Height < 0 {
+		return fmt.Errorf("invalid frame size %dx%d", opts.Width, opts.Height)
+	}
+	if opts.FrameRate < 0 {
+		return fmt.Errorf("invalid frame rate %d", opts.FrameRate)
+	}
+	if opts.InputFrameRate < 0 {
+		return fmt.Errorf("invalid input frame rate %d", opts.InputFrameRate)
+	}
+	if opts.InputFrameRate > 0 && opts.TimestampSource != "" {
+		return fmt.Errorf("input frame rate cannot be combined with a timestamp source")
+	}
+	if opts.CaptureFrameRate < 0 {
+		return fmt.Errorf("invalid capture frame rate %d", opts.CaptureFrameRate)
+	}
+	if opts.CaptureFrameRate > 0 && opts.InputFrameRate > 0 {
+		return fmt.Errorf("capture frame rate cannot be combined with an input frame rate")
+	}
+	if opts.Width%2 != 0 || opts.Height%2 != 0 {
+		return fmt.Errorf("%w, got %dx%d; pad or crop frames to %dx%d",
+			ErrOddDimensions, opts.Width, opts.Height, opts.Width+opts.Width%2, opts.Height+opts.Height%2)
+	}
+	switch opts.InputPixelFormat {
+	case PixelFormatRGBA, PixelFormatRGBA64, PixelFormatNV12,
+		PixelFormatGray, PixelFormatYUV422P, PixelFormatYUV444P:
+	default:
+		return fmt.Errorf("unsupported input pixel format %q", opts.InputPixelFormat)
+	}
+	switch opts.InputCodec {
+	case "", ImageCodecJPEG, ImageCodecPNG:
+	default:
+		return fmt.Errorf("unsupported input codec %q", opts.InputCodec)
+	}
+	if opts.InputCodec != "" && (len(opts.Transforms) > 0 || opts.AutoPixFmt || opts.StrictFirstFrame || opts.TimestampSource != "" || opts.MaxLatency > 0) {
+		return fmt.Errorf("input codec cannot be combined with Transforms, AutoPixFmt, StrictFirstFrame, TimestampSource or MaxLatency")
+	}
+	switch opts.ColorRange {
+	case "", ColorRangeLimited, ColorRangeFull:
+	default:
+		return fmt.Errorf("unsupported color range %q", opts.ColorRange)
+	}
+	switch opts.TimestampSource {
+	case "", TimestampSourceWallClock, TimestampSourceMonotonic, TimestampSourceProvided:
+	default:
+		return fmt.Errorf("unsupported timestamp source %q", opts.TimestampSource)
+	}
+	if opts.BitDepth != 8 && opts.BitDepth != 10 {
+		return fmt.Errorf("unsupported bit depth %d, must be 8 or 10", opts.BitDepth)
+	}
+	if formats, ok := codecPixelFormats[opts.Codec]; ok {
+		if _, ok := formats[opts.BitDepth]; !ok {
+			return fmt.Errorf("codec %s cannot encode bit depth %d, supported: %s", opts.Codec, opts.BitDepth, supportedBitDepths(opts.Codec))
+		}
+	}
+	if opts.SegmentDuration < 0 {
+		return fmt.Errorf("invalid segment duration %d", opts.SegmentDuration)
+	}
+	if opts.SegmentTime < 0 {
+		return fmt.Errorf("invalid segment time %v", opts.SegmentTime)
+	}
+	if opts.MaxOriginBandwidth < 0 {
+		return fmt.Errorf("invalid max origin bandwidth %d", opts.MaxOriginBandwidth)
+	}
+	if opts.MaxOriginBandwidth > 0 && (opts.RotateInterval > 0 || opts.SingleFile) {
+		return fmt.Errorf("max origin bandwidth cannot be combined with output rotation or SingleFile")
+	}
+	if opts.RecordDir != "" && opts.PlaylistType != PlaylistTypeVOD {
+		return fmt.Errorf("record dir requires PlaylistTypeVOD")
+	}
+	if opts.RecordDir != "" && (opts.RotateInterval > 0 || opts.MaxOriginBandwidth > 0) {
+		return fmt.Errorf("record dir cannot be combined with output rotation or max origin bandwidth")
+	}
+	if opts.Uploader != nil {
+		if opts.PublicBaseURL == "" {
+			return fmt.Errorf("uploader requires the PublicBaseURL of the uploaded files")
+		}
+		if opts.RotateInterval > 0 || opts.SingleFile || opts.KeyProvider != nil {
+			return fmt.Errorf("uploader cannot be combined with output rotation, SingleFile or KeyProvider")
+		}
+	}
+	for ext := range opts.MIMETypes {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("MIME type extension %q must start with a dot", ext)
+		}
+	}
+	for ext, headers := range opts.ResponseHeaders {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("response header extension %q must start with a dot", ext)
+		}
+		for name, value := range headers {
+			if !validHeaderName(name) || strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid response header %q: %q for %s", name, value, ext)
+			}
+		}
+	}
+	if opts.FallbackTimeout < 0 {
+		return fmt.Errorf("invalid fallback timeout %v", opts.FallbackTimeout)
+	}
+	if opts.FallbackSource != "" && opts.InputCodec != "" {
+		return fmt.Errorf("fallback source cannot be combined with an input codec")
+	}
+	if opts.OverlayFontSize < 0 {
+		return fmt.Errorf("invalid overlay font size %d", opts.OverlayFontSize)
+	}
+	if opts.VerifyOrdering && opts.TimestampSource != TimestampSourceProvided {
+		return fmt.Errorf("frame ordering can only be verified with TimestampSourceProvided")
+	}
+	for _, addr := range opts.ExtraListeners {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid extra listener address %q: %w", addr, err)
+		}
+	}
+	if opts.MaxWriteErrors < 0 {
+		return fmt.Errorf("invalid max write errors %d", opts.MaxWriteErrors)
+	}
+	if opts.MaxWriteErrors > 0 && opts.WriteBufferSize > 0 {
+		return fmt.Errorf("max write errors cannot be combined with WriteBufferSize")
+	}
+	if opts.ThumbnailInterval < 0 {
+		return fmt.Errorf("invalid thumbnail interval %v", opts.ThumbnailInterval)
+	}
+	if opts.ThumbnailWidth < 0 {
+		return fmt.Errorf("invalid thumbnail width %d", opts.ThumbnailWidth)
+	}
+	if opts.ThumbnailInterval > 0 && opts.InputCodec != "" {
+		return fmt.Errorf("thumbnails cannot be combined with an input codec")
+	}
+	if opts.MaxDiskBytes < 0 {
+		return fmt.Errorf("invalid max disk bytes %d", opts.MaxDiskBytes)
+	}
+	if opts.MaxDiskBytes > 0 && (!keepsAllSegments(opts) || opts.SingleFile) {
+		return fmt.Errorf("max disk bytes requires kept segments in separate files: PlaylistTypeEvent, PlaylistTypeVOD or RotateInterval without SingleFile")
+	}
+	if opts.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout %v", opts.ShutdownTimeout)
+	}
+	if opts.DeleteThreshold < 0 {
+		return fmt.Errorf("invalid delete threshold %d", opts.DeleteThreshold)
+	}
+	if opts.PlaylistSize < 0 {
+		return fmt.Errorf("invalid playlist size %d", opts.PlaylistSize)
+	}
+	if opts.BufferStartupFrames < 0 {
+		return fmt.Errorf("invalid startup frame buffer %d", opts.BufferStartupFrames)
+	}
+	if opts.ThreadQueueSize < 0 {
+		return fmt.Errorf("invalid thread queue size %d", opts.ThreadQueueSize)
+	}
+	if opts.DeleteThreshold > 0 && !deletesSegments(opts) {
+		return fmt.Errorf("delete threshold requires a live playlist with a file per segment")
+	}
+	if opts.SlowOutputThreshold < 0 {
+		return fmt.Errorf("invalid slow output threshold %v", opts.SlowOutputThreshold)
+	}
+	if opts.StallTimeout < 0 || (opts.StallTimeout > 0 && opts.StallTimeout <= opts.segmentDuration()) {
+		return fmt.Errorf("stall timeout %v must be longer than the segment duration", opts.StallTimeout)
+	}
+	if opts.MaxSegmentSize < 0 {
+		return fmt.Errorf("invalid max segment size %d", opts.MaxSegmentSize)
+	}
+	if opts.MinSegmentsBeforeReady < 0 {
+		return fmt.Errorf("invalid minimum segments %d", opts.MinSegmentsBeforeReady)
+	}
+	if size := playlistSize(opts); size > 0 && opts.MinSegmentsBeforeReady > size {
+		return fmt.Errorf("minimum segments %d exceeds the playlist size %d", opts.MinSegmentsBeforeReady, size)
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("invalid port %d", opts.Port)
+	}
+	if opts.UnixSocket != "" && opts.Port != 0 {
+		return fmt.Errorf("port and unix socket are mutually exclusive")
+	}
+	switch opts.PlaylistType {
+	case PlaylistTypeLive, PlaylistTypeEvent, PlaylistTypeVOD:
+	default:
+		return fmt.Errorf("unsupported playlist type %q", opts.PlaylistType)
+	}
+	switch opts.IPVersion {
+	case IPVersionAuto, IPVersion4, IPVersion6:
+	default:
+		return fmt.Errorf("unsupported IP version %q", opts.IPVersion)
+	}
+	if opts.BindRetries < 0 {
+		return fmt.Errorf("invalid bind retries %d", opts.BindRetries)
+	}
+	if opts.BindRetryDelay < 0 {
+		return fmt.Errorf("invalid bind retry delay %v", opts.BindRetryDelay)
+	}
+	if opts.SegmentFilename != "" {
+		if strings.ContainsAny(opts.SegmentFilename, `/\`) || opts.SegmentFilename == ".." {
+			return fmt.Errorf("segment filename %q must not contain a path", opts.SegmentFilename)
+		}
+	}
+	if err := opts.validateProfile(); err != nil {
+		return err
+	}
+	if err := opts.validateAlpha(); err != nil {
+		return err
+	}
+	if opts.TargetQuality != 0 {
+		if opts.TargetQuality < 1 || opts.TargetQuality > 100 {
+			return fmt.Errorf("target quality %d out of range 1-100", opts.TargetQuality)
+		}
+		if maxCRF(opts.Codec) == 0 {
+			return fmt.Errorf("target quality is not supported for codec %s", opts.Codec)
+		}
+	}
+	if opts.InputPattern != "" {
+		if !patternNumber.MatchString(opts.InputPattern) {
+			return fmt.Errorf("input pattern %q has no frame number such as %%05d", opts.InputPattern)
+		}
+		if opts.InputCodec != "" || opts.RotateInterval > 0 || opts.MaxOriginBandwidth > 0 {
+			return fmt.Errorf("input pattern cannot be combined with an input codec, output rotation or max origin bandwidth")
+		}
+	}
+	if opts.MaxPixels < 0 || opts.MaxFrameRate < 0 {
+		return fmt.Errorf("invalid limits of %d pixels and %d fps", opts.MaxPixels, opts.MaxFrameRate)
+	}
+	if opts.MaxPixels > 0 && opts.Width*opts.Height > opts.MaxPixels {
+		return fmt.Errorf("%w: %dx%d is more than %d pixels", ErrLimitExceeded, opts.Width, opts.Height, opts.MaxPixels)
+	}
+	if opts.MaxFrameRate > 0 {
+		for _, rate := range []int{opts.FrameRate, opts.InputFrameRate, opts.CaptureFrameRate} {
+			if rate > opts.MaxFrameRate {
+				return fmt.Errorf("%w: %d fps is more than %d", ErrLimitExceeded, rate, opts.MaxFrameRate)
+			}
+		}
+	}
+	if opts.IFramePlaylist && (opts.SingleFile || opts.KeyProvider != nil) {
+		return fmt.Errorf("i-frame playlist cannot be combined with SingleFile or KeyProvider")
+	}
+	switch opts.ScaleAlgorithm {
+	case "", "fast_bilinear", "bilinear", "bicubic", "experimental", "neighbor",
+		"area", "bicublin", "gauss", "sinc", "lanczos", "spline":
+	default:
+		return fmt.Errorf("unsupported scale algorithm %q", opts.ScaleAlgorithm)
+	}
+	if opts.SampleAspectRatio != "" && !validRatio(opts.SampleAspectRatio) {
+		return fmt.Errorf("invalid sample aspect ratio %q, want width:height such as 16:15", opts.SampleAspectRatio)
+	}
+	if opts.FrameTimeout < 0 {
+		return fmt.Errorf("invalid frame timeout %v", opts.FrameTimeout)
+	}
+	if opts.StopOnFrameTimeout && opts.FrameTimeout == 0 {
+		return fmt.Errorf("stop on frame timeout needs a frame timeout")
+	}
+	if opts.DropLogInterval < 0 {
+		return fmt.Errorf("invalid drop log interval %v", opts.DropLogInterval)
+	}
+	if opts.PreviewInterval < 0 {
+		return fmt.Errorf("invalid preview interval %v", opts.PreviewInterval)
+	}
+	if name := strings.ToLower(opts.PreviewName); name != "" &&
+		(strings.ContainsAny(name, `/\`) || !(strings.HasSuffix(name, ".jpg") || strings.HasSuffix(name, ".jpeg"))) {
+		return fmt.Errorf("invalid preview name %q, want a .jpg file name", opts.PreviewName)
+	}
+	if opts.HLSVersion != 0 {
+		minVersion := 3
+		if opts.SingleFile {
+			minVersion = 4
+		}
+		if opts.HLSVersion < minVersion {
+			return fmt.Errorf("HLS version %d doesn't support the enabled features, which need version %d", opts.HLSVersion, minVersion)
+		}
+	}
+	if opts.MaxBitrate < 0 {
+		return fmt.Errorf("invalid max bitrate %d", opts.MaxBitrate)
+	}
+	if opts.SingleFile {
+		if opts.StrftimeSegments {
+			return fmt.Errorf("single file output cannot use strftime segment names")
+		}
+		if opts.MaxSegmentSize > 0 {
+			return fmt.Errorf("single file output cannot split segments by size")
+		}
+		if opts.SegmentChecksums {
+			return fmt.Errorf("segment checksums are not supported with single file output")
+		}
+	}
+	if opts.WriteBufferSize < 0 {
+		return fmt.Errorf("invalid write buffer size %d", opts.WriteBufferSize)
+	}
+	if opts.Threads < 0 {
+		return fmt.Errorf("invalid thread count %d", opts.Threads)
+	}
+	if opts.MaxLatency < 0 {
+		return fmt.Errorf("invalid max latency %v", opts.MaxLatency)
+	}
+	if opts.KeyRotationInterval < 0 {
+		return fmt.Errorf("invalid key rotation interval %v", opts.KeyRotationInterval)
+	}
+	if opts.KeyRotationInterval > 0 && opts.KeyProvider == nil {
+		return fmt.Errorf("key rotation requires a KeyProvider")
+	}
+	if opts.RotateInterval < 0 {
+		return fmt.Errorf("invalid rotate interval %v", opts.RotateInterval)
+	}
+	if opts.RotateInterval > 0 {
+		if opts.ArchiveDir == "" {
+			return fmt.Errorf("output rotation requires an ArchiveDir")
+		}
+		if opts.RecordPath != "" {
+			return fmt.Errorf("output rotation cannot be combined with RecordPath")
+		}
+		if len(opts.Outputs) > 0 {
+			return fmt.Errorf("output rotation cannot be combined with Outputs")
+		}
+	}
+	for _, out := range opts.Outputs {
+		if err := out.validate(); err != nil {
+			return err
+		}
+	}
+	if opts.RTSPURL != "" {
+		u, err := url.Parse(opts.RTSPURL)
+		if err != nil || (u.Scheme != "rtsp" && u.Scheme != "rtsps") || u.Host == "" {
+			return fmt.Errorf("invalid RTSP URL %q", opts.RTSPURL)
+		}
+	}
+	if !validStreamID(opts.StreamID) {
+		return fmt.Errorf("invalid stream ID %q, want letters, digits, '-', '_' and '.'", opts.StreamID)
+	}
+	if opts.MaxFrames < 0 {
+		return fmt.Errorf("invalid max frames %d", opts.MaxFrames)
+	}
+	if opts.DumpFramesEvery < 0 {
+		return fmt.Errorf("invalid dump frames interval %d", opts.DumpFramesEvery)
+	}
+	if opts.MaxConcurrentPerClient < 0 {
+		return fmt.Errorf("invalid max concurrent requests per client %d", opts.MaxConcurrentPerClient)
+	}
+	if opts.WHIPEndpoint != "" {
+		u, err := url.Parse(opts.WHIPEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid WHIP endpoint %q", opts.WHIPEndpoint)
+		}
+		if !isH264Codec(opts.Codec) || opts.SilentAudio {
+			return fmt.Errorf("WHIP needs an H.264 codec and cannot be combined with SilentAudio")
+		}
+	}
+	if opts.PublicBaseURL != "" {
+		u, err := url.Parse(opts.PublicBaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid public base URL %q", opts.PublicBaseURL)
+		}
+	}
+	for key := range opts.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", key)
+		}
+	}
+	return nil
+}
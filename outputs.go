@@ -0,0 +1,96 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// OutputSpec describes an additional output written from the same encode as
+// the HLS stream.
+type OutputSpec struct {
+	// Format is the ffmpeg muxer, e.g. "mp4", "dash", "mpegts" or "flv".
+	Format string
+
+	// Path is the output file path or URL, e.g. /srv/dash/stream.mpd or
+	// rtmp://host/app/key.
+	Path string
+
+	// Options are muxer options without the leading dash, e.g.
+	// {"movflags": "+faststart"}. The tee muxer's own per-output options may
+	// be given too, such as {"onfail": "ignore"} to keep the other outputs
+	// running if this one fails.
+	Options map[string]string
+}
+
+// validate checks the output spec.
+func (o OutputSpec) validate() error {
+	if o.Format == "" {
+		return fmt.Errorf("output %q has no format", o.Path)
+	}
+	if o.Path == "" {
+		return fmt.Errorf("%s output has no path", o.Format)
+	}
+	for name := range o.Options {
+		if name == "" || strings.HasPrefix(name, "-") {
+			return fmt.Errorf("invalid option name %q for %s output", name, o.Format)
+		}
+	}
+	return nil
+}
+
+// args returns the ffmpeg output arguments for the spec.
+func (o OutputSpec) args() []string {
+	names := make([]string, 0, len(o.Options))
+	for name := range o.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{"-f", o.Format}
+	for _, name := range names {
+		args = append(args, "-"+name, o.Options[name])
+	}
+	return append(args, o.Path)
+}
+
+// teeOutput returns the tee muxer target that writes every output, each
+// given as ffmpeg output arguments: option pairs followed by the path.
+func teeOutput(outputs [][]string) string {
+	slaves := make([]string, len(outputs))
+	for i, out := range outputs {
+		slaves[i] = teeSlave(out)
+	}
+	return strings.Join(slaves, "|")
+}
+
+// teeSlave converts output arguments such as [-f hls -hls_time 2 path] to a
+// tee slave such as [f=hls:hls_time=2]path.
+//
+// The tee muxer unescapes the slave list, then the bracketed options, then
+// each option value, so option values are escaped for all three levels and
+// the path for the first only.
+func teeSlave(args []string) string {
+	path := args[len(args)-1]
+
+	var options []string
+	for i := 0; i+1 < len(args)-1; i += 2 {
+		name := strings.TrimPrefix(args[i], "-")
+		options = append(options, name+"="+escapeTee(args[i+1], ":="))
+	}
+
+	return escapeTee("["+escapeTee(strings.Join(options, ":"), "]")+"]", "|") + escapeTee(path, "|")
+}
+
+// escapeTee backslash-escapes backslashes, quotes and the special characters
+// in s.
+func escapeTee(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || r == '\'' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
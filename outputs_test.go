@@ -0,0 +1,117 @@
+package nimsforestencoder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// teeToken reads a token of s up to an unescaped character of term, as
+// ffmpeg's av_get_token does: a backslash escapes the next character and
+// single quotes enclose literal text.
+func teeToken(s, term string) (token, rest string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				end = len(s) - i - 1
+			}
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case strings.IndexByte(term, c) >= 0:
+			return b.String(), s[i:]
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), ""
+}
+
+// parseTee splits a tee muxer target the way the tee muxer does, into the
+// options and path of every slave.
+func parseTee(t *testing.T, target string) (options []map[string]string, paths []string) {
+	t.Helper()
+	for rest := target; ; rest = rest[1:] {
+		var slave string
+		slave, rest = teeToken(rest, "|")
+
+		opts := make(map[string]string)
+		if list, ok := strings.CutPrefix(slave, "["); ok {
+			list, slave = teeToken(list, "]")
+			if !strings.HasPrefix(slave, "]") {
+				t.Fatalf("slave options %q not closed in %q", list, target)
+			}
+			slave = slave[1:]
+			for list != "" {
+				var key, value string
+				key, list = teeToken(list, "=")
+				if !strings.HasPrefix(list, "=") {
+					t.Fatalf("option %q has no value in %q", key, target)
+				}
+				value, list = teeToken(list[1:], ":")
+				opts[key] = value
+				list = strings.TrimPrefix(list, ":")
+			}
+		}
+		options = append(options, opts)
+		paths = append(paths, slave)
+		if rest == "" {
+			return options, paths
+		}
+	}
+}
+
+func TestTeeOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		outputs []OutputSpec
+		want    string // "" to only check the round trip
+	}{
+		{"plain", []OutputSpec{{Format: "mp4", Path: "/srv/out.mp4"}}, "[f=mp4]/srv/out.mp4"},
+		{"rtmp url", []OutputSpec{{Format: "flv", Path: "rtmp://host:1935/app/key"}}, "[f=flv]rtmp://host:1935/app/key"},
+		{"pipe in path", []OutputSpec{{Format: "mpegts", Path: "a|b.ts"}}, `[f=mpegts]a\|b.ts`},
+		{"quote and backslash in path", []OutputSpec{{Format: "mp4", Path: `C:\out\it's.mp4`}}, `[f=mp4]C:\\out\\it\'s.mp4`},
+		{"brackets in path", []OutputSpec{{Format: "mp4", Path: "/srv/[live]/out.mp4"}}, ""},
+		{"option values", []OutputSpec{{Format: "mp4", Path: "out.mp4", Options: map[string]string{
+			"metadata": "title=a:b",
+			"movflags": "+faststart",
+		}}}, ""},
+		{"special option value", []OutputSpec{{Format: "mpegts", Path: "out.ts", Options: map[string]string{
+			"select": `v]|'x\y`,
+		}}}, ""},
+		{"several outputs", []OutputSpec{
+			{Format: "mp4", Path: "one|[1].mp4", Options: map[string]string{"onfail": "ignore"}},
+			{Format: "flv", Path: `rtmp://host/app/'key'`},
+		}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := make([][]string, len(tc.outputs))
+			for i, out := range tc.outputs {
+				args[i] = out.args()
+			}
+			target := teeOutput(args)
+			if tc.want != "" && target != tc.want {
+				t.Errorf("teeOutput = %q, want %q", target, tc.want)
+			}
+
+			options, paths := parseTee(t, target)
+			if len(paths) != len(tc.outputs) {
+				t.Fatalf("%q parses as %d outputs, want %d", target, len(paths), len(tc.outputs))
+			}
+			for i, out := range tc.outputs {
+				want := map[string]string{"f": out.Format}
+				for name, value := range out.Options {
+					want[name] = value
+				}
+				if paths[i] != out.Path || !reflect.DeepEqual(options[i], want) {
+					t.Errorf("%q output %d parses as %v %q, want %v %q", target, i, options[i], paths[i], want, out.Path)
+				}
+			}
+		})
+	}
+}
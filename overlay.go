@@ -0,0 +1,136 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SetOverlayText changes the text drawn with Options.TextOverlay, taking
+// effect within a frame. It may be called before the encoder starts to set
+// the initial text. Multi-line text is drawn as multiple lines.
+func (e *Encoder) SetOverlayText(text string) error {
+	if !e.opts.TextOverlay {
+		return fmt.Errorf("text overlay is not enabled")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.overlayText = text
+	if e.opts.overlayFile == "" {
+		return nil
+	}
+	return writeOverlayText(e.opts.overlayFile, text)
+}
+
+// startOverlay creates the file ffmpeg reads the overlay text from, if the
+// overlay is enabled. It lives outside the output directory, which isn't
+// there when encoding to a writer. It also checks that ffmpeg can draw the
+// Clock. Callers must hold e.mu.
+func (e *Encoder) startOverlay() error {
+	if err := checkDrawtext(e.opts); err != nil {
+		return err
+	}
+	if !e.opts.TextOverlay {
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "nimsforestencoder-overlay-*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create overlay text file: %w", err)
+	}
+	f.Close()
+
+	if err := writeOverlayText(f.Name(), e.overlayText); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	e.opts.overlayFile = f.Name()
+	return nil
+}
+
+// stopOverlay removes the overlay text file. Callers must hold e.mu.
+func (e *Encoder) stopOverlay() {
+	if e.opts.overlayFile != "" {
+		os.Remove(e.opts.overlayFile)
+		e.opts.overlayFile = ""
+	}
+}
+
+// writeOverlayText replaces the contents of the overlay text file at path.
+func writeOverlayText(path, text string) error {
+	// drawtext re-reads the file every frame, so it must never see a
+	// partially written one
+	if err := replaceFile(path, []byte(text)); err != nil {
+		return fmt.Errorf("failed to write overlay text: %w", err)
+	}
+	return nil
+}
+
+// overlayFilter returns the drawtext filter that draws the overlay text.
+func overlayFilter(opts Options) string {
+	options := []string{
+		"textfile=" + escapeFilterValue(opts.overlayFile),
+		"reload=1",
+		// Draw the text as is rather than expanding %{...} sequences
+		"expansion=none",
+		fmt.Sprintf("fontsize=%d", opts.OverlayFontSize),
+		"fontcolor=white",
+		// Readable on any background
+		"box=1",
+		"boxcolor=black@0.5",
+		"boxborderw=5",
+		"x=10",
+		"y=10",
+	}
+	if opts.OverlayFontFile != "" {
+		options = append(options, "fontfile="+escapeFilterValue(opts.OverlayFontFile))
+	}
+	return "drawtext=" + strings.Join(options, ":")
+}
+
+// clockFilter returns the drawtext filter that draws the wall-clock time
+// for Options.Clock in the top-right corner, clear of the overlay text.
+func clockFilter(opts Options) string {
+	options := []string{
+		"text=" + escapeFilterValue("%{localtime}"),
+		fmt.Sprintf("fontsize=%d", opts.OverlayFontSize),
+		"fontcolor=white",
+		"box=1",
+		"boxcolor=black@0.5",
+		"boxborderw=5",
+		"x=w-tw-10",
+		"y=10",
+	}
+	if opts.OverlayFontFile != "" {
+		options = append(options, "fontfile="+escapeFilterValue(opts.OverlayFontFile))
+	}
+	return "drawtext=" + strings.Join(options, ":")
+}
+
+// checkDrawtext verifies that the installed ffmpeg has the drawtext filter
+// Options.Clock needs. A CommandFactory runs its own command, so it isn't
+// checked then.
+func checkDrawtext(opts Options) error {
+	if !opts.Clock || opts.CommandFactory != nil {
+		return nil
+	}
+	filters, err := AvailableFilters()
+	if err != nil {
+		return err
+	}
+	for _, name := range filters {
+		if name == "drawtext" {
+			return nil
+		}
+	}
+	return fmt.Errorf("clock overlay needs ffmpeg built with libfreetype for the drawtext filter")
+}
+
+// escapeFilterValue escapes a filter option value for the filter graph. The
+// graph parser unescapes the filter arguments, then the option parser each
+// option, with the same rules as the tee muxer.
+func escapeFilterValue(s string) string {
+	return escapeTee(escapeTee(s, ":"), "[],;")
+}
@@ -0,0 +1,57 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// patternNumber matches the frame number in an image sequence pattern, such
+// as %05d.
+var patternNumber = regexp.MustCompile(`%0?[0-9]*d`)
+
+// StartFromPattern is like Start, but ffmpeg reads the frames itself from
+// the numbered image files of Options.InputPattern, e.g. PNGs dumped by a
+// rendering pipeline, instead of them being sent on a channel. The stream
+// ends after the last file of the sequence. Returns an error if no file
+// matches the pattern.
+func (e *Encoder) StartFromPattern(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return e.url(), ErrAlreadyRunning
+	}
+	if e.opts.InputPattern == "" {
+		return "", fmt.Errorf("no input pattern")
+	}
+	if err := checkPattern(e.opts.InputPattern); err != nil {
+		return "", err
+	}
+
+	return e.start(ctx, func(ctx context.Context) {
+		defer e.wg.Done()
+
+		// ffmpeg exits once it has encoded the last file
+		select {
+		case <-ctx.Done():
+		case <-e.ffmpeg.Load().Exited():
+		}
+	})
+}
+
+// checkPattern returns an error if no file matches the image sequence
+// pattern.
+func checkPattern(pattern string) error {
+	glob := patternNumber.ReplaceAllString(strings.ReplaceAll(pattern, "%%", "%"), "*")
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		return fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no files match input pattern %q", pattern)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Plan describes what Start would run, as returned by DryRun.
+type Plan struct {
+	// Options are the options with defaults applied.
+	Options Options
+
+	// Args is the ffmpeg command line, including the program name, after
+	// ModifyArgs or as built by the CommandFactory.
+	Args []string
+
+	// OutputDir stands for the temporary output directory, which Start
+	// creates with a random name in its place.
+	OutputDir string
+
+	// Listen is the address the HLS server would listen on: ":port", with
+	// port 0 for a random one, or the Unix socket path.
+	Listen string
+
+	// FFmpegVersion and Encoders describe the installed ffmpeg, empty if it
+	// couldn't be queried.
+	FFmpegVersion string
+	Encoders      []string
+}
+
+// DryRun returns the plan for Start without starting anything: the resolved
+// options, the ffmpeg command line and the server address. It only queries
+// the installed ffmpeg for its version and encoders, and returns the plan
+// together with an error if that fails or the configured Codec isn't
+// available, so configurations can be checked in CI.
+func (e *Encoder) DryRun() (Plan, error) {
+	e.mu.Lock()
+	opts := e.opts
+	e.mu.Unlock()
+
+	outputDir := filepath.Join(os.TempDir(), "nimsforestencoder-XXXXXX")
+	plan := Plan{
+		Options:   opts,
+		OutputDir: outputDir,
+		Listen:    fmt.Sprintf(":%d", opts.Port),
+	}
+	if opts.UnixSocket != "" {
+		plan.Listen = opts.UnixSocket
+	}
+
+	// Like the output directory, the overlay text file is created by Start
+	if opts.TextOverlay {
+		opts.overlayFile = filepath.Join(os.TempDir(), "nimsforestencoder-overlay-XXXXXX.txt")
+	}
+
+	if opts.CommandFactory != nil {
+		cmd := opts.CommandFactory(outputDir, opts)
+		if cmd == nil {
+			return plan, fmt.Errorf("command factory returned nil")
+		}
+		plan.Args = cmd.Args
+	} else {
+		args := buildFFmpegArgs(outputDir, opts, false)
+		if opts.ModifyArgs != nil {
+			args = opts.ModifyArgs(args)
+		}
+		plan.Args = append([]string{"ffmpeg"}, args...)
+	}
+
+	version, err := FFmpegVersion()
+	if err != nil {
+		return plan, err
+	}
+	plan.FFmpegVersion = version
+
+	encoders, err := AvailableEncoders()
+	if err != nil {
+		return plan, err
+	}
+	plan.Encoders = encoders
+	if opts.CommandFactory == nil && !slices.Contains(encoders, opts.Codec) {
+		return plan, fmt.Errorf("codec %q is not available in ffmpeg %s", opts.Codec, version)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,167 @@
+package nimsforestencoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// AvailableEncoders returns the names of the video encoders compiled into
+// the installed ffmpeg, such as "libx264" or "h264_nvenc", for use as
+// Options.Codec. Hardware encoders are listed even if the host lacks the
+// hardware; use CheckEncoder to confirm one actually works.
+func AvailableEncoders() ([]string, error) {
+	return availableEncoders(context.Background())
+}
+
+// availableEncoders is AvailableEncoders bounded by ctx.
+func availableEncoders(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg encoders: %w", err)
+	}
+	return parseEncoders(out), nil
+}
+
+// CheckEncoder verifies that the named video encoder can encode on this
+// host by encoding a single test frame.
+func CheckEncoder(name string) error {
+	cmd := exec.Command("ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "lavfi",
+		"-i", "color=black:size=256x256",
+		"-frames:v", "1",
+		"-c:v", name,
+		"-f", "null",
+		"-",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("encoder %s unusable: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseEncoders extracts the video encoder names from `ffmpeg -encoders`
+// output. After a legend, each line lists flags (V for video) and a name:
+//
+//	V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC
+func parseEncoders(out []byte) []string {
+	var encoders []string
+	inList := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The legend ends with a " ------" separator
+		if !inList {
+			inList = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "V") {
+			encoders = append(encoders, fields[1])
+		}
+	}
+
+	return encoders
+}
+
+// FFmpegVersion returns the version of the installed ffmpeg, e.g. "6.1.1".
+func FFmpegVersion() (string, error) {
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get ffmpeg version: %w", err)
+	}
+	return parseVersion(out), nil
+}
+
+// parseVersion extracts the version from `ffmpeg -version` output, whose
+// first line reads:
+//
+//	ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers
+func parseVersion(out []byte) string {
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2]
+	}
+	return ""
+}
+
+// AvailableFilters returns the names of the filters compiled into the
+// installed ffmpeg, such as "drawtext", which is only there when ffmpeg was
+// built with libfreetype.
+func AvailableFilters() ([]string, error) {
+	return availableFilters(context.Background())
+}
+
+// availableFilters is AvailableFilters bounded by ctx.
+func availableFilters(ctx context.Context) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-filters").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ffmpeg filters: %w", err)
+	}
+	return parseFilters(out), nil
+}
+
+// parseFilters extracts the filter names from `ffmpeg -filters` output.
+// Below a legend, each line lists flags, a name and the pad types:
+//
+//	T.C drawtext          V->V       Draw text on top of video frames using libfreetype library.
+func parseFilters(out []byte) []string {
+	var filters []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Only filter lines have pad types, the legend doesn't
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && strings.Contains(fields[2], "->") {
+			filters = append(filters, fields[1])
+		}
+	}
+
+	return filters
+}
+
+// probeFFmpeg checks that the installed ffmpeg has the encoder of
+// opts.Codec and, for opts.Clock, the drawtext filter. Both lists are
+// fetched at once; ctx bounds the ffmpeg runs.
+func probeFFmpeg(ctx context.Context, opts Options) error {
+	type result struct {
+		names []string
+		err   error
+	}
+	filters := make(chan result, 1)
+	if opts.Clock {
+		go func() {
+			names, err := availableFilters(ctx)
+			filters <- result{names, err}
+		}()
+	} else {
+		filters <- result{names: []string{"drawtext"}}
+	}
+
+	encoders, err := availableEncoders(ctx)
+	f := <-filters
+	if ctx.Err() != nil {
+		return fmt.Errorf("failed to probe ffmpeg: %w", ctx.Err())
+	}
+	if err != nil {
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if !slices.Contains(encoders, opts.Codec) {
+		return fmt.Errorf("ffmpeg has no %s encoder", opts.Codec)
+	}
+	if !slices.Contains(f.names, "drawtext") {
+		return fmt.Errorf("clock overlay needs ffmpeg built with libfreetype for the drawtext filter")
+	}
+	return nil
+}
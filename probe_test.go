@@ -0,0 +1,71 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseEncoders(t *testing.T) {
+	out := []byte(`Encoders:
+ V..... = Video
+ A..... = Audio
+ S..... = Subtitle
+ .F.... = Frame-level multithreading
+ ..S... = Slice-level multithreading
+ ...X.. = Codec is experimental
+ ....B. = Supports draw_horiz_band
+ .....D = Supports direct rendering method 1
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+ S..... srt                  SubRip subtitle
+ V....D libvpx-vp9           libvpx VP9 (codec vp9)
+`)
+	want := []string{"libx264", "h264_nvenc", "libvpx-vp9"}
+	if got := parseEncoders(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseEncoders = %q, want %q", got, want)
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	out := []byte(`Filters:
+  T.. = Timeline support
+  .S. = Slice threading
+  ..C = Command support
+  A = Audio input/output
+  V = Video input/output
+  N = Dynamic number and/or type of input/output
+  | = Source or sink filter
+ ... abench            A->A       Benchmark part of a filtergraph.
+ T.C drawtext          V->V       Draw text on top of video frames using libfreetype library.
+ ... color             |->V       Provide an uniformly colored input.
+`)
+	want := []string{"abench", "drawtext", "color"}
+	if got := parseFilters(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFilters = %q, want %q", got, want)
+	}
+}
+
+func TestNewWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewWithContext(ctx, DefaultOptions()); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewWithContext with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	// A CommandFactory runs its own command, so there is nothing to probe
+	opts := DefaultOptions()
+	opts.CommandFactory = helperCommand
+	if _, err := NewWithContext(ctx, opts); err != nil {
+		t.Errorf("NewWithContext with a CommandFactory = %v", err)
+	}
+
+	opts.Width = -1
+	if _, err := NewWithContext(context.Background(), opts); err == nil {
+		t.Error("NewWithContext accepted invalid options")
+	}
+}
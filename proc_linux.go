@@ -0,0 +1,56 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times in /proc, USER_HZ, which is 100
+// on every Linux architecture.
+const clockTicks = 100
+
+// processUsage reads the usage of the running process pid from
+// /proc/<pid>/stat.
+func processUsage(pid int) (ProcUsage, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ProcUsage{}, fmt.Errorf("failed to read process stats: %w", err)
+	}
+
+	// The command name in parentheses may contain spaces, so fields are
+	// counted from the closing one: state is field 3, utime 14, stime 15
+	// and rss (in pages) 24
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return ProcUsage{}, fmt.Errorf("malformed process stats")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return ProcUsage{}, fmt.Errorf("malformed process stats")
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	rss, err3 := strconv.ParseInt(fields[21], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return ProcUsage{}, fmt.Errorf("malformed process stats")
+	}
+
+	return ProcUsage{
+		UserTime:   time.Duration(utime) * time.Second / clockTicks,
+		SystemTime: time.Duration(stime) * time.Second / clockTicks,
+		RSS:        rss * int64(os.Getpagesize()),
+	}, nil
+}
+
+// peakRSS returns the peak resident memory in bytes of an exited process.
+func peakRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports kilobytes
+		return rusage.Maxrss * 1024
+	}
+	return 0
+}
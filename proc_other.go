@@ -0,0 +1,20 @@
+//go:build !linux
+
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// processUsage is not supported without /proc.
+func processUsage(pid int) (ProcUsage, error) {
+	return ProcUsage{}, fmt.Errorf("process usage of a running ffmpeg is not supported on %s", runtime.GOOS)
+}
+
+// peakRSS returns 0, as the peak resident memory is reported in different
+// units across operating systems.
+func peakRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,65 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"time"
+)
+
+// profileSettings are the settings a Profile stands for.
+type profileSettings struct {
+	// preset and tune are the x264 and x265 encoder settings; an empty tune
+	// leaves it unset
+	preset, tune string
+
+	segmentDuration int
+
+	// quality is the TargetQuality, 0 for the encoder's rate control
+	quality int
+}
+
+// profiles maps each Profile to its settings.
+var profiles = map[Profile]profileSettings{
+	ProfileLowLatency:  {preset: "ultrafast", tune: "zerolatency", segmentDuration: 1},
+	ProfileBalanced:    {preset: "veryfast", segmentDuration: 2, quality: 55},
+	ProfileHighQuality: {preset: "medium", segmentDuration: 6, quality: 65},
+}
+
+// maxLowLatencySegment is the longest segment duration ProfileLowLatency
+// accepts as an override; longer segments defeat its purpose.
+const maxLowLatencySegment = 2 * time.Second
+
+// withProfile returns a copy of opts with the profile's settings applied to
+// the fields left zero. opts.Codec must already be set.
+func (opts Options) withProfile() Options {
+	p, ok := profiles[opts.Profile]
+	if !ok {
+		return opts
+	}
+	if opts.SegmentDuration == 0 {
+		opts.SegmentDuration = p.segmentDuration
+	}
+	if opts.TargetQuality == 0 && maxCRF(opts.Codec) != 0 {
+		opts.TargetQuality = p.quality
+	}
+	return opts
+}
+
+// validateProfile checks the profile and the options overriding it.
+func (opts Options) validateProfile() error {
+	if opts.Profile == "" {
+		return nil
+	}
+	if _, ok := profiles[opts.Profile]; !ok {
+		return fmt.Errorf("unsupported profile %q", opts.Profile)
+	}
+	if opts.Profile == ProfileLowLatency && opts.segmentDuration() > maxLowLatencySegment {
+		return fmt.Errorf("low latency profile needs segments of at most %v, got %v", maxLowLatencySegment, opts.segmentDuration())
+	}
+	return nil
+}
+
+// keyframeInterval returns the number of frames per segment, so that a
+// keyframe starts every segment.
+func keyframeInterval(opts Options) int {
+	return max(1, int(opts.segmentDuration()*time.Duration(opts.FrameRate)/time.Second))
+}
@@ -0,0 +1,48 @@
+package nimsforestencoder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		opts        Options
+		want, avoid []string
+	}{
+		{Options{Profile: ProfileLowLatency}, []string{"-preset ultrafast -tune zerolatency -g 30 "}, []string{"-crf"}},
+		{Options{Profile: ProfileBalanced}, []string{"-preset veryfast -g 60 ", "-crf 23"}, []string{"-tune"}},
+		{Options{Profile: ProfileHighQuality}, []string{"-preset medium -g 180 ", "-crf 18"}, []string{"-tune"}},
+		// Explicit settings take precedence
+		{Options{Profile: ProfileHighQuality, SegmentDuration: 4, TargetQuality: 80}, []string{"-g 120 ", "-crf 10"}, nil},
+		// Only the keyframe interval applies to other codecs
+		{Options{Profile: ProfileHighQuality, Codec: "h264_nvenc"}, []string{"-c:v h264_nvenc -g 180 "}, []string{"-preset", "-crf"}},
+	} {
+		name := string(tc.opts.Profile)
+		if tc.opts.Codec != "" || tc.opts.SegmentDuration != 0 {
+			name += " with overrides"
+		}
+		args := strings.Join(videoCodecArgs(tc.opts.withDefaults()), " ")
+		for _, want := range tc.want {
+			if !strings.Contains(args, want) {
+				t.Errorf("%s: args %q don't contain %q", name, args, want)
+			}
+		}
+		for _, avoid := range tc.avoid {
+			if strings.Contains(args, avoid) {
+				t.Errorf("%s: args %q contain %q", name, args, avoid)
+			}
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.Profile = "fast"
+	if _, err := New(opts); err == nil {
+		t.Error("unknown profile accepted")
+	}
+	opts.Profile = ProfileLowLatency
+	opts.SegmentDuration = 4
+	if _, err := New(opts); err == nil {
+		t.Error("low latency profile with 4 second segments accepted")
+	}
+}
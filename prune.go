@@ -0,0 +1,147 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// segmentPruner bounds the disk space of kept segments by deleting the
+// oldest ones once their total size exceeds a cap.
+//
+// ffmpeg keeps listing deleted segments in the playlist it writes, so like
+// the custom tags the pruned entries are dropped whenever the playlist is
+// served over HTTP. Segments complete in playlist order, so the pruned
+// segments are always the first ones listed and a count identifies them.
+type segmentPruner struct {
+	outputDir string
+	maxBytes  int64
+
+	mu sync.Mutex
+	// kept holds the segments still on disk, oldest first, totalling bytes.
+	kept  []segmentInfo
+	bytes int64
+	// pruned is the number of segments deleted from the current playlist.
+	pruned int
+}
+
+// newSegmentPruner creates a pruner that keeps the segments in outputDir
+// within maxBytes.
+func newSegmentPruner(outputDir string, maxBytes int64) *segmentPruner {
+	return &segmentPruner{outputDir: outputDir, maxBytes: maxBytes}
+}
+
+// segmentDone records seg, which has just completed, and deletes the oldest
+// segments while the total exceeds the cap. The newest segment is always
+// kept.
+func (p *segmentPruner) segmentDone(seg segmentInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.kept = append(p.kept, seg)
+	p.bytes += seg.Size
+
+	for p.bytes > p.maxBytes && len(p.kept) > 1 {
+		oldest := p.kept[0]
+		// A segment that is already gone doesn't take up space either
+		_ = os.Remove(filepath.Join(p.outputDir, filepath.FromSlash(oldest.URI)))
+		p.kept = p.kept[1:]
+		p.bytes -= oldest.Size
+		p.pruned++
+	}
+}
+
+// reset forgets the segments, for when ffmpeg starts a new playlist.
+func (p *segmentPruner) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.kept = nil
+	p.bytes = 0
+	p.pruned = 0
+}
+
+// rewrite returns playlist without the pruned segments. The media and
+// discontinuity sequence numbers are advanced past them, and the playlist
+// type is dropped, as event and VOD playlists must not lose segments.
+func (p *segmentPruner) rewrite(playlist []byte) []byte {
+	p.mu.Lock()
+	pruned := p.pruned
+	p.mu.Unlock()
+
+	if pruned == 0 {
+		return playlist
+	}
+
+	var lines, pending []string
+	var dropped, discontinuities int
+	scanPlaylist(bytes.NewReader(playlist), func(line string, seg *segmentInfo) {
+		if seg == nil {
+			pending = append(pending, line)
+			return
+		}
+		if dropped < pruned {
+			// Keep tags such as #EXT-X-KEY that apply to later segments
+			for _, tag := range pending {
+				switch {
+				case strings.HasPrefix(tag, "#EXT-X-DISCONTINUITY") && !strings.HasPrefix(tag, "#EXT-X-DISCONTINUITY-SEQUENCE"):
+					discontinuities++
+				case !isSegmentTag(tag):
+					lines = append(lines, tag)
+				}
+			}
+			dropped++
+		} else {
+			lines = append(lines, pending...)
+			lines = append(lines, line)
+		}
+		pending = pending[:0]
+	})
+	lines = append(lines, pending...)
+
+	hasDiscontinuitySequence := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:") {
+			hasDiscontinuitySequence = true
+		}
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(playlist))
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE:"):
+			continue
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			line = advanceTag(line, dropped)
+			if discontinuities > 0 && !hasDiscontinuitySequence {
+				line += "\n#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.Itoa(discontinuities)
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			line = advanceTag(line, discontinuities)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// advanceTag adds n to the value of a #TAG:<number> line.
+func advanceTag(line string, n int) string {
+	name, value, _ := strings.Cut(line, ":")
+	v, _ := strconv.Atoi(value)
+	return name + ":" + strconv.Itoa(v+n)
+}
+
+// isSegmentTag reports whether tag applies only to the segment following it.
+func isSegmentTag(tag string) bool {
+	for _, prefix := range []string{"#EXTINF:", "#EXT-X-BYTERANGE:", "#EXT-X-PROGRAM-DATE-TIME:", "#EXT-X-GAP"} {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
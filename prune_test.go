@@ -0,0 +1,72 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentPruner(t *testing.T) {
+	dir := t.TempDir()
+	p := newSegmentPruner(dir, 250)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("segment%d.ts", i)
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p.segmentDone(segmentInfo{URI: name, Size: 100})
+	}
+	for i, kept := range []bool{false, false, true, true} {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("segment%d.ts", i))); (err == nil) != kept {
+			t.Errorf("segment %d kept = %v, want %v", i, err == nil, kept)
+		}
+	}
+
+	playlist := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:EVENT
+#EXT-X-KEY:METHOD=AES-128,URI="key0.key"
+#EXTINF:2.000000,
+segment0.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:2.000000,
+segment1.ts
+#EXTINF:2.000000,
+segment2.ts
+#EXTINF:2.000000,
+segment3.ts
+#EXT-X-ENDLIST
+`
+	want := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:2
+#EXT-X-DISCONTINUITY-SEQUENCE:1
+#EXT-X-KEY:METHOD=AES-128,URI="key0.key"
+#EXTINF:2.000000,
+segment2.ts
+#EXTINF:2.000000,
+segment3.ts
+#EXT-X-ENDLIST
+`
+	if got := string(p.rewrite([]byte(playlist))); got != want {
+		t.Errorf("rewrite = %q, want %q", got, want)
+	}
+
+	// A new playlist starts with nothing pruned, and the newest segment is
+	// kept even above the cap
+	p.reset()
+	if got := string(p.rewrite([]byte(playlist))); got != playlist {
+		t.Errorf("rewrite after reset = %q, want the playlist unchanged", got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "segment4.ts"), make([]byte, 300), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p.segmentDone(segmentInfo{URI: "segment4.ts", Size: 300})
+	if _, err := os.Stat(filepath.Join(dir, "segment4.ts")); err != nil {
+		t.Errorf("newest segment above the cap deleted: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package nimsforestencoder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rotateOutput finalizes the current output as a complete VOD playlist,
+// moves it to the archive directory and starts a new ffmpeg process writing
+// a fresh playlist. It runs on the frame processing goroutine, so no frame
+// writes happen concurrently.
+func (e *Encoder) rotateOutput() error {
+	// Closing stdin makes ffmpeg write #EXT-X-ENDLIST and exit
+	if err := e.ffmpeg.Load().Close(); err != nil {
+		return fmt.Errorf("ffmpeg close: %w", err)
+	}
+	e.watcher.scan()
+	if e.opts.PlaylistType == PlaylistTypeVOD {
+		if err := finalizeVOD(e.outputDir); err != nil {
+			return fmt.Errorf("finalize playlist: %w", err)
+		}
+	}
+
+	if err := archiveOutput(e.outputDir, e.opts.ArchiveDir, e.periodStart, e.opts.SyncSegments); err != nil {
+		return fmt.Errorf("archive: %w", err)
+	}
+	e.watcher.reset()
+	e.tags.reset()
+	if e.pruner != nil {
+		e.pruner.reset()
+	}
+	if e.thumbs != nil {
+		e.thumbs.reset()
+	}
+	e.periodStart = e.clock.Now()
+
+	ffmpeg, err := newFFmpegProcess(e.outputDir, e.opts, e.clock, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	ffmpeg.frameBase = int64(e.stats.Load().framesWritten.Load())
+	e.ffmpeg.Store(ffmpeg)
+
+	e.emit(Event{Type: EventFFmpegRestarted})
+	return nil
+}
+
+// archiveOutput moves the playlist and segments in outputDir into a new
+// subdirectory of archiveDir named after the period start time. Encryption
+// keys are copied, since the current key stays in use. With sync the moved
+// files are flushed to stable storage.
+func archiveOutput(outputDir, archiveDir string, start time.Time, sync bool) error {
+	dest := filepath.Join(archiveDir, start.UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == keyInfoName || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		src := filepath.Join(outputDir, name)
+		dst := filepath.Join(dest, name)
+		if filepath.Ext(name) == ".key" {
+			err = copyFile(src, dst)
+		} else {
+			err = moveFile(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+		if sync {
+			if err := syncFile(dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sync {
+		return syncDir(dest)
+	}
+	return nil
+}
+
+// finalizeVOD marks the event playlist in outputDir as a complete VOD
+// playlist. ffmpeg only writes a VOD playlist when it finishes, with every
+// segment listed at once, so a VOD stream is written as an event and turned
+// into VOD once ffmpeg has exited.
+func finalizeVOD(outputDir string) error {
+	path := filepath.Join(outputDir, playlistName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// No segment was written
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	playlist := strings.Replace(string(data), "#EXT-X-PLAYLIST-TYPE:EVENT", "#EXT-X-PLAYLIST-TYPE:VOD", 1)
+	if !strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		// Throttling omits it, as restarts continue the playlist
+		playlist = strings.TrimRight(playlist, "\n") + "\n#EXT-X-ENDLIST\n"
+	}
+	return replaceFile(path, []byte(playlist))
+}
+
+// moveFile moves src to dst, copying if they are on different file systems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// replaceFile replaces the contents of the file at path with data, so that
+// readers see either the old or the new contents, never a partial write.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Like os.WriteFile, rather than CreateTemp's private mode
+	err = tmp.Chmod(0o644)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the contents of src to a new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,97 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFinalizeVOD(t *testing.T) {
+	const segments = "#EXTINF:2.000000,\nsegment0.ts\n"
+	tests := []struct {
+		name, playlist string
+	}{
+		{"finished", "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n" + segments + "#EXT-X-ENDLIST\n"},
+		{"throttled", "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n" + segments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, playlistName)
+			if err := os.WriteFile(path, []byte(tt.playlist), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := finalizeVOD(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n" + segments + "#EXT-X-ENDLIST\n"
+			if string(data) != want {
+				t.Errorf("playlist = %q, want %q", data, want)
+			}
+		})
+	}
+
+	// Without segments there is no playlist to finalize
+	if err := finalizeVOD(t.TempDir()); err != nil {
+		t.Errorf("finalizeVOD without playlist = %v", err)
+	}
+}
+
+func TestRotateRestartFailure(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = 0
+	opts.RotateInterval = time.Minute
+	opts.ArchiveDir = t.TempDir()
+	var started atomic.Int32
+	opts.CommandFactory = func(outputDir string, opts Options) *exec.Cmd {
+		if started.Add(1) > 1 {
+			// The restarted ffmpeg can't be run
+			return exec.Command(filepath.Join(t.TempDir(), "missing-ffmpeg"))
+		}
+		return helperCommand(outputDir, opts)
+	}
+	e, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClock(time.Unix(0, 0))
+	e.clock = c
+	if _, err := e.Start(context.Background(), make(chan image.Image)); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	c.waitTicker(opts.RotateInterval)
+	c.Advance(opts.RotateInterval)
+	timeout := time.After(10 * time.Second)
+	for failed := false; !failed; {
+		select {
+		case ev := <-e.Events():
+			failed = ev.Type == EventError
+			if failed && !strings.Contains(ev.Err.Error(), "failed to start ffmpeg") {
+				t.Errorf("error event %v, want the failed restart", ev.Err)
+			}
+		case <-timeout:
+			t.Fatal("no error event for the failed restart")
+		}
+	}
+
+	// The ffmpeg closed by the rotation isn't closed again
+	if err := e.Wait(context.Background()); err != nil {
+		t.Errorf("Wait = %v", err)
+	}
+	if err := e.Stop(); err != nil {
+		t.Errorf("Stop = %v", err)
+	}
+}
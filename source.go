@@ -0,0 +1,74 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// FrameSource is a pull-based source of frames, such as a camera capture
+// library.
+type FrameSource interface {
+	// Next returns the next frame, blocking until one is available. It
+	// returns io.EOF at the end of the stream and must return once ctx is
+	// done.
+	Next(ctx context.Context) (image.Image, error)
+}
+
+// StartFromSource is like Start, but pulls frames from src instead of
+// receiving them from a channel. The stream ends when src returns io.EOF.
+// Other errors are logged and, unless Options.SkipSourceErrors is set, also
+// end the stream.
+func (e *Encoder) StartFromSource(ctx context.Context, src FrameSource) (string, error) {
+	first, err := e.peekFirst(ctx, func() (image.Image, error) {
+		return src.Next(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	frames := make(chan image.Image)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	url, err := e.startFrames(ctx, frames, first)
+	if err != nil {
+		return url, err
+	}
+
+	e.wg.Add(1)
+	go e.pullFrames(e.runCtx, src, frames)
+
+	return url, nil
+}
+
+// pullFrames feeds frames from src to the frame processing goroutine until
+// the source ends or ctx is done.
+func (e *Encoder) pullFrames(ctx context.Context, src FrameSource, frames chan<- image.Image) {
+	defer e.wg.Done()
+	defer close(frames)
+
+	for {
+		frame, err := src.Next(ctx)
+		if errors.Is(err, io.EOF) || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			e.drops.drop(dropSource, fmt.Errorf("frame source failed: %w", err))
+			e.stats.Load().framesDropped.Add(1)
+			if !e.opts.SkipSourceErrors {
+				return
+			}
+			continue
+		}
+
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"testing"
+)
+
+// sliceSource returns its frames, or errors where a frame is nil, and then
+// io.EOF.
+type sliceSource struct {
+	frames []image.Image
+}
+
+func (s *sliceSource) Next(ctx context.Context) (image.Image, error) {
+	if len(s.frames) == 0 {
+		return nil, io.EOF
+	}
+	frame := s.frames[0]
+	s.frames = s.frames[1:]
+	if frame == nil {
+		return nil, errors.New("capture failed")
+	}
+	return frame, nil
+}
+
+func TestStartFromSource(t *testing.T) {
+	for _, tc := range []struct {
+		skip             bool
+		written, dropped uint64
+	}{
+		// The error ends the stream
+		{false, 1, 1},
+		{true, 2, 1},
+	} {
+		opts := DefaultOptions()
+		opts.Port = 0
+		opts.Width, opts.Height = 16, 16
+		opts.SkipSourceErrors = tc.skip
+		opts.CommandFactory = helperCommand
+		e, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		if _, err := e.StartFromSource(context.Background(), &sliceSource{[]image.Image{frame, nil, frame}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Wait(context.Background()); err != nil {
+			t.Errorf("SkipSourceErrors %v: Wait = %v", tc.skip, err)
+		}
+		if stats := e.Stats(); stats.FramesWritten != tc.written || stats.FramesDropped != tc.dropped {
+			t.Errorf("SkipSourceErrors %v: %d frames written and %d dropped, want %d and %d",
+				tc.skip, stats.FramesWritten, stats.FramesDropped, tc.written, tc.dropped)
+		}
+		e.Stop()
+	}
+}
@@ -0,0 +1,22 @@
+package nimsforestencoder
+
+import "fmt"
+
+// restartStalled kills a stalled ffmpeg and starts a new one with the same
+// options, continuing the playlist. It runs on the frame processing
+// goroutine, so no frame writes happen concurrently.
+func (e *Encoder) restartStalled() error {
+	old := e.ffmpeg.Load()
+	// A hung ffmpeg may never finish the stream, so don't wait for it
+	old.kill()
+	e.watcher.scan()
+
+	ffmpeg, err := newFFmpegProcess(e.outputDir, old.opts, e.clock, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	ffmpeg.frameBase = int64(e.stats.Load().framesWritten.Load())
+	e.ffmpeg.Store(ffmpeg)
+	e.emit(Event{Type: EventFFmpegRestarted})
+	return nil
+}
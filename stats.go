@@ -0,0 +1,153 @@
+package nimsforestencoder
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds a snapshot of encoder statistics.
+type Stats struct {
+	// StreamID is Options.StreamID.
+	StreamID string `json:"stream_id,omitempty"`
+
+	// Uptime is how long the encoder has been running, or ran for if it has
+	// stopped. Encoded in JSON as nanoseconds.
+	Uptime time.Duration `json:"uptime"`
+
+	// FramesWritten is the number of frames written to ffmpeg.
+	FramesWritten uint64 `json:"frames_written"`
+
+	// FramesDropped is the number of received frames that were not encoded.
+	FramesDropped uint64 `json:"frames_dropped"`
+
+	// LatencyExceeded is the number of frames dropped because they would have
+	// been encoded later than Options.MaxLatency after arriving.
+	LatencyExceeded uint64 `json:"latency_exceeded"`
+
+	// FramesDecimated is the number of frames dropped to bring an input
+	// running at Options.InputFrameRate down to FrameRate.
+	FramesDecimated uint64 `json:"frames_decimated"`
+
+	// OutOfOrderFrames is the number of frames dropped by
+	// Options.VerifyOrdering for a PTS that didn't follow the previous one.
+	OutOfOrderFrames uint64 `json:"out_of_order_frames"`
+
+	// Segments is the number of completed HLS segments produced.
+	Segments uint64 `json:"segments"`
+
+	// TimeToFirstSegment is the time from starting the encoder to the first
+	// completed segment appearing in the playlist, when viewers can start
+	// playing. It includes starting ffmpeg, filling the first GOP and
+	// finalizing the segment. 0 until the first segment. Encoded in JSON as
+	// nanoseconds.
+	TimeToFirstSegment time.Duration `json:"time_to_first_segment"`
+
+	// OutputBytes is the total size in bytes of all completed HLS segments.
+	// Unlike the raw frame data written to ffmpeg, this is what viewers
+	// download when following the stream from the start.
+	OutputBytes int64 `json:"output_bytes"`
+
+	// OutputBitrate is the output bitrate in bits per second, averaged over
+	// the segments in the current playlist window.
+	OutputBitrate float64 `json:"output_bitrate"`
+
+	// SlowOutput reports that frames are being written but no new segment
+	// has appeared for longer than expected, e.g. because the output
+	// directory is on a stalled network mount.
+	SlowOutput bool `json:"slow_output"`
+
+	// SlowOutputEvents is the number of times slow output was detected.
+	SlowOutputEvents uint64 `json:"slow_output_events"`
+
+	// WriteErrors is the number of failed frame writes to ffmpeg that were
+	// retried, see Options.MaxWriteErrors.
+	WriteErrors uint64 `json:"write_errors"`
+
+	// CorruptSegments is the number of segments that failed to decode, see
+	// Options.VerifySegments.
+	CorruptSegments uint64 `json:"corrupt_segments"`
+
+	// Failed reports that frame processing panicked and has stopped. A
+	// panic converting a frame, e.g. in a Transform, only drops that frame.
+	// No further frames are encoded until the encoder is stopped and started
+	// again.
+	Failed bool `json:"failed"`
+
+	// ConvertLatency is the distribution of the time spent converting a
+	// frame to the input pixel format.
+	ConvertLatency LatencyPercentiles `json:"convert_latency"`
+
+	// WriteLatency is the distribution of the time spent writing a frame to
+	// ffmpeg. High values mean ffmpeg is applying backpressure because it
+	// can't encode in real time.
+	WriteLatency LatencyPercentiles `json:"write_latency"`
+}
+
+// encoderStats holds the live counters behind Stats.
+type encoderStats struct {
+	clock   clock
+	started time.Time
+	stopped atomic.Int64 // Unix nanoseconds, 0 while running
+
+	framesWritten   atomic.Uint64
+	framesDropped   atomic.Uint64
+	latencyExceeded atomic.Uint64
+	framesDecimated atomic.Uint64
+	outOfOrder      atomic.Uint64
+	segments        atomic.Uint64
+	firstSegment    atomic.Int64 // time.Duration since started, 0 until then
+	outputBytes     atomic.Int64
+	outputBitrate   atomic.Uint64 // math.Float64bits
+	slowOutput      atomic.Bool
+	slowOutputs     atomic.Uint64
+	writeErrors     atomic.Uint64
+	corruptSegments atomic.Uint64
+	failed          atomic.Bool
+	convertLatency  latencyHistogram
+	writeLatency    latencyHistogram
+}
+
+// newEncoderStats returns counters for a run starting now according to c.
+func newEncoderStats(c clock) *encoderStats {
+	return &encoderStats{clock: c, started: c.Now()}
+}
+
+// stop records that the run has ended.
+func (s *encoderStats) stop() {
+	s.stopped.Store(s.clock.Now().UnixNano())
+}
+
+// uptime returns the duration of the run so far.
+func (s *encoderStats) uptime() time.Duration {
+	if s.started.IsZero() {
+		return 0
+	}
+	if stopped := s.stopped.Load(); stopped != 0 {
+		return time.Unix(0, stopped).Sub(s.started)
+	}
+	return since(s.clock, s.started)
+}
+
+// snapshot returns the current counter values.
+func (s *encoderStats) snapshot() Stats {
+	return Stats{
+		Uptime:             s.uptime(),
+		FramesWritten:      s.framesWritten.Load(),
+		FramesDropped:      s.framesDropped.Load(),
+		LatencyExceeded:    s.latencyExceeded.Load(),
+		FramesDecimated:    s.framesDecimated.Load(),
+		OutOfOrderFrames:   s.outOfOrder.Load(),
+		Segments:           s.segments.Load(),
+		TimeToFirstSegment: time.Duration(s.firstSegment.Load()),
+		OutputBytes:        s.outputBytes.Load(),
+		OutputBitrate:      math.Float64frombits(s.outputBitrate.Load()),
+		SlowOutput:         s.slowOutput.Load(),
+		SlowOutputEvents:   s.slowOutputs.Load(),
+		WriteErrors:        s.writeErrors.Load(),
+		CorruptSegments:    s.corruptSegments.Load(),
+		Failed:             s.failed.Load(),
+		ConvertLatency:     s.convertLatency.percentiles(),
+		WriteLatency:       s.writeLatency.percentiles(),
+	}
+}
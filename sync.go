@@ -0,0 +1,57 @@
+package nimsforestencoder
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// syncSegment flushes seg, the playlist listing it and, with checksums, the
+// checksum manifest to stable storage, followed by outputDir so their
+// directory entries survive a crash too.
+func syncSegment(outputDir string, seg segmentInfo, checksums bool) error {
+	paths := []string{
+		filepath.Join(outputDir, filepath.FromSlash(seg.URI)),
+		filepath.Join(outputDir, playlistName),
+	}
+	if checksums {
+		paths = append(paths, filepath.Join(outputDir, checksumsName))
+	}
+	for _, path := range paths {
+		if err := syncFile(path); err != nil {
+			return err
+		}
+	}
+	return syncDir(outputDir)
+}
+
+// syncFile flushes the file at path to stable storage.
+func syncFile(path string) error {
+	// Windows only flushes files opened for writing
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the entries of the directory at path to stable storage.
+// Windows can't sync directories and persists entries with the files.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
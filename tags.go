@@ -0,0 +1,108 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// playlistTags holds custom tags inserted into the served playlist.
+//
+// ffmpeg rewrites the entire playlist after every segment, replacing it
+// atomically via a temporary file, so tags written into the file on disk
+// would be lost or race with ffmpeg's own writes. Instead the tags are kept
+// in memory, anchored to the segment they follow, and spliced in whenever
+// the playlist is served over HTTP. The playlist on disk and in FS() stays
+// exactly as ffmpeg wrote it.
+type playlistTags struct {
+	mu sync.Mutex
+	// pending holds tags waiting for the next segment boundary.
+	pending []string
+	// after maps a segment key to the tags that follow it.
+	after map[string][]string
+}
+
+// newPlaylistTags creates an empty tag set.
+func newPlaylistTags() *playlistTags {
+	return &playlistTags{after: make(map[string][]string)}
+}
+
+// add queues tag for the next segment boundary.
+func (t *playlistTags) add(tag string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, tag)
+}
+
+// segmentDone anchors the pending tags after seg, which has just completed.
+func (t *playlistTags) segmentDone(seg segmentInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) == 0 {
+		return
+	}
+	key := seg.key()
+	t.after[key] = append(t.after[key], t.pending...)
+	t.pending = nil
+}
+
+// reset drops the anchored tags, for when ffmpeg starts a new playlist that
+// may reuse segment names. Pending tags are kept for the new playlist.
+func (t *playlistTags) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.after = make(map[string][]string)
+}
+
+// rewrite returns playlist with the anchored tags inserted after their
+// segments. Tags of segments that have left the playlist are forgotten.
+func (t *playlistTags) rewrite(playlist []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.after) == 0 {
+		return playlist
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(playlist))
+	seen := make(map[string]bool, len(t.after))
+
+	scanPlaylist(bytes.NewReader(playlist), func(line string, seg *segmentInfo) {
+		out.WriteString(line)
+		out.WriteByte('\n')
+		if seg == nil {
+			return
+		}
+		key := seg.key()
+		for _, tag := range t.after[key] {
+			out.WriteString(tag)
+			out.WriteByte('\n')
+		}
+		seen[key] = true
+	})
+
+	for key := range t.after {
+		if !seen[key] {
+			delete(t.after, key)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// validatePlaylistTag checks that tag is a single playlist tag or comment
+// line.
+func validatePlaylistTag(tag string) error {
+	if !strings.HasPrefix(tag, "#") {
+		return fmt.Errorf("playlist tag %q must start with #", tag)
+	}
+	if strings.ContainsAny(tag, "\r\n") {
+		return fmt.Errorf("playlist tag %q must be a single line", tag)
+	}
+	return nil
+}
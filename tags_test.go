@@ -0,0 +1,94 @@
+package nimsforestencoder
+
+import (
+	"strings"
+	"testing"
+)
+
+// testPlaylist returns a playlist listing segments, each a URI or a
+// "length@offset" byte range of stream.ts.
+func testPlaylist(segments ...string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+	for _, seg := range segments {
+		b.WriteString("#EXTINF:2.000000,\n")
+		if strings.Contains(seg, "@") {
+			b.WriteString("#EXT-X-BYTERANGE:" + seg + "\nstream.ts\n")
+			continue
+		}
+		b.WriteString(seg + "\n")
+	}
+	return b.String()
+}
+
+func TestPlaylistTags(t *testing.T) {
+	tags := newPlaylistTags()
+	tags.add("#EXT-X-CUE-OUT:30")
+	tags.add("#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:00Z")
+	tags.segmentDone(segmentInfo{URI: "segment1.ts"})
+	tags.add("#EXT-X-CUE-IN")
+	tags.segmentDone(segmentInfo{URI: "segment2.ts"})
+
+	for _, tc := range []struct {
+		name     string
+		segments []string
+		want     string
+	}{
+		{"anchored after their segments", []string{"segment0.ts", "segment1.ts", "segment2.ts"},
+			"#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+				"#EXTINF:2.000000,\nsegment0.ts\n" +
+				"#EXTINF:2.000000,\nsegment1.ts\n#EXT-X-CUE-OUT:30\n#EXT-X-PROGRAM-DATE-TIME:2026-01-01T00:00:00Z\n" +
+				"#EXTINF:2.000000,\nsegment2.ts\n#EXT-X-CUE-IN\n"},
+		{"segment left the window", []string{"segment2.ts", "segment3.ts"},
+			"#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+				"#EXTINF:2.000000,\nsegment2.ts\n#EXT-X-CUE-IN\n" +
+				"#EXTINF:2.000000,\nsegment3.ts\n"},
+		{"forgotten once dropped", []string{"segment1.ts", "segment2.ts"},
+			"#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+				"#EXTINF:2.000000,\nsegment1.ts\n" +
+				"#EXTINF:2.000000,\nsegment2.ts\n#EXT-X-CUE-IN\n"},
+	} {
+		if got := string(tags.rewrite([]byte(testPlaylist(tc.segments...)))); got != tc.want {
+			t.Errorf("%s: rewrite = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// A new playlist reuses the segment names, the pending tag carries over
+	tags.add("#EXT-X-CUE-OUT:10")
+	tags.reset()
+	if got, want := string(tags.rewrite([]byte(testPlaylist("segment2.ts")))), testPlaylist("segment2.ts"); got != want {
+		t.Errorf("rewrite after reset = %q, want %q", got, want)
+	}
+	tags.segmentDone(segmentInfo{URI: "segment0.ts"})
+	if got := string(tags.rewrite([]byte(testPlaylist("segment0.ts")))); !strings.HasSuffix(got, "segment0.ts\n#EXT-X-CUE-OUT:10\n") {
+		t.Errorf("rewrite = %q, want the pending tag after segment0.ts", got)
+	}
+
+	// Byte ranges of a single file share their URI
+	tags = newPlaylistTags()
+	tags.add("#EXT-X-CUE-IN")
+	tags.segmentDone(segmentInfo{URI: "stream.ts", Size: 100, Offset: 100, ranged: true})
+	want := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+		"#EXTINF:2.000000,\n#EXT-X-BYTERANGE:100@0\nstream.ts\n" +
+		"#EXTINF:2.000000,\n#EXT-X-BYTERANGE:100@100\nstream.ts\n#EXT-X-CUE-IN\n"
+	if got := string(tags.rewrite([]byte(testPlaylist("100@0", "100@100")))); got != want {
+		t.Errorf("byte range rewrite = %q, want %q", got, want)
+	}
+}
+
+func TestValidatePlaylistTag(t *testing.T) {
+	for _, tc := range []struct {
+		tag string
+		ok  bool
+	}{
+		{"#EXT-X-CUE-OUT:30", true},
+		{"# a comment", true},
+		{"EXT-X-CUE-IN", false},
+		{"#EXT-X-CUE-IN\nsegment9.ts", false},
+		{"#EXT-X-CUE-IN\r", false},
+	} {
+		if err := validatePlaylistTag(tc.tag); (err == nil) != tc.ok {
+			t.Errorf("validatePlaylistTag(%q) = %v, want ok %v", tc.tag, err, tc.ok)
+		}
+	}
+}
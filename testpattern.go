@@ -0,0 +1,155 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"strconv"
+)
+
+// PatternKind selects the content of a TestPattern.
+type PatternKind string
+
+const (
+	// PatternMovingRect is a rectangle bouncing between the left and right
+	// edges, with a bar along the top edge marking the frame count.
+	PatternMovingRect PatternKind = "moving_rect"
+
+	// PatternColorBars is vertical color bars with a marker moving across
+	// them, for checking color conversion.
+	PatternColorBars PatternKind = "color_bars"
+
+	// PatternCounter is the frame number in large digits, for checking
+	// that no frames are dropped or repeated.
+	PatternCounter PatternKind = "counter"
+)
+
+var (
+	patternBackground = color.RGBA{R: 30, G: 30, B: 50, A: 255}
+	patternRect       = color.RGBA{R: 255, G: 100, B: 50, A: 255}
+	patternMarker     = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+	// patternBars are the 75% color bars, from white to blue
+	patternBars = []color.RGBA{
+		{R: 191, G: 191, B: 191, A: 255},
+		{R: 191, G: 191, B: 0, A: 255},
+		{R: 0, G: 191, B: 191, A: 255},
+		{R: 0, G: 191, B: 0, A: 255},
+		{R: 191, G: 0, B: 191, A: 255},
+		{R: 191, G: 0, B: 0, A: 255},
+		{R: 0, G: 0, B: 191, A: 255},
+	}
+)
+
+// TestPattern is a deterministic synthetic FrameSource for tests,
+// benchmarks and demos: frame n always has the same content. Next is not
+// safe for concurrent use.
+type TestPattern struct {
+	// Width and Height are the frame size. Default: 1920x1080
+	Width, Height int
+
+	// Kind selects the content. Default: PatternMovingRect
+	Kind PatternKind
+
+	// Frames ends the source with io.EOF after this many frames.
+	// Default: 0 (endless)
+	Frames int
+
+	// next is the number of the frame Next returns
+	next int
+}
+
+// Next returns the next frame. Frames are returned as fast as they are
+// drawn; use Options.PaceToRealtime to encode them as a live stream.
+func (p *TestPattern) Next(ctx context.Context) (image.Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if p.Frames > 0 && p.next >= p.Frames {
+		return nil, io.EOF
+	}
+	frame := p.Frame(p.next)
+	p.next++
+	return frame, nil
+}
+
+// Frame returns frame n of the pattern.
+func (p *TestPattern) Frame(n int) *image.RGBA {
+	width, height := p.Width, p.Height
+	if width == 0 || height == 0 {
+		width, height = 1920, 1080
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	switch p.Kind {
+	case PatternColorBars:
+		for i, c := range patternBars {
+			fillRect(img, image.Rect(i*width/len(patternBars), 0, (i+1)*width/len(patternBars), height), c)
+		}
+		x := n * max(width/256, 1) % width
+		fillRect(img, image.Rect(x, height*7/8, x+max(width/64, 1), height), patternMarker)
+	case PatternCounter:
+		fillRect(img, img.Rect, patternBackground)
+		drawDigits(img, strconv.Itoa(n), patternMarker)
+	default:
+		fillRect(img, img.Rect, patternBackground)
+
+		// Bounce the rectangle between the edges
+		size := max(height*5/36, 1)
+		travel := max(width-size, 1)
+		x := n * max(width/256, 1) % (2 * travel)
+		if x > travel {
+			x = 2*travel - x
+		}
+		y := height/2 - size/2
+		fillRect(img, image.Rect(x, y, x+size, y+size), patternRect)
+
+		indicator := n * 2 % width
+		fillRect(img, image.Rect(indicator, 0, indicator+1, min(10, height)), patternMarker)
+	}
+	return img
+}
+
+// fillRect fills r of img with c.
+func fillRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// digitSegments holds the lit segments of each digit on a seven-segment
+// display, in the bit order top, top right, bottom right, bottom, bottom
+// left, top left, middle.
+var digitSegments = [10]uint8{
+	0b0111111, 0b0000110, 0b1011011, 0b1001111, 0b1100110,
+	0b1101101, 0b1111101, 0b0000111, 0b1111111, 0b1101111,
+}
+
+// drawDigits draws digits centered in img as seven-segment digits.
+func drawDigits(img *image.RGBA, digits string, c color.RGBA) {
+	bounds := img.Rect
+	h := bounds.Dy() / 3
+	w := h / 2
+	t := max(h/10, 1)
+	gap := w / 2
+	x := (bounds.Dx() - len(digits)*(w+gap) + gap) / 2
+	y := (bounds.Dy() - h) / 2
+
+	for _, d := range digits {
+		segments := digitSegments[d-'0']
+		for i, r := range []image.Rectangle{
+			image.Rect(x, y, x+w, y+t),                 // top
+			image.Rect(x+w-t, y, x+w, y+h/2),           // top right
+			image.Rect(x+w-t, y+h/2, x+w, y+h),         // bottom right
+			image.Rect(x, y+h-t, x+w, y+h),             // bottom
+			image.Rect(x, y+h/2, x+t, y+h),             // bottom left
+			image.Rect(x, y, x+t, y+h/2),               // top left
+			image.Rect(x, y+h/2-t/2, x+w, y+h/2-t/2+t), // middle
+		} {
+			if segments&(1<<i) != 0 {
+				fillRect(img, r, c)
+			}
+		}
+		x += w + gap
+	}
+}
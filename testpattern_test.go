@@ -0,0 +1,45 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"testing"
+)
+
+func TestTestPattern(t *testing.T) {
+	for _, kind := range []PatternKind{PatternMovingRect, PatternColorBars, PatternCounter} {
+		p := &TestPattern{Width: 64, Height: 36, Kind: kind, Frames: 3}
+		var frames [][]byte
+		for {
+			frame, err := p.Next(context.Background())
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: Next = %v", kind, err)
+			}
+			if b := frame.Bounds(); b.Dx() != 64 || b.Dy() != 36 {
+				t.Fatalf("%s: frame size %v, want 64x36", kind, b)
+			}
+			frames = append(frames, frame.(*image.RGBA).Pix)
+		}
+		if len(frames) != 3 {
+			t.Fatalf("%s: %d frames before io.EOF, want 3", kind, len(frames))
+		}
+		if bytes.Equal(frames[0], frames[1]) {
+			t.Errorf("%s: frames 0 and 1 are the same", kind)
+		}
+		if !bytes.Equal(p.Frame(1).Pix, frames[1]) {
+			t.Errorf("%s: frame 1 differs when drawn again", kind)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (&TestPattern{}).Next(ctx); err != context.Canceled {
+		t.Errorf("Next with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
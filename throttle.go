@@ -0,0 +1,159 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Hysteresis of the bandwidth governor, so the output isn't reconfigured
+// every time a viewer joins or leaves.
+const (
+	// throttleHoldoff is the minimum time between two reconfigurations.
+	throttleHoldoff = 30 * time.Second
+
+	// throttleRelease is the fraction of the budget that full quality
+	// output must fit in for all viewers before throttling is lifted.
+	throttleRelease = 0.8
+
+	// throttleStep is the relative change of the bitrate cap below which
+	// an existing cap is left alone.
+	throttleStep = 0.25
+
+	// minThrottleScale is the smallest fraction of the configured
+	// resolution the output is scaled down to.
+	minThrottleScale = 0.25
+)
+
+// throttleLevel reduces the encoded output to fit the origin bandwidth
+// budget. The zero value encodes at full quality.
+type throttleLevel struct {
+	// width and height are the scaled output size, 0 for the input size
+	width, height int
+
+	// maxBitrate caps the output in bits per second, 0 for no cap
+	maxBitrate int64
+}
+
+// throttled reports whether the level reduces the output.
+func (l throttleLevel) throttled() bool {
+	return l != throttleLevel{}
+}
+
+// bandwidthGovernor picks the throttle level that keeps the output bitrate
+// times the number of viewers within the origin bandwidth budget.
+//
+// While unthrottled it measures the full quality bitrate. Once viewers would
+// need more than the budget it caps the bitrate at the budget per viewer and
+// scales the resolution down with the square root of the reduction, as
+// bitrate grows roughly with the pixel count. The cap is only adjusted when
+// it would change by more than throttleStep, and lifted once full quality
+// fits in throttleRelease of the budget, with at least throttleHoldoff
+// between two changes.
+type bandwidthGovernor struct {
+	opts    Options
+	clients *clientTracker
+	stats   *encoderStats
+	clock   clock
+	apply   func(throttleLevel)
+
+	level   throttleLevel
+	full    float64 // bits per second while unthrottled
+	changed time.Time
+}
+
+// run re-evaluates the level once per segment until ctx is done.
+func (g *bandwidthGovernor) run(ctx context.Context) {
+	ticker := g.clock.NewTicker(g.opts.segmentDuration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.Chan():
+			g.tick(now)
+		}
+	}
+}
+
+// tick applies a new level if the viewer count calls for one.
+func (g *bandwidthGovernor) tick(now time.Time) {
+	bitrate := math.Float64frombits(g.stats.outputBitrate.Load())
+	if !g.level.throttled() && bitrate > 0 {
+		g.full = bitrate
+	}
+	if g.full == 0 || now.Sub(g.changed) < throttleHoldoff {
+		return
+	}
+
+	clients := float64(g.clients.active())
+	budget := float64(g.opts.MaxOriginBandwidth)
+	demand := clients * g.full
+
+	var next throttleLevel
+	switch {
+	case !g.level.throttled() && demand <= budget:
+		return
+	case g.level.throttled() && demand < throttleRelease*budget:
+		// Full quality fits again
+	default:
+		limit := budget / clients
+		if g.level.throttled() && math.Abs(limit-float64(g.level.maxBitrate)) <= throttleStep*float64(g.level.maxBitrate) {
+			return
+		}
+		next = g.levelFor(limit)
+	}
+
+	g.level = next
+	g.changed = now
+	g.apply(next)
+}
+
+// levelFor returns the level that caps the output at limit bits per second.
+func (g *bandwidthGovernor) levelFor(limit float64) throttleLevel {
+	scale := math.Max(minThrottleScale, math.Min(1, math.Sqrt(limit/g.full)))
+	return throttleLevel{
+		// 4:2:0 output needs even dimensions
+		width:      int(float64(g.opts.Width)*scale) &^ 1,
+		height:     int(float64(g.opts.Height)*scale) &^ 1,
+		maxBitrate: int64(limit),
+	}
+}
+
+// maxBitrateArgs returns the encoder arguments that cap the bitrate at
+// maxBitrate bits per second, or none for 0.
+func maxBitrateArgs(maxBitrate int64) []string {
+	if maxBitrate == 0 {
+		return nil
+	}
+	return []string{
+		"-maxrate", fmt.Sprint(maxBitrate),
+		"-bufsize", fmt.Sprint(2 * maxBitrate),
+	}
+}
+
+// setThrottle restarts ffmpeg with the playlist continued at a new throttle
+// level. It runs on the frame processing goroutine, so no frame writes
+// happen concurrently.
+func (e *Encoder) setThrottle(level throttleLevel) error {
+	if err := e.ffmpeg.Load().Close(); err != nil {
+		return fmt.Errorf("ffmpeg close: %w", err)
+	}
+	e.watcher.scan()
+
+	opts := e.opts
+	opts.throttle = level
+	ffmpeg, err := newFFmpegProcess(e.outputDir, opts, e.clock, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	ffmpeg.frameBase = int64(e.stats.Load().framesWritten.Load())
+	e.ffmpeg.Store(ffmpeg)
+	e.emit(Event{Type: EventFFmpegRestarted})
+
+	e.opts.logger().Info("output throttled for origin bandwidth",
+		"width", level.width, "height", level.height, "max_bitrate", level.maxBitrate)
+	return nil
+}
@@ -0,0 +1,56 @@
+package nimsforestencoder
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBandwidthGovernorTick(t *testing.T) {
+	c := newFakeClock(time.Unix(0, 0))
+	clients := newClientTracker(10*time.Second, c)
+	stats := newEncoderStats(c)
+	stats.outputBitrate.Store(math.Float64bits(2e6))
+
+	var applied []throttleLevel
+	g := &bandwidthGovernor{
+		opts:    Options{Width: 1280, Height: 720, MaxOriginBandwidth: 4e6},
+		clients: clients,
+		stats:   stats,
+		clock:   c,
+		apply:   func(level throttleLevel) { applied = append(applied, level) },
+	}
+
+	// Two viewers fit the budget
+	for i := 0; i < 2; i++ {
+		fetch(clients, fmt.Sprintf("192.0.2.%d", i), "/segment0.ts", 0)
+	}
+	g.tick(c.Now())
+	if len(applied) != 0 {
+		t.Fatalf("throttled with 2 viewers: %+v", applied)
+	}
+
+	// Four need half the bitrate each, at sqrt(1/2) of the size
+	for i := 2; i < 4; i++ {
+		fetch(clients, fmt.Sprintf("192.0.2.%d", i), "/segment0.ts", 0)
+	}
+	g.tick(c.Now())
+	want := throttleLevel{width: 904, height: 508, maxBitrate: 1e6}
+	if len(applied) != 1 || applied[0] != want {
+		t.Fatalf("applied = %+v, want [%+v]", applied, want)
+	}
+
+	// The viewers leave, but the level holds for throttleHoldoff
+	c.Advance(20 * time.Second)
+	g.tick(c.Now())
+	if len(applied) != 1 {
+		t.Fatalf("level changed within the holdoff: %+v", applied)
+	}
+
+	c.Advance(throttleHoldoff)
+	g.tick(c.Now())
+	if len(applied) != 2 || applied[1].throttled() {
+		t.Fatalf("applied = %+v, want the throttle lifted", applied)
+	}
+}
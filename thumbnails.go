@@ -0,0 +1,229 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the WebVTT thumbnails track and of the image playlist listing
+// the sprite sheets, referenced by #EXT-X-IMAGE-STREAM-INF in the master
+// playlist.
+const (
+	thumbnailsName         = "thumbnails.vtt"
+	thumbnailsPlaylistName = "thumbnails.m3u8"
+)
+
+// Sprite sheet layout: each sheet holds a grid of thumbnails, so players
+// fetch one image per 25 thumbnails.
+const (
+	thumbnailColumns   = 5
+	thumbnailRows      = 5
+	thumbnailsPerSheet = thumbnailColumns * thumbnailRows
+)
+
+// thumbnailer writes trick-play thumbnails for scrubbing previews: every
+// Options.ThumbnailInterval of stream time a frame is scaled down into a
+// sprite sheet. A WebVTT track maps each interval to its region of a sheet,
+// as read by the thumbnail support of common web players, and an image
+// playlist lists the sheets for players that support HLS image streams.
+//
+// Only the sheet being filled is rewritten as thumbnails are added; track
+// and image playlist are rewritten to cover the stream so far. Cue times
+// are relative to the first frame of the playlist. In a live window, cues older
+// than the window are dropped and sheets without cues deleted, like the
+// segments that left the playlist.
+type thumbnailer struct {
+	outputDir     string
+	interval      time.Duration
+	frameRate     int
+	width, height int
+	// window is the stream time the thumbnails are kept for, 0 for all.
+	window time.Duration
+
+	// base is the frame slot the playlist started at, -1 until the first
+	// frame after a reset.
+	base  int64
+	next  time.Duration
+	sheet *image.RGBA
+	count int // thumbnails taken since the reset
+	cues  []thumbnailCue
+	// firstSheet is the oldest sheet still on disk.
+	firstSheet int
+
+	// bitrate is the peak bitrate of the sheets in bits per second, for
+	// the master playlist served by another goroutine.
+	bitrate atomic.Int64
+}
+
+// thumbnailCue is the region of a sprite sheet showing an interval.
+type thumbnailCue struct {
+	start, end time.Duration
+	sheet      int
+	x, y       int
+}
+
+// newThumbnailer creates a thumbnailer writing to outputDir.
+func newThumbnailer(outputDir string, opts Options) *thumbnailer {
+	width, height := thumbnailSize(opts)
+	t := &thumbnailer{
+		outputDir: outputDir,
+		interval:  opts.ThumbnailInterval,
+		frameRate: opts.FrameRate,
+		width:     width,
+		height:    height,
+	}
+	if !keepsAllSegments(opts) {
+		t.window = time.Duration(playlistSize(opts)) * opts.segmentDuration()
+	}
+	t.reset()
+	return t
+}
+
+// thumbnailSize returns the size of a thumbnail for opts.
+func thumbnailSize(opts Options) (width, height int) {
+	height = (opts.ThumbnailWidth*opts.Height + opts.Width/2) / opts.Width
+	return opts.ThumbnailWidth, max(height, 1)
+}
+
+// reset starts over for a new playlist. The files of the previous one are
+// overwritten.
+func (t *thumbnailer) reset() {
+	t.base = -1
+	t.next = 0
+	t.sheet = nil
+	t.count = 0
+	t.cues = nil
+	t.firstSheet = 0
+}
+
+// add takes a thumbnail of frame, written at frame slot pos, if one is due.
+func (t *thumbnailer) add(frame image.Image, pos int64) error {
+	if t.base < 0 {
+		t.base = pos
+	}
+	at := time.Duration(pos-t.base) * time.Second / time.Duration(t.frameRate)
+	if at < t.next {
+		return nil
+	}
+	start := t.next
+	for t.next <= at {
+		t.next += t.interval
+	}
+
+	cell := t.count % thumbnailsPerSheet
+	if cell == 0 {
+		t.sheet = image.NewRGBA(image.Rect(0, 0, thumbnailColumns*t.width, thumbnailRows*t.height))
+	}
+	x, y := cell%thumbnailColumns*t.width, cell/thumbnailColumns*t.height
+	scaleInto(t.sheet, image.Rect(x, y, x+t.width, y+t.height), frame)
+
+	sheet := t.count / thumbnailsPerSheet
+	t.count++
+	t.cues = append(t.cues, thumbnailCue{start: start, end: t.next, sheet: sheet, x: x, y: y})
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, t.sheet, &jpeg.Options{Quality: 75}); err != nil {
+		return fmt.Errorf("failed to encode thumbnails: %w", err)
+	}
+	if err := replaceFile(filepath.Join(t.outputDir, sheetName(sheet)), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write thumbnails: %w", err)
+	}
+	sheetDuration := thumbnailsPerSheet * t.interval
+	if bitrate := int64(float64(buf.Len()*8) / sheetDuration.Seconds()); bitrate > t.bitrate.Load() {
+		t.bitrate.Store(bitrate)
+	}
+
+	t.prune()
+
+	if err := replaceFile(filepath.Join(t.outputDir, thumbnailsName), t.track()); err != nil {
+		return fmt.Errorf("failed to write thumbnails track: %w", err)
+	}
+	if err := replaceFile(filepath.Join(t.outputDir, thumbnailsPlaylistName), t.playlist()); err != nil {
+		return fmt.Errorf("failed to write thumbnails playlist: %w", err)
+	}
+	return nil
+}
+
+// prune drops the cues that ended before the window and deletes the sheets
+// no cue refers to any more.
+func (t *thumbnailer) prune() {
+	if t.window == 0 {
+		return
+	}
+
+	drop := 0
+	for drop < len(t.cues)-1 && t.cues[drop].end <= t.next-t.window {
+		drop++
+	}
+	t.cues = t.cues[drop:]
+
+	for ; t.firstSheet < t.cues[0].sheet; t.firstSheet++ {
+		// A sheet that is already gone doesn't matter
+		_ = os.Remove(filepath.Join(t.outputDir, sheetName(t.firstSheet)))
+	}
+}
+
+// track returns the WebVTT track of the cues.
+func (t *thumbnailer) track() []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+	for _, c := range t.cues {
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(c.start), vttTimestamp(c.end), sheetName(c.sheet), c.x, c.y, t.width, t.height)
+	}
+	return b.Bytes()
+}
+
+// playlist returns the image media playlist of the sheets holding the
+// cues, each a segment covering its thumbnails.
+func (t *thumbnailer) playlist() []byte {
+	sheetDuration := thumbnailsPerSheet * t.interval
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(sheetDuration.Seconds())))
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", t.cues[0].sheet)
+	b.WriteString("#EXT-X-IMAGES-ONLY\n")
+	for i := 0; i < len(t.cues); {
+		sheet, start := t.cues[i].sheet, t.cues[i].start
+		for i < len(t.cues) && t.cues[i].sheet == sheet {
+			i++
+		}
+		fmt.Fprintf(&b, "#EXTINF:%s,\n", formatSeconds(t.cues[i-1].end-start))
+		fmt.Fprintf(&b, "#EXT-X-TILES:RESOLUTION=%dx%d,LAYOUT=%dx%d,DURATION=%s\n",
+			t.width, t.height, thumbnailColumns, thumbnailRows, formatSeconds(t.interval))
+		b.WriteString(sheetName(sheet) + "\n")
+	}
+	return b.Bytes()
+}
+
+// sheetName returns the file name of sprite sheet n.
+func sheetName(n int) string {
+	return fmt.Sprintf("thumbnails-%d.jpg", n)
+}
+
+// scaleInto draws src scaled to fill r of dst, sampling the nearest pixel.
+func scaleInto(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	b := src.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		sy := b.Min.Y + (y-r.Min.Y)*b.Dy()/r.Dy()
+		for x := r.Min.X; x < r.Max.X; x++ {
+			sx := b.Min.X + (x-r.Min.X)*b.Dx()/r.Dx()
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+}
+
+// vttTimestamp formats d as a WebVTT timestamp, hh:mm:ss.ttt.
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,65 @@
+package nimsforestencoder
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThumbnailerLiveWindow(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Width, opts.Height, opts.FrameRate = 320, 180, 10
+	opts.ThumbnailInterval, opts.ThumbnailWidth = time.Second, 32
+	opts = opts.withDefaults()
+	th := newThumbnailer(dir, opts)
+
+	// A minute of video, 60 thumbnails on 3 sheets
+	frame := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	for pos := int64(0); pos < 600; pos++ {
+		if err := th.add(frame, pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the sheet holding the cues of the live window is left
+	for n, want := range []bool{false, false, true} {
+		_, err := os.Stat(filepath.Join(dir, sheetName(n)))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", sheetName(n), got, want)
+		}
+	}
+
+	track, err := os.ReadFile(filepath.Join(dir, thumbnailsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	window := time.Duration(playlistSize(opts)) * opts.segmentDuration()
+	first := vttTimestamp(60*time.Second - window)
+	if cues := strings.Count(string(track), " --> "); cues != int(window/time.Second) {
+		t.Errorf("track has %d cues, want %d", cues, window/time.Second)
+	}
+	if !strings.Contains(string(track), "\n"+first+" --> ") {
+		t.Errorf("track doesn't start at %s:\n%s", first, track)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(dir, thumbnailsPlaylistName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:2\n",
+		"#EXT-X-IMAGES-ONLY\n",
+		"#EXT-X-TILES:RESOLUTION=32x18,LAYOUT=5x5,DURATION=1\n" + sheetName(2) + "\n",
+	} {
+		if !strings.Contains(string(playlist), want) {
+			t.Errorf("image playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Contains(string(playlist), sheetName(1)) {
+		t.Errorf("image playlist lists a deleted sheet:\n%s", playlist)
+	}
+}
@@ -0,0 +1,136 @@
+package nimsforestencoder
+
+import (
+	"image"
+	"math"
+	"time"
+)
+
+// TimedFrame is a frame with a presentation timestamp, used with
+// TimestampSourceProvided. It can be sent on the frames channel like any
+// other image.
+type TimedFrame struct {
+	image.Image
+
+	// PTS is the presentation time of the frame. Only differences between
+	// frames matter, so any epoch can be used.
+	PTS time.Duration
+}
+
+// maxTimestampGap is the largest jump between frame timestamps that is
+// bridged by repeating or dropping frames. Larger jumps are treated as a
+// discontinuity and the timeline restarts at the next frame slot.
+const maxTimestampGap = time.Second
+
+// frameClock maps frame timestamps onto the constant frame rate grid ffmpeg
+// reads its raw input at.
+type frameClock struct {
+	source TimestampSource
+	rate   int // slots per second of timestamps, the capture rate
+	epoch  time.Time
+
+	started bool
+	// base is the timestamp of the frame written at slot baseSlot
+	base     time.Duration
+	baseSlot int64
+}
+
+// newFrameClock creates a clock for opts starting at the current time of c,
+// or returns nil if frames are simply encoded one per slot.
+func newFrameClock(opts Options, c clock) *frameClock {
+	if opts.TimestampSource == "" {
+		return nil
+	}
+	return &frameClock{
+		source: opts.TimestampSource,
+		rate:   opts.captureRate(),
+		epoch:  c.Now(),
+	}
+}
+
+// timestamp returns the timestamp of frame, which arrived at arrived. ok is
+// false if the frame has no timestamp of the configured source.
+func (c *frameClock) timestamp(frame image.Image, arrived time.Time) (ts time.Duration, ok bool) {
+	switch c.source {
+	case TimestampSourceWallClock:
+		// Round strips the monotonic reading, so clock adjustments show
+		return arrived.Round(0).Sub(c.epoch.Round(0)), true
+	case TimestampSourceProvided:
+		tf, ok := frame.(TimedFrame)
+		return tf.PTS, ok
+	default:
+		return arrived.Sub(c.epoch), true
+	}
+}
+
+// place returns the slot frame belongs in, given that next is the next slot
+// to be written. A slot before next means the frame is too early and should
+// be dropped; one after next means the previous frame should be repeated to
+// fill the gap.
+func (c *frameClock) place(frame image.Image, arrived time.Time, next int64) int64 {
+	ts, ok := c.timestamp(frame, arrived)
+	if !ok {
+		// Untimed frames follow the previous one
+		return next
+	}
+
+	if c.started {
+		target := c.baseSlot + int64(math.Round((ts-c.base).Seconds()*float64(c.rate)))
+		if gap := time.Duration(target-next) * time.Second / time.Duration(c.rate); gap.Abs() <= maxTimestampGap {
+			return target
+		}
+	}
+
+	// First frame or discontinuity
+	c.started = true
+	c.base = ts
+	c.baseSlot = next
+	return next
+}
+
+// orderChecker verifies that TimedFrame timestamps strictly increase.
+type orderChecker struct {
+	started bool
+	// last is the timestamp of the latest frame in order
+	last time.Duration
+}
+
+// check returns a *FrameOrderError if frame is a TimedFrame whose PTS isn't
+// after that of the latest frame in order. Untimed frames aren't checked.
+func (c *orderChecker) check(frame image.Image) error {
+	tf, ok := frame.(TimedFrame)
+	if !ok {
+		return nil
+	}
+	if c.started && tf.PTS <= c.last {
+		return &FrameOrderError{PTS: tf.PTS, PreviousPTS: c.last}
+	}
+	c.started = true
+	c.last = tf.PTS
+	return nil
+}
+
+// frameDecimator drops frames of an input running faster than the output
+// frame rate, keeping them evenly spread.
+type frameDecimator struct {
+	in, out int64
+	// n is the number of frames seen so far
+	n int64
+}
+
+// newFrameDecimator creates a decimator for opts, or returns nil if the
+// input doesn't run faster than FrameRate.
+func newFrameDecimator(opts Options) *frameDecimator {
+	if opts.InputFrameRate <= opts.FrameRate {
+		return nil
+	}
+	return &frameDecimator{in: int64(opts.InputFrameRate), out: int64(opts.FrameRate)}
+}
+
+// keep reports whether the next frame is kept. Of every InputFrameRate
+// frames, FrameRate are kept.
+func (d *frameDecimator) keep() bool {
+	k := d.n
+	d.n++
+	return k*d.out%d.in < d.out
+}
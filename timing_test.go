@@ -0,0 +1,143 @@
+package nimsforestencoder
+
+import (
+	"errors"
+	"image"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderChecker(t *testing.T) {
+	ms := func(n int) image.Image {
+		return TimedFrame{Image: image.NewRGBA(image.Rect(0, 0, 1, 1)), PTS: time.Duration(n) * time.Millisecond}
+	}
+	untimed := image.NewRGBA(image.Rect(0, 0, 1, 1))
+
+	for _, tc := range []struct {
+		name   string
+		frames []image.Image
+		// rejected holds the index of every frame rejected, with the PTS of
+		// the frame it is reported after
+		rejected map[int]time.Duration
+	}{
+		{"in order", []image.Image{ms(0), ms(33), ms(66)}, nil},
+		{"out of order", []image.Image{ms(0), ms(66), ms(33), ms(100)}, map[int]time.Duration{2: 66 * time.Millisecond}},
+		{"duplicate", []image.Image{ms(0), ms(33), ms(33)}, map[int]time.Duration{2: 33 * time.Millisecond}},
+		// A rejected frame doesn't move the latest timestamp back
+		{"after a rejected frame", []image.Image{ms(100), ms(50), ms(60), ms(101)}, map[int]time.Duration{
+			1: 100 * time.Millisecond,
+			2: 100 * time.Millisecond,
+		}},
+		{"untimed frames", []image.Image{ms(10), untimed, ms(5), untimed}, map[int]time.Duration{2: 10 * time.Millisecond}},
+		{"negative start", []image.Image{ms(-50), ms(-10)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c orderChecker
+			for i, frame := range tc.frames {
+				err := c.check(frame)
+				previous, rejected := tc.rejected[i]
+				if !rejected {
+					if err != nil {
+						t.Errorf("frame %d rejected: %v", i, err)
+					}
+					continue
+				}
+				var orderErr *FrameOrderError
+				if !errors.As(err, &orderErr) {
+					t.Errorf("frame %d: check = %v, want a *FrameOrderError", i, err)
+					continue
+				}
+				if want := frame.(TimedFrame).PTS; orderErr.PTS != want || orderErr.PreviousPTS != previous {
+					t.Errorf("frame %d: error PTS %v after %v, want %v after %v", i, orderErr.PTS, orderErr.PreviousPTS, want, previous)
+				}
+				if duplicate := orderErr.PTS == previous; duplicate != strings.HasPrefix(err.Error(), "duplicate") {
+					t.Errorf("frame %d: error %q, duplicate %v", i, err, duplicate)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameClock(t *testing.T) {
+	ms := func(n int) image.Image {
+		return TimedFrame{Image: image.NewRGBA(image.Rect(0, 0, 1, 1)), PTS: time.Duration(n) * time.Millisecond}
+	}
+	untimed := image.NewRGBA(image.Rect(0, 0, 1, 1))
+
+	opts := DefaultOptions()
+	opts.FrameRate = 10
+	if newFrameClock(opts, newFakeClock(time.Unix(0, 0))) != nil {
+		t.Error("frame clock without a TimestampSource")
+	}
+	opts.TimestampSource = TimestampSourceProvided
+	c := newFrameClock(opts, newFakeClock(time.Unix(0, 0)))
+
+	arrived := time.Unix(0, 0)
+	for i, tc := range []struct {
+		frame      image.Image
+		next, want int64
+	}{
+		// The first frame starts the timeline at the next slot
+		{ms(5000), 0, 0},
+		{ms(5100), 1, 1},
+		// A gap repeats the previous frame, a late frame is dropped
+		{ms(5300), 2, 3},
+		{ms(5300), 4, 3},
+		{untimed, 4, 4},
+		// A jump beyond maxTimestampGap restarts the timeline
+		{ms(60000), 4, 4},
+		{ms(60100), 5, 5},
+	} {
+		if got := c.place(tc.frame, arrived, tc.next); got != tc.want {
+			t.Errorf("frame %d placed at slot %d, want %d", i, got, tc.want)
+		}
+	}
+
+	// Arrival times are used by the other sources, relative to the start
+	epoch := time.Unix(100, 0)
+	for _, source := range []TimestampSource{TimestampSourceWallClock, TimestampSourceMonotonic} {
+		opts.TimestampSource = source
+		c := newFrameClock(opts, newFakeClock(epoch))
+		if ts, ok := c.timestamp(ms(5000), epoch.Add(250*time.Millisecond)); !ok || ts != 250*time.Millisecond {
+			t.Errorf("%s timestamp = %v, %v, want 250ms", source, ts, ok)
+		}
+	}
+
+	opts.TimestampSource = "pts"
+	if _, err := New(opts); err == nil {
+		t.Error("unknown timestamp source accepted")
+	}
+}
+
+func TestFrameDecimator(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FrameRate = 30
+	opts.InputFrameRate = 30
+	if newFrameDecimator(opts) != nil {
+		t.Error("decimator for an input at the output frame rate")
+	}
+
+	for _, tc := range []struct {
+		in   int
+		kept string
+	}{
+		{60, "10101010"},
+		{90, "100100100"},
+		{45, "101101101"},
+	} {
+		opts.InputFrameRate = tc.in
+		d := newFrameDecimator(opts)
+		var kept strings.Builder
+		for range tc.kept {
+			if d.keep() {
+				kept.WriteByte('1')
+			} else {
+				kept.WriteByte('0')
+			}
+		}
+		if kept.String() != tc.kept {
+			t.Errorf("%d fps to 30: kept %s, want %s", tc.in, kept.String(), tc.kept)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nimsforestencoder
+
+import "image"
+
+// FrameTransform transforms a frame before it is encoded. Transforms are
+// applied in order, and the final frame must still match the configured
+// Width and Height.
+type FrameTransform interface {
+	Apply(src image.Image) image.Image
+}
+
+// FlipHorizontal mirrors frames left to right.
+type FlipHorizontal struct{}
+
+// Apply implements FrameTransform.
+func (FlipHorizontal) Apply(src image.Image) image.Image {
+	b := src.Bounds()
+	return remap(src, b.Dx(), b.Dy(), func(x, y int) (int, int) {
+		return b.Max.X - 1 - x, b.Min.Y + y
+	})
+}
+
+// FlipVertical mirrors frames top to bottom.
+type FlipVertical struct{}
+
+// Apply implements FrameTransform.
+func (FlipVertical) Apply(src image.Image) image.Image {
+	b := src.Bounds()
+	return remap(src, b.Dx(), b.Dy(), func(x, y int) (int, int) {
+		return b.Min.X + x, b.Max.Y - 1 - y
+	})
+}
+
+// Rotate90 rotates frames 90 degrees clockwise, swapping width and height.
+type Rotate90 struct{}
+
+// Apply implements FrameTransform.
+func (Rotate90) Apply(src image.Image) image.Image {
+	b := src.Bounds()
+	return remap(src, b.Dy(), b.Dx(), func(x, y int) (int, int) {
+		return b.Min.X + y, b.Max.Y - 1 - x
+	})
+}
+
+// Crop cuts frames down to Rect, given in the coordinates of the source
+// frame.
+type Crop struct {
+	Rect image.Rectangle
+}
+
+// Apply implements FrameTransform.
+func (c Crop) Apply(src image.Image) image.Image {
+	r := c.Rect.Intersect(src.Bounds())
+	// Most image types crop without copying, keeping conversion fast paths
+	if sub, ok := src.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	return remap(src, r.Dx(), r.Dy(), func(x, y int) (int, int) {
+		return r.Min.X + x, r.Min.Y + y
+	})
+}
+
+// remap returns a width x height image whose pixel (x, y) is the pixel of
+// src at the coordinates returned by at. *image.RGBA sources are copied
+// directly; other types are copied through their color model at 16 bits
+// per channel.
+func remap(src image.Image, width, height int, at func(x, y int) (int, int)) image.Image {
+	if rgba, ok := src.(*image.RGBA); ok {
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				sx, sy := at(x, y)
+				i, j := dst.PixOffset(x, y), rgba.PixOffset(sx, sy)
+				copy(dst.Pix[i:i+4], rgba.Pix[j:j+4])
+			}
+		}
+		return dst
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(at(x, y)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,60 @@
+package nimsforestencoder
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// plainImage hides the SubImage method of an image.
+type plainImage struct {
+	image.Image
+}
+
+func TestTransforms(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, src := range []image.Image{
+		randomImage(rng, 0, 5, 3, true),
+		randomImage(rng, 4, 5, 3, false),
+		plainImage{randomImage(rng, 1, 5, 3, false)},
+	} {
+		b := src.Bounds()
+		crop := image.Rect(1, 1, 4, 3).Add(b.Min)
+		for _, tc := range []struct {
+			name      string
+			transform FrameTransform
+			size      image.Point
+			// at returns the source pixel of the output pixel at (x, y)
+			// from its top left corner
+			at func(x, y int) (int, int)
+		}{
+			{"flip horizontal", FlipHorizontal{}, b.Size(), func(x, y int) (int, int) { return b.Max.X - 1 - x, b.Min.Y + y }},
+			{"flip vertical", FlipVertical{}, b.Size(), func(x, y int) (int, int) { return b.Min.X + x, b.Max.Y - 1 - y }},
+			{"rotate 90", Rotate90{}, image.Pt(b.Dy(), b.Dx()), func(x, y int) (int, int) { return b.Min.X + y, b.Max.Y - 1 - x }},
+			{"crop", Crop{Rect: crop}, crop.Size(), func(x, y int) (int, int) { return crop.Min.X + x, crop.Min.Y + y }},
+		} {
+			out := tc.transform.Apply(src)
+			ob := out.Bounds()
+			if ob.Size() != tc.size {
+				t.Errorf("%T %s: size %v, want %v", src, tc.name, ob.Size(), tc.size)
+				continue
+			}
+			for y := 0; y < ob.Dy(); y++ {
+				for x := 0; x < ob.Dx(); x++ {
+					got := color.RGBA64Model.Convert(out.At(ob.Min.X+x, ob.Min.Y+y))
+					want := color.RGBA64Model.Convert(src.At(tc.at(x, y)))
+					if got != want {
+						t.Fatalf("%T %s: pixel (%d, %d) is %v, want %v", src, tc.name, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+
+	// The size is checked after the transforms
+	e := &Encoder{opts: Options{Width: 3, Height: 5, Transforms: []FrameTransform{FlipVertical{}, Rotate90{}}}}
+	if err := e.ValidateFrame(image.NewRGBA(image.Rect(0, 0, 5, 3))); err != nil {
+		t.Errorf("ValidateFrame of a frame rotated to size = %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package nimsforestencoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploader stores output files in object storage, such as an S3 or MinIO
+// bucket, for delivery from there or a CDN in front of it.
+type Uploader interface {
+	// Put stores data under key, the file's path relative to the output
+	// directory using forward slashes, e.g. "stream.m3u8" or
+	// "segment42.ts", replacing any object with the same key. It must
+	// return once ctx is done.
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+const (
+	// uploadConcurrency bounds the segment uploads in flight.
+	uploadConcurrency = 4
+
+	// uploadAttempts is how often a failed upload is tried in total.
+	uploadAttempts = 3
+)
+
+// Delay before retrying a failed upload, doubling for each further attempt.
+const uploadRetryDelay = 500 * time.Millisecond
+
+// segmentUploader uploads each completed segment and then the playlist
+// listing it. Segments are uploaded concurrently, but a playlist is only
+// uploaded once every segment it lists is, so players following the
+// uploaded playlist never miss a segment.
+type segmentUploader struct {
+	uploader  Uploader
+	outputDir string
+	tags      *playlistTags
+	pruner    *segmentPruner // nil without Options.MaxDiskBytes
+	version   int            // Options.HLSVersion
+	clock     clock
+	onError   func(error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// pending holds the uploads whose playlist isn't uploaded yet, in
+	// segment order; publishing is set while publish works through them.
+	pending    []*pendingUpload
+	publishing bool
+}
+
+// pendingUpload is a segment being uploaded and the playlist to upload
+// after it.
+type pendingUpload struct {
+	done     chan struct{}
+	playlist []byte
+}
+
+// newSegmentUploader creates an uploader for the output in outputDir,
+// uploading the playlist as served. onError is called for each upload that
+// failed every attempt.
+func newSegmentUploader(uploader Uploader, outputDir string, tags *playlistTags, pruner *segmentPruner, version int, c clock, onError func(error)) *segmentUploader {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &segmentUploader{
+		uploader:  uploader,
+		outputDir: outputDir,
+		tags:      tags,
+		pruner:    pruner,
+		version:   version,
+		clock:     c,
+		onError:   onError,
+		ctx:       ctx,
+		cancel:    cancel,
+		sem:       make(chan struct{}, uploadConcurrency),
+	}
+}
+
+// segmentDone starts uploading seg, which has just completed, followed by
+// the current playlist cut after seg, as the segments listed after it may
+// not be uploaded yet.
+func (u *segmentUploader) segmentDone(seg segmentInfo) {
+	// Read now, as ffmpeg may delete the segment before it is uploaded
+	data, err := os.ReadFile(filepath.Join(u.outputDir, filepath.FromSlash(seg.URI)))
+	if err != nil {
+		u.onError(fmt.Errorf("upload %s: %w", seg.URI, err))
+		return
+	}
+	playlist, err := readPlaylist(u.outputDir, u.tags, u.pruner, u.version)
+	if err != nil {
+		u.onError(fmt.Errorf("upload %s: %w", playlistName, err))
+		playlist = nil
+	}
+
+	p := &pendingUpload{done: make(chan struct{}), playlist: playlistUntil(playlist, seg.URI)}
+	u.mu.Lock()
+	u.pending = append(u.pending, p)
+	publish := !u.publishing
+	u.publishing = true
+	u.mu.Unlock()
+
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer close(p.done)
+
+		select {
+		case u.sem <- struct{}{}:
+		case <-u.ctx.Done():
+			return
+		}
+		defer func() { <-u.sem }()
+		u.put(seg.URI, data)
+	}()
+
+	if publish {
+		u.wg.Add(1)
+		go u.publish()
+	}
+}
+
+// publish uploads the playlists of the pending uploads in order, each once
+// its segment is uploaded. Only the newest playlist among the finished
+// segments is uploaded, as it replaces the older ones.
+func (u *segmentUploader) publish() {
+	defer u.wg.Done()
+
+	for {
+		u.mu.Lock()
+		if len(u.pending) == 0 {
+			u.publishing = false
+			u.mu.Unlock()
+			return
+		}
+		next := u.pending[0]
+		u.mu.Unlock()
+
+		<-next.done
+
+		u.mu.Lock()
+		playlist := next.playlist
+		u.pending = u.pending[1:]
+		for len(u.pending) > 0 && isClosed(u.pending[0].done) {
+			playlist = u.pending[0].playlist
+			u.pending = u.pending[1:]
+		}
+		u.mu.Unlock()
+
+		if playlist != nil && u.ctx.Err() == nil {
+			u.put(playlistName, playlist)
+		}
+	}
+}
+
+// close waits up to timeout for the pending uploads, cancelling them after
+// it, then uploads the final playlist.
+func (u *segmentUploader) close(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	t := u.clock.NewTicker(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.Chan():
+		u.cancel()
+		<-done
+	}
+
+	if u.ctx.Err() == nil {
+		if playlist, err := readPlaylist(u.outputDir, u.tags, u.pruner, u.version); err == nil {
+			u.put(playlistName, playlist)
+		}
+	}
+	u.cancel()
+}
+
+// put uploads data under key, retrying failed attempts.
+func (u *segmentUploader) put(key string, data []byte) {
+	delay := uploadRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = u.uploader.Put(u.ctx, key, data); err == nil {
+			return
+		}
+		if attempt == uploadAttempts || !sleep(u.ctx, u.clock, delay) {
+			break
+		}
+		delay *= 2
+	}
+	u.onError(fmt.Errorf("upload %s: %w", key, err))
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// playlistUntil returns playlist cut after the URI line of the segment
+// uri, or nil if it doesn't list uri.
+func playlistUntil(playlist []byte, uri string) []byte {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		b.WriteString(line + "\n")
+		if strings.TrimSpace(line) == uri {
+			return b.Bytes()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUploader stores uploads in memory, failing the first failures puts.
+type fakeUploader struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	objects  map[string]string
+	failures int
+}
+
+func (f *fakeUploader) Put(ctx context.Context, key string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("unavailable")
+	}
+	if key == playlistName {
+		// Every listed segment must be uploaded first
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				if _, ok := f.objects[line]; !ok {
+					f.t.Errorf("playlist uploaded before its segment %s", line)
+				}
+			}
+		}
+	}
+	f.objects[key] = string(data)
+	return nil
+}
+
+func TestSegmentUploader(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("segment0.ts", "zero")
+	write("segment1.ts", "one")
+	write(playlistName, "#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n#EXTINF:2.0,\nsegment1.ts\n")
+
+	up := &fakeUploader{t: t, objects: make(map[string]string), failures: 1}
+	var mu sync.Mutex
+	var errs []error
+	u := newSegmentUploader(up, dir, newPlaylistTags(), nil, 0, realClock{}, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+	u.segmentDone(segmentInfo{URI: "segment0.ts"})
+	u.segmentDone(segmentInfo{URI: "segment1.ts"})
+
+	write(playlistName, "#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n#EXTINF:2.0,\nsegment1.ts\n#EXT-X-ENDLIST\n")
+	u.close(5 * time.Second)
+
+	if len(errs) > 0 {
+		t.Errorf("upload errors %v despite retries", errs)
+	}
+	want := map[string]string{
+		"segment0.ts": "zero",
+		"segment1.ts": "one",
+		playlistName:  "#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n#EXTINF:2.0,\nsegment1.ts\n#EXT-X-ENDLIST\n",
+	}
+	for key, data := range want {
+		if got := up.objects[key]; got != data {
+			t.Errorf("uploaded %s = %q, want %q", key, got, data)
+		}
+	}
+}
+
+func TestPlaylistUntil(t *testing.T) {
+	playlist := []byte("#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n#EXTINF:2.0,\nsegment1.ts\n")
+	if got, want := string(playlistUntil(playlist, "segment0.ts")), "#EXTM3U\n#EXTINF:2.0,\nsegment0.ts\n"; got != want {
+		t.Errorf("playlistUntil = %q, want %q", got, want)
+	}
+	if got := playlistUntil(playlist, "segment2.ts"); got != nil {
+		t.Errorf("playlistUntil of an unlisted segment = %q, want nil", got)
+	}
+}
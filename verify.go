@@ -0,0 +1,116 @@
+package nimsforestencoder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// verifyConcurrency bounds the ffprobe processes verifying segments.
+const verifyConcurrency = 2
+
+// probeCommand returns the ffprobe invocation decoding every video frame of
+// the segment at path and printing their number.
+func probeCommand(ctx context.Context, path string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-count_frames",
+		"-show_entries", "stream=nb_read_frames",
+		"-of", "csv=p=0",
+		path,
+	)
+}
+
+// segmentVerifier decodes each completed segment with ffprobe, for
+// Options.VerifySegments. Segments are verified in the background so a
+// slow ffprobe doesn't hold up the segment watcher.
+type segmentVerifier struct {
+	outputDir string
+	command   func(ctx context.Context, path string) *exec.Cmd
+	clock     clock
+	onCorrupt func(uri string, err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newSegmentVerifier creates a verifier of the segments in outputDir, run
+// with command. onCorrupt is called for each segment that fails to decode.
+func newSegmentVerifier(outputDir string, command func(ctx context.Context, path string) *exec.Cmd, c clock, onCorrupt func(uri string, err error)) *segmentVerifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &segmentVerifier{
+		outputDir: outputDir,
+		command:   command,
+		clock:     c,
+		onCorrupt: onCorrupt,
+		ctx:       ctx,
+		cancel:    cancel,
+		sem:       make(chan struct{}, verifyConcurrency),
+	}
+}
+
+// segmentDone starts verifying seg, which has just completed.
+func (v *segmentVerifier) segmentDone(seg segmentInfo) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		select {
+		case v.sem <- struct{}{}:
+		case <-v.ctx.Done():
+			return
+		}
+		defer func() { <-v.sem }()
+		if err := v.verify(seg.URI); err != nil && v.ctx.Err() == nil {
+			v.onCorrupt(seg.URI, err)
+		}
+	}()
+}
+
+// verify decodes the segment uri, returning why it isn't playable.
+func (v *segmentVerifier) verify(uri string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := v.command(v.ctx, filepath.Join(v.outputDir, filepath.FromSlash(uri)))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffprobe: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// Decoding errors are logged without failing ffprobe
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("decoding failed: %s", msg)
+	}
+	if frames, err := strconv.Atoi(strings.TrimSpace(stdout.String())); err != nil || frames == 0 {
+		return fmt.Errorf("no decodable video frames")
+	}
+	return nil
+}
+
+// close waits up to timeout for the pending verifications, cancelling them
+// after it.
+func (v *segmentVerifier) close(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		v.wg.Wait()
+		close(done)
+	}()
+
+	t := v.clock.NewTicker(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.Chan():
+		v.cancel()
+		<-done
+	}
+	v.cancel()
+}
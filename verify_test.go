@@ -0,0 +1,43 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helperProbe is a probe command running TestHelperProcess as an ffprobe
+// that finds the segments named bad*.ts corrupt.
+func helperProbe(ctx context.Context, path string) *exec.Cmd {
+	mode := "probe"
+	if strings.HasPrefix(filepath.Base(path), "bad") {
+		mode = "probe-corrupt"
+	}
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), "NIMSFOREST_HELPER_PROCESS="+mode)
+	return cmd
+}
+
+func TestSegmentVerifier(t *testing.T) {
+	var mu sync.Mutex
+	corrupt := make(map[string]string)
+	v := newSegmentVerifier(t.TempDir(), helperProbe, realClock{}, func(uri string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		corrupt[uri] = err.Error()
+	})
+
+	for _, uri := range []string{"segment0.ts", "bad1.ts", "segment2.ts"} {
+		v.segmentDone(segmentInfo{URI: uri})
+	}
+	v.close(10 * time.Second)
+
+	if len(corrupt) != 1 || !strings.Contains(corrupt["bad1.ts"], "Invalid NAL unit size") {
+		t.Errorf("corrupt segments = %v, want bad1.ts with the decoding error", corrupt)
+	}
+}
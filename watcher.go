@@ -0,0 +1,291 @@
+package nimsforestencoder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentInfo describes a completed HLS segment.
+type segmentInfo struct {
+	// URI is the segment URI as listed in the playlist.
+	URI string
+
+	// Size is the segment size in bytes.
+	Size int64
+
+	// Offset is the byte offset of the segment within URI for
+	// #EXT-X-BYTERANGE segments, otherwise 0.
+	Offset int64
+
+	// ranged reports whether the segment is a byte range of URI.
+	ranged bool
+
+	// Duration is the segment duration from its #EXTINF tag.
+	Duration time.Duration
+}
+
+// segmentWatcher reads the playlist ffmpeg writes whenever the output
+// directory changes, or every interval where change notifications aren't
+// available, and reports each segment once it appears in it. ffmpeg only
+// lists a segment after it has been fully written, so listed segments are
+// complete.
+//
+// The watcher also reports slow output: when frames keep being written but
+// no new segment appears for longer than slowAfter, ffmpeg is most likely
+// blocked writing to the output directory. After stallAfter, if set, ffmpeg
+// is reported as stalled.
+type segmentWatcher struct {
+	outputDir string
+	interval  time.Duration
+	stats     *encoderStats
+	clock     clock
+	slowAfter time.Duration
+	onSegment func(segmentInfo)
+	onSlow    func(time.Duration)
+
+	// stallAfter, if positive, is how long without a new segment, while
+	// frames are written, until onStall is called; set before run
+	stallAfter time.Duration
+	onStall    func(time.Duration)
+
+	// watchDir watches the output directory; tests replace it with a fake
+	watchDir func(dir string, c clock, interval time.Duration) dirWatcher
+
+	mu sync.Mutex
+	// window holds the segments listed in the most recently read playlist.
+	window map[string]segmentInfo
+	// lastSegment is when the last new segment appeared, and framesAt the
+	// number of frames written at that time.
+	lastSegment time.Time
+	framesAt    uint64
+	slow        bool
+	stalled     bool
+}
+
+// newSegmentWatcher creates a watcher for the playlist in outputDir that
+// records completed segments in stats, timed by c.
+func newSegmentWatcher(outputDir string, stats *encoderStats, c clock, slowAfter time.Duration, onSegment func(segmentInfo), onSlow func(time.Duration)) *segmentWatcher {
+	return &segmentWatcher{
+		outputDir:   outputDir,
+		interval:    250 * time.Millisecond,
+		stats:       stats,
+		clock:       c,
+		slowAfter:   slowAfter,
+		onSegment:   onSegment,
+		onSlow:      onSlow,
+		watchDir:    newDirWatcher,
+		window:      make(map[string]segmentInfo),
+		lastSegment: c.Now(),
+	}
+}
+
+// run reads the playlist whenever the output directory may have changed,
+// until ctx is cancelled.
+func (w *segmentWatcher) run(ctx context.Context) {
+	dir := w.watchDir(w.outputDir, w.clock, w.interval)
+	defer dir.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dir.Changes():
+			w.scan()
+		}
+	}
+}
+
+// reset forgets the segments seen so far, for when ffmpeg starts a new
+// playlist that may reuse segment names.
+func (w *segmentWatcher) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.window = make(map[string]segmentInfo)
+	w.segmentSeen()
+}
+
+// scan reads the playlist once and reports segments not seen before.
+func (w *segmentWatcher) scan() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	defer w.checkSlow()
+
+	entries, err := readPlaylistEntries(filepath.Join(w.outputDir, playlistName))
+	if err != nil {
+		// Playlist not written yet or being replaced
+		return
+	}
+
+	window := make(map[string]segmentInfo, len(entries))
+	for _, entry := range entries {
+		key := entry.key()
+		if seg, ok := w.window[key]; ok {
+			window[key] = seg
+			continue
+		}
+
+		seg := entry
+		if !seg.ranged {
+			if info, err := os.Stat(filepath.Join(w.outputDir, filepath.FromSlash(entry.URI))); err == nil {
+				seg.Size = info.Size()
+			}
+		}
+		window[key] = seg
+
+		w.segmentSeen()
+		if w.stats.segments.Add(1) == 1 {
+			w.stats.firstSegment.Store(int64(since(w.clock, w.stats.started)))
+		}
+		w.stats.outputBytes.Add(seg.Size)
+		if w.onSegment != nil {
+			w.onSegment(seg)
+		}
+	}
+
+	// Segments that left the playlist never come back, so forget them
+	w.window = window
+	w.stats.outputBitrate.Store(math.Float64bits(w.bitrate()))
+}
+
+// segmentSeen records that a new segment appeared, ending any slow output
+// episode. Callers must hold w.mu.
+func (w *segmentWatcher) segmentSeen() {
+	w.lastSegment = w.clock.Now()
+	w.framesAt = w.stats.framesWritten.Load()
+	w.slow = false
+	w.stalled = false
+	w.stats.slowOutput.Store(false)
+}
+
+// checkSlow reports slow output, and a stall, once per episode if frames
+// were written since the last segment but it is overdue. Callers must hold
+// w.mu.
+func (w *segmentWatcher) checkSlow() {
+	overdue := since(w.clock, w.lastSegment)
+	if w.stats.framesWritten.Load() == w.framesAt {
+		return
+	}
+	if w.stallAfter > 0 && !w.stalled && overdue > w.stallAfter {
+		w.stalled = true
+		w.onStall(overdue)
+	}
+	if w.slow || overdue <= w.slowAfter {
+		return
+	}
+
+	w.slow = true
+	w.stats.slowOutput.Store(true)
+	w.stats.slowOutputs.Add(1)
+	if w.onSlow != nil {
+		w.onSlow(overdue)
+	}
+}
+
+// bitrate returns the average bitrate in bits per second of the segments in
+// the current playlist window. Callers must hold w.mu.
+func (w *segmentWatcher) bitrate() float64 {
+	var bytes int64
+	var duration time.Duration
+	for _, seg := range w.window {
+		bytes += seg.Size
+		duration += seg.Duration
+	}
+
+	if duration <= 0 {
+		return 0
+	}
+	return float64(bytes*8) / duration.Seconds()
+}
+
+// key identifies the segment within a playlist, as byte-range segments
+// share their URI.
+func (s segmentInfo) key() string {
+	if s.ranged {
+		return s.URI + "@" + strconv.FormatInt(s.Offset, 10)
+	}
+	return s.URI
+}
+
+// readPlaylistEntries parses the media segments listed in an m3u8 playlist.
+func readPlaylistEntries(path string) ([]segmentInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []segmentInfo
+	err = scanPlaylist(f, func(_ string, seg *segmentInfo) {
+		if seg != nil {
+			entries = append(entries, *seg)
+		}
+	})
+	return entries, err
+}
+
+// scanPlaylist calls fn for every line of an m3u8 playlist. For segment URI
+// lines seg describes the segment, built from the tags preceding it;
+// otherwise seg is nil.
+func scanPlaylist(r io.Reader, fn func(line string, seg *segmentInfo)) error {
+	var duration time.Duration
+	// Byte range of the next segment, and where the previous one ended
+	var next *segmentInfo
+	ends := make(map[string]int64)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<duration>,[<title>]
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				duration = time.Duration(seconds * float64(time.Second))
+			}
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			// #EXT-X-BYTERANGE:<length>[@<offset>]
+			length, offset, hasOffset := strings.Cut(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"), "@")
+			n, err := strconv.ParseInt(length, 10, 64)
+			if err != nil {
+				break
+			}
+			next = &segmentInfo{Size: n, ranged: true, Offset: -1}
+			if hasOffset {
+				if o, err := strconv.ParseInt(offset, 10, 64); err == nil {
+					next.Offset = o
+				}
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			seg := segmentInfo{URI: line, Duration: duration}
+			if next != nil {
+				seg.Size, seg.ranged, seg.Offset = next.Size, true, next.Offset
+				if seg.Offset < 0 {
+					// Without an offset the range follows the previous one
+					seg.Offset = ends[line]
+				}
+				ends[line] = seg.Offset + seg.Size
+			}
+			duration = 0
+			next = nil
+			fn(raw, &seg)
+			continue
+		}
+		fn(raw, nil)
+	}
+
+	return scanner.Err()
+}
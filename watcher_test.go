@@ -0,0 +1,161 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDirWatcher is a dirWatcher whose changes are sent by the test.
+type fakeDirWatcher struct {
+	changes chan struct{}
+	closed  chan struct{}
+}
+
+func newFakeDirWatcher() *fakeDirWatcher {
+	return &fakeDirWatcher{changes: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (w *fakeDirWatcher) Changes() <-chan struct{} { return w.changes }
+
+func (w *fakeDirWatcher) Close() error {
+	close(w.closed)
+	return nil
+}
+
+func TestSegmentWatcher(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeClock(time.Unix(0, 0))
+	stats := newEncoderStats(c)
+	segments := make(chan segmentInfo, 10)
+	slow := make(chan time.Duration, 10)
+	w := newSegmentWatcher(dir, stats, c, 4*time.Second,
+		func(seg segmentInfo) { segments <- seg },
+		func(overdue time.Duration) { slow <- overdue })
+	stalled := make(chan time.Duration, 10)
+	w.stallAfter = 10 * time.Second
+	w.onStall = func(overdue time.Duration) { stalled <- overdue }
+
+	fake := newFakeDirWatcher()
+	w.watchDir = func(string, clock, time.Duration) dirWatcher { return fake }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+
+	// writeSegments writes the segments and a playlist listing them
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n"
+	writeSegments := func(names ...string) {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), make([]byte, 1000), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			playlist += "#EXTINF:2.000000,\n" + name + "\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, playlistName), []byte(playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fake.changes <- struct{}{}
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, uri := range want {
+			seg := <-segments
+			if seg.URI != uri || seg.Size != 1000 || seg.Duration != 2*time.Second {
+				t.Errorf("segment = %+v, want %s of 1000 bytes and 2s", seg, uri)
+			}
+		}
+		// Another change flushes the previous scan
+		fake.changes <- struct{}{}
+		select {
+		case seg := <-segments:
+			t.Errorf("unexpected segment %+v", seg)
+		default:
+		}
+	}
+
+	c.Advance(3 * time.Second)
+	writeSegments("segment0.ts")
+	expect("segment0.ts")
+	if got := stats.snapshot().TimeToFirstSegment; got != 3*time.Second {
+		t.Errorf("TimeToFirstSegment = %v, want 3s", got)
+	}
+	writeSegments("segment1.ts", "segment2.ts")
+	expect("segment1.ts", "segment2.ts")
+
+	// Frames keep coming, but no segment does
+	stats.framesWritten.Add(100)
+	c.Advance(5 * time.Second)
+	fake.changes <- struct{}{}
+	fake.changes <- struct{}{}
+	select {
+	case overdue := <-slow:
+		if overdue != 5*time.Second {
+			t.Errorf("slow output overdue %v, want 5s", overdue)
+		}
+	default:
+		t.Error("slow output not reported")
+	}
+	if got := stats.segments.Load(); got != 3 {
+		t.Errorf("segments = %d, want 3", got)
+	}
+	if len(stalled) > 0 {
+		t.Errorf("stall reported after %v, before the stall timeout", <-stalled)
+	}
+
+	// Still no segment after the stall timeout
+	c.Advance(6 * time.Second)
+	fake.changes <- struct{}{}
+	fake.changes <- struct{}{}
+	fake.changes <- struct{}{}
+	if got := len(stalled); got != 1 {
+		t.Fatalf("%d stalls reported, want 1", got)
+	}
+	if overdue := <-stalled; overdue != 11*time.Second {
+		t.Errorf("stall overdue %v, want 11s", overdue)
+	}
+
+	cancel()
+	<-done
+	select {
+	case <-fake.closed:
+	default:
+		t.Error("dirWatcher not closed")
+	}
+}
+
+func TestSegmentWatcherBitrate(t *testing.T) {
+	dir := t.TempDir()
+	c := newFakeClock(time.Unix(0, 0))
+	stats := newEncoderStats(c)
+	w := newSegmentWatcher(dir, stats, c, time.Minute, nil, nil)
+
+	sizes := map[string]int{"segment0.ts": 1000, "segment1.ts": 3000, "segment2.ts": 500}
+	for name, size := range sizes {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		playlist string
+		bytes    int64
+		bitrate  float64
+	}{
+		{"#EXTINF:2.000000,\nsegment0.ts\n#EXTINF:2.000000,\nsegment1.ts\n", 4000, 4000 * 8 / 4},
+		// The bitrate is that of the window, the bytes those of every segment
+		{"#EXTINF:2.000000,\nsegment1.ts\n#EXTINF:1.000000,\nsegment2.ts\n", 4500, 3500 * 8 / 3.0},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, playlistName), []byte("#EXTM3U\n"+tc.playlist), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		w.scan()
+		if s := stats.snapshot(); s.OutputBytes != tc.bytes || s.OutputBitrate != tc.bitrate {
+			t.Errorf("OutputBytes, OutputBitrate = %d, %v, want %d, %v", s.OutputBytes, s.OutputBitrate, tc.bytes, tc.bitrate)
+		}
+	}
+}
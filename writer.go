@@ -0,0 +1,103 @@
+package nimsforestencoder
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"sync/atomic"
+)
+
+// StartToWriter begins encoding frames from the channel into an MPEG-TS
+// stream written to w, such as os.Stdout, instead of an HLS stream. No HTTP
+// server is started and URL returns "". RecordPath, RTSPURL, WHIPEndpoint
+// and Outputs still apply. The encoder runs until frames is closed, ctx is
+// done or Stop is called; Stop returns once ffmpeg has written the rest of
+// the stream to w.
+//
+// With a CommandFactory, the command's stdout is connected to w and
+// progress reports are read from file descriptor 3 (-progress pipe:3).
+func (e *Encoder) StartToWriter(ctx context.Context, frames <-chan image.Image, w io.Writer) error {
+	if w == nil {
+		return fmt.Errorf("nil writer")
+	}
+	if e.opts.RotateInterval > 0 || e.opts.KeyProvider != nil || e.opts.Uploader != nil {
+		return fmt.Errorf("output rotation, encryption and uploads require HLS output")
+	}
+	if err := e.checkImageInput(); err != nil {
+		return err
+	}
+
+	first, err := e.peekFirst(ctx, func() (image.Image, error) {
+		return receiveFirst(ctx, frames)
+	})
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return ErrAlreadyRunning
+	}
+
+	e.dumper = nil
+	if e.opts.DumpFramesDir != "" {
+		if e.dumper, err = newFrameDumper(e.opts); err != nil {
+			return err
+		}
+	}
+
+	if err := e.startOverlay(); err != nil {
+		return err
+	}
+
+	stats := newEncoderStats(e.clock)
+	ffmpeg, err := newFFmpegProcess("", e.opts, e.clock, &countingWriter{w: w, n: &stats.outputBytes})
+	if err != nil {
+		e.stopOverlay()
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	if e.opts.WaitForFFmpegStart {
+		if err := ffmpeg.waitStarted(); err != nil {
+			e.stopOverlay()
+			return err
+		}
+	}
+	e.ffmpeg.Store(ffmpeg)
+	e.stats.Store(stats)
+
+	// Nothing HLS related runs for this stream
+	e.hlsServer = nil
+	e.watcher = nil
+	e.thumbs = nil
+	e.uploads = nil
+	e.outputDir = ""
+	e.tags = newPlaylistTags()
+
+	// Create cancellable context for frame processing
+	ctx, cancel := context.WithCancel(ctx)
+	e.runCtx = ctx
+	e.cancel = cancel
+	e.running = true
+
+	e.goProcess(ctx, func(ctx context.Context) {
+		e.processFrames(ctx, frames, first)
+	})
+
+	e.emit(Event{Type: EventStarted})
+	return nil
+}
+
+// countingWriter adds the number of bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}